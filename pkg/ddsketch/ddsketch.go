@@ -0,0 +1,262 @@
+// Package ddsketch implements the DDSketch, a streaming quantile sketch
+// with a relative-accuracy guarantee and a bounded memory.
+//
+// A quantile computed from the sketch is within the relative accuracy
+// of the exact quantile, as long as the number of bins doesn't exceed the limit.
+// Beyond the limit, the lowest bins are collapsed so only
+// the accuracy of the lowest quantiles is lost.
+//
+// http://www.vldb.org/pvldb/vol12/p2195-masson.pdf
+package ddsketch
+
+import (
+	"errors"
+	"math"
+)
+
+// DefaultMaxBins is the default max number of bins per sign.
+// With a relative accuracy of 1% it covers more than 17 orders of magnitude.
+const DefaultMaxBins = 2048
+
+// Sketch is a DDSketch. It isn't safe for concurrent use.
+type Sketch struct {
+	gamma        float64
+	logGamma     float64
+	minIndexable float64
+
+	positive  store
+	negative  store
+	zeroCount uint64
+
+	count uint64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// New creates a sketch with the relative accuracy, in the (0, 1) range,
+// and the max number of bins per sign.
+func New(relativeAccuracy float64, maxBins int) (*Sketch, error) {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		return nil, errors.New("the relative accuracy must be between 0 and 1")
+	}
+	if maxBins < 1 {
+		return nil, errors.New("the max number of bins must be greater than zero")
+	}
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	logGamma := math.Log(gamma)
+	return &Sketch{
+		gamma:    gamma,
+		logGamma: logGamma,
+		// the smallest value with an index that doesn't overflow an int32,
+		// the smaller values are counted as zeros
+		minIndexable: math.Max(math.Exp((math.MinInt32+1)*logGamma), math.SmallestNonzeroFloat64*gamma),
+		positive:     store{maxBins: maxBins},
+		negative:     store{maxBins: maxBins},
+		min:          math.Inf(1),
+		max:          math.Inf(-1),
+	}, nil
+}
+
+// Add adds a value to the sketch.
+func (s *Sketch) Add(v float64) {
+	switch {
+	case v > s.minIndexable:
+		s.positive.add(s.index(v))
+	case v < -s.minIndexable:
+		s.negative.add(s.index(-v))
+	default:
+		s.zeroCount++
+	}
+	s.count++
+	s.sum += v
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+}
+
+// Merge adds the values of the other sketch to the sketch.
+// The sketches must have the same relative accuracy.
+func (s *Sketch) Merge(o *Sketch) error {
+	if s.gamma != o.gamma {
+		return errors.New("the sketches to merge must have the same relative accuracy")
+	}
+	if o.count == 0 {
+		return nil
+	}
+	s.positive.merge(&o.positive)
+	s.negative.merge(&o.negative)
+	s.zeroCount += o.zeroCount
+	s.count += o.count
+	s.sum += o.sum
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+	return nil
+}
+
+// Quantile returns the value at the quantile q, in the [0, 1] range.
+// It returns NaN if the sketch is empty or q is out of range.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+
+	rank := q * float64(s.count-1)
+	var v float64
+	switch {
+	case rank < float64(s.negative.count):
+		// the negative values are ordered from the highest index
+		i := s.negative.keyAtRank(float64(s.negative.count) - 1 - rank)
+		v = -s.value(i)
+	case rank < float64(s.negative.count+s.zeroCount):
+		v = 0
+	default:
+		i := s.positive.keyAtRank(rank - float64(s.negative.count+s.zeroCount))
+		v = s.value(i)
+	}
+	// the bins' values can be slightly outside of the observed range
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+// Count returns the number of values.
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+// Sum returns the sum of the values.
+func (s *Sketch) Sum() float64 {
+	return s.sum
+}
+
+// Avg returns the average of the values, zero if the sketch is empty.
+func (s *Sketch) Avg() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.sum / float64(s.count)
+}
+
+// Min returns the min value, zero if the sketch is empty.
+func (s *Sketch) Min() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.min
+}
+
+// Max returns the max value, zero if the sketch is empty.
+func (s *Sketch) Max() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.max
+}
+
+// Bins returns the number of bins in use,
+// the memory used from the sketch is proportional to it.
+func (s *Sketch) Bins() int {
+	return len(s.positive.bins) + len(s.negative.bins)
+}
+
+// index returns the index of the bin for the positive value.
+func (s *Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the value representing the bin at the index,
+// it is the value with the same relative distance from the bin's bounds.
+func (s *Sketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+// store is a dense store of the bins' counters.
+// When the number of bins exceeds the limit, the lowest ones are collapsed.
+type store struct {
+	maxBins int
+
+	// bins are the counters of the bins from the offset index.
+	bins   []uint64
+	offset int
+	count  uint64
+}
+
+func (st *store) add(i int) {
+	st.addCount(i, 1)
+}
+
+func (st *store) addCount(i int, n uint64) {
+	st.count += n
+	if len(st.bins) == 0 {
+		st.bins = append(st.bins, n)
+		st.offset = i
+		return
+	}
+
+	if i < st.offset {
+		// the values lower than the lowest bin within the limit
+		// are counted in it, as if it has been collapsed
+		if lowest := st.offset + len(st.bins) - st.maxBins; i < lowest {
+			i = lowest
+		}
+		if i < st.offset {
+			grown := make([]uint64, st.offset+len(st.bins)-i)
+			copy(grown[st.offset-i:], st.bins)
+			st.bins = grown
+			st.offset = i
+		}
+	}
+	if i > st.offset+len(st.bins)-1 {
+		// the lowest bins are collapsed before growing,
+		// so the bins never exceed the limit
+		if lowest := i - st.maxBins + 1; lowest > st.offset {
+			st.collapse(lowest)
+		}
+		st.bins = append(st.bins, make([]uint64, i-(st.offset+len(st.bins)-1))...)
+	}
+	st.bins[i-st.offset] += n
+}
+
+// merge adds the counters of the other store.
+func (st *store) merge(o *store) {
+	for i, c := range o.bins {
+		if c > 0 {
+			st.addCount(o.offset+i, c)
+		}
+	}
+}
+
+// collapse merges the bins lower than the index into its bin.
+func (st *store) collapse(lowest int) {
+	n := lowest - st.offset
+	if n >= len(st.bins) {
+		var collapsed uint64
+		for _, c := range st.bins {
+			collapsed += c
+		}
+		st.bins = append(st.bins[:0], collapsed)
+		st.offset = lowest
+		return
+	}
+
+	var collapsed uint64
+	for _, c := range st.bins[:n] {
+		collapsed += c
+	}
+	// the bins are shifted so the capacity isn't lost
+	m := copy(st.bins, st.bins[n:])
+	st.bins = st.bins[:m]
+	st.bins[0] += collapsed
+	st.offset = lowest
+}
+
+// keyAtRank returns the index of the bin with the value at the rank,
+// zero is the lowest rank.
+func (st *store) keyAtRank(rank float64) int {
+	var n uint64
+	for i, c := range st.bins {
+		n += c
+		if float64(n) > rank {
+			return st.offset + i
+		}
+	}
+	return st.offset + len(st.bins) - 1
+}
@@ -0,0 +1,146 @@
+package ddsketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exactQuantile returns the quantile with the same rank definition of the sketch.
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestSketchRelativeAccuracy(t *testing.T) {
+	t.Parallel()
+
+	r := rand.New(rand.NewSource(42)) //nolint:gosec
+	tests := map[string]func() float64{
+		"Uniform":   func() float64 { return r.Float64() * 1000 },
+		"LogNormal": func() float64 { return math.Exp(r.NormFloat64()*1.5 + 4) },
+		"Negative":  func() float64 { return r.NormFloat64() * 100 },
+		"WithZeros": func() float64 { return math.Max(0, r.NormFloat64()) },
+	}
+	for name, gen := range tests {
+		values := make([]float64, 10000)
+		for i := range values {
+			values[i] = gen()
+		}
+
+		const accuracy = 0.01
+		s, err := New(accuracy, DefaultMaxBins)
+		require.NoError(t, err)
+		for _, v := range values {
+			s.Add(v)
+		}
+		sort.Float64s(values)
+
+		for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.95, 0.99, 0.999, 1} {
+			exp := exactQuantile(values, q)
+			got := s.Quantile(q)
+			assert.LessOrEqual(t, math.Abs(got-exp), accuracy*math.Abs(exp)+1e-12,
+				"%s p(%v): exp %v, got %v", name, q, exp, got)
+		}
+		assert.Equal(t, uint64(len(values)), s.Count(), name)
+		assert.Equal(t, values[0], s.Min(), name)
+		assert.Equal(t, values[len(values)-1], s.Max(), name)
+	}
+}
+
+func TestSketchEmpty(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(0.01, DefaultMaxBins)
+	require.NoError(t, err)
+	assert.True(t, math.IsNaN(s.Quantile(0.5)))
+	assert.Zero(t, s.Count())
+	assert.Zero(t, s.Avg())
+	assert.Zero(t, s.Min())
+	assert.Zero(t, s.Max())
+
+	s.Add(42)
+	assert.Equal(t, 42.0, s.Quantile(0.5))
+	assert.Equal(t, 42.0, s.Avg())
+	assert.True(t, math.IsNaN(s.Quantile(1.1)))
+}
+
+func TestSketchMaxBins(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(0.01, 100)
+	require.NoError(t, err)
+	// the values span many more orders of magnitude than 100 bins can cover
+	for _, v := range []float64{1e-9, 1e-6, 1e-3, 1, 1e3, 1e6, 1e9, 1e9} {
+		s.Add(v)
+	}
+	s.Add(1e12)
+	s.Add(1e-12)
+
+	assert.LessOrEqual(t, s.Bins(), 100)
+	assert.Equal(t, uint64(10), s.Count())
+	// the highest quantiles remain accurate,
+	// the lowest values have been collapsed into the lowest bin
+	assert.InEpsilon(t, 1e12, s.Quantile(1), 0.01)
+	assert.Greater(t, s.Quantile(0.5), 1e9)
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(0, DefaultMaxBins)
+	assert.ErrorContains(t, err, "relative accuracy")
+	_, err = New(1, DefaultMaxBins)
+	assert.ErrorContains(t, err, "relative accuracy")
+	_, err = New(0.01, 0)
+	assert.ErrorContains(t, err, "max number of bins")
+}
+
+func BenchmarkSketchAdd(b *testing.B) {
+	s, err := New(0.01, DefaultMaxBins)
+	require.NoError(b, err)
+	r := rand.New(rand.NewSource(42)) //nolint:gosec
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Add(math.Exp(r.NormFloat64() + 4))
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	t.Parallel()
+
+	all, err := New(0.01, DefaultMaxBins)
+	require.NoError(t, err)
+	a, err := New(0.01, DefaultMaxBins)
+	require.NoError(t, err)
+	b, err := New(0.01, DefaultMaxBins)
+	require.NoError(t, err)
+
+	for i := -500; i <= 1000; i++ {
+		v := float64(i)
+		all.Add(v)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	require.NoError(t, a.Merge(b))
+
+	assert.Equal(t, all.Count(), a.Count())
+	assert.Equal(t, all.Sum(), a.Sum())
+	assert.Equal(t, all.Min(), a.Min())
+	assert.Equal(t, all.Max(), a.Max())
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+		assert.Equal(t, all.Quantile(q), a.Quantile(q), q)
+	}
+
+	other, err := New(0.02, DefaultMaxBins)
+	require.NoError(t, err)
+	assert.Error(t, a.Merge(other))
+}
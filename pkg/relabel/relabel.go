@@ -0,0 +1,253 @@
+// Package relabel implements the relabeling of the time series' labels
+// compatible with the Prometheus' relabel_config.
+//
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+package relabel
+
+import (
+	"crypto/md5" //nolint:gosec
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+)
+
+// Action is the action to perform with a relabeling rule.
+type Action string
+
+const (
+	// Replace sets the target label to the replacement,
+	// if the regex matches the concatenated source labels.
+	// The replacement can reference the regex's capture groups.
+	Replace Action = "replace"
+
+	// Keep drops the time series if the regex doesn't match
+	// the concatenated source labels.
+	Keep Action = "keep"
+
+	// Drop drops the time series if the regex matches
+	// the concatenated source labels.
+	Drop Action = "drop"
+
+	// HashMod sets the target label to the modulus
+	// of the hash of the concatenated source labels.
+	HashMod Action = "hashmod"
+
+	// LabelMap copies the labels with a name matching the regex
+	// to the labels with the name defined from the replacement.
+	LabelMap Action = "labelmap"
+
+	// LabelDrop removes the labels with a name matching the regex.
+	LabelDrop Action = "labeldrop"
+
+	// LabelKeep removes the labels with a name not matching the regex.
+	LabelKeep Action = "labelkeep"
+)
+
+const (
+	defaultSeparator   = ";"
+	defaultRegex       = "(.*)"
+	defaultReplacement = "$1"
+)
+
+//nolint:gochecknoglobals
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Config is a relabeling rule.
+// The unset fields have the same defaults used from Prometheus.
+type Config struct {
+	// SourceLabels are the labels whose values are concatenated
+	// with the separator and matched against the regex.
+	SourceLabels []string `json:"sourceLabels"`
+
+	// Separator is the separator for the source labels' values, the default is ";".
+	Separator *string `json:"separator"`
+
+	// Regex is the regular expression matched against the source labels' values.
+	// It is anchored on both ends, the default is "(.*)".
+	Regex *string `json:"regex"`
+
+	// Modulus is the modulus for the hashmod action.
+	Modulus uint64 `json:"modulus"`
+
+	// TargetLabel is the label set from the replace and hashmod actions.
+	// The capture groups can be referenced from the replace action.
+	TargetLabel string `json:"targetLabel"`
+
+	// Replacement is the value for the replace and labelmap actions,
+	// the capture groups can be referenced. The default is "$1".
+	Replacement *string `json:"replacement"`
+
+	// Action is the action to perform, the default is replace.
+	Action Action `json:"action"`
+}
+
+// Rules is a compiled set of relabeling rules.
+type Rules struct {
+	rules []rule
+}
+
+type rule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	modulus      uint64
+	targetLabel  string
+	replacement  string
+	action       Action
+}
+
+// New validates and compiles the relabeling rules.
+func New(configs []Config) (*Rules, error) {
+	rules := make([]rule, 0, len(configs))
+	for i, c := range configs {
+		r, err := newRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("the relabeling rule #%d is invalid: %w", i, err)
+		}
+		rules = append(rules, r)
+	}
+	return &Rules{rules: rules}, nil
+}
+
+func newRule(c Config) (rule, error) {
+	r := rule{
+		sourceLabels: c.SourceLabels,
+		separator:    defaultSeparator,
+		modulus:      c.Modulus,
+		targetLabel:  c.TargetLabel,
+		replacement:  defaultReplacement,
+		action:       c.Action,
+	}
+	if c.Separator != nil {
+		r.separator = *c.Separator
+	}
+	if c.Replacement != nil {
+		r.replacement = *c.Replacement
+	}
+	if r.action == "" {
+		r.action = Replace
+	}
+
+	regex := defaultRegex
+	if c.Regex != nil {
+		regex = *c.Regex
+	}
+	var err error
+	r.regex, err = regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return r, fmt.Errorf("the regex %q is invalid: %w", regex, err)
+	}
+
+	switch r.action {
+	case Replace:
+		if r.targetLabel == "" {
+			return r, errors.New("the target label is required for the replace action")
+		}
+		// the name can be validated only after the expansion if it references a group
+		if !strings.Contains(r.targetLabel, "$") && !labelNameRegex.MatchString(r.targetLabel) {
+			return r, fmt.Errorf("the target label %q is not a valid label name", r.targetLabel)
+		}
+	case HashMod:
+		if !labelNameRegex.MatchString(r.targetLabel) {
+			return r, fmt.Errorf("the target label %q is not a valid label name", r.targetLabel)
+		}
+		if r.modulus == 0 {
+			return r, errors.New("the modulus must be greater than zero for the hashmod action")
+		}
+	case Keep, Drop, LabelMap, LabelDrop, LabelKeep:
+	default:
+		return r, fmt.Errorf("the action %q is not supported", r.action)
+	}
+	return r, nil
+}
+
+// Process applies the rules in order to the labels.
+// It returns the new labels sorted by name,
+// false is returned if the time series has to be dropped.
+func (rs *Rules) Process(labels []*prompb.Label) ([]*prompb.Label, bool) {
+	lset := make(map[string]string, len(labels))
+	for _, l := range labels {
+		lset[l.Name] = l.Value
+	}
+	for _, r := range rs.rules {
+		if !r.apply(lset) {
+			return nil, false
+		}
+	}
+
+	result := make([]*prompb.Label, 0, len(lset))
+	for name, value := range lset {
+		result = append(result, &prompb.Label{Name: name, Value: value})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, true
+}
+
+// apply applies the rule to the label set,
+// it returns false if the time series has to be dropped.
+func (r rule) apply(lset map[string]string) bool {
+	values := make([]string, 0, len(r.sourceLabels))
+	for _, name := range r.sourceLabels {
+		values = append(values, lset[name])
+	}
+	val := strings.Join(values, r.separator)
+
+	switch r.action {
+	case Keep:
+		return r.regex.MatchString(val)
+	case Drop:
+		return !r.regex.MatchString(val)
+	case Replace:
+		indexes := r.regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.targetLabel, val, indexes))
+		if !labelNameRegex.MatchString(target) {
+			return true
+		}
+		res := string(r.regex.ExpandString(nil, r.replacement, val, indexes))
+		if res == "" {
+			delete(lset, target)
+			return true
+		}
+		lset[target] = res
+	case HashMod:
+		sum := md5.Sum([]byte(val)) //nolint:gosec
+		mod := binary.BigEndian.Uint64(sum[8:]) % r.modulus
+		lset[r.targetLabel] = strconv.FormatUint(mod, 10)
+	case LabelMap:
+		// the new labels are collected first,
+		// so they aren't matched again during the iteration
+		mapped := make(map[string]string)
+		for name, value := range lset {
+			if r.regex.MatchString(name) {
+				mapped[r.regex.ReplaceAllString(name, r.replacement)] = value
+			}
+		}
+		for name, value := range mapped {
+			lset[name] = value
+		}
+	case LabelDrop:
+		for name := range lset {
+			if r.regex.MatchString(name) {
+				delete(lset, name)
+			}
+		}
+	case LabelKeep:
+		for name := range lset {
+			if !r.regex.MatchString(name) {
+				delete(lset, name)
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package relabel
+
+import (
+	"testing"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptr(s string) *string {
+	return &s
+}
+
+func labels(kv ...string) []*prompb.Label {
+	l := make([]*prompb.Label, 0, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		l = append(l, &prompb.Label{Name: kv[i], Value: kv[i+1]})
+	}
+	return l
+}
+
+func TestRulesProcess(t *testing.T) {
+	t.Parallel()
+
+	input := labels(
+		"__name__", "k6_http_req_duration",
+		"method", "GET",
+		"name", "https://test.k6.io/users/42",
+		"status", "200",
+		"url", "https://test.k6.io/users/42",
+	)
+
+	tests := map[string]struct {
+		configs []Config
+		exp     []*prompb.Label
+		dropped bool
+	}{
+		"NoRules": {
+			exp: input,
+		},
+		"ReplaceRouteTemplate": {
+			configs: []Config{{
+				SourceLabels: []string{"name"},
+				Regex:        ptr(`(https://[^/]+/users)/\d+`),
+				TargetLabel:  "name",
+				Replacement:  ptr("${1}/{id}"),
+			}},
+			exp: labels(
+				"__name__", "k6_http_req_duration",
+				"method", "GET",
+				"name", "https://test.k6.io/users/{id}",
+				"status", "200",
+				"url", "https://test.k6.io/users/42",
+			),
+		},
+		"ReplaceNoMatch": {
+			configs: []Config{{
+				SourceLabels: []string{"method"},
+				Regex:        ptr("POST"),
+				TargetLabel:  "write",
+				Replacement:  ptr("true"),
+			}},
+			exp: input,
+		},
+		"ReplaceMultipleSources": {
+			configs: []Config{{
+				SourceLabels: []string{"method", "status"},
+				TargetLabel:  "request",
+			}},
+			exp: labels(
+				"__name__", "k6_http_req_duration",
+				"method", "GET",
+				"name", "https://test.k6.io/users/42",
+				"request", "GET;200",
+				"status", "200",
+				"url", "https://test.k6.io/users/42",
+			),
+		},
+		"ReplaceEmptyRemovesLabel": {
+			configs: []Config{{
+				SourceLabels: []string{"status"},
+				TargetLabel:  "url",
+				Replacement:  ptr(""),
+			}},
+			exp: labels(
+				"__name__", "k6_http_req_duration",
+				"method", "GET",
+				"name", "https://test.k6.io/users/42",
+				"status", "200",
+			),
+		},
+		"Keep": {
+			configs: []Config{{SourceLabels: []string{"status"}, Regex: ptr("2.."), Action: Keep}},
+			exp:     input,
+		},
+		"KeepDrops": {
+			configs: []Config{{SourceLabels: []string{"status"}, Regex: ptr("5.."), Action: Keep}},
+			dropped: true,
+		},
+		"Drop": {
+			configs: []Config{{SourceLabels: []string{"__name__"}, Regex: ptr("k6_http_.*"), Action: Drop}},
+			dropped: true,
+		},
+		"DropAnchored": {
+			// the regex is anchored so a partial match doesn't drop it
+			configs: []Config{{SourceLabels: []string{"__name__"}, Regex: ptr("http_req"), Action: Drop}},
+			exp:     input,
+		},
+		"LabelDrop": {
+			configs: []Config{{Regex: ptr("url|name"), Action: LabelDrop}},
+			exp: labels(
+				"__name__", "k6_http_req_duration",
+				"method", "GET",
+				"status", "200",
+			),
+		},
+		"LabelKeep": {
+			configs: []Config{{Regex: ptr("__name__|status"), Action: LabelKeep}},
+			exp: labels(
+				"__name__", "k6_http_req_duration",
+				"status", "200",
+			),
+		},
+		"LabelMap": {
+			configs: []Config{{Regex: ptr("(method|status)"), Replacement: ptr("http_$1"), Action: LabelMap}},
+			exp: labels(
+				"__name__", "k6_http_req_duration",
+				"http_method", "GET",
+				"http_status", "200",
+				"method", "GET",
+				"name", "https://test.k6.io/users/42",
+				"status", "200",
+				"url", "https://test.k6.io/users/42",
+			),
+		},
+		"HashMod": {
+			configs: []Config{{SourceLabels: []string{"url"}, Modulus: 8, TargetLabel: "shard", Action: HashMod}},
+			exp: labels(
+				"__name__", "k6_http_req_duration",
+				"method", "GET",
+				"name", "https://test.k6.io/users/42",
+				"shard", "4",
+				"status", "200",
+				"url", "https://test.k6.io/users/42",
+			),
+		},
+		"InOrder": {
+			configs: []Config{
+				{SourceLabels: []string{"url"}, TargetLabel: "endpoint"},
+				{Regex: ptr("url|name"), Action: LabelDrop},
+				{SourceLabels: []string{"endpoint"}, Regex: ptr(".*/users/.*"), Action: Drop},
+			},
+			dropped: true,
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			rules, err := New(tt.configs)
+			require.NoError(t, err)
+			got, ok := rules.Process(input)
+			assert.Equal(t, !tt.dropped, ok)
+			if !tt.dropped {
+				assert.Equal(t, tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config Config
+		expErr string
+	}{
+		"UnknownAction":     {config: Config{Action: "lowercase"}, expErr: "not supported"},
+		"InvalidRegex":      {config: Config{Regex: ptr("(")}, expErr: "regex"},
+		"ReplaceNoTarget":   {config: Config{SourceLabels: []string{"a"}}, expErr: "target label is required"},
+		"ReplaceBadTarget":  {config: Config{TargetLabel: "1abc"}, expErr: "not a valid label name"},
+		"HashModNoModulus":  {config: Config{TargetLabel: "shard", Action: HashMod}, expErr: "modulus"},
+		"HashModBadTarget":  {config: Config{TargetLabel: "$1", Modulus: 2, Action: HashMod}, expErr: "not a valid"},
+		"ReplaceTargetExpr": {config: Config{TargetLabel: "${1}_label"}},
+	}
+	for name, tt := range tests {
+		_, err := New([]Config{tt.config})
+		if tt.expErr == "" {
+			assert.NoError(t, err, name)
+			continue
+		}
+		assert.ErrorContains(t, err, tt.expErr, name)
+		assert.ErrorContains(t, err, "rule #0", name)
+	}
+}
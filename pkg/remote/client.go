@@ -5,17 +5,18 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/grafana/xk6-output-prometheus-remote/pkg/sigv4"
 
 	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
-	"github.com/klauspost/compress/snappy"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -26,6 +27,49 @@ type HTTPConfig struct {
 	BasicAuth *BasicAuth
 	SigV4     *sigv4.Config
 	Headers   http.Header
+	Retry     *RetryConfig
+
+	// ProtocolVersion is the Remote Write protocol's version,
+	// the 1.0 version is used if it is empty.
+	ProtocolVersion ProtocolVersion
+
+	// MaxSamplesPerRequest and MaxBytesPerRequest cap the size of a request,
+	// a batch exceeding them is split into multiple requests.
+	// The bytes are the size of the encoded protobuf message before the compression.
+	// Zero means no limit.
+	MaxSamplesPerRequest int
+	MaxBytesPerRequest   int
+
+	// Compression is the codec for the requests' body,
+	// Snappy is used if it is empty.
+	Compression Compression
+
+	// CompressionLevel is the level of the codec, it is supported
+	// only from zstd and gzip. Zero means the codec's default.
+	CompressionLevel int
+}
+
+// RetryConfig holds the config for retrying the failed requests.
+//
+// Only the recoverable failures are retried: network errors,
+// 429 Too Many Requests and 5xx status codes.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts
+	// for each request, the first attempt included.
+	MaxAttempts int
+
+	// MinBackoff is the wait time before the first retry,
+	// it is doubled on every next retry.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the upper bound for the wait time between two attempts.
+	MaxBackoff time.Duration
+
+	// MaxElapsed caps the total time spent for a request across all the attempts,
+	// measured from the start of the first attempt. An attempt is interrupted
+	// when the cap is reached and a retry is not attempted if it would exceed it.
+	// Zero means no cap.
+	MaxElapsed time.Duration
 }
 
 // BasicAuth holds the config for basic authentication.
@@ -40,6 +84,7 @@ type WriteClient struct {
 	hc  *http.Client
 	url *url.URL
 	cfg *HTTPConfig
+	enc encoder
 }
 
 // NewWriteClient creates a new WriteClient.
@@ -51,12 +96,17 @@ func NewWriteClient(endpoint string, cfg *HTTPConfig) (*WriteClient, error) {
 	if err != nil {
 		return nil, err
 	}
+	enc, err := newEncoder(cfg.Compression, cfg.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
 	wc := &WriteClient{
 		hc: &http.Client{
 			Timeout: cfg.Timeout,
 		},
 		url: u,
 		cfg: cfg,
+		enc: enc,
 	}
 	if cfg.TLSConfig != nil {
 		wc.hc.Transport = &http.Transport{
@@ -73,17 +123,223 @@ func NewWriteClient(endpoint string, cfg *HTTPConfig) (*WriteClient, error) {
 	return wc, nil
 }
 
+// StoreError is returned when a batch of samples failed to be stored,
+// it reports the number of attempts done before giving up.
+type StoreError struct {
+	Attempts int
+	Err      error
+}
+
+// Error implements the error interface.
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("storing the time series failed after %d attempt(s): %s", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// recoverableError is a failure that could succeed if the same request is retried.
+type recoverableError struct {
+	error
+
+	// retryAfter is the wait time requested by the server
+	// through the Retry-After header, if any.
+	retryAfter time.Duration
+}
+
+func (e *recoverableError) Unwrap() error {
+	return e.error
+}
+
+// WriteRequest is a batch of time series to store
+// with the optional information related to them.
+type WriteRequest struct {
+	Timeseries []*prompb.TimeSeries
+
+	// Metadata is the metadata of the metrics in the batch.
+	// With Remote Write 2.0, it is attached to each time series
+	// with a __name__ matching the metric family name.
+	Metadata []*prompb.MetricMetadata
+
+	// CreatedTimestamps maps a time series to the time in ms
+	// when it has been created. It is sent only with Remote Write 2.0.
+	CreatedTimestamps map[*prompb.TimeSeries]int64
+}
+
+// IsRecoverable returns true if the error is a failure
+// that could succeed if the same request is retried later,
+// for example because the endpoint is temporarily unavailable.
+func IsRecoverable(err error) bool {
+	var rerr *recoverableError
+	return errors.As(err, &rerr)
+}
+
 // Store sends a batch of samples to the HTTP endpoint,
 // the request is the proto marshaled and encoded.
+//
+// The recoverable failures are retried according to the Retry config,
+// if the batch can't be stored then a *StoreError is returned.
 func (c *WriteClient) Store(ctx context.Context, series []*prompb.TimeSeries) error {
-	b, err := newWriteRequestBody(series)
+	return c.StoreRequest(ctx, &WriteRequest{Timeseries: series})
+}
+
+// StoreRequest is the same as Store but it supports
+// the optional information defined from the WriteRequest.
+//
+// If the request exceeds the configured max samples or bytes
+// then it is split and the splits are sent in sequence.
+// A *SplitError is returned if any of them fails.
+func (c *WriteClient) StoreRequest(ctx context.Context, wr *WriteRequest) error {
+	retry := c.cfg.Retry
+	if retry == nil || retry.MaxAttempts < 1 {
+		retry = &RetryConfig{MaxAttempts: 1}
+	}
+
+	// the retry time budget is shared between the splits
+	budget := &retryBudget{max: retry.MaxElapsed}
+
+	var sizer seriesSizer = v1SeriesSizer{}
+	if c.cfg.ProtocolVersion == ProtocolV2 {
+		sizer = newV2SeriesSizer(wr)
+	}
+	splits := splitSeries(wr.Timeseries, c.cfg.MaxSamplesPerRequest, c.cfg.MaxBytesPerRequest, sizer)
+	if len(splits) < 2 {
+		return c.storeRequest(ctx, wr, retry, budget)
+	}
+
+	serr := &SplitError{Splits: len(splits)}
+	for i, series := range splits {
+		req := &WriteRequest{
+			Timeseries:        series,
+			CreatedTimestamps: wr.CreatedTimestamps,
+		}
+		// the Remote Write 1.0 metadata is not bound to the series
+		// so it is enough to send it once
+		if i == 0 || c.cfg.ProtocolVersion == ProtocolV2 {
+			req.Metadata = wr.Metadata
+		}
+		if err := c.storeRequest(ctx, req, retry, budget); err != nil {
+			serr.Errors = append(serr.Errors, fmt.Errorf("split %d/%d: %w", i+1, len(splits), err))
+			serr.Failed = append(serr.Failed, series...)
+			if IsRecoverable(err) {
+				serr.Recoverable = append(serr.Recoverable, series...)
+			}
+		}
+	}
+	if len(serr.Errors) > 0 {
+		return serr
+	}
+	return nil
+}
+
+// retryBudget is the time budget for the attempts of a request,
+// it starts with the first attempt.
+type retryBudget struct {
+	max      time.Duration
+	deadline time.Time
+}
+
+// start starts the budget, if it isn't already started,
+// and it returns the deadline. The zero time means no deadline.
+func (b *retryBudget) start() time.Time {
+	if b.max > 0 && b.deadline.IsZero() {
+		b.deadline = time.Now().Add(b.max)
+	}
+	return b.deadline
+}
+
+// storeRequest sends a single request retrying the recoverable failures.
+// The attempts, and not only the waits between them, are bounded from the budget.
+func (c *WriteClient) storeRequest(
+	ctx context.Context, wr *WriteRequest, retry *RetryConfig, budget *retryBudget,
+) error {
+	var (
+		b      []byte
+		counts WriteCounts
+		err    error
+	)
+	if c.cfg.ProtocolVersion == ProtocolV2 {
+		b, counts, err = newWriteRequestV2Body(c.encoder(), wr)
+	} else {
+		b, err = newWriteRequestBody(c.encoder(), wr.Timeseries, wr.Metadata...)
+	}
 	if err != nil {
 		return err
 	}
+
+	deadline := budget.start()
+	backoff := retry.MinBackoff
+	for attempt := 1; ; attempt++ {
+		var header http.Header
+		header, err = c.sendBefore(ctx, b, deadline)
+		if err == nil && c.cfg.ProtocolVersion == ProtocolV2 {
+			err = checkWrittenHeaders(header, counts)
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() == nil && !deadline.IsZero() && !time.Now().Before(deadline) {
+			// the attempt has been interrupted from the budget,
+			// the request could still succeed later
+			return &StoreError{
+				Attempts: attempt,
+				Err: &recoverableError{
+					error: fmt.Errorf("the retry time budget of %s is exhausted: %w", retry.MaxElapsed, err),
+				},
+			}
+		}
+
+		var rerr *recoverableError
+		if !errors.As(err, &rerr) || attempt >= retry.MaxAttempts {
+			return &StoreError{Attempts: attempt, Err: err}
+		}
+
+		wait := jitter(backoff)
+		if rerr.retryAfter > wait {
+			wait = rerr.retryAfter
+		}
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return &StoreError{
+				Attempts: attempt,
+				Err:      fmt.Errorf("the retry time budget of %s is exhausted: %w", retry.MaxElapsed, err),
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &StoreError{Attempts: attempt, Err: ctx.Err()}
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if retry.MaxBackoff > 0 && backoff > retry.MaxBackoff {
+			backoff = retry.MaxBackoff
+		}
+	}
+}
+
+// sendBefore executes a single attempt that is canceled
+// if it doesn't complete before the deadline, if it is set.
+func (c *WriteClient) sendBefore(ctx context.Context, b []byte, deadline time.Time) (http.Header, error) {
+	if deadline.IsZero() {
+		return c.send(ctx, b)
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	return c.send(ctx, b)
+}
+
+// send executes a single attempt of a remote write request
+// and it returns the response's headers.
+func (c *WriteClient) send(ctx context.Context, b []byte) (http.Header, error) {
 	req, err := http.NewRequestWithContext(
 		ctx, http.MethodPost, c.url.String(), bytes.NewReader(b))
 	if err != nil {
-		return fmt.Errorf("create new HTTP request failed: %w", err)
+		return nil, fmt.Errorf("create new HTTP request failed: %w", err)
 	}
 	if c.cfg.BasicAuth != nil {
 		req.SetBasicAuth(c.cfg.BasicAuth.Username, c.cfg.BasicAuth.Password)
@@ -96,13 +352,24 @@ func (c *WriteClient) Store(ctx context.Context, series []*prompb.TimeSeries) er
 	req.Header.Set("User-Agent", "k6-prometheus-rw-output")
 
 	// They are mostly defined by the specs
-	req.Header.Set("Content-Encoding", "snappy")
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if ce := c.encoder().ContentEncoding(); ce != "" {
+		req.Header.Set("Content-Encoding", ce)
+	}
+	if c.cfg.ProtocolVersion == ProtocolV2 {
+		req.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "2.0.0")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	}
 
 	resp, err := c.hc.Do(req)
 	if err != nil {
-		return fmt.Errorf("HTTP POST request failed: %w", err)
+		err = fmt.Errorf("HTTP POST request failed: %w", err)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, &recoverableError{error: err}
 	}
 	defer func() {
 		err = resp.Body.Close()
@@ -113,24 +380,63 @@ func (c *WriteClient) Store(ctx context.Context, series []*prompb.TimeSeries) er
 
 	_, err = io.Copy(io.Discard, resp.Body)
 	if err != nil {
-		return err
+		// e.g. the connection has been reset while reading the response
+		err = fmt.Errorf("reading the HTTP response failed: %w", err)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, &recoverableError{error: err}
+	}
+
+	err = validateResponseStatus(resp.StatusCode)
+	if err == nil || !isRecoverableStatus(resp.StatusCode) {
+		return resp.Header, err
+	}
+	rerr := &recoverableError{error: err}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		rerr.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return resp.Header, rerr
+}
+
+// Close releases the resources held from the client,
+// the client can't be used after.
+func (c *WriteClient) Close() error {
+	if c.enc == nil {
+		return nil
 	}
+	return c.enc.Close()
+}
 
-	return validateResponseStatus(resp.StatusCode)
+// encoder returns the codec for the requests' body,
+// it defaults to Snappy if the client has been created without it.
+func (c *WriteClient) encoder() encoder {
+	if c.enc == nil {
+		return snappyEncoder{}
+	}
+	return c.enc
 }
 
-func newWriteRequestBody(series []*prompb.TimeSeries) ([]byte, error) {
+func newWriteRequestBody(
+	enc encoder, series []*prompb.TimeSeries, metadata ...*prompb.MetricMetadata,
+) ([]byte, error) {
 	b, err := proto.Marshal(&prompb.WriteRequest{
 		Timeseries: series,
+		Metadata:   metadata,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("encoding series as protobuf write request failed: %w", err)
 	}
-	if snappy.MaxEncodedLen(len(b)) < 0 {
-		return nil, fmt.Errorf("the protobuf message is too large to be handled by Snappy encoder; "+
-			"size: %d, limit: %d", len(b), math.MaxUint32)
+	return enc.Encode(b)
+}
+
+func newWriteRequestV2Body(enc encoder, wr *WriteRequest) ([]byte, WriteCounts, error) {
+	b, counts, err := marshalWriteRequestV2(wr)
+	if err != nil {
+		return nil, counts, fmt.Errorf("encoding series as protobuf v2 write request failed: %w", err)
 	}
-	return snappy.Encode(nil, b), nil
+	b, err = enc.Encode(b)
+	return b, counts, err
 }
 
 func validateResponseStatus(code int) error {
@@ -140,3 +446,40 @@ func validateResponseStatus(code int) error {
 
 	return fmt.Errorf("got status code: %d instead expected a 2xx successful status code", code)
 }
+
+// isRecoverableStatus returns true if the request could succeed
+// if retried as is. The client errors (4xx) are not recoverable
+// with the exception of 429 Too Many Requests.
+func isRecoverableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter parses the Retry-After header's value
+// that can be expressed in seconds or as an HTTP date.
+// Zero is returned if it is empty, invalid or in the past.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(v)
+	if err != nil || !t.After(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
+
+// jitter returns a random duration in the [d/2, d) interval,
+// so concurrent clients don't retry all at the same time.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half))) //nolint:gosec
+}
@@ -2,11 +2,13 @@ package remote
 
 import (
 	"context"
+	"errors"
 	"io"
 	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -163,6 +165,196 @@ func TestClientStoreHeaders(t *testing.T) {
 	assert.NoError(t, c.Store(context.Background(), nil))
 }
 
+func TestClientStoreRetry(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		statuses    []int
+		retryAfter  string
+		retry       *RetryConfig
+		expAttempts int
+		expErr      bool
+	}{
+		"RecoverAfterServerError": {
+			statuses:    []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusNoContent},
+			retry:       &RetryConfig{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			expAttempts: 3,
+		},
+		"NonRecoverableClientError": {
+			statuses:    []int{http.StatusBadRequest, http.StatusNoContent},
+			retry:       &RetryConfig{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			expAttempts: 1,
+			expErr:      true,
+		},
+		"MaxAttemptsReached": {
+			statuses:    []int{http.StatusServiceUnavailable},
+			retry:       &RetryConfig{MaxAttempts: 4, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond},
+			expAttempts: 4,
+			expErr:      true,
+		},
+		"NoRetryConfig": {
+			statuses:    []int{http.StatusInternalServerError, http.StatusNoContent},
+			expAttempts: 1,
+			expErr:      true,
+		},
+		"RetryAfterExceedsTheBudget": {
+			statuses:   []int{http.StatusTooManyRequests, http.StatusNoContent},
+			retryAfter: "10",
+			retry: &RetryConfig{
+				MaxAttempts: 3, MinBackoff: time.Millisecond,
+				MaxBackoff: time.Millisecond, MaxElapsed: time.Second,
+			},
+			expAttempts: 1,
+			expErr:      true,
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int64
+			h := func(rw http.ResponseWriter, _ *http.Request) {
+				i := int(atomic.AddInt64(&calls, 1)) - 1
+				if i >= len(tt.statuses) {
+					i = len(tt.statuses) - 1
+				}
+				if tt.retryAfter != "" {
+					rw.Header().Set("Retry-After", tt.retryAfter)
+				}
+				rw.WriteHeader(tt.statuses[i])
+			}
+			ts := httptest.NewServer(http.HandlerFunc(h))
+			defer ts.Close()
+
+			u, err := url.Parse(ts.URL)
+			require.NoError(t, err)
+
+			c := &WriteClient{
+				hc:  ts.Client(),
+				url: u,
+				cfg: &HTTPConfig{Retry: tt.retry},
+			}
+			err = c.Store(context.Background(), nil)
+			assert.Equal(t, int64(tt.expAttempts), atomic.LoadInt64(&calls))
+			if !tt.expErr {
+				require.NoError(t, err)
+				return
+			}
+			var serr *StoreError
+			require.True(t, errors.As(err, &serr))
+			assert.Equal(t, tt.expAttempts, serr.Attempts)
+		})
+	}
+}
+
+func TestClientStoreRetryBudgetIncludesAttempts(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		<-release
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	c := &WriteClient{
+		hc:  ts.Client(),
+		url: u,
+		cfg: &HTTPConfig{Retry: &RetryConfig{
+			MaxAttempts: 5, MinBackoff: time.Millisecond,
+			MaxBackoff: time.Millisecond, MaxElapsed: 100 * time.Millisecond,
+		}},
+	}
+
+	start := time.Now()
+	err = c.Store(context.Background(), nil)
+	assert.Less(t, time.Since(start), time.Second)
+
+	var serr *StoreError
+	require.True(t, errors.As(err, &serr))
+	assert.Equal(t, 1, serr.Attempts)
+	assert.ErrorContains(t, err, "budget")
+	// the request could succeed later
+	assert.True(t, IsRecoverable(err))
+}
+
+func TestClientStoreRetryNetworkError(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	// close it so the connection is refused
+	ts.Close()
+
+	c := &WriteClient{
+		hc:  &http.Client{},
+		url: u,
+		cfg: &HTTPConfig{
+			Retry: &RetryConfig{MaxAttempts: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		},
+	}
+	err = c.Store(context.Background(), nil)
+	var serr *StoreError
+	require.True(t, errors.As(err, &serr))
+	assert.Equal(t, 2, serr.Attempts)
+	assert.ErrorContains(t, err, "after 2 attempt(s)")
+}
+
+func TestClientStoreRetryResponseBodyError(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) == 1 {
+			// the response is truncated, so the connection is closed while it is read
+			rw.Header().Set("Content-Length", "100")
+			rw.WriteHeader(http.StatusOK)
+			_, _ = rw.Write([]byte("partial"))
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	c := &WriteClient{
+		hc:  &http.Client{},
+		url: u,
+		cfg: &HTTPConfig{
+			Retry: &RetryConfig{MaxAttempts: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		},
+	}
+	require.NoError(t, c.Store(context.Background(), nil))
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in  string
+		exp time.Duration
+	}{
+		{in: "", exp: 0},
+		{in: "3", exp: 3 * time.Second},
+		{in: "-1", exp: 0},
+		{in: "invalid", exp: 0},
+		{in: now.Add(5 * time.Second).Format(http.TimeFormat), exp: 5 * time.Second},
+		{in: now.Add(-5 * time.Second).Format(http.TimeFormat), exp: 0},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.exp, parseRetryAfter(tt.in, now), tt.in)
+	}
+}
+
 func TestNewWriteRequestBody(t *testing.T) {
 	t.Parallel()
 	ts := []*prompb.TimeSeries{
@@ -171,7 +363,7 @@ func TestNewWriteRequestBody(t *testing.T) {
 			Samples: []*prompb.Sample{{Value: 10.1, Timestamp: time.Unix(1, 0).Unix()}},
 		},
 	}
-	b, err := newWriteRequestBody(ts)
+	b, err := newWriteRequestBody(snappyEncoder{}, ts)
 	require.NoError(t, err)
 	require.NotEmpty(t, string(b))
 	assert.Contains(t, string(b), `label1`)
@@ -191,7 +383,7 @@ func TestNewWriteRequestBodyWithStaleMarker(t *testing.T) {
 			}},
 		},
 	}
-	b, err := newWriteRequestBody(ts)
+	b, err := newWriteRequestBody(snappyEncoder{}, ts)
 	require.NoError(t, err)
 	require.NotEmpty(t, b)
 
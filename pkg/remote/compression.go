@@ -0,0 +1,156 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec used for compressing the requests' body.
+type Compression string
+
+const (
+	// CompressionSnappy is the Snappy block format, it is the only
+	// compression required from the Remote Write specification.
+	CompressionSnappy Compression = "snappy"
+
+	// CompressionZstd is the Zstandard format.
+	CompressionZstd Compression = "zstd"
+
+	// CompressionGzip is the gzip format.
+	CompressionGzip Compression = "gzip"
+
+	// CompressionNone sends the requests' body uncompressed.
+	CompressionNone Compression = "none"
+)
+
+// encoder compresses the requests' body.
+type encoder interface {
+	Encode(b []byte) ([]byte, error)
+
+	// ContentEncoding is the value for the Content-Encoding header,
+	// it is empty if the body isn't compressed.
+	ContentEncoding() string
+
+	// Close releases the resources held from the encoder,
+	// it can't be used after.
+	Close() error
+}
+
+// newEncoder creates the encoder for the compression.
+// The level is supported only from zstd and gzip, zero means the default level.
+func newEncoder(c Compression, level int) (encoder, error) {
+	if level != 0 && c != CompressionZstd && c != CompressionGzip {
+		return nil, fmt.Errorf("the compression level is not supported from %q", c)
+	}
+
+	switch c {
+	case "", CompressionSnappy:
+		return snappyEncoder{}, nil
+	case CompressionZstd:
+		zlevel := zstd.SpeedDefault
+		if level != 0 {
+			zlevel = zstd.EncoderLevelFromZstd(level)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zlevel))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the zstd encoder: %w", err)
+		}
+		return &zstdEncoder{enc: enc}, nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		// validate the level, so the encoding can't fail for it later
+		if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+			return nil, err
+		}
+		return gzipEncoder{level: level}, nil
+	case CompressionNone:
+		return noneEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("the compression %q is not supported, the supported values are "+
+			"%q, %q, %q and %q", c, CompressionSnappy, CompressionZstd, CompressionGzip, CompressionNone)
+	}
+}
+
+type snappyEncoder struct{}
+
+func (snappyEncoder) Encode(b []byte) ([]byte, error) {
+	if snappy.MaxEncodedLen(len(b)) < 0 {
+		return nil, fmt.Errorf("the protobuf message is too large to be handled by Snappy encoder; "+
+			"size: %d, limit: %d", len(b), math.MaxUint32)
+	}
+	return snappy.Encode(nil, b), nil
+}
+
+func (snappyEncoder) ContentEncoding() string {
+	return "snappy"
+}
+
+func (snappyEncoder) Close() error {
+	return nil
+}
+
+type zstdEncoder struct {
+	// enc is safe for concurrent use when EncodeAll is used.
+	enc *zstd.Encoder
+}
+
+func (e *zstdEncoder) Encode(b []byte) ([]byte, error) {
+	return e.enc.EncodeAll(b, nil), nil
+}
+
+func (*zstdEncoder) ContentEncoding() string {
+	return "zstd"
+}
+
+// Close releases the encoder's resources.
+func (e *zstdEncoder) Close() error {
+	return e.enc.Close()
+}
+
+type gzipEncoder struct {
+	level int
+}
+
+func (e gzipEncoder) Encode(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, e.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipEncoder) ContentEncoding() string {
+	return "gzip"
+}
+
+func (gzipEncoder) Close() error {
+	return nil
+}
+
+type noneEncoder struct{}
+
+func (noneEncoder) Encode(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (noneEncoder) ContentEncoding() string {
+	return ""
+}
+
+func (noneEncoder) Close() error {
+	return nil
+}
@@ -0,0 +1,184 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func decodeBody(t testing.TB, contentEncoding string, b []byte) []byte {
+	t.Helper()
+
+	switch contentEncoding {
+	case "snappy":
+		d, err := snappy.Decode(nil, b)
+		require.NoError(t, err)
+		return d
+	case "zstd":
+		dec, err := zstd.NewReader(nil)
+		require.NoError(t, err)
+		defer dec.Close()
+		d, err := dec.DecodeAll(b, nil)
+		require.NoError(t, err)
+		return d
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		require.NoError(t, err)
+		d, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return d
+	case "":
+		return b
+	default:
+		t.Fatalf("unexpected content encoding %q", contentEncoding)
+		return nil
+	}
+}
+
+func TestNewEncoder(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		compression Compression
+		level       int
+		expEncoding string
+		expErr      string
+	}{
+		{compression: "", expEncoding: "snappy"},
+		{compression: CompressionSnappy, expEncoding: "snappy"},
+		{compression: CompressionZstd, expEncoding: "zstd"},
+		{compression: CompressionZstd, level: 19, expEncoding: "zstd"},
+		{compression: CompressionGzip, expEncoding: "gzip"},
+		{compression: CompressionGzip, level: 9, expEncoding: "gzip"},
+		{compression: CompressionNone, expEncoding: ""},
+		{compression: CompressionGzip, level: 42, expErr: "invalid compression level"},
+		{compression: CompressionSnappy, level: 1, expErr: "level is not supported"},
+		{compression: CompressionNone, level: 1, expErr: "level is not supported"},
+		{compression: "lz4", expErr: "not supported"},
+	}
+	for _, tt := range tests {
+		enc, err := newEncoder(tt.compression, tt.level)
+		if tt.expErr != "" {
+			assert.ErrorContains(t, err, tt.expErr, tt)
+			continue
+		}
+		require.NoError(t, err, tt)
+		assert.Equal(t, tt.expEncoding, enc.ContentEncoding())
+
+		in := []byte("k6 k6 k6 k6 k6 k6 k6 k6")
+		b, err := enc.Encode(in)
+		require.NoError(t, err)
+		assert.Equal(t, in, decodeBody(t, tt.expEncoding, b), tt)
+		assert.NoError(t, enc.Close(), tt)
+	}
+}
+
+func TestClientStoreCompression(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd, CompressionGzip, CompressionNone} {
+		c := c
+		t.Run(string(c), func(t *testing.T) {
+			t.Parallel()
+
+			var got prompb.WriteRequest
+			h := func(rw http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				contentEncoding := r.Header.Get("Content-Encoding")
+				if c == CompressionNone {
+					_, ok := r.Header["Content-Encoding"]
+					assert.False(t, ok)
+				} else {
+					assert.Equal(t, string(c), contentEncoding)
+				}
+				assert.NoError(t, proto.Unmarshal(decodeBody(t, contentEncoding, b), &got))
+				rw.WriteHeader(http.StatusNoContent)
+			}
+			ts := httptest.NewServer(http.HandlerFunc(h))
+			defer ts.Close()
+
+			wc, err := NewWriteClient(ts.URL, &HTTPConfig{Compression: c})
+			require.NoError(t, err)
+			require.NoError(t, wc.Store(context.Background(), []*prompb.TimeSeries{testSeries("metric", 1)}))
+
+			require.Len(t, got.Timeseries, 1)
+			assert.Equal(t, 1.0, got.Timeseries[0].Samples[0].Value)
+			assert.NoError(t, wc.Close())
+		})
+	}
+}
+
+func TestNewWriteClientInvalidCompression(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewWriteClient("http://localhost", &HTTPConfig{Compression: CompressionSnappy, CompressionLevel: 3})
+	assert.ErrorContains(t, err, "level is not supported")
+}
+
+// BenchmarkCompression reports the bytes on the wire for each codec
+// encoding a batch of time series with the k6's typical labels.
+func BenchmarkCompression(b *testing.B) {
+	series := make([]*prompb.TimeSeries, 0, 2000)
+	now := time.Now().UnixMilli()
+	for i := 0; i < cap(series); i++ {
+		series = append(series, &prompb.TimeSeries{
+			Labels: []*prompb.Label{
+				{Name: "__name__", Value: "k6_http_req_duration_seconds"},
+				{Name: "expected_response", Value: "true"},
+				{Name: "method", Value: "GET"},
+				{Name: "name", Value: fmt.Sprintf("https://test.k6.io/contacts.php?id=%d", i%50)},
+				{Name: "proto", Value: "HTTP/1.1"},
+				{Name: "scenario", Value: "default"},
+				{Name: "status", Value: "200"},
+				{Name: "tls_version", Value: "tls1.3"},
+				{Name: "url", Value: fmt.Sprintf("https://test.k6.io/contacts.php?id=%d", i%50)},
+			},
+			Samples: []*prompb.Sample{{Value: float64(i%100) / 1000, Timestamp: now + int64(i)}},
+		})
+	}
+	raw, err := proto.Marshal(&prompb.WriteRequest{Timeseries: series})
+	require.NoError(b, err)
+
+	tests := []struct {
+		compression Compression
+		level       int
+	}{
+		{compression: CompressionNone},
+		{compression: CompressionSnappy},
+		{compression: CompressionGzip},
+		{compression: CompressionZstd, level: 1},
+		{compression: CompressionZstd},
+		{compression: CompressionZstd, level: 11},
+	}
+	for _, tt := range tests {
+		enc, err := newEncoder(tt.compression, tt.level)
+		require.NoError(b, err)
+		b.Run(fmt.Sprintf("%s-%d", tt.compression, tt.level), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(raw)))
+			var size int
+			for i := 0; i < b.N; i++ {
+				out, err := enc.Encode(raw)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(out)
+			}
+			b.ReportMetric(float64(size), "wire-bytes")
+		})
+	}
+}
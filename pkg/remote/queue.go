@@ -0,0 +1,578 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+)
+
+// OverflowPolicy defines the behavior when a shard's queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest drops the oldest queued time series
+	// for making room for the new one.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+
+	// OverflowBlock blocks the producer until there is room in the queue.
+	OverflowBlock OverflowPolicy = "block"
+)
+
+// Storer stores a batch of time series.
+type Storer interface {
+	Store(ctx context.Context, series []*prompb.TimeSeries) error
+}
+
+// RequestStorer stores a batch of time series
+// with the optional information related to them.
+type RequestStorer interface {
+	StoreRequest(ctx context.Context, wr *WriteRequest) error
+}
+
+// QueueConfig holds the config for the QueueManager.
+type QueueConfig struct {
+	// Capacity is the max number of time series buffered per shard.
+	Capacity int
+
+	// MaxSamplesPerSend is the max number of samples sent in a request,
+	// the native histograms included. A time series is never split,
+	// if it exceeds the limit by itself then it is sent alone.
+	MaxSamplesPerSend int
+
+	// BatchSendDeadline is the max time a time series waits in a shard
+	// before it is sent, also if the batch isn't full.
+	BatchSendDeadline time.Duration
+
+	// MinShards and MaxShards are the bounds for the number of shards
+	// sending the requests in parallel.
+	MinShards, MaxShards int
+
+	// ReshardInterval is the interval between two checks of the backlog
+	// for deciding if the number of shards should be changed.
+	// Zero disables the resharding.
+	ReshardInterval time.Duration
+
+	// OverflowPolicy is the behavior when a shard's queue is full.
+	OverflowPolicy OverflowPolicy
+}
+
+// Validate checks if the config is valid.
+func (c QueueConfig) Validate() error {
+	if c.Capacity < 1 {
+		return fmt.Errorf("the queue capacity must be greater than zero")
+	}
+	if c.MaxSamplesPerSend < 1 {
+		return fmt.Errorf("the max samples per send must be greater than zero")
+	}
+	if c.MinShards < 1 || c.MaxShards < c.MinShards {
+		return fmt.Errorf("the shards must be in the range 1 <= min (%d) <= max (%d)", c.MinShards, c.MaxShards)
+	}
+	switch c.OverflowPolicy {
+	case OverflowDropOldest, OverflowBlock:
+	default:
+		return fmt.Errorf("the queue overflow policy %q is not supported, "+
+			"the supported values are %q and %q", c.OverflowPolicy, OverflowDropOldest, OverflowBlock)
+	}
+	return nil
+}
+
+// QueueStats are the counters of the time series processed by the QueueManager.
+type QueueStats struct {
+	// Enqueued is the number of time series added to the queue.
+	Enqueued int64
+
+	// Sent is the number of time series successfully sent.
+	Sent int64
+
+	// Failed is the number of time series failed to be sent.
+	Failed int64
+
+	// Dropped is the number of time series dropped due to a full queue.
+	Dropped int64
+
+	// Diverted is the number of time series taken over from the divert callback.
+	Diverted int64
+
+	// Pending is the number of time series waiting in the queue.
+	Pending int64
+
+	// Shards is the current number of shards.
+	Shards int
+}
+
+// QueueManager decouples the production of the time series
+// from the requests for storing them, that are sent from a set of shards
+// in parallel. A time series is always assigned to the same shard,
+// so its samples are sent in order.
+//
+// The number of shards is scaled between the configured bounds
+// according to the backlog.
+type QueueManager struct {
+	cfg       QueueConfig
+	client    Storer
+	onFailure func(series []*prompb.TimeSeries, err error)
+
+	// divert is the optional callback taking over
+	// some time series of a batch before it is sent.
+	divert func(batch []*prompb.TimeSeries) []*prompb.TimeSeries
+
+	// mu guards the shards, the write lock
+	// is required for replacing them.
+	mu     sync.RWMutex
+	shards []*shard
+
+	stop chan struct{}
+	done chan struct{}
+
+	enqueued, sent, failed, dropped, diverted atomic.Int64
+
+	// metadata is the metadata by time series' name
+	// attached to the batches, if it is set.
+	metadata atomic.Pointer[map[string]*prompb.MetricMetadata]
+
+	// createdMu guards created.
+	createdMu sync.Mutex
+
+	// created are the created timestamps of the queued time series.
+	created map[*prompb.TimeSeries]int64
+}
+
+// NewQueueManager creates a new QueueManager.
+// The onFailure callback is invoked with the batches that failed to be stored,
+// it could be invoked concurrently from different shards.
+func NewQueueManager(
+	client Storer, cfg QueueConfig,
+	onFailure func(series []*prompb.TimeSeries, err error),
+) *QueueManager {
+	return &QueueManager{
+		cfg:       cfg,
+		client:    client,
+		onFailure: onFailure,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start starts the shards.
+func (q *QueueManager) Start() {
+	q.mu.Lock()
+	q.startShards(q.cfg.MinShards)
+	q.mu.Unlock()
+
+	go q.reshardLoop()
+}
+
+// Append enqueues the time series.
+// Depending on the overflow policy, it blocks or it drops the oldest
+// queued time series if the shard's queue is full.
+func (q *QueueManager) Append(series []*prompb.TimeSeries) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, ts := range series {
+		q.enqueued.Add(1)
+		q.enqueue(ts)
+	}
+}
+
+// AppendCreated is the same as Append but the time series are sent
+// with their created timestamps, as Remote Write 2.0 supports.
+// The client must implement RequestStorer.
+func (q *QueueManager) AppendCreated(series []*prompb.TimeSeries, created map[*prompb.TimeSeries]int64) {
+	if len(created) > 0 {
+		q.createdMu.Lock()
+		if q.created == nil {
+			q.created = make(map[*prompb.TimeSeries]int64, len(created))
+		}
+		for ts, ct := range created {
+			q.created[ts] = ct
+		}
+		q.createdMu.Unlock()
+	}
+	q.Append(series)
+}
+
+// SetDivert sets the callback invoked with every batch before it is sent,
+// it returns the time series to send and it takes over the others,
+// e.g. for holding them back. It must not change the batch.
+// The callback could be invoked concurrently from different shards
+// and it must be set before the queue is started.
+func (q *QueueManager) SetDivert(divert func(batch []*prompb.TimeSeries) []*prompb.TimeSeries) {
+	q.divert = divert
+}
+
+// SetMetadata sets the metadata attached to the batches, by time series' name.
+// The time series in a batch get the metadata matching their __name__ label,
+// as Remote Write 2.0 requires. The client must implement RequestStorer.
+func (q *QueueManager) SetMetadata(metadata map[string]*prompb.MetricMetadata) {
+	q.metadata.Store(&metadata)
+}
+
+// store sends the batch with its metadata and created timestamps, if they are set.
+func (q *QueueManager) store(batch []*prompb.TimeSeries) error {
+	created := q.takeCreated(batch)
+	md := q.metadata.Load()
+	rs, ok := q.client.(RequestStorer)
+	if (md == nil && created == nil) || !ok {
+		return q.client.Store(context.Background(), batch)
+	}
+
+	wr := &WriteRequest{Timeseries: batch, CreatedTimestamps: created}
+	if md != nil {
+		wr.Metadata = batchMetadata(*md, batch)
+	}
+	return rs.StoreRequest(context.Background(), wr)
+}
+
+// divertBatch returns the time series of the batch to send,
+// the created timestamps of the diverted time series are released.
+func (q *QueueManager) divertBatch(batch []*prompb.TimeSeries) []*prompb.TimeSeries {
+	if q.divert == nil {
+		return batch
+	}
+	kept := q.divert(batch)
+	if len(kept) == len(batch) {
+		return kept
+	}
+	q.diverted.Add(int64(len(batch) - len(kept)))
+
+	send := make(map[*prompb.TimeSeries]struct{}, len(kept))
+	for _, ts := range kept {
+		send[ts] = struct{}{}
+	}
+	diverted := make([]*prompb.TimeSeries, 0, len(batch)-len(kept))
+	for _, ts := range batch {
+		if _, ok := send[ts]; !ok {
+			diverted = append(diverted, ts)
+		}
+	}
+	q.takeCreated(diverted)
+	return kept
+}
+
+// batchMetadata returns the metadata matching the batch's time series by name.
+func batchMetadata(md map[string]*prompb.MetricMetadata, batch []*prompb.TimeSeries) []*prompb.MetricMetadata {
+	var (
+		seen     = make(map[string]struct{})
+		metadata []*prompb.MetricMetadata
+	)
+	for _, ts := range batch {
+		for _, l := range ts.Labels {
+			if l.Name != namelbl {
+				continue
+			}
+			if _, ok := seen[l.Value]; ok {
+				break
+			}
+			seen[l.Value] = struct{}{}
+			if m, ok := md[l.Value]; ok {
+				metadata = append(metadata, &prompb.MetricMetadata{
+					Type:             m.Type,
+					MetricFamilyName: l.Value,
+					Help:             m.Help,
+					Unit:             m.Unit,
+				})
+			}
+			break
+		}
+	}
+	return metadata
+}
+
+// takeCreated removes and returns the created timestamps of the time series,
+// nil is returned if none of them has it.
+func (q *QueueManager) takeCreated(series []*prompb.TimeSeries) map[*prompb.TimeSeries]int64 {
+	q.createdMu.Lock()
+	defer q.createdMu.Unlock()
+	if len(q.created) < 1 {
+		return nil
+	}
+
+	var created map[*prompb.TimeSeries]int64
+	for _, ts := range series {
+		ct, ok := q.created[ts]
+		if !ok {
+			continue
+		}
+		if created == nil {
+			created = make(map[*prompb.TimeSeries]int64)
+		}
+		created[ts] = ct
+		delete(q.created, ts)
+	}
+	return created
+}
+
+// enqueue adds the time series to its shard's queue.
+// The caller must hold the lock.
+func (q *QueueManager) enqueue(ts *prompb.TimeSeries) {
+	s := q.shards[shardIndex(ts, len(q.shards))]
+	s.samples.Add(int64(seriesSamples(ts)))
+	if q.cfg.OverflowPolicy == OverflowBlock {
+		s.queue <- ts
+		return
+	}
+	for {
+		select {
+		case s.queue <- ts:
+			return
+		default:
+			select {
+			case dropped := <-s.queue:
+				q.dropped.Add(1)
+				s.samples.Add(-int64(seriesSamples(dropped)))
+				q.takeCreated([]*prompb.TimeSeries{dropped})
+			default:
+			}
+		}
+	}
+}
+
+// Stop sends the queued time series and stops the shards.
+func (q *QueueManager) Stop() {
+	close(q.stop)
+	<-q.done
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopShards()
+}
+
+// Stats returns the current counters.
+func (q *QueueManager) Stats() QueueStats {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return QueueStats{
+		Enqueued: q.enqueued.Load(),
+		Sent:     q.sent.Load(),
+		Failed:   q.failed.Load(),
+		Dropped:  q.dropped.Load(),
+		Diverted: q.diverted.Load(),
+		Pending:  int64(q.pending()),
+		Shards:   len(q.shards),
+	}
+}
+
+// pending returns the number of the queued time series.
+// The caller must hold the lock.
+func (q *QueueManager) pending() int {
+	var n int
+	for _, s := range q.shards {
+		n += len(s.queue) + int(s.inflight.Load())
+	}
+	return n
+}
+
+// pendingSamples returns the number of the queued samples.
+// The caller must hold the lock.
+func (q *QueueManager) pendingSamples() int {
+	var n int
+	for _, s := range q.shards {
+		n += int(s.samples.Load())
+	}
+	return n
+}
+
+func (q *QueueManager) reshardLoop() {
+	defer close(q.done)
+	if q.cfg.ReshardInterval <= 0 {
+		<-q.stop
+		return
+	}
+
+	ticker := time.NewTicker(q.cfg.ReshardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.mu.RLock()
+			current := len(q.shards)
+			desired := desiredShards(q.pendingSamples(), current, q.cfg)
+			q.mu.RUnlock()
+
+			if desired == current {
+				continue
+			}
+			q.mu.Lock()
+			q.reshard(desired)
+			q.mu.Unlock()
+		}
+	}
+}
+
+// desiredShards computes the number of shards required
+// for sending the backlog with a single request per shard.
+// The backlog is counted in samples, as the requests are sized by them.
+// It scales up as soon as it is required and it scales down
+// one shard at time for avoiding to flap.
+func desiredShards(pendingSamples, current int, cfg QueueConfig) int {
+	desired := (pendingSamples + cfg.MaxSamplesPerSend - 1) / cfg.MaxSamplesPerSend
+	if desired < current {
+		desired = current - 1
+	}
+	if desired < cfg.MinShards {
+		desired = cfg.MinShards
+	}
+	if desired > cfg.MaxShards {
+		desired = cfg.MaxShards
+	}
+	return desired
+}
+
+// reshard replaces the current shards with n new shards.
+// The old shards send their in-flight batch, then the time series
+// still queued are moved to the new shards, so the order is preserved.
+// The caller must hold the write lock.
+func (q *QueueManager) reshard(n int) {
+	old := q.shards
+	for _, s := range old {
+		close(s.quit)
+	}
+	for _, s := range old {
+		<-s.done
+	}
+
+	q.startShards(n)
+	for _, s := range old {
+		for len(s.queue) > 0 {
+			q.enqueue(<-s.queue)
+		}
+	}
+}
+
+// startShards starts n new shards. The caller must hold the write lock.
+func (q *QueueManager) startShards(n int) {
+	q.shards = make([]*shard, n)
+	for i := 0; i < n; i++ {
+		s := &shard{
+			queue: make(chan *prompb.TimeSeries, q.cfg.Capacity),
+			quit:  make(chan struct{}),
+			done:  make(chan struct{}),
+		}
+		q.shards[i] = s
+		go q.runShard(s)
+	}
+}
+
+// stopShards stops the current shards waiting for them
+// to send all the queued time series. The caller must hold the write lock.
+func (q *QueueManager) stopShards() {
+	for _, s := range q.shards {
+		close(s.queue)
+	}
+	for _, s := range q.shards {
+		<-s.done
+	}
+	q.shards = nil
+}
+
+type shard struct {
+	queue chan *prompb.TimeSeries
+
+	// quit stops the shard without draining the queue.
+	quit chan struct{}
+	done chan struct{}
+
+	// inflight is the number of time series
+	// dequeued but not yet sent.
+	inflight atomic.Int64
+
+	// samples is the number of samples of the time series
+	// queued or in flight.
+	samples atomic.Int64
+}
+
+// runShard batches the time series from the shard's queue
+// and it sends a batch when it is full or when the deadline expires.
+// It drains the queue when it is closed.
+func (q *QueueManager) runShard(s *shard) {
+	defer close(s.done)
+
+	var samples int
+	batch := make([]*prompb.TimeSeries, 0, q.cfg.MaxSamplesPerSend)
+	send := func() {
+		if len(batch) < 1 {
+			return
+		}
+		if kept := q.divertBatch(batch); len(kept) > 0 {
+			if err := q.store(kept); err != nil {
+				q.failed.Add(int64(len(kept)))
+				if q.onFailure != nil {
+					q.onFailure(kept, err)
+				}
+			} else {
+				q.sent.Add(int64(len(kept)))
+			}
+		}
+		s.inflight.Add(-int64(len(batch)))
+		s.samples.Add(-int64(samples))
+		// the batch could be retained from the failure handler
+		batch = make([]*prompb.TimeSeries, 0, q.cfg.MaxSamplesPerSend)
+		samples = 0
+	}
+
+	deadline := q.cfg.BatchSendDeadline
+	if deadline <= 0 {
+		deadline = time.Second
+	}
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ts, ok := <-s.queue:
+			if !ok {
+				send()
+				return
+			}
+			s.inflight.Add(1)
+			n := seriesSamples(ts)
+			if samples > 0 && samples+n > q.cfg.MaxSamplesPerSend {
+				send()
+				resetTimer(timer, deadline)
+			}
+			batch = append(batch, ts)
+			samples += n
+			if samples >= q.cfg.MaxSamplesPerSend {
+				send()
+				resetTimer(timer, deadline)
+			}
+		case <-timer.C:
+			send()
+			timer.Reset(deadline)
+		case <-s.quit:
+			send()
+			return
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// shardIndex returns the shard for the time series hashing its labels.
+func shardIndex(ts *prompb.TimeSeries, shards int) int {
+	h := fnv.New64a()
+	for _, l := range ts.Labels {
+		_, _ = h.Write([]byte(l.Name))
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(l.Value))
+		_, _ = h.Write([]byte{0xff})
+	}
+	return int(h.Sum64() % uint64(shards)) //nolint:gosec
+}
@@ -0,0 +1,406 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storerMock records the stored batches.
+type storerMock struct {
+	mu      sync.Mutex
+	batches [][]*prompb.TimeSeries
+	err     error
+
+	// block, if set, blocks the Store calls until it is closed.
+	block chan struct{}
+}
+
+func (s *storerMock) Store(_ context.Context, series []*prompb.TimeSeries) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, series)
+	return s.err
+}
+
+func (s *storerMock) Batches() [][]*prompb.TimeSeries {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func testSeries(name string, value float64) *prompb.TimeSeries {
+	return &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: name}},
+		Samples: []*prompb.Sample{{Value: value}},
+	}
+}
+
+func testQueueConfig() QueueConfig {
+	return QueueConfig{
+		Capacity:          100,
+		MaxSamplesPerSend: 10,
+		BatchSendDeadline: time.Hour,
+		MinShards:         1,
+		MaxShards:         4,
+		OverflowPolicy:    OverflowDropOldest,
+	}
+}
+
+func TestQueueManagerBatching(t *testing.T) {
+	t.Parallel()
+
+	storer := &storerMock{}
+	q := NewQueueManager(storer, testQueueConfig(), nil)
+	q.Start()
+
+	series := make([]*prompb.TimeSeries, 25)
+	for i := range series {
+		series[i] = testSeries("metric", float64(i))
+	}
+	q.Append(series)
+	q.Stop()
+
+	batches := storer.Batches()
+	require.Len(t, batches, 3)
+	var values []float64
+	for i, b := range batches {
+		assert.LessOrEqual(t, len(b), 10, i)
+		for _, ts := range b {
+			values = append(values, ts.Samples[0].Value)
+		}
+	}
+	// the same time series is always on the same shard so the order is preserved
+	for i, v := range values {
+		assert.Equal(t, float64(i), v)
+	}
+
+	stats := q.Stats()
+	assert.Equal(t, int64(25), stats.Enqueued)
+	assert.Equal(t, int64(25), stats.Sent)
+	assert.Zero(t, stats.Pending)
+}
+
+func TestQueueManagerBatchingCountsSamples(t *testing.T) {
+	t.Parallel()
+
+	storer := &storerMock{}
+	q := NewQueueManager(storer, testQueueConfig(), nil)
+	q.Start()
+
+	// the counters with the zero sample hold two samples
+	series := make([]*prompb.TimeSeries, 8)
+	for i := range series {
+		series[i] = testSeries("metric", float64(i))
+		series[i].Samples = append([]*prompb.Sample{{}}, series[i].Samples...)
+	}
+	q.Append(series)
+	q.Stop()
+
+	batches := storer.Batches()
+	require.Len(t, batches, 2)
+	for _, b := range batches {
+		var samples int
+		for _, ts := range b {
+			samples += len(ts.Samples)
+		}
+		assert.LessOrEqual(t, samples, 10)
+	}
+	assert.Len(t, batches[0], 5)
+}
+
+// requestStorerMock records the stored requests.
+type requestStorerMock struct {
+	storerMock
+
+	requests []*WriteRequest
+}
+
+func (s *requestStorerMock) StoreRequest(ctx context.Context, wr *WriteRequest) error {
+	s.mu.Lock()
+	s.requests = append(s.requests, wr)
+	s.mu.Unlock()
+	return s.Store(ctx, wr.Timeseries)
+}
+
+func TestQueueManagerMetadata(t *testing.T) {
+	t.Parallel()
+
+	storer := &requestStorerMock{}
+	q := NewQueueManager(storer, testQueueConfig(), nil)
+	q.SetMetadata(map[string]*prompb.MetricMetadata{
+		"metric1": {Type: prompb.MetricMetadata_COUNTER, Help: "The first metric."},
+		"metric3": {Type: prompb.MetricMetadata_GAUGE, Unit: "bytes"},
+	})
+	q.Start()
+	q.Append([]*prompb.TimeSeries{
+		testSeries("metric1", 1), testSeries("metric2", 2), testSeries("metric1", 3),
+	})
+	q.Stop()
+
+	require.Len(t, storer.requests, 1)
+	assert.Len(t, storer.requests[0].Timeseries, 3)
+	assert.Equal(t, []*prompb.MetricMetadata{
+		{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "metric1", Help: "The first metric."},
+	}, storer.requests[0].Metadata)
+}
+
+func TestQueueManagerCreatedTimestamps(t *testing.T) {
+	t.Parallel()
+
+	storer := &requestStorerMock{}
+	q := NewQueueManager(storer, testQueueConfig(), nil)
+	q.Start()
+	series := []*prompb.TimeSeries{testSeries("metric1", 1), testSeries("metric2", 2)}
+	q.AppendCreated(series, map[*prompb.TimeSeries]int64{series[0]: 10})
+	q.Stop()
+
+	require.Len(t, storer.requests, 1)
+	assert.Len(t, storer.requests[0].Timeseries, 2)
+	assert.Nil(t, storer.requests[0].Metadata)
+	assert.Equal(t, map[*prompb.TimeSeries]int64{series[0]: 10}, storer.requests[0].CreatedTimestamps)
+
+	// the sent created timestamps are released
+	assert.Empty(t, q.created)
+}
+
+func TestQueueManagerBatchSendDeadline(t *testing.T) {
+	t.Parallel()
+
+	storer := &storerMock{}
+	cfg := testQueueConfig()
+	cfg.BatchSendDeadline = 10 * time.Millisecond
+	q := NewQueueManager(storer, cfg, nil)
+	q.Start()
+	defer q.Stop()
+
+	q.Append([]*prompb.TimeSeries{testSeries("metric", 1)})
+	assert.Eventually(t, func() bool {
+		return len(storer.Batches()) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestQueueManagerFailure(t *testing.T) {
+	t.Parallel()
+
+	storer := &storerMock{err: errors.New("endpoint down")}
+	var failed []*prompb.TimeSeries
+	q := NewQueueManager(storer, testQueueConfig(), func(series []*prompb.TimeSeries, err error) {
+		assert.ErrorContains(t, err, "endpoint down")
+		failed = append(failed, series...)
+	})
+	q.Start()
+	q.Append([]*prompb.TimeSeries{testSeries("metric", 1), testSeries("metric", 2)})
+	q.Stop()
+
+	assert.Len(t, failed, 2)
+	stats := q.Stats()
+	assert.Equal(t, int64(2), stats.Failed)
+	assert.Zero(t, stats.Sent)
+}
+
+func TestQueueManagerDivert(t *testing.T) {
+	t.Parallel()
+
+	storer := &requestStorerMock{}
+	q := NewQueueManager(storer, testQueueConfig(), nil)
+	var diverted []*prompb.TimeSeries
+	q.SetDivert(func(batch []*prompb.TimeSeries) []*prompb.TimeSeries {
+		var kept []*prompb.TimeSeries
+		for _, ts := range batch {
+			if ts.Labels[0].Value == "held" {
+				diverted = append(diverted, ts)
+				continue
+			}
+			kept = append(kept, ts)
+		}
+		return kept
+	})
+	q.Start()
+	series := []*prompb.TimeSeries{testSeries("metric", 1), testSeries("held", 2)}
+	q.AppendCreated(series, map[*prompb.TimeSeries]int64{series[1]: 10})
+	q.Stop()
+
+	// the kept time series has no created timestamp
+	assert.Empty(t, storer.requests)
+	assert.Equal(t, [][]*prompb.TimeSeries{series[:1]}, storer.Batches())
+	assert.Equal(t, series[1:], diverted)
+
+	// the diverted created timestamps are released
+	assert.Empty(t, q.created)
+	stats := q.Stats()
+	assert.Equal(t, int64(1), stats.Sent)
+	assert.Equal(t, int64(1), stats.Diverted)
+	assert.Zero(t, stats.Pending)
+}
+
+func TestQueueManagerOverflowDropOldest(t *testing.T) {
+	t.Parallel()
+
+	storer := &storerMock{block: make(chan struct{})}
+	cfg := testQueueConfig()
+	cfg.Capacity = 5
+	cfg.MaxSamplesPerSend = 1
+	cfg.MaxShards = 1
+	q := NewQueueManager(storer, cfg, nil)
+	q.Start()
+
+	series := make([]*prompb.TimeSeries, 20)
+	for i := range series {
+		series[i] = testSeries("metric", float64(i))
+	}
+	// it doesn't block even if the endpoint is stuck
+	q.Append(series)
+	close(storer.block)
+	q.Stop()
+
+	stats := q.Stats()
+	assert.Equal(t, int64(20), stats.Enqueued)
+	assert.Positive(t, stats.Dropped)
+	assert.Equal(t, stats.Enqueued, stats.Sent+stats.Dropped)
+
+	// the newest time series are kept
+	batches := storer.Batches()
+	last := batches[len(batches)-1]
+	assert.Equal(t, 19.0, last[len(last)-1].Samples[0].Value)
+}
+
+func TestQueueManagerOverflowBlock(t *testing.T) {
+	t.Parallel()
+
+	storer := &storerMock{block: make(chan struct{})}
+	cfg := testQueueConfig()
+	cfg.Capacity = 1
+	cfg.MaxSamplesPerSend = 1
+	cfg.MaxShards = 1
+	cfg.OverflowPolicy = OverflowBlock
+	q := NewQueueManager(storer, cfg, nil)
+	q.Start()
+
+	appended := make(chan struct{})
+	go func() {
+		defer close(appended)
+		q.Append([]*prompb.TimeSeries{
+			testSeries("metric", 1), testSeries("metric", 2), testSeries("metric", 3),
+		})
+	}()
+
+	select {
+	case <-appended:
+		t.Fatal("append should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(storer.block)
+	<-appended
+	q.Stop()
+
+	stats := q.Stats()
+	assert.Equal(t, int64(3), stats.Sent)
+	assert.Zero(t, stats.Dropped)
+}
+
+func TestQueueManagerReshard(t *testing.T) {
+	t.Parallel()
+
+	storer := &storerMock{}
+	cfg := testQueueConfig()
+	q := NewQueueManager(storer, cfg, nil)
+	q.Start()
+
+	series := make([]*prompb.TimeSeries, 0, 40)
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 10; j++ {
+			series = append(series, testSeries("metric"+strconv.Itoa(i), float64(j)))
+		}
+	}
+	q.Append(series)
+
+	q.mu.Lock()
+	q.reshard(3)
+	q.mu.Unlock()
+	assert.Equal(t, 3, q.Stats().Shards)
+	q.Stop()
+
+	// all the time series are sent in order after the resharding
+	got := make(map[string][]float64)
+	for _, b := range storer.Batches() {
+		for _, ts := range b {
+			name := ts.Labels[0].Value
+			got[name] = append(got[name], ts.Samples[0].Value)
+		}
+	}
+	require.Len(t, got, 4)
+	for name, values := range got {
+		require.Len(t, values, 10, name)
+		for i, v := range values {
+			assert.Equal(t, float64(i), v, name)
+		}
+	}
+}
+
+func TestDesiredShards(t *testing.T) {
+	t.Parallel()
+
+	cfg := QueueConfig{MaxSamplesPerSend: 100, MinShards: 1, MaxShards: 5}
+	tests := []struct {
+		samples, current, exp int
+	}{
+		{samples: 0, current: 1, exp: 1},
+		{samples: 250, current: 1, exp: 3},
+		{samples: 10000, current: 2, exp: 5},
+		// it scales down one shard at time
+		{samples: 0, current: 4, exp: 3},
+		{samples: 150, current: 2, exp: 2},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.exp, desiredShards(tt.samples, tt.current, cfg), tt)
+	}
+}
+
+func TestQueueManagerPendingSamples(t *testing.T) {
+	t.Parallel()
+
+	storer := &storerMock{}
+	q := NewQueueManager(storer, testQueueConfig(), nil)
+	q.Start()
+
+	// the counters with the zero sample hold two samples
+	series := make([]*prompb.TimeSeries, 4)
+	for i := range series {
+		series[i] = testSeries("metric", float64(i))
+		series[i].Samples = append([]*prompb.Sample{{}}, series[i].Samples...)
+	}
+	q.Append(series)
+
+	q.mu.RLock()
+	assert.Equal(t, 8, q.pendingSamples())
+	q.mu.RUnlock()
+	assert.Equal(t, int64(4), q.Stats().Pending)
+
+	q.Stop()
+	assert.Zero(t, q.pendingSamples())
+}
+
+func TestQueueConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, testQueueConfig().Validate())
+
+	cfg := testQueueConfig()
+	cfg.MinShards = 5
+	assert.ErrorContains(t, cfg.Validate(), "shards")
+
+	cfg = testQueueConfig()
+	cfg.OverflowPolicy = "unknown"
+	assert.ErrorContains(t, cfg.Validate(), "overflow policy")
+}
@@ -0,0 +1,146 @@
+package remote
+
+import (
+	"fmt"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// SplitError is returned when a batch has been split
+// into multiple requests and some of them failed.
+type SplitError struct {
+	// Splits is the number of requests the batch has been split into.
+	Splits int
+
+	// Errors are the failures of the single requests.
+	Errors []error
+
+	// Failed are the time series of the failed requests.
+	Failed []*prompb.TimeSeries
+
+	// Recoverable are the time series of the failed requests
+	// that could succeed if retried later, they are a subset of Failed.
+	Recoverable []*prompb.TimeSeries
+}
+
+// Error implements the error interface.
+func (e *SplitError) Error() string {
+	msg := fmt.Sprintf("%d of %d split requests failed", len(e.Errors), e.Splits)
+	for _, err := range e.Errors {
+		msg += "; " + err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the failures of the single requests.
+func (e *SplitError) Unwrap() []error {
+	return e.Errors
+}
+
+// splitSeries splits the time series so each split doesn't exceed
+// the max samples and the max encoded bytes, as sized from the sizer.
+// Zero means no limit.
+//
+// A time series is never split across two splits,
+// if it exceeds the limits by itself then it gets a dedicated split.
+// The order of the time series is preserved.
+func splitSeries(series []*prompb.TimeSeries, maxSamples, maxBytes int, sizer seriesSizer) [][]*prompb.TimeSeries {
+	if maxSamples <= 0 && maxBytes <= 0 {
+		return [][]*prompb.TimeSeries{series}
+	}
+
+	var (
+		splits  [][]*prompb.TimeSeries
+		current []*prompb.TimeSeries
+		samples int
+		size    int
+	)
+	for _, ts := range series {
+		tsSamples := seriesSamples(ts)
+		tsSize := sizer.Size(ts)
+
+		exceeds := (maxSamples > 0 && samples+tsSamples > maxSamples) ||
+			(maxBytes > 0 && size+tsSize > maxBytes)
+		if exceeds && len(current) > 0 {
+			splits = append(splits, current)
+			current, samples, size = nil, 0, 0
+			sizer.Reset()
+			tsSize = sizer.Size(ts)
+		}
+		current = append(current, ts)
+		samples += tsSamples
+		size += tsSize
+	}
+	if len(current) > 0 || len(splits) == 0 {
+		splits = append(splits, current)
+	}
+	return splits
+}
+
+// seriesSamples returns the number of samples of the time series,
+// the native histograms included.
+func seriesSamples(ts *prompb.TimeSeries) int {
+	return len(ts.Samples) + len(ts.Histograms)
+}
+
+// encodedSeriesSize returns the size of the time series
+// encoded as a field of the WriteRequest message.
+func encodedSeriesSize(ts *prompb.TimeSeries) int {
+	n := proto.Size(ts)
+	return protowire.SizeTag(1) + protowire.SizeBytes(n)
+}
+
+// seriesSizer sizes the time series with the encoding of the request.
+type seriesSizer interface {
+	// Size returns the bytes the time series adds to the current split.
+	Size(ts *prompb.TimeSeries) int
+
+	// Reset starts a new split.
+	Reset()
+}
+
+// v1SeriesSizer sizes the time series with the Remote Write 1.0 encoding.
+type v1SeriesSizer struct{}
+
+func (v1SeriesSizer) Size(ts *prompb.TimeSeries) int {
+	return encodedSeriesSize(ts)
+}
+
+func (v1SeriesSizer) Reset() {}
+
+// v2SeriesSizer sizes the time series with the Remote Write 2.0 encoding.
+// The strings are counted once per split because they are interned
+// in the request's symbols table.
+type v2SeriesSizer struct {
+	created  map[*prompb.TimeSeries]int64
+	metadata map[string]*prompb.MetricMetadata
+	symbols  *symbolsTable
+}
+
+func newV2SeriesSizer(wr *WriteRequest) *v2SeriesSizer {
+	return &v2SeriesSizer{
+		created:  wr.CreatedTimestamps,
+		metadata: metadataByName(wr.Metadata),
+		symbols:  newSymbolsTable(),
+	}
+}
+
+func (s *v2SeriesSizer) Size(ts *prompb.TimeSeries) int {
+	n := len(s.symbols.symbols)
+	b, err := appendSeriesV2(nil, s.symbols, ts, s.metadata, s.created[ts])
+	if err != nil {
+		// the encoding will fail anyway
+		return encodedSeriesSize(ts)
+	}
+	size := len(b)
+	for _, sym := range s.symbols.symbols[n:] {
+		size += protowire.SizeTag(v2RequestSymbols) + protowire.SizeBytes(len(sym))
+	}
+	return size
+}
+
+func (s *v2SeriesSizer) Reset() {
+	s.symbols = newSymbolsTable()
+}
@@ -0,0 +1,216 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSplitSeries(t *testing.T) {
+	t.Parallel()
+
+	multi := &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "multi"}},
+		Samples: []*prompb.Sample{{Value: 1}, {Value: 2}, {Value: 3}},
+	}
+	series := []*prompb.TimeSeries{
+		testSeries("a", 1), testSeries("b", 1), multi, testSeries("c", 1), testSeries("d", 1),
+	}
+
+	t.Run("NoLimits", func(t *testing.T) {
+		t.Parallel()
+		splits := splitSeries(series, 0, 0, v1SeriesSizer{})
+		require.Len(t, splits, 1)
+		assert.Equal(t, series, splits[0])
+	})
+
+	t.Run("MaxSamples", func(t *testing.T) {
+		t.Parallel()
+		splits := splitSeries(series, 2, 0, v1SeriesSizer{})
+		// the series with 3 samples exceeds the limit but it isn't split
+		require.Len(t, splits, 3)
+		assert.Equal(t, series[:2], splits[0])
+		assert.Equal(t, []*prompb.TimeSeries{multi}, splits[1])
+		assert.Equal(t, series[3:], splits[2])
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		t.Parallel()
+		size := encodedSeriesSize(series[0])
+		splits := splitSeries(series, 0, 2*size, v1SeriesSizer{})
+		var flat []*prompb.TimeSeries
+		for _, s := range splits {
+			b, err := proto.Marshal(&prompb.WriteRequest{Timeseries: s})
+			require.NoError(t, err)
+			if len(s) > 1 {
+				assert.LessOrEqual(t, len(b), 2*size)
+			}
+			flat = append(flat, s...)
+		}
+		assert.Equal(t, series, flat)
+		assert.Greater(t, len(splits), 2)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		t.Parallel()
+		splits := splitSeries(nil, 10, 10, v1SeriesSizer{})
+		require.Len(t, splits, 1)
+		assert.Empty(t, splits[0])
+	})
+}
+
+func TestClientStoreSplit(t *testing.T) {
+	t.Parallel()
+
+	var requests int64
+	h := func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		b, err = snappy.Decode(nil, b)
+		require.NoError(t, err)
+		var wr prompb.WriteRequest
+		require.NoError(t, proto.Unmarshal(b, &wr))
+		assert.LessOrEqual(t, len(wr.Timeseries), 2)
+
+		// the requests with the "bad" series fail
+		for _, ts := range wr.Timeseries {
+			if strings.HasPrefix(ts.Labels[0].Value, "bad") {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(h))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	c := &WriteClient{
+		hc:  ts.Client(),
+		url: u,
+		cfg: &HTTPConfig{MaxSamplesPerRequest: 2},
+	}
+
+	series := []*prompb.TimeSeries{
+		testSeries("a", 1), testSeries("b", 1),
+		testSeries("bad1", 1), testSeries("c", 1),
+		testSeries("d", 1), testSeries("bad2", 1),
+		testSeries("e", 1),
+	}
+	err = c.Store(context.Background(), series)
+	assert.Equal(t, int64(4), atomic.LoadInt64(&requests))
+
+	var serr *SplitError
+	require.True(t, errors.As(err, &serr))
+	assert.Equal(t, 4, serr.Splits)
+	assert.Len(t, serr.Errors, 2)
+	assert.Equal(t, series[2:6], serr.Failed)
+	assert.ErrorContains(t, err, "split 2/4")
+	assert.ErrorContains(t, err, "split 3/4")
+
+	// the single failures are still inspectable
+	var storeErr *StoreError
+	assert.True(t, errors.As(err, &storeErr))
+	assert.False(t, IsRecoverable(err))
+}
+
+func TestClientStoreSplitRecoverable(t *testing.T) {
+	t.Parallel()
+
+	h := func(rw http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		b, err = snappy.Decode(nil, b)
+		require.NoError(t, err)
+		var wr prompb.WriteRequest
+		require.NoError(t, proto.Unmarshal(b, &wr))
+
+		for _, ts := range wr.Timeseries {
+			switch {
+			case strings.HasPrefix(ts.Labels[0].Value, "bad"):
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			case strings.HasPrefix(ts.Labels[0].Value, "unavailable"):
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(h))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	c := &WriteClient{
+		hc:  ts.Client(),
+		url: u,
+		cfg: &HTTPConfig{MaxSamplesPerRequest: 2},
+	}
+
+	series := []*prompb.TimeSeries{
+		testSeries("a", 1), testSeries("bad1", 1),
+		testSeries("b", 1), testSeries("unavailable1", 1),
+		testSeries("c", 1),
+	}
+	err = c.Store(context.Background(), series)
+
+	var serr *SplitError
+	require.True(t, errors.As(err, &serr))
+	assert.Equal(t, series[:4], serr.Failed)
+	// the series rejected from the endpoint are not recoverable
+	assert.Equal(t, series[2:4], serr.Recoverable)
+}
+
+func TestSplitSeriesV2Size(t *testing.T) {
+	t.Parallel()
+
+	series := make([]*prompb.TimeSeries, 10)
+	for i := range series {
+		series[i] = &prompb.TimeSeries{
+			Labels: []*prompb.Label{
+				{Name: "__name__", Value: "k6_http_req_duration_p99"},
+				{Name: "url", Value: "https://test.k6.io/very/long/path/shared/from/the/series"},
+			},
+			Samples: []*prompb.Sample{{Value: float64(i), Timestamp: 1}},
+		}
+	}
+	wr := &WriteRequest{Timeseries: series}
+
+	// the shared strings are counted once per split
+	sizer := newV2SeriesSizer(wr)
+	total := 0
+	for _, ts := range series {
+		total += sizer.Size(ts)
+	}
+	b, _, err := marshalWriteRequestV2(wr)
+	require.NoError(t, err)
+	// the empty symbol is the only difference
+	assert.Equal(t, len(b), total+2)
+
+	v1Size := encodedSeriesSize(series[0])
+	splits := splitSeries(series, 0, 3*v1Size, newV2SeriesSizer(wr))
+	// the v1 encoding would require at least 4 splits
+	assert.Less(t, len(splits), 4)
+	for _, s := range splits {
+		b, _, err := marshalWriteRequestV2(&WriteRequest{Timeseries: s})
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(b), 3*v1Size+2)
+	}
+}
@@ -0,0 +1,277 @@
+package remote
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtocolVersion is the version of the Remote Write protocol
+// used for encoding the requests.
+type ProtocolVersion string
+
+const (
+	// ProtocolV1 is the Remote Write 1.0 protocol
+	// encoding the prometheus.WriteRequest message.
+	ProtocolV1 ProtocolVersion = "1.0"
+
+	// ProtocolV2 is the Remote Write 2.0 protocol
+	// encoding the io.prometheus.write.v2.Request message.
+	//
+	// Check the specification for details:
+	// https://prometheus.io/docs/specs/remote_write_spec_2_0/
+	ProtocolV2 ProtocolVersion = "2.0"
+)
+
+const namelbl = "__name__"
+
+// The field numbers of the io.prometheus.write.v2 messages.
+//
+// The messages are encoded directly on the wire format because
+// the generated code of the v2 protos isn't available
+// from the Prometheus' buf module currently in use.
+// The Sample and Histogram messages have the same definition
+// between v1 and v2, so they are encoded reusing the v1 types.
+const (
+	v2RequestSymbols    protowire.Number = 4
+	v2RequestTimeseries protowire.Number = 5
+
+	v2SeriesLabelsRefs       protowire.Number = 1
+	v2SeriesSamples          protowire.Number = 2
+	v2SeriesHistograms       protowire.Number = 3
+	v2SeriesExemplars        protowire.Number = 4
+	v2SeriesMetadata         protowire.Number = 5
+	v2SeriesCreatedTimestamp protowire.Number = 6
+
+	v2ExemplarLabelsRefs protowire.Number = 1
+	v2ExemplarValue      protowire.Number = 2
+	v2ExemplarTimestamp  protowire.Number = 3
+
+	v2MetadataType    protowire.Number = 1
+	v2MetadataHelpRef protowire.Number = 3
+	v2MetadataUnitRef protowire.Number = 4
+)
+
+// symbolsTable interns the strings referenced from a Remote Write 2.0 request.
+// The first symbol is always the empty string as required from the specification.
+type symbolsTable struct {
+	symbols []string
+	refs    map[string]uint32
+}
+
+func newSymbolsTable() *symbolsTable {
+	return &symbolsTable{
+		symbols: []string{""},
+		refs:    map[string]uint32{"": 0},
+	}
+}
+
+// Ref returns the reference of the string,
+// it is added to the table if it's the first time it is seen.
+func (t *symbolsTable) Ref(s string) uint32 {
+	if ref, ok := t.refs[s]; ok {
+		return ref
+	}
+	ref := uint32(len(t.symbols)) //nolint:gosec
+	t.symbols = append(t.symbols, s)
+	t.refs[s] = ref
+	return ref
+}
+
+// LabelsRefs returns the references of the labels' names and values
+// as a sequence of name and value pairs.
+func (t *symbolsTable) LabelsRefs(labels []*prompb.Label) []uint32 {
+	refs := make([]uint32, 0, len(labels)*2)
+	for _, l := range labels {
+		refs = append(refs, t.Ref(l.Name), t.Ref(l.Value))
+	}
+	return refs
+}
+
+// WriteCounts is the number of the items in a request
+// as reported from the X-Prometheus-Remote-Write-*-Written headers.
+type WriteCounts struct {
+	Samples, Histograms, Exemplars int
+}
+
+// marshalWriteRequestV2 encodes the request as
+// a Remote Write 2.0 io.prometheus.write.v2.Request message.
+//
+// The metadata is matched to each time series through its __name__ label.
+func marshalWriteRequestV2(req *WriteRequest) ([]byte, WriteCounts, error) {
+	var counts WriteCounts
+
+	metadata := metadataByName(req.Metadata)
+	st := newSymbolsTable()
+	var series []byte
+	for _, ts := range req.Timeseries {
+		b, err := appendSeriesV2(nil, st, ts, metadata, req.CreatedTimestamps[ts])
+		if err != nil {
+			return nil, counts, err
+		}
+		series = append(series, b...)
+
+		counts.Samples += len(ts.Samples)
+		counts.Histograms += len(ts.Histograms)
+		counts.Exemplars += len(ts.Exemplars)
+	}
+
+	var buf []byte
+	for _, s := range st.symbols {
+		buf = protowire.AppendTag(buf, v2RequestSymbols, protowire.BytesType)
+		buf = protowire.AppendString(buf, s)
+	}
+	return append(buf, series...), counts, nil
+}
+
+// metadataByName indexes the metadata by metric family's name.
+func metadataByName(mds []*prompb.MetricMetadata) map[string]*prompb.MetricMetadata {
+	metadata := make(map[string]*prompb.MetricMetadata, len(mds))
+	for _, md := range mds {
+		metadata[md.MetricFamilyName] = md
+	}
+	return metadata
+}
+
+// appendSeriesV2 appends the time series encoded as a field
+// of the io.prometheus.write.v2.Request message, its strings are interned
+// in the symbols table. The created timestamp is not sent if it is zero.
+func appendSeriesV2(
+	buf []byte, st *symbolsTable, ts *prompb.TimeSeries,
+	metadata map[string]*prompb.MetricMetadata, ct int64,
+) ([]byte, error) {
+	var b []byte
+	var name string
+	for _, l := range ts.Labels {
+		if l.Name == namelbl {
+			name = l.Value
+			break
+		}
+	}
+	b = appendPackedUint32(b, v2SeriesLabelsRefs, st.LabelsRefs(ts.Labels))
+
+	for _, s := range ts.Samples {
+		sb, err := proto.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, v2SeriesSamples, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	for _, h := range ts.Histograms {
+		hb, err := proto.Marshal(h)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, v2SeriesHistograms, protowire.BytesType)
+		b = protowire.AppendBytes(b, hb)
+	}
+	for _, e := range ts.Exemplars {
+		var eb []byte
+		eb = appendPackedUint32(eb, v2ExemplarLabelsRefs, st.LabelsRefs(e.Labels))
+		eb = protowire.AppendTag(eb, v2ExemplarValue, protowire.Fixed64Type)
+		eb = protowire.AppendFixed64(eb, math.Float64bits(e.Value))
+		eb = protowire.AppendTag(eb, v2ExemplarTimestamp, protowire.VarintType)
+		eb = protowire.AppendVarint(eb, uint64(e.Timestamp))
+		b = protowire.AppendTag(b, v2SeriesExemplars, protowire.BytesType)
+		b = protowire.AppendBytes(b, eb)
+	}
+
+	if md, ok := metadata[name]; ok {
+		var mb []byte
+		mb = protowire.AppendTag(mb, v2MetadataType, protowire.VarintType)
+		mb = protowire.AppendVarint(mb, uint64(md.Type))
+		if md.Help != "" {
+			mb = protowire.AppendTag(mb, v2MetadataHelpRef, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(st.Ref(md.Help)))
+		}
+		if md.Unit != "" {
+			mb = protowire.AppendTag(mb, v2MetadataUnitRef, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(st.Ref(md.Unit)))
+		}
+		b = protowire.AppendTag(b, v2SeriesMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+
+	if ct != 0 {
+		b = protowire.AppendTag(b, v2SeriesCreatedTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ct))
+	}
+
+	buf = protowire.AppendTag(buf, v2RequestTimeseries, protowire.BytesType)
+	return protowire.AppendBytes(buf, b), nil
+}
+
+func appendPackedUint32(b []byte, num protowire.Number, vals []uint32) []byte {
+	if len(vals) < 1 {
+		return b
+	}
+	var packed []byte
+	for _, v := range vals {
+		packed = protowire.AppendVarint(packed, uint64(v))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+// PartialWriteError is returned when the receiver
+// confirms to have written only part of the sent data.
+//
+// It isn't retried because the written part would be a duplicate.
+type PartialWriteError struct {
+	Sent, Written WriteCounts
+}
+
+// Error implements the error interface.
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("the remote write endpoint partially wrote the request; "+
+		"samples: %d/%d, histograms: %d/%d, exemplars: %d/%d",
+		e.Written.Samples, e.Sent.Samples,
+		e.Written.Histograms, e.Sent.Histograms,
+		e.Written.Exemplars, e.Sent.Exemplars)
+}
+
+// checkWrittenHeaders compares the sent counts with the ones reported
+// from the Remote Write 2.0 response headers.
+// The check is skipped if the receiver doesn't return the headers.
+func checkWrittenHeaders(h http.Header, sent WriteCounts) error {
+	written := sent
+	found := false
+	for key, count := range map[string]*int{
+		"X-Prometheus-Remote-Write-Samples-Written":    &written.Samples,
+		"X-Prometheus-Remote-Write-Histograms-Written": &written.Histograms,
+		"X-Prometheus-Remote-Write-Exemplars-Written":  &written.Exemplars,
+	} {
+		if v, ok := headerInt(h, key); ok {
+			*count = v
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	if written.Samples < sent.Samples ||
+		written.Histograms < sent.Histograms ||
+		written.Exemplars < sent.Exemplars {
+		return &PartialWriteError{Sent: sent, Written: written}
+	}
+	return nil
+}
+
+func headerInt(h http.Header, key string) (int, bool) {
+	v := h.Get(key)
+	if v == "" {
+		return 0, false
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return i, true
+}
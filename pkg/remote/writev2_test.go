@@ -0,0 +1,294 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// v2Series is the decoded version of a io.prometheus.write.v2.TimeSeries
+// with only the fields required from the tests.
+type v2Series struct {
+	labels           map[string]string
+	samples          []*prompb.Sample
+	histograms       []*prompb.Histogram
+	exemplars        int
+	metadataType     uint64
+	help, unit       string
+	createdTimestamp int64
+}
+
+// decodeWriteRequestV2 decodes a io.prometheus.write.v2.Request message
+// resolving the symbols' references.
+func decodeWriteRequestV2(t *testing.T, b []byte) ([]string, []v2Series) {
+	t.Helper()
+
+	var symbols []string
+	var rawSeries [][]byte
+	forEachField(t, b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) {
+		switch num {
+		case v2RequestSymbols:
+			symbols = append(symbols, string(v))
+		case v2RequestTimeseries:
+			rawSeries = append(rawSeries, v)
+		}
+	})
+
+	series := make([]v2Series, 0, len(rawSeries))
+	for _, raw := range rawSeries {
+		s := v2Series{labels: make(map[string]string)}
+		forEachField(t, raw, func(num protowire.Number, _ protowire.Type, v []byte, x uint64) {
+			switch num {
+			case v2SeriesLabelsRefs:
+				var refs []uint64
+				for len(v) > 0 {
+					ref, n := protowire.ConsumeVarint(v)
+					require.GreaterOrEqual(t, n, 0)
+					refs = append(refs, ref)
+					v = v[n:]
+				}
+				require.Zero(t, len(refs)%2)
+				for i := 0; i < len(refs); i += 2 {
+					s.labels[symbols[refs[i]]] = symbols[refs[i+1]]
+				}
+			case v2SeriesSamples:
+				sample := &prompb.Sample{}
+				require.NoError(t, proto.Unmarshal(v, sample))
+				s.samples = append(s.samples, sample)
+			case v2SeriesHistograms:
+				h := &prompb.Histogram{}
+				require.NoError(t, proto.Unmarshal(v, h))
+				s.histograms = append(s.histograms, h)
+			case v2SeriesExemplars:
+				s.exemplars++
+			case v2SeriesMetadata:
+				forEachField(t, v, func(num protowire.Number, _ protowire.Type, _ []byte, x uint64) {
+					switch num {
+					case v2MetadataType:
+						s.metadataType = x
+					case v2MetadataHelpRef:
+						s.help = symbols[x]
+					case v2MetadataUnitRef:
+						s.unit = symbols[x]
+					}
+				})
+			case v2SeriesCreatedTimestamp:
+				s.createdTimestamp = int64(x)
+			}
+		})
+		series = append(series, s)
+	}
+	return symbols, series
+}
+
+func forEachField(
+	t *testing.T, b []byte,
+	fn func(num protowire.Number, typ protowire.Type, bytesVal []byte, varintVal uint64),
+) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			require.GreaterOrEqual(t, n, 0)
+			fn(num, typ, v, 0)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			require.GreaterOrEqual(t, n, 0)
+			fn(num, typ, nil, v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			require.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+		}
+	}
+}
+
+func TestMarshalWriteRequestV2(t *testing.T) {
+	t.Parallel()
+
+	counter := &prompb.TimeSeries{
+		Labels: []*prompb.Label{
+			{Name: "__name__", Value: "k6_http_reqs_total"},
+			{Name: "method", Value: "GET"},
+		},
+		Samples: []*prompb.Sample{{Value: 3, Timestamp: 1000}},
+	}
+	histogram := &prompb.TimeSeries{
+		Labels: []*prompb.Label{
+			{Name: "__name__", Value: "k6_http_req_duration_seconds"},
+			{Name: "method", Value: "GET"},
+		},
+		Histograms: []*prompb.Histogram{{
+			Count:     &prompb.Histogram_CountInt{CountInt: 2},
+			Sum:       0.3,
+			Schema:    3,
+			Timestamp: 1000,
+		}},
+	}
+	wr := &WriteRequest{
+		Timeseries: []*prompb.TimeSeries{counter, histogram},
+		Metadata: []*prompb.MetricMetadata{
+			{
+				MetricFamilyName: "k6_http_reqs_total",
+				Type:             prompb.MetricMetadata_COUNTER,
+				Help:             "Total HTTP requests.",
+			},
+			{
+				MetricFamilyName: "k6_http_req_duration_seconds",
+				Type:             prompb.MetricMetadata_HISTOGRAM,
+				Unit:             "seconds",
+			},
+		},
+		CreatedTimestamps: map[*prompb.TimeSeries]int64{counter: 500},
+	}
+
+	b, counts, err := marshalWriteRequestV2(wr)
+	require.NoError(t, err)
+	assert.Equal(t, WriteCounts{Samples: 1, Histograms: 1}, counts)
+
+	symbols, series := decodeWriteRequestV2(t, b)
+	require.NotEmpty(t, symbols)
+	assert.Equal(t, "", symbols[0])
+	// the labels' name and value shared between the series are interned once
+	assert.Equal(t, []string{
+		"", "__name__", "k6_http_reqs_total", "method", "GET",
+		"Total HTTP requests.", "k6_http_req_duration_seconds", "seconds",
+	}, symbols)
+
+	require.Len(t, series, 2)
+	assert.Equal(t, map[string]string{"__name__": "k6_http_reqs_total", "method": "GET"}, series[0].labels)
+	require.Len(t, series[0].samples, 1)
+	assert.Equal(t, 3.0, series[0].samples[0].Value)
+	assert.Equal(t, int64(1000), series[0].samples[0].Timestamp)
+	assert.Equal(t, uint64(prompb.MetricMetadata_COUNTER), series[0].metadataType)
+	assert.Equal(t, "Total HTTP requests.", series[0].help)
+	assert.Equal(t, int64(500), series[0].createdTimestamp)
+
+	assert.Equal(t, "k6_http_req_duration_seconds", series[1].labels["__name__"])
+	require.Len(t, series[1].histograms, 1)
+	assert.Equal(t, uint64(2), series[1].histograms[0].GetCountInt())
+	assert.Equal(t, int32(3), series[1].histograms[0].Schema)
+	assert.Equal(t, uint64(prompb.MetricMetadata_HISTOGRAM), series[1].metadataType)
+	assert.Equal(t, "seconds", series[1].unit)
+	assert.Zero(t, series[1].createdTimestamp)
+}
+
+func TestCheckWrittenHeaders(t *testing.T) {
+	t.Parallel()
+
+	sent := WriteCounts{Samples: 10, Histograms: 2}
+	tests := map[string]struct {
+		headers map[string]string
+		expErr  bool
+	}{
+		"NoHeaders": {},
+		"AllWritten": {
+			headers: map[string]string{
+				"X-Prometheus-Remote-Write-Samples-Written":    "10",
+				"X-Prometheus-Remote-Write-Histograms-Written": "2",
+				"X-Prometheus-Remote-Write-Exemplars-Written":  "0",
+			},
+		},
+		"OnlySamplesHeader": {
+			headers: map[string]string{"X-Prometheus-Remote-Write-Samples-Written": "10"},
+		},
+		"PartialSamples": {
+			headers: map[string]string{
+				"X-Prometheus-Remote-Write-Samples-Written":    "7",
+				"X-Prometheus-Remote-Write-Histograms-Written": "2",
+			},
+			expErr: true,
+		},
+		"PartialHistograms": {
+			headers: map[string]string{"X-Prometheus-Remote-Write-Histograms-Written": "0"},
+			expErr:  true,
+		},
+	}
+	for name, tt := range tests {
+		h := make(http.Header)
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		err := checkWrittenHeaders(h, sent)
+		if !tt.expErr {
+			assert.NoError(t, err, name)
+			continue
+		}
+		var perr *PartialWriteError
+		assert.True(t, errors.As(err, &perr), name)
+	}
+}
+
+func TestClientStoreV2(t *testing.T) {
+	t.Parallel()
+
+	for _, partial := range []bool{false, true} {
+		var calls int
+		h := func(rw http.ResponseWriter, r *http.Request) {
+			calls++
+			assert.Equal(t, "application/x-protobuf;proto=io.prometheus.write.v2.Request", r.Header.Get("Content-Type"))
+			assert.Equal(t, "2.0.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			b, err = snappy.Decode(nil, b)
+			assert.NoError(t, err)
+			_, series := decodeWriteRequestV2(t, b)
+			assert.Len(t, series, 1)
+
+			written := "1"
+			if partial {
+				written = "0"
+			}
+			rw.Header().Set("X-Prometheus-Remote-Write-Samples-Written", written)
+			rw.WriteHeader(http.StatusNoContent)
+		}
+		ts := httptest.NewServer(http.HandlerFunc(h))
+
+		u, err := url.Parse(ts.URL)
+		require.NoError(t, err)
+
+		c := &WriteClient{
+			hc:  ts.Client(),
+			url: u,
+			cfg: &HTTPConfig{
+				ProtocolVersion: ProtocolV2,
+				Retry:           &RetryConfig{MaxAttempts: 3},
+			},
+		}
+		err = c.Store(context.Background(), []*prompb.TimeSeries{{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "k6_vus"}},
+			Samples: []*prompb.Sample{{Value: math.Pi, Timestamp: 1}},
+		}})
+		ts.Close()
+
+		// the partial writes are not retried
+		assert.Equal(t, 1, calls)
+		if !partial {
+			assert.NoError(t, err)
+			continue
+		}
+		var perr *PartialWriteError
+		require.True(t, errors.As(err, &perr))
+		assert.Equal(t, WriteCounts{Samples: 1}, perr.Sent)
+		assert.Equal(t, WriteCounts{Samples: 0}, perr.Written)
+	}
+}
@@ -0,0 +1,300 @@
+package remotewrite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/mstoykov/atlas"
+	"github.com/sirupsen/logrus"
+	"go.k6.io/k6/metrics"
+)
+
+const (
+	// seriesOverflowBucket collapses the time series beyond the limit
+	// into a single time series per metric with the __overflow__ label.
+	seriesOverflowBucket = "overflow"
+
+	// seriesOverflowDrop drops the time series beyond the limit.
+	seriesOverflowDrop = "drop"
+
+	overflowLabel = "__overflow__"
+
+	// cardinalityReportSize is the number of metrics listed
+	// in the end-of-run cardinality report.
+	cardinalityReportSize = 10
+
+	// cardinalityWarnLabels is the number of labels listed
+	// in the warning when a metric reaches the limit.
+	cardinalityWarnLabels = 3
+)
+
+// seriesLimiter limits the number of active time series.
+type seriesLimiter struct {
+	max  int
+	drop bool
+
+	// active is the number of the admitted time series.
+	active int
+
+	// limited is the number of time series per metric
+	// that have not been admitted.
+	limited map[*metrics.Metric]int64
+
+	// rejected caches the time series that have not been admitted,
+	// so their samples are not mapped and counted again.
+	// A rejected time series stays rejected for the rest of the test,
+	// also when the admitted time series are released, so its samples
+	// are not split between the overflow and a dedicated time series.
+	rejected map[metrics.TimeSeries]struct{}
+}
+
+// newSeriesLimiter creates the limiter from the config,
+// it returns nil if the limit is not set.
+func newSeriesLimiter(conf Config) (*seriesLimiter, error) {
+	if !conf.MaxSeries.Valid || conf.MaxSeries.Int64 == 0 {
+		return nil, nil //nolint:nilnil
+	}
+	if conf.MaxSeries.Int64 < 0 {
+		return nil, fmt.Errorf("the max series must be a positive number, zero means no limit")
+	}
+
+	l := &seriesLimiter{
+		max:      int(conf.MaxSeries.Int64),
+		limited:  make(map[*metrics.Metric]int64),
+		rejected: make(map[metrics.TimeSeries]struct{}),
+	}
+	if conf.SeriesOverflowPolicy.Valid {
+		switch conf.SeriesOverflowPolicy.String {
+		case seriesOverflowBucket:
+		case seriesOverflowDrop:
+			l.drop = true
+		default:
+			return nil, fmt.Errorf("the series overflow policy %q is not supported, "+
+				"the supported values are %q and %q",
+				conf.SeriesOverflowPolicy.String, seriesOverflowBucket, seriesOverflowDrop)
+		}
+	}
+	return l, nil
+}
+
+// admit returns true if a new time series can be added.
+// Otherwise, it caches the time series as rejected
+// and it returns true if it is the first time for the metric.
+func (l *seriesLimiter) admit(series metrics.TimeSeries) (admitted bool, first bool) {
+	if l.active < l.max {
+		l.active++
+		return true, false
+	}
+	l.rejected[series] = struct{}{}
+	l.limited[series.Metric]++
+	return false, l.limited[series.Metric] == 1
+}
+
+// isRejected returns true if the time series has not been admitted before.
+func (l *seriesLimiter) isRejected(series metrics.TimeSeries) bool {
+	_, rejected := l.rejected[series]
+	return rejected
+}
+
+// release releases an admitted time series,
+// so a new time series can be admitted.
+func (l *seriesLimiter) release() {
+	if l.active > 0 {
+		l.active--
+	}
+}
+
+// overflowSeries returns the time series collecting the samples
+// of the metric's time series not admitted from the limiter.
+func overflowSeries(series metrics.TimeSeries) metrics.TimeSeries {
+	return metrics.TimeSeries{
+		Metric: series.Metric,
+		Tags:   rootTagSet(series.Tags).With(overflowLabel, "true"),
+	}
+}
+
+// addLimitedSeries aggregates the time series not admitted from the limiter
+// into the metric's overflow time series or it drops it, depending on the policy.
+// It returns nil if the time series has been dropped
+// and true if it has been aggregated into an existing one.
+func (o *Output) addLimitedSeries(series metrics.TimeSeries) (*seriesWithMeasure, bool) {
+	if o.limiter.drop {
+		return nil, false
+	}
+	series = overflowSeries(series)
+	if swm, ok := o.tsdb[series]; ok {
+		return swm, true
+	}
+	labels, keep := o.mapOverflowLabels(series)
+	if !keep {
+		return nil, false
+	}
+	swm := o.newSeries(series, labels)
+	swm.Overflow = true
+	return swm, false
+}
+
+// mapOverflowLabels maps the overflow time series to the labels.
+// The __overflow__ label is added after the relabeling rules and the sanitization
+// have been applied, so it isn't changed from them.
+func (o *Output) mapOverflowLabels(series metrics.TimeSeries) ([]*prompb.Label, bool) {
+	labels, keep := o.mapLabels(metrics.TimeSeries{Metric: series.Metric, Tags: rootTagSet(series.Tags)})
+	if !keep {
+		return nil, false
+	}
+	labels = append(labels, &prompb.Label{Name: overflowLabel, Value: "true"})
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels, true
+}
+
+// rootTagSet returns the empty tag set
+// from where the provided tag set has been derived.
+func rootTagSet(t *metrics.TagSet) *metrics.TagSet {
+	n := (*atlas.Node)(t)
+	for !n.IsRoot() {
+		n, _, _ = n.Data()
+	}
+	return (*metrics.TagSet)(n)
+}
+
+// metricCardinality is the number of time series of a metric.
+type metricCardinality struct {
+	Metric  string
+	Series  int
+	Limited int64
+}
+
+// cardinalityReport returns the metrics with the highest number
+// of active time series, the overflow time series are not counted.
+func (o *Output) cardinalityReport(size int) []metricCardinality {
+	byMetric := make(map[*metrics.Metric]*metricCardinality)
+	for _, swm := range o.tsdb {
+		if swm.Overflow {
+			continue
+		}
+		mc, ok := byMetric[swm.Metric]
+		if !ok {
+			mc = &metricCardinality{Metric: swm.Metric.Name}
+			byMetric[swm.Metric] = mc
+		}
+		mc.Series++
+	}
+	if o.limiter != nil {
+		for metric, limited := range o.limiter.limited {
+			mc, ok := byMetric[metric]
+			if !ok {
+				mc = &metricCardinality{Metric: metric.Name}
+				byMetric[metric] = mc
+			}
+			mc.Limited = limited
+		}
+	}
+
+	report := make([]metricCardinality, 0, len(byMetric))
+	for _, mc := range byMetric {
+		report = append(report, *mc)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Series != report[j].Series {
+			return report[i].Series > report[j].Series
+		}
+		return report[i].Metric < report[j].Metric
+	})
+	if len(report) > size {
+		report = report[:size]
+	}
+	return report
+}
+
+// topLabels returns the labels with the highest number of distinct values
+// across the active time series of the metric, in the form name (values).
+func (o *Output) topLabels(metric *metrics.Metric, size int) string {
+	values := make(map[string]map[string]struct{})
+	for _, swm := range o.tsdb {
+		if swm.Metric != metric {
+			continue
+		}
+		labels := swm.Labels
+		if labels == nil {
+			labels = MapSeries(swm.TimeSeries, "")
+		}
+		for _, l := range labels {
+			if l.Name == namelbl || l.Name == overflowLabel {
+				continue
+			}
+			if values[l.Name] == nil {
+				values[l.Name] = make(map[string]struct{})
+			}
+			values[l.Name][l.Value] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(values[names[i]]) != len(values[names[j]]) {
+			return len(values[names[i]]) > len(values[names[j]])
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > size {
+		names = names[:size]
+	}
+
+	top := make([]string, 0, len(names))
+	for _, name := range names {
+		top = append(top, fmt.Sprintf("%s (%d)", name, len(values[name])))
+	}
+	return strings.Join(top, ", ")
+}
+
+// warnSeriesLimit warns that the metric has reached the max series limit,
+// with the labels with the highest number of distinct values.
+func (o *Output) warnSeriesLimit(metric *metrics.Metric) {
+	action := "aggregated into the time series with the " + overflowLabel + " label"
+	if o.limiter.drop {
+		action = "dropped"
+	}
+	o.logger.WithFields(logrus.Fields{
+		"metric": metric.Name,
+		"limit":  o.limiter.max,
+		"labels": o.topLabels(metric, cardinalityWarnLabels),
+	}).Warnf("The max series limit has been reached, the new time series of the metric are %s. "+
+		"Consider to reduce the distinct values of the listed labels, "+
+		"for example using the relabeling rules or a URL grouping.", action)
+}
+
+// logCardinalityReport logs the metrics with the highest number of time series.
+// It is a warning if the max series limit has been reached.
+func (o *Output) logCardinalityReport() {
+	report := o.cardinalityReport(cardinalityReportSize)
+	if len(report) < 1 {
+		return
+	}
+
+	metricsList := make([]string, 0, len(report))
+	for _, mc := range report {
+		entry := fmt.Sprintf("%s (%d series", mc.Metric, mc.Series)
+		if mc.Limited > 0 {
+			entry += fmt.Sprintf(", %d limited series", mc.Limited)
+		}
+		metricsList = append(metricsList, entry+")")
+	}
+
+	logger := o.logger.WithField("series", len(o.tsdb))
+	msg := "The metrics with the highest number of time series: " + strings.Join(metricsList, ", ")
+	switch {
+	case o.limiter == nil:
+		logger.Debug(msg)
+	case len(o.limiter.limited) > 0:
+		logger.Warn(msg)
+	default:
+		logger.Info(msg)
+	}
+}
@@ -0,0 +1,190 @@
+package remotewrite
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestNewSeriesLimiter(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config  Config
+		expNil  bool
+		expDrop bool
+		expErr  string
+	}{
+		"Unset":    {expNil: true},
+		"Zero":     {config: Config{MaxSeries: null.IntFrom(0)}, expNil: true},
+		"Negative": {config: Config{MaxSeries: null.IntFrom(-1)}, expErr: "positive number"},
+		"Overflow": {config: Config{MaxSeries: null.IntFrom(10)}},
+		"Drop": {
+			config:  Config{MaxSeries: null.IntFrom(10), SeriesOverflowPolicy: null.StringFrom("drop")},
+			expDrop: true,
+		},
+		"Unknown": {
+			config: Config{MaxSeries: null.IntFrom(10), SeriesOverflowPolicy: null.StringFrom("block")},
+			expErr: "not supported",
+		},
+	}
+	for name, tt := range tests {
+		l, err := newSeriesLimiter(tt.config)
+		if tt.expErr != "" {
+			assert.ErrorContains(t, err, tt.expErr, name)
+			continue
+		}
+		require.NoError(t, err, name)
+		if tt.expNil {
+			assert.Nil(t, l, name)
+			continue
+		}
+		require.NotNil(t, l, name)
+		assert.Equal(t, tt.expDrop, l.drop, name)
+	}
+}
+
+func TestOutputConvertToPbSeriesWithSeriesLimit(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("metric1", metrics.Counter)
+	gauge := registry.MustNewMetric("metric2", metrics.Gauge)
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	sample := func(m *metrics.Metric, url string, v float64) metrics.Sample {
+		return metrics.Sample{
+			TimeSeries: metrics.TimeSeries{
+				Metric: m,
+				Tags:   registry.RootTagSet().With("method", "GET").With("url", url),
+			},
+			Time:  t0,
+			Value: v,
+		}
+	}
+	samples := []metrics.SampleContainer{
+		sample(counter, "/1", 1),
+		sample(counter, "/2", 1),
+		sample(counter, "/3", 1),
+		sample(counter, "/4", 1),
+		sample(gauge, "/1", 5),
+	}
+
+	newOutput := func(policy string) (*Output, *bytes.Buffer) {
+		var logs bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&logs)
+
+		limiter, err := newSeriesLimiter(Config{
+			MaxSeries:            null.IntFrom(2),
+			SeriesOverflowPolicy: null.StringFrom(policy),
+		})
+		require.NoError(t, err)
+		return &Output{
+			logger:  logger,
+			tsdb:    make(map[metrics.TimeSeries]*seriesWithMeasure),
+			limiter: limiter,
+		}, &logs
+	}
+
+	t.Run("Overflow", func(t *testing.T) {
+		t.Parallel()
+
+		o, logs := newOutput("overflow")
+		pbseries := o.convertToPbSeries(samples)
+		sortByNameLabel(pbseries)
+
+		// the two admitted time series, then the overflow time series per metric
+		require.Len(t, o.tsdb, 4)
+		require.Len(t, pbseries, 4)
+
+		overflow := func(name string) *prompb.TimeSeries {
+			for _, s := range pbseries {
+				if s.Labels[0].Value == name && len(s.Labels) == 2 {
+					return s
+				}
+			}
+			return nil
+		}
+		counterOverflow := overflow("k6_metric1_total")
+		require.NotNil(t, counterOverflow)
+		assert.Equal(t, []*prompb.Label{
+			{Name: "__name__", Value: "k6_metric1_total"},
+			{Name: "__overflow__", Value: "true"},
+		}, counterOverflow.Labels)
+		assert.Equal(t, 2.0, counterOverflow.Samples[0].Value)
+
+		gaugeOverflow := overflow("k6_metric2")
+		require.NotNil(t, gaugeOverflow)
+		assert.Equal(t, 5.0, gaugeOverflow.Samples[0].Value)
+
+		assert.Equal(t, map[*metrics.Metric]int64{counter: 2, gauge: 1}, o.limiter.limited)
+
+		// the rejected time series are counted once
+		pbseries = o.convertToPbSeries([]metrics.SampleContainer{
+			metrics.Sample{TimeSeries: samples[2].(metrics.Sample).TimeSeries, Time: t0.Add(time.Second), Value: 1},
+		})
+		require.Len(t, pbseries, 1)
+		assert.Equal(t, 3.0, pbseries[0].Samples[0].Value)
+		assert.Equal(t, map[*metrics.Metric]int64{counter: 2, gauge: 1}, o.limiter.limited)
+
+		// warned once per metric
+		assert.Equal(t, 1, bytes.Count(logs.Bytes(), []byte("metric=metric1")))
+		assert.Contains(t, logs.String(), `labels="url (2), method (1)"`)
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		t.Parallel()
+
+		o, logs := newOutput("drop")
+		pbseries := o.convertToPbSeries(samples)
+
+		assert.Len(t, o.tsdb, 2)
+		assert.Len(t, pbseries, 2)
+		assert.Contains(t, logs.String(), "are dropped")
+	})
+}
+
+func TestOutputCardinalityReport(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("metric1", metrics.Counter)
+	gauge := registry.MustNewMetric("metric2", metrics.Gauge)
+	rate := registry.MustNewMetric("metric3", metrics.Rate)
+
+	o := Output{
+		tsdb:    make(map[metrics.TimeSeries]*seriesWithMeasure),
+		limiter: &seriesLimiter{limited: map[*metrics.Metric]int64{rate: 7}},
+	}
+	add := func(m *metrics.Metric, tags *metrics.TagSet) *seriesWithMeasure {
+		series := metrics.TimeSeries{Metric: m, Tags: tags}
+		o.tsdb[series] = newSeriesWithMeasure(series, trendMapping{}, rateMapping{})
+		return o.tsdb[series]
+	}
+	add(counter, registry.RootTagSet().With("url", "/1"))
+	add(counter, registry.RootTagSet().With("url", "/2"))
+	// a tag with the overflow label's name doesn't make it an overflow time series
+	add(counter, registry.RootTagSet().With(overflowLabel, "true"))
+	add(gauge, registry.RootTagSet())
+	// the overflow time series is not counted
+	add(rate, registry.RootTagSet().With(overflowLabel, "true")).Overflow = true
+
+	assert.Equal(t, []metricCardinality{
+		{Metric: "metric1", Series: 3},
+		{Metric: "metric2", Series: 1},
+	}, o.cardinalityReport(2))
+
+	assert.Equal(t, []metricCardinality{
+		{Metric: "metric1", Series: 3},
+		{Metric: "metric2", Series: 1},
+		{Metric: "metric3", Limited: 7},
+	}, o.cardinalityReport(10))
+}
@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/grafana/xk6-output-prometheus-remote/pkg/sigv4"
 
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/relabel"
 	"github.com/grafana/xk6-output-prometheus-remote/pkg/remote"
 	"go.k6.io/k6/lib/types"
 	"gopkg.in/guregu/null.v3"
@@ -22,10 +26,29 @@ const (
 	defaultTimeout      = 5 * time.Second
 	defaultPushInterval = 5 * time.Second
 	defaultMetricPrefix = "k6_"
+
+	defaultRetryMaxAttempts = 3
+	defaultRetryMinBackoff  = 250 * time.Millisecond
+	defaultRetryMaxBackoff  = 5 * time.Second
+
+	defaultWALMaxSize = 256 << 20
+
+	defaultQueueCapacity       = 10000
+	defaultMaxSamplesPerSend   = 2000
+	defaultMinShards           = 1
+	defaultMaxShards           = 10
+	defaultBatchSendDeadline   = time.Second
+	defaultQueueOverflowPolicy = remote.OverflowDropOldest
+	defaultMaxBytesPerSend     = 4 << 20
 )
 
 //nolint:gochecknoglobals
-var defaultTrendStats = []string{"p(99)"}
+var (
+	defaultTrendStats = []string{"p(99)"}
+
+	metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegex  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
 
 // Config contains the configuration for the Output.
 type Config struct {
@@ -65,13 +88,104 @@ type Config struct {
 	// should map to a Prometheus' Native Histogram.
 	TrendAsNativeHistogram null.Bool `json:"trendAsNativeHistogram"`
 
+	// NativeHistogramBucketFactor is the max growth factor between two consecutive
+	// buckets of the native histograms, it must be greater than 1. The default is 1.1.
+	NativeHistogramBucketFactor null.Float `json:"nativeHistogramBucketFactor"`
+
+	// NativeHistogramZeroThreshold is the width of the zero bucket of the native histograms.
+	NativeHistogramZeroThreshold null.Float `json:"nativeHistogramZeroThreshold"`
+
+	// NativeHistogramMaxBucketNumber is the max number of buckets of the native histograms,
+	// when it is exceeded the resolution is reduced. Zero (default) means no limit.
+	NativeHistogramMaxBucketNumber null.Int `json:"nativeHistogramMaxBucketNumber"`
+
+	// NativeHistogramMinResetDuration is the min time between the resets of a native histogram
+	// when the max number of buckets is exceeded. The resolution is reduced in the meantime.
+	NativeHistogramMinResetDuration types.NullDuration `json:"nativeHistogramMinResetDuration"`
+
+	// NativeHistogramCustomBuckets defines if the native histograms have custom buckets (NHCB),
+	// using the classic histograms' buckets. It requires a receiver supporting them.
+	NativeHistogramCustomBuckets null.Bool `json:"nativeHistogramCustomBuckets"`
+
+	// TrendAsHistogram defines if the mapping for metrics defined as Trend type
+	// should map to a Prometheus' classic histogram, with the _bucket, _sum and _count series.
+	TrendAsHistogram null.Bool `json:"trendAsHistogram"`
+
+	// HistogramBuckets are the upper bounds of the classic histograms' buckets,
+	// in the base unit: seconds for the time and bytes for the data.
+	// The default buckets depend on the metric's unit.
+	HistogramBuckets []float64 `json:"histogramBuckets"`
+
+	// MetricHistogramBuckets are the buckets by metric's name,
+	// they take precedence over the global buckets.
+	MetricHistogramBuckets map[string][]float64 `json:"metricHistogramBuckets"`
+
 	// TrendStats defines the stats to flush for Trend metrics.
 	//
 	// TODO: should we support K6_SUMMARY_TREND_STATS?
 	TrendStats []string `json:"trendStats"`
 
+	// IncludeMetrics are the rules for the time series to send, if defined
+	// only the matching time series are sent. A rule is a metric's name glob,
+	// optionally with the tags: http_req_*{scenario="smoke"}. The glob can be omitted.
+	IncludeMetrics []string `json:"includeMetrics"`
+
+	// ExcludeMetrics are the rules for the time series to not send,
+	// they take precedence over the include rules. The format is the same.
+	ExcludeMetrics []string `json:"excludeMetrics"`
+
+	// MetricTrendStats are the stats to flush by Trend metric, the global stats
+	// are the fallback. The key is the metric's name, optionally
+	// with the tags selecting the time series: metric{tag1=value1,tag2=value2}.
+	// The selectors with more tags take precedence.
+	MetricTrendStats map[string][]string `json:"metricTrendStats"`
+
+	// TrendStatsSketch defines if the Trend stats are computed from a sketch,
+	// so the memory used per time series is bounded. The percentiles are
+	// approximated within the TrendStatsSketchAccuracy relative accuracy.
+	TrendStatsSketch null.Bool `json:"trendStatsSketch"`
+
+	// TrendStatsSketchAccuracy is the relative accuracy of the percentiles
+	// computed from the sketch, in the (0, 1) range. The default is 0.01.
+	TrendStatsSketchAccuracy null.Float `json:"trendStatsSketchAccuracy"`
+
+	// TrendStatsWindowed defines if the Trend stats are computed from the values
+	// since the previous flush, instead of since the start of the test.
+	// The stats' series have the window label with the window's duration,
+	// a k6 tag with the same name is renamed to exported_window.
+	TrendStatsWindowed null.Bool `json:"trendStatsWindowed"`
+
+	// TrendStatsWindow is the duration of a window sliding over the flushes
+	// for computing the Trend stats. Setting it enables the windowed stats.
+	TrendStatsWindow types.NullDuration `json:"trendStatsWindow"`
+
 	StaleMarkers null.Bool `json:"staleMarkers"`
 
+	// CreatedTimestamps sends the time when the counters started from zero,
+	// as the created timestamp with Remote Write 2.0
+	// or as the OpenMetrics' _created time series otherwise,
+	// sent when the counter is seen for the first time and then once per minute.
+	// The created timestamps are not stored in the on-disk queue,
+	// the _created time series are.
+	CreatedTimestamps null.Bool `json:"createdTimestamps"`
+
+	// CounterZeroSample sends a zero sample at the created time
+	// before the first sample of the counters.
+	CounterZeroSample null.Bool `json:"counterZeroSample"`
+
+	// RateAsCounters maps the Rate metrics to the counters of the true values
+	// and of all the values, with the _passes_total and _total suffixes,
+	// instead of the rate's gauge.
+	RateAsCounters null.Bool `json:"rateAsCounters"`
+
+	// RateGauge defines if the rate's gauge is sent too
+	// when the Rate metrics are mapped to counters.
+	RateGauge null.Bool `json:"rateGauge"`
+
+	// StaleSeriesTTL is the duration after that a time series without new samples
+	// is marked as stale and released, during the test. Zero disables it.
+	StaleSeriesTTL types.NullDuration `json:"staleSeriesTTL"`
+
 	// SigV4Region is the AWS region where the workspace is.
 	SigV4Region null.String `json:"sigV4Region"`
 
@@ -80,6 +194,134 @@ type Config struct {
 
 	// SigV4SecretKey is the AWS secret key.
 	SigV4SecretKey null.String `json:"sigV4SecretKey"`
+
+	// RetryMaxAttempts is the maximum number of attempts for sending a batch
+	// of time series, the first attempt included. Set it to 1 for disabling the retries.
+	RetryMaxAttempts null.Int `json:"retryMaxAttempts"`
+
+	// RetryMinBackoff is the wait time before the first retry,
+	// it is exponentially increased for the next retries.
+	RetryMinBackoff types.NullDuration `json:"retryMinBackoff"`
+
+	// RetryMaxBackoff is the upper bound for the wait time between two retries.
+	RetryMaxBackoff types.NullDuration `json:"retryMaxBackoff"`
+
+	// Exemplars defines if the Trend's time series have the exemplars
+	// with the trace ID of the samples, set from the k6 tracing instrumentation.
+	Exemplars null.Bool `json:"exemplars"`
+
+	// ExemplarMetadataKey is the sample's metadata key with the trace ID.
+	// The default is trace_id.
+	ExemplarMetadataKey null.String `json:"exemplarMetadataKey"`
+
+	// ExemplarSampling is the strategy for sampling one exemplar per time series
+	// per flush: max (default), min, first or last.
+	ExemplarSampling null.String `json:"exemplarSampling"`
+
+	// MetadataSendInterval enables sending the metrics' metadata,
+	// it is the interval for sending again the metadata of all the metrics.
+	// The metadata is always sent when a metric is seen for the first time.
+	// Sending the metadata is disabled if it is not set or zero,
+	// Prometheus uses 1m.
+	MetadataSendInterval types.NullDuration `json:"metadataSendInterval"`
+
+	// MetricHelp is the help text sent in the metadata by metric's name,
+	// it takes precedence over the built-in help text of the k6 metrics.
+	MetricHelp map[string]string `json:"metricHelp"`
+
+	// ProtocolVersion is the Remote Write protocol's version to use.
+	// The supported values are 1 (default) and 2.
+	ProtocolVersion null.String `json:"protocolVersion"`
+
+	// WALDir is the directory of the on-disk queue where the time series
+	// are stored when they can't be sent, so they can be sent later
+	// when the endpoint recovers, also from a next test run.
+	// The queue is disabled if it isn't set.
+	WALDir null.String `json:"walDir"`
+
+	// WALMaxSize is the max size in bytes of the on-disk queue,
+	// the oldest time series are dropped when the limit is reached.
+	WALMaxSize null.Int `json:"walMaxSize"`
+
+	// WALMaxAge is the max age of the time series in the on-disk queue,
+	// the older time series are dropped.
+	WALMaxAge types.NullDuration `json:"walMaxAge"`
+
+	// QueueCapacity is the max number of time series
+	// buffered for each shard of the sending queue.
+	QueueCapacity null.Int `json:"queueCapacity"`
+
+	// MaxSamplesPerSend is the max number of samples sent in a single request,
+	// the native histograms included. A time series is never split.
+	MaxSamplesPerSend null.Int `json:"maxSamplesPerSend"`
+
+	// MaxBytesPerSend is the max size in bytes of the encoded protobuf message
+	// sent in a single request, before the compression.
+	// A larger batch of time series is split into multiple requests.
+	MaxBytesPerSend null.Int `json:"maxBytesPerSend"`
+
+	// MinShards is the min number of shards sending the requests in parallel.
+	MinShards null.Int `json:"minShards"`
+
+	// MaxShards is the max number of shards sending the requests in parallel,
+	// the shards are scaled up to it when the backlog grows.
+	MaxShards null.Int `json:"maxShards"`
+
+	// QueueOverflowPolicy defines what to do when the sending queue is full.
+	// The supported values are drop-oldest (default) and block.
+	QueueOverflowPolicy null.String `json:"queueOverflowPolicy"`
+
+	// Compression is the codec for the requests' body.
+	// The supported values are snappy (default), zstd, gzip and none.
+	Compression null.String `json:"compression"`
+
+	// CompressionLevel is the level of the codec,
+	// it is supported only from zstd and gzip.
+	CompressionLevel null.Int `json:"compressionLevel"`
+
+	// RelabelConfigs are the relabeling rules applied in order
+	// to the labels of each time series before it is sent.
+	// The rules are compatible with the Prometheus' relabel_config,
+	// the __name__ label holds the metric's name without the suffixes.
+	RelabelConfigs []relabel.Config `json:"relabelConfigs"`
+
+	// MaxSeries is the max number of active time series,
+	// zero (default) means no limit.
+	MaxSeries null.Int `json:"maxSeries"`
+
+	// SeriesOverflowPolicy defines what to do with the new time series
+	// when the max series limit is reached. The supported values are
+	// overflow (default), that aggregates them into a time series per metric
+	// with the __overflow__="true" label, and drop.
+	SeriesOverflowPolicy null.String `json:"seriesOverflowPolicy"`
+
+	// MetricPrefix is the prefix for the metrics' names, it can be empty.
+	// The default is k6_.
+	MetricPrefix null.String `json:"metricPrefix"`
+
+	// MetricRenames maps the k6 metrics' names to the names to use in place of them,
+	// the renamed metrics are not prefixed. The suffixes are appended to the new name.
+	MetricRenames map[string]string `json:"metricRenames"`
+
+	// UTF8Names allows the UTF-8 characters in the metrics' and labels' names,
+	// otherwise the characters not allowed from the Prometheus' legacy names
+	// are replaced with an underscore. It requires a receiver supporting them.
+	UTF8Names null.Bool `json:"utf8Names"`
+
+	// ExternalLabels are the labels added to every time series,
+	// for example the environment or the test's ID.
+	// The k6 tags with the same name take precedence over them.
+	ExternalLabels map[string]string `json:"externalLabels"`
+
+	// RunID is the value of the run_id label added to every time series,
+	// for keeping distinct the time series of concurrent test runs.
+	// If it is auto then a ULID is generated.
+	RunID null.String `json:"runID"`
+
+	// Instance is the value of the instance label added to every time series,
+	// for keeping distinct the time series of the load generators of a distributed test run.
+	// If it is auto then the hostname is used.
+	Instance null.String `json:"instance"`
 }
 
 // NewConfig creates an Output's configuration.
@@ -141,6 +383,64 @@ func (conf Config) RemoteConfig() (*remote.HTTPConfig, error) {
 		}
 	}
 
+	hc.Retry = &remote.RetryConfig{
+		MaxAttempts: defaultRetryMaxAttempts,
+		MinBackoff:  defaultRetryMinBackoff,
+		MaxBackoff:  defaultRetryMaxBackoff,
+		// the retries must never overlap the next flush
+		MaxElapsed: conf.PushInterval.TimeDuration(),
+	}
+	if conf.RetryMaxAttempts.Valid {
+		if conf.RetryMaxAttempts.Int64 < 1 {
+			return nil, errors.New("the retry max attempts must be greater than zero")
+		}
+		hc.Retry.MaxAttempts = int(conf.RetryMaxAttempts.Int64)
+	}
+	if conf.RetryMinBackoff.Valid {
+		hc.Retry.MinBackoff = conf.RetryMinBackoff.TimeDuration()
+	}
+	if conf.RetryMaxBackoff.Valid {
+		hc.Retry.MaxBackoff = conf.RetryMaxBackoff.TimeDuration()
+	}
+	if hc.Retry.MinBackoff < 0 || hc.Retry.MaxBackoff < 0 {
+		return nil, errors.New("the retry backoffs can't be negative")
+	}
+	if hc.Retry.MinBackoff > hc.Retry.MaxBackoff {
+		return nil, fmt.Errorf("the retry min backoff (%s) can't be greater than the max backoff (%s)",
+			hc.Retry.MinBackoff, hc.Retry.MaxBackoff)
+	}
+
+	hc.MaxSamplesPerRequest = defaultMaxSamplesPerSend
+	if conf.MaxSamplesPerSend.Valid {
+		hc.MaxSamplesPerRequest = int(conf.MaxSamplesPerSend.Int64)
+	}
+	hc.MaxBytesPerRequest = defaultMaxBytesPerSend
+	if conf.MaxBytesPerSend.Valid {
+		if conf.MaxBytesPerSend.Int64 < 1 {
+			return nil, errors.New("the max bytes per send must be greater than zero")
+		}
+		hc.MaxBytesPerRequest = int(conf.MaxBytesPerSend.Int64)
+	}
+
+	if conf.ProtocolVersion.Valid {
+		switch {
+		case conf.ProtocolVersion.String == "1" || conf.ProtocolVersion.String == "1.0":
+			hc.ProtocolVersion = remote.ProtocolV1
+		case conf.protocolV2():
+			hc.ProtocolVersion = remote.ProtocolV2
+		default:
+			return nil, fmt.Errorf("the remote write protocol version %q is not supported, "+
+				"the supported versions are 1 and 2", conf.ProtocolVersion.String)
+		}
+	}
+
+	if conf.Compression.Valid {
+		hc.Compression = remote.Compression(conf.Compression.String)
+	}
+	if conf.CompressionLevel.Valid {
+		hc.CompressionLevel = int(conf.CompressionLevel.Int64)
+	}
+
 	if len(conf.Headers) > 0 {
 		hc.Headers = make(http.Header)
 		for k, v := range conf.Headers {
@@ -158,6 +458,154 @@ func (conf Config) RemoteConfig() (*remote.HTTPConfig, error) {
 	return &hc, nil
 }
 
+// protocolV2 returns true if the Remote Write 2.0 protocol is used.
+func (conf Config) protocolV2() bool {
+	return conf.ProtocolVersion.String == "2" || conf.ProtocolVersion.String == "2.0"
+}
+
+// QueueConfig creates a configuration for the sending queue.
+func (conf Config) QueueConfig() (remote.QueueConfig, error) {
+	qc := remote.QueueConfig{
+		Capacity:          defaultQueueCapacity,
+		MaxSamplesPerSend: defaultMaxSamplesPerSend,
+		BatchSendDeadline: defaultBatchSendDeadline,
+		MinShards:         defaultMinShards,
+		MaxShards:         defaultMaxShards,
+		ReshardInterval:   defaultPushInterval,
+		OverflowPolicy:    defaultQueueOverflowPolicy,
+	}
+	if conf.PushInterval.Valid {
+		qc.ReshardInterval = conf.PushInterval.TimeDuration()
+	}
+	if conf.QueueCapacity.Valid {
+		qc.Capacity = int(conf.QueueCapacity.Int64)
+	}
+	if conf.MaxSamplesPerSend.Valid {
+		qc.MaxSamplesPerSend = int(conf.MaxSamplesPerSend.Int64)
+	}
+	if conf.MinShards.Valid {
+		qc.MinShards = int(conf.MinShards.Int64)
+		if qc.MaxShards < qc.MinShards && !conf.MaxShards.Valid {
+			qc.MaxShards = qc.MinShards
+		}
+	}
+	if conf.MaxShards.Valid {
+		qc.MaxShards = int(conf.MaxShards.Int64)
+	}
+	if conf.QueueOverflowPolicy.Valid {
+		qc.OverflowPolicy = remote.OverflowPolicy(conf.QueueOverflowPolicy.String)
+	}
+	if err := qc.Validate(); err != nil {
+		return qc, fmt.Errorf("invalid queue config: %w", err)
+	}
+	return qc, nil
+}
+
+// validateMetricNames validates the metrics' prefix and renames,
+// the resulting names must be valid Prometheus' metric names.
+func (conf Config) validateMetricNames() error {
+	if conf.MetricPrefix.Valid && !validName(conf.MetricPrefix.String, conf.UTF8Names.Bool, true) {
+		return fmt.Errorf("the metric prefix %q is not a valid metric name's prefix", conf.MetricPrefix.String)
+	}
+	for name, renamed := range conf.MetricRenames {
+		if !validName(renamed, conf.UTF8Names.Bool, false) {
+			return fmt.Errorf("the rename %q for the metric %q is not a valid metric name", renamed, name)
+		}
+	}
+	return nil
+}
+
+// validateExternalLabels validates the external labels' names and values.
+// The names starting with __ are reserved.
+func (conf Config) validateExternalLabels() error {
+	for name, value := range conf.ExternalLabels {
+		valid := labelNameRegex.MatchString(name)
+		if conf.UTF8Names.Bool {
+			valid = name != "" && utf8.ValidString(name)
+		}
+		if !valid || strings.HasPrefix(name, reservedNamePrefix) {
+			return fmt.Errorf("the external label %q is not a valid label name", name)
+		}
+		if value == "" {
+			return fmt.Errorf("the external label %q has an empty value", name)
+		}
+	}
+	return nil
+}
+
+// validateHistogram validates the Trend's mapping to the classic histogram.
+func (conf Config) validateHistogram() error {
+	if conf.TrendAsHistogram.Bool && conf.TrendAsNativeHistogram.Bool {
+		return errors.New("the Trend can't be mapped to a classic and a native histogram at the same time")
+	}
+	if conf.NativeHistogramCustomBuckets.Bool && !conf.TrendAsNativeHistogram.Bool {
+		return errors.New("the native histograms with custom buckets require the Trend mapped to native histograms")
+	}
+	if conf.NativeHistogramBucketFactor.Valid && conf.NativeHistogramBucketFactor.Float64 <= 1 {
+		return errors.New("the native histogram's bucket factor must be greater than 1")
+	}
+	if conf.NativeHistogramZeroThreshold.Valid && conf.NativeHistogramZeroThreshold.Float64 < 0 {
+		return errors.New("the native histogram's zero threshold can't be negative")
+	}
+	if conf.NativeHistogramMaxBucketNumber.Valid &&
+		(conf.NativeHistogramMaxBucketNumber.Int64 < 0 || conf.NativeHistogramMaxBucketNumber.Int64 > math.MaxUint32) {
+		return errors.New("the native histogram's max bucket number is out of range")
+	}
+	if conf.NativeHistogramMinResetDuration.Valid && conf.NativeHistogramMinResetDuration.Duration < 0 {
+		return errors.New("the native histogram's min reset duration can't be negative")
+	}
+	if len(conf.HistogramBuckets) > 0 {
+		if err := validateBuckets(conf.HistogramBuckets); err != nil {
+			return fmt.Errorf("the histogram buckets are invalid: %w", err)
+		}
+	}
+	for name, buckets := range conf.MetricHistogramBuckets {
+		if err := validateBuckets(buckets); err != nil {
+			return fmt.Errorf("the histogram buckets of the metric %q are invalid: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validateTrendStatsSketch validates the sketch for computing the Trend stats.
+func (conf Config) validateTrendStatsSketch() error {
+	if conf.TrendStatsSketchAccuracy.Valid &&
+		(conf.TrendStatsSketchAccuracy.Float64 <= 0 || conf.TrendStatsSketchAccuracy.Float64 >= 1) {
+		return errors.New("the Trend stats sketch's accuracy must be between 0 and 1")
+	}
+	return nil
+}
+
+// validateTrendStatsWindow validates the window for computing the Trend stats.
+func (conf Config) validateTrendStatsWindow() error {
+	if !conf.TrendStatsWindowed.Bool && !conf.TrendStatsWindow.Valid {
+		return nil
+	}
+	if conf.TrendAsHistogram.Bool || conf.TrendAsNativeHistogram.Bool {
+		return errors.New("the windowed Trend stats are not supported when the Trend is mapped to a histogram")
+	}
+	if conf.TrendStatsWindow.Valid && conf.TrendStatsWindow.Duration < conf.PushInterval.Duration {
+		return fmt.Errorf("the Trend stats window can't be shorter than the push interval (%s)",
+			conf.PushInterval.String())
+	}
+	return nil
+}
+
+// validateStaleSeriesTTL validates the TTL of the idle time series.
+func (conf Config) validateStaleSeriesTTL() error {
+	if !conf.StaleSeriesTTL.Valid || conf.StaleSeriesTTL.Duration == 0 {
+		return nil
+	}
+	if conf.StaleSeriesTTL.Duration < 0 {
+		return errors.New("the stale series TTL must be a positive duration, zero disables it")
+	}
+	if conf.StaleSeriesTTL.Duration <= conf.PushInterval.Duration {
+		return fmt.Errorf("the stale series TTL must be longer than the push interval (%s)",
+			conf.PushInterval.String())
+	}
+	return nil
+}
+
 // Apply merges applied Config into base.
 func (conf Config) Apply(applied Config) Config {
 	if applied.ServerURL.Valid {
@@ -204,17 +652,110 @@ func (conf Config) Apply(applied Config) Config {
 		conf.StaleMarkers = applied.StaleMarkers
 	}
 
+	if applied.CreatedTimestamps.Valid {
+		conf.CreatedTimestamps = applied.CreatedTimestamps
+	}
+
+	if applied.CounterZeroSample.Valid {
+		conf.CounterZeroSample = applied.CounterZeroSample
+	}
+
+	if applied.RateAsCounters.Valid {
+		conf.RateAsCounters = applied.RateAsCounters
+	}
+
+	if applied.RateGauge.Valid {
+		conf.RateGauge = applied.RateGauge
+	}
+
+	if applied.StaleSeriesTTL.Valid {
+		conf.StaleSeriesTTL = applied.StaleSeriesTTL
+	}
+
 	if len(applied.Headers) > 0 {
 		for k, v := range applied.Headers {
 			conf.Headers[k] = v
 		}
 	}
 
+	if applied.NativeHistogramBucketFactor.Valid {
+		conf.NativeHistogramBucketFactor = applied.NativeHistogramBucketFactor
+	}
+
+	if applied.NativeHistogramZeroThreshold.Valid {
+		conf.NativeHistogramZeroThreshold = applied.NativeHistogramZeroThreshold
+	}
+
+	if applied.NativeHistogramMaxBucketNumber.Valid {
+		conf.NativeHistogramMaxBucketNumber = applied.NativeHistogramMaxBucketNumber
+	}
+
+	if applied.NativeHistogramMinResetDuration.Valid {
+		conf.NativeHistogramMinResetDuration = applied.NativeHistogramMinResetDuration
+	}
+
+	if applied.NativeHistogramCustomBuckets.Valid {
+		conf.NativeHistogramCustomBuckets = applied.NativeHistogramCustomBuckets
+	}
+
+	if applied.TrendAsHistogram.Valid {
+		conf.TrendAsHistogram = applied.TrendAsHistogram
+	}
+
+	if len(applied.HistogramBuckets) > 0 {
+		conf.HistogramBuckets = make([]float64, len(applied.HistogramBuckets))
+		copy(conf.HistogramBuckets, applied.HistogramBuckets)
+	}
+
+	if len(applied.MetricHistogramBuckets) > 0 {
+		if conf.MetricHistogramBuckets == nil {
+			conf.MetricHistogramBuckets = make(map[string][]float64, len(applied.MetricHistogramBuckets))
+		}
+		for k, v := range applied.MetricHistogramBuckets {
+			conf.MetricHistogramBuckets[k] = v
+		}
+	}
+
 	if len(applied.TrendStats) > 0 {
 		conf.TrendStats = make([]string, len(applied.TrendStats))
 		copy(conf.TrendStats, applied.TrendStats)
 	}
 
+	if len(applied.IncludeMetrics) > 0 {
+		conf.IncludeMetrics = make([]string, len(applied.IncludeMetrics))
+		copy(conf.IncludeMetrics, applied.IncludeMetrics)
+	}
+
+	if len(applied.ExcludeMetrics) > 0 {
+		conf.ExcludeMetrics = make([]string, len(applied.ExcludeMetrics))
+		copy(conf.ExcludeMetrics, applied.ExcludeMetrics)
+	}
+
+	if len(applied.MetricTrendStats) > 0 {
+		if conf.MetricTrendStats == nil {
+			conf.MetricTrendStats = make(map[string][]string, len(applied.MetricTrendStats))
+		}
+		for k, v := range applied.MetricTrendStats {
+			conf.MetricTrendStats[k] = v
+		}
+	}
+
+	if applied.TrendStatsSketch.Valid {
+		conf.TrendStatsSketch = applied.TrendStatsSketch
+	}
+
+	if applied.TrendStatsSketchAccuracy.Valid {
+		conf.TrendStatsSketchAccuracy = applied.TrendStatsSketchAccuracy
+	}
+
+	if applied.TrendStatsWindowed.Valid {
+		conf.TrendStatsWindowed = applied.TrendStatsWindowed
+	}
+
+	if applied.TrendStatsWindow.Valid {
+		conf.TrendStatsWindow = applied.TrendStatsWindow
+	}
+
 	if applied.ClientCertificate.Valid {
 		conf.ClientCertificate = applied.ClientCertificate
 	}
@@ -223,13 +764,144 @@ func (conf Config) Apply(applied Config) Config {
 		conf.ClientCertificateKey = applied.ClientCertificateKey
 	}
 
+	if applied.RetryMaxAttempts.Valid {
+		conf.RetryMaxAttempts = applied.RetryMaxAttempts
+	}
+
+	if applied.RetryMinBackoff.Valid {
+		conf.RetryMinBackoff = applied.RetryMinBackoff
+	}
+
+	if applied.RetryMaxBackoff.Valid {
+		conf.RetryMaxBackoff = applied.RetryMaxBackoff
+	}
+
+	if applied.Exemplars.Valid {
+		conf.Exemplars = applied.Exemplars
+	}
+
+	if applied.ExemplarMetadataKey.Valid {
+		conf.ExemplarMetadataKey = applied.ExemplarMetadataKey
+	}
+
+	if applied.ExemplarSampling.Valid {
+		conf.ExemplarSampling = applied.ExemplarSampling
+	}
+
+	if applied.MetadataSendInterval.Valid {
+		conf.MetadataSendInterval = applied.MetadataSendInterval
+	}
+
+	if len(applied.MetricHelp) > 0 {
+		if conf.MetricHelp == nil {
+			conf.MetricHelp = make(map[string]string, len(applied.MetricHelp))
+		}
+		for k, v := range applied.MetricHelp {
+			conf.MetricHelp[k] = v
+		}
+	}
+
+	if applied.ProtocolVersion.Valid {
+		conf.ProtocolVersion = applied.ProtocolVersion
+	}
+
+	if applied.WALDir.Valid {
+		conf.WALDir = applied.WALDir
+	}
+
+	if applied.WALMaxSize.Valid {
+		conf.WALMaxSize = applied.WALMaxSize
+	}
+
+	if applied.WALMaxAge.Valid {
+		conf.WALMaxAge = applied.WALMaxAge
+	}
+
+	if applied.QueueCapacity.Valid {
+		conf.QueueCapacity = applied.QueueCapacity
+	}
+
+	if applied.MaxSamplesPerSend.Valid {
+		conf.MaxSamplesPerSend = applied.MaxSamplesPerSend
+	}
+
+	if applied.MaxBytesPerSend.Valid {
+		conf.MaxBytesPerSend = applied.MaxBytesPerSend
+	}
+
+	if applied.MinShards.Valid {
+		conf.MinShards = applied.MinShards
+	}
+
+	if applied.MaxShards.Valid {
+		conf.MaxShards = applied.MaxShards
+	}
+
+	if applied.QueueOverflowPolicy.Valid {
+		conf.QueueOverflowPolicy = applied.QueueOverflowPolicy
+	}
+
+	if applied.Compression.Valid {
+		conf.Compression = applied.Compression
+	}
+
+	if applied.CompressionLevel.Valid {
+		conf.CompressionLevel = applied.CompressionLevel
+	}
+
+	if len(applied.RelabelConfigs) > 0 {
+		conf.RelabelConfigs = applied.RelabelConfigs
+	}
+
+	if applied.MaxSeries.Valid {
+		conf.MaxSeries = applied.MaxSeries
+	}
+
+	if applied.SeriesOverflowPolicy.Valid {
+		conf.SeriesOverflowPolicy = applied.SeriesOverflowPolicy
+	}
+
+	if len(applied.ExternalLabels) > 0 {
+		if conf.ExternalLabels == nil {
+			conf.ExternalLabels = make(map[string]string, len(applied.ExternalLabels))
+		}
+		for k, v := range applied.ExternalLabels {
+			conf.ExternalLabels[k] = v
+		}
+	}
+
+	if applied.RunID.Valid {
+		conf.RunID = applied.RunID
+	}
+
+	if applied.Instance.Valid {
+		conf.Instance = applied.Instance
+	}
+
+	if applied.UTF8Names.Valid {
+		conf.UTF8Names = applied.UTF8Names
+	}
+
+	if applied.MetricPrefix.Valid {
+		conf.MetricPrefix = applied.MetricPrefix
+	}
+
+	if len(applied.MetricRenames) > 0 {
+		if conf.MetricRenames == nil {
+			conf.MetricRenames = make(map[string]string, len(applied.MetricRenames))
+		}
+		for k, v := range applied.MetricRenames {
+			conf.MetricRenames[k] = v
+		}
+	}
+
 	return conf
 }
 
 // GetConsolidatedConfig combines the options' values from the different sources
 // and returns the merged options. The Order of precedence used is documented
 // in the k6 Documentation https://k6.io/docs/using-k6/k6-options/how-to/#order-of-precedence.
-func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, _ string) (Config, error) {
+func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, arg string) (Config, error) {
 	result := NewConfig()
 	if jsonRawConf != nil {
 		jsonConf, err := parseJSON(jsonRawConf)
@@ -247,18 +919,13 @@ func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, _
 		result = result.Apply(envConf)
 	}
 
-	// TODO: define a way for defining Output's options
-	// then support them.
-	// url is the third GetConsolidatedConfig's argument which is omitted for now
-	//nolint:gocritic
-	//
-	//if url != "" {
-	//urlConf, err := parseArg(url)
-	//if err != nil {
-	//return result, fmt.Errorf("parse argument string options failed: %w", err)
-	//}
-	//result = result.Apply(urlConf)
-	//}
+	if arg != "" {
+		argConf, err := parseArg(arg)
+		if err != nil {
+			return result, fmt.Errorf("parse argument string options failed: %w", err)
+		}
+		result = result.Apply(argConf)
+	}
 
 	return result, nil
 }
@@ -275,6 +942,40 @@ func envBool(env map[string]string, name string) (null.Bool, error) {
 	return null.NewBool(false, false), nil
 }
 
+func envInt(env map[string]string, name string) (null.Int, error) {
+	if v, vDefined := env[name]; vDefined {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return null.NewInt(0, false), err
+		}
+
+		return null.IntFrom(i), nil
+	}
+	return null.NewInt(0, false), nil
+}
+
+func envFloat(env map[string]string, name string) (null.Float, error) {
+	if v, vDefined := env[name]; vDefined {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return null.NewFloat(0, false), err
+		}
+
+		return null.FloatFrom(f), nil
+	}
+	return null.NewFloat(0, false), nil
+}
+
+func envDuration(env map[string]string, name string) (types.NullDuration, error) {
+	var d types.NullDuration
+	if v, vDefined := env[name]; vDefined {
+		if err := d.UnmarshalText([]byte(v)); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
 func envMap(env map[string]string, prefix string) map[string]string {
 	result := make(map[string]string)
 	for ek, ev := range env {
@@ -367,13 +1068,284 @@ func parseEnvs(env map[string]string) (Config, error) { //nolint:funlen
 		c.StaleMarkers = b
 	}
 
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_CREATED_TIMESTAMPS"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.CreatedTimestamps = b
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_COUNTER_ZERO_SAMPLE"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.CounterZeroSample = b
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_RATE_AS_COUNTERS"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.RateAsCounters = b
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_RATE_GAUGE"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.RateGauge = b
+	}
+
+	if d, err := envDuration(env, "K6_PROMETHEUS_RW_STALE_SERIES_TTL"); err != nil {
+		return c, err
+	} else if d.Valid {
+		c.StaleSeriesTTL = d
+	}
+
+	for name, field := range map[string]*null.Float{
+		"K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_BUCKET_FACTOR":  &c.NativeHistogramBucketFactor,
+		"K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_ZERO_THRESHOLD": &c.NativeHistogramZeroThreshold,
+	} {
+		if f, err := envFloat(env, name); err != nil {
+			return c, err
+		} else if f.Valid {
+			*field = f
+		}
+	}
+
+	if i, err := envInt(env, "K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_MAX_BUCKET_NUMBER"); err != nil {
+		return c, err
+	} else if i.Valid {
+		c.NativeHistogramMaxBucketNumber = i
+	}
+
+	if d, err := envDuration(env, "K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_MIN_RESET_DURATION"); err != nil {
+		return c, err
+	} else if d.Valid {
+		c.NativeHistogramMinResetDuration = d
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_CUSTOM_BUCKETS"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.NativeHistogramCustomBuckets = b
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_TREND_AS_HISTOGRAM"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.TrendAsHistogram = b
+	}
+
+	if buckets, bucketsDefined := env["K6_PROMETHEUS_RW_HISTOGRAM_BUCKETS"]; bucketsDefined {
+		var err error
+		if c.HistogramBuckets, err = parseBuckets(buckets); err != nil {
+			return c, fmt.Errorf("K6_PROMETHEUS_RW_HISTOGRAM_BUCKETS %w", err)
+		}
+	}
+
+	for name, buckets := range envMap(env, "K6_PROMETHEUS_RW_METRIC_HISTOGRAM_BUCKETS_") {
+		b, err := parseBuckets(buckets)
+		if err != nil {
+			return c, fmt.Errorf("K6_PROMETHEUS_RW_METRIC_HISTOGRAM_BUCKETS_%s %w", name, err)
+		}
+		if c.MetricHistogramBuckets == nil {
+			c.MetricHistogramBuckets = make(map[string][]float64)
+		}
+		c.MetricHistogramBuckets[name] = b
+	}
+
 	if trendStats, trendStatsDefined := env["K6_PROMETHEUS_RW_TREND_STATS"]; trendStatsDefined {
 		c.TrendStats = strings.Split(trendStats, ",")
 	}
 
+	if include, includeDefined := env["K6_PROMETHEUS_RW_INCLUDE_METRICS"]; includeDefined {
+		c.IncludeMetrics = splitSelectors(include)
+	}
+
+	if exclude, excludeDefined := env["K6_PROMETHEUS_RW_EXCLUDE_METRICS"]; excludeDefined {
+		c.ExcludeMetrics = splitSelectors(exclude)
+	}
+
+	for name, stats := range envMap(env, "K6_PROMETHEUS_RW_METRIC_TREND_STATS_") {
+		if c.MetricTrendStats == nil {
+			c.MetricTrendStats = make(map[string][]string)
+		}
+		c.MetricTrendStats[name] = strings.Split(stats, ",")
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_TREND_STATS_SKETCH"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.TrendStatsSketch = b
+	}
+
+	if f, err := envFloat(env, "K6_PROMETHEUS_RW_TREND_STATS_SKETCH_ACCURACY"); err != nil {
+		return c, err
+	} else if f.Valid {
+		c.TrendStatsSketchAccuracy = f
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_TREND_STATS_WINDOWED"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.TrendStatsWindowed = b
+	}
+
+	if d, err := envDuration(env, "K6_PROMETHEUS_RW_TREND_STATS_WINDOW"); err != nil {
+		return c, err
+	} else if d.Valid {
+		c.TrendStatsWindow = d
+	}
+
+	if i, err := envInt(env, "K6_PROMETHEUS_RW_RETRY_MAX_ATTEMPTS"); err != nil {
+		return c, err
+	} else if i.Valid {
+		c.RetryMaxAttempts = i
+	}
+
+	if d, err := envDuration(env, "K6_PROMETHEUS_RW_RETRY_MIN_BACKOFF"); err != nil {
+		return c, err
+	} else if d.Valid {
+		c.RetryMinBackoff = d
+	}
+
+	if d, err := envDuration(env, "K6_PROMETHEUS_RW_RETRY_MAX_BACKOFF"); err != nil {
+		return c, err
+	} else if d.Valid {
+		c.RetryMaxBackoff = d
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_EXEMPLARS"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.Exemplars = b
+	}
+
+	if key, keyDefined := env["K6_PROMETHEUS_RW_EXEMPLAR_METADATA_KEY"]; keyDefined {
+		c.ExemplarMetadataKey = null.StringFrom(key)
+	}
+
+	if sampling, samplingDefined := env["K6_PROMETHEUS_RW_EXEMPLAR_SAMPLING"]; samplingDefined {
+		c.ExemplarSampling = null.StringFrom(sampling)
+	}
+
+	if d, err := envDuration(env, "K6_PROMETHEUS_RW_METADATA_SEND_INTERVAL"); err != nil {
+		return c, err
+	} else if d.Valid {
+		c.MetadataSendInterval = d
+	}
+
+	for name, help := range envMap(env, "K6_PROMETHEUS_RW_METRIC_HELP_") {
+		if c.MetricHelp == nil {
+			c.MetricHelp = make(map[string]string)
+		}
+		c.MetricHelp[name] = help
+	}
+
+	if version, versionDefined := env["K6_PROMETHEUS_RW_PROTOCOL_VERSION"]; versionDefined {
+		c.ProtocolVersion = null.StringFrom(version)
+	}
+
+	if walDir, walDirDefined := env["K6_PROMETHEUS_RW_WAL_DIR"]; walDirDefined {
+		c.WALDir = null.StringFrom(walDir)
+	}
+
+	if i, err := envInt(env, "K6_PROMETHEUS_RW_WAL_MAX_SIZE"); err != nil {
+		return c, err
+	} else if i.Valid {
+		c.WALMaxSize = i
+	}
+
+	if d, err := envDuration(env, "K6_PROMETHEUS_RW_WAL_MAX_AGE"); err != nil {
+		return c, err
+	} else if d.Valid {
+		c.WALMaxAge = d
+	}
+
+	for name, field := range map[string]*null.Int{
+		"K6_PROMETHEUS_RW_QUEUE_CAPACITY":       &c.QueueCapacity,
+		"K6_PROMETHEUS_RW_MAX_SAMPLES_PER_SEND": &c.MaxSamplesPerSend,
+		"K6_PROMETHEUS_RW_MAX_BYTES_PER_SEND":   &c.MaxBytesPerSend,
+		"K6_PROMETHEUS_RW_MIN_SHARDS":           &c.MinShards,
+		"K6_PROMETHEUS_RW_MAX_SHARDS":           &c.MaxShards,
+	} {
+		if i, err := envInt(env, name); err != nil {
+			return c, err
+		} else if i.Valid {
+			*field = i
+		}
+	}
+
+	if policy, policyDefined := env["K6_PROMETHEUS_RW_QUEUE_OVERFLOW_POLICY"]; policyDefined {
+		c.QueueOverflowPolicy = null.StringFrom(policy)
+	}
+
+	if compression, compressionDefined := env["K6_PROMETHEUS_RW_COMPRESSION"]; compressionDefined {
+		c.Compression = null.StringFrom(compression)
+	}
+
+	if i, err := envInt(env, "K6_PROMETHEUS_RW_COMPRESSION_LEVEL"); err != nil {
+		return c, err
+	} else if i.Valid {
+		c.CompressionLevel = i
+	}
+
+	if relabelConfigs, relabelDefined := env["K6_PROMETHEUS_RW_RELABEL_CONFIGS"]; relabelDefined {
+		if err := json.Unmarshal([]byte(relabelConfigs), &c.RelabelConfigs); err != nil {
+			return c, fmt.Errorf("the relabel configs must be a JSON array: %w", err)
+		}
+	}
+
+	if i, err := envInt(env, "K6_PROMETHEUS_RW_MAX_SERIES"); err != nil {
+		return c, err
+	} else if i.Valid {
+		c.MaxSeries = i
+	}
+
+	if policy, policyDefined := env["K6_PROMETHEUS_RW_SERIES_OVERFLOW_POLICY"]; policyDefined {
+		c.SeriesOverflowPolicy = null.StringFrom(policy)
+	}
+
+	if externalLabels := envMap(env, "K6_PROMETHEUS_RW_EXTERNAL_LABELS_"); len(externalLabels) > 0 {
+		c.ExternalLabels = externalLabels
+	}
+
+	if runID, runIDDefined := env["K6_PROMETHEUS_RW_RUN_ID"]; runIDDefined {
+		c.RunID = null.StringFrom(runID)
+	}
+
+	if instance, instanceDefined := env["K6_PROMETHEUS_RW_INSTANCE"]; instanceDefined {
+		c.Instance = null.StringFrom(instance)
+	}
+
+	if b, err := envBool(env, "K6_PROMETHEUS_RW_UTF8_NAMES"); err != nil {
+		return c, err
+	} else if b.Valid {
+		c.UTF8Names = b
+	}
+
+	if prefix, prefixDefined := env["K6_PROMETHEUS_RW_METRIC_PREFIX"]; prefixDefined {
+		c.MetricPrefix = null.StringFrom(prefix)
+	}
+
+	if renames := envMap(env, "K6_PROMETHEUS_RW_METRIC_RENAMES_"); len(renames) > 0 {
+		c.MetricRenames = renames
+	}
+
 	return c, nil
 }
 
+// parseBuckets parses a comma-separated list of buckets' upper bounds.
+func parseBuckets(s string) ([]float64, error) {
+	values := strings.Split(s, ",")
+	buckets := make([]float64, 0, len(values))
+	for _, v := range values {
+		b, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("value must be a comma-separated list of numbers, not %q", s)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
 // parseJSON parses the supplied JSON into a Config.
 func parseJSON(data json.RawMessage) (Config, error) {
 	var c Config
@@ -382,65 +1354,274 @@ func parseJSON(data json.RawMessage) (Config, error) {
 }
 
 // parseArg parses the supplied string of arguments into a Config.
-func parseArg(text string) (Config, error) {
+//
+// The string is a comma-separated list of key=value options,
+// where the keys are the same used from the JSON config.
+// A value containing commas must be quoted, with single or double quotes,
+// or the commas must be escaped with a backslash. For example:
+//
+//	url=http://localhost:9090/api/v1/write,trendStats="p(90),p(99)",headers.X-Values=a\,b
+func parseArg(text string) (Config, error) { //nolint:funlen
 	var c Config
-	opts := strings.Split(text, ",")
 
+	stringOpts := map[string]*null.String{
+		"url":                  &c.ServerURL,
+		"username":             &c.Username,
+		"password":             &c.Password,
+		"clientCertificate":    &c.ClientCertificate,
+		"clientCertificateKey": &c.ClientCertificateKey,
+		"bearerToken":          &c.BearerToken,
+		"sigV4Region":          &c.SigV4Region,
+		"sigV4AccessKey":       &c.SigV4AccessKey,
+		"sigV4SecretKey":       &c.SigV4SecretKey,
+		"protocolVersion":      &c.ProtocolVersion,
+		"walDir":               &c.WALDir,
+		"queueOverflowPolicy":  &c.QueueOverflowPolicy,
+		"compression":          &c.Compression,
+		"seriesOverflowPolicy": &c.SeriesOverflowPolicy,
+		"metricPrefix":         &c.MetricPrefix,
+		"runID":                &c.RunID,
+		"instance":             &c.Instance,
+		"exemplarMetadataKey":  &c.ExemplarMetadataKey,
+		"exemplarSampling":     &c.ExemplarSampling,
+	}
+	boolOpts := map[string]*null.Bool{
+		"insecureSkipTLSVerify":  &c.InsecureSkipTLSVerify,
+		"trendAsNativeHistogram": &c.TrendAsNativeHistogram,
+		"trendAsHistogram":       &c.TrendAsHistogram,
+
+		"nativeHistogramCustomBuckets": &c.NativeHistogramCustomBuckets,
+		"staleMarkers":                 &c.StaleMarkers,
+		"utf8Names":                    &c.UTF8Names,
+		"trendStatsSketch":             &c.TrendStatsSketch,
+		"trendStatsWindowed":           &c.TrendStatsWindowed,
+		"exemplars":                    &c.Exemplars,
+		"rateAsCounters":               &c.RateAsCounters,
+		"rateGauge":                    &c.RateGauge,
+		"createdTimestamps":            &c.CreatedTimestamps,
+		"counterZeroSample":            &c.CounterZeroSample,
+	}
+	intOpts := map[string]*null.Int{
+		"retryMaxAttempts":  &c.RetryMaxAttempts,
+		"walMaxSize":        &c.WALMaxSize,
+		"queueCapacity":     &c.QueueCapacity,
+		"maxSamplesPerSend": &c.MaxSamplesPerSend,
+		"maxBytesPerSend":   &c.MaxBytesPerSend,
+		"minShards":         &c.MinShards,
+		"maxShards":         &c.MaxShards,
+		"compressionLevel":  &c.CompressionLevel,
+		"maxSeries":         &c.MaxSeries,
+
+		"nativeHistogramMaxBucketNumber": &c.NativeHistogramMaxBucketNumber,
+	}
+	floatOpts := map[string]*null.Float{
+		"nativeHistogramBucketFactor":  &c.NativeHistogramBucketFactor,
+		"nativeHistogramZeroThreshold": &c.NativeHistogramZeroThreshold,
+		"trendStatsSketchAccuracy":     &c.TrendStatsSketchAccuracy,
+	}
+	durationOpts := map[string]*types.NullDuration{
+		"pushInterval":     &c.PushInterval,
+		"retryMinBackoff":  &c.RetryMinBackoff,
+		"retryMaxBackoff":  &c.RetryMaxBackoff,
+		"walMaxAge":        &c.WALMaxAge,
+		"trendStatsWindow": &c.TrendStatsWindow,
+		"staleSeriesTTL":   &c.StaleSeriesTTL,
+
+		"metadataSendInterval": &c.MetadataSendInterval,
+
+		"nativeHistogramMinResetDuration": &c.NativeHistogramMinResetDuration,
+	}
+
+	opts, err := splitArg(text)
+	if err != nil {
+		return c, err
+	}
 	for _, opt := range opts {
-		r := strings.SplitN(opt, "=", 2)
-		if len(r) != 2 {
+		key, v, ok := cutOption(opt)
+		if !ok {
 			return c, fmt.Errorf("couldn't parse argument %q as option", opt)
 		}
-		key, v := r[0], r[1]
-		switch key {
-		case "url":
-			c.ServerURL = null.StringFrom(v)
-		case "insecureSkipTLSVerify":
-			if err := c.InsecureSkipTLSVerify.UnmarshalText([]byte(v)); err != nil {
-				return c, fmt.Errorf("insecureSkipTLSVerify value must be true or false, not %q", v)
+
+		if field, ok := stringOpts[key]; ok {
+			*field = null.StringFrom(v)
+			continue
+		}
+		if field, ok := boolOpts[key]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return c, fmt.Errorf("%s value must be true or false, not %q", key, v)
+			}
+			*field = null.BoolFrom(b)
+			continue
+		}
+		if field, ok := intOpts[key]; ok {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return c, fmt.Errorf("%s value must be an integer, not %q", key, v)
 			}
-		case "username":
-			c.Username = null.StringFrom(v)
-		case "password":
-			c.Password = null.StringFrom(v)
-		case "pushInterval":
-			if err := c.PushInterval.UnmarshalText([]byte(v)); err != nil {
-				return c, err
+			*field = null.IntFrom(i)
+			continue
+		}
+		if field, ok := floatOpts[key]; ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return c, fmt.Errorf("%s value must be a number, not %q", key, v)
 			}
-		case "trendAsNativeHistogram":
-			if err := c.TrendAsNativeHistogram.UnmarshalText([]byte(v)); err != nil {
-				return c, fmt.Errorf("trendAsNativeHistogram value must be true or false, not %q", v)
+			*field = null.FloatFrom(f)
+			continue
+		}
+		if field, ok := durationOpts[key]; ok {
+			if err := field.UnmarshalText([]byte(v)); err != nil {
+				return c, fmt.Errorf("%s value must be a duration, not %q", key, v)
 			}
+			continue
+		}
 
-		// TODO: add the support for trendStats
-		// strvals doesn't support the same format used by --summary-trend-stats
-		// using the comma as the separator, because it is already used for
-		// dividing the keys.
-		//nolint:gocritic
-		//
-		//if v, ok := params["trendStats"].(string); ok && len(v) > 0 {
-		//c.TrendStats = strings.Split(v, ",")
-		//}
-
-		case "clientCertificate":
-			c.ClientCertificate = null.StringFrom(v)
-		case "clientCertificateKey":
-			c.ClientCertificateKey = null.StringFrom(v)
-
-		default:
-			if !strings.HasPrefix(key, "headers.") {
-				return c, fmt.Errorf("%q is an unknown option's key", r[0])
+		switch {
+		case key == "relabelConfigs":
+			if err := json.Unmarshal([]byte(v), &c.RelabelConfigs); err != nil {
+				return c, fmt.Errorf("relabelConfigs value must be a JSON array: %w", err)
+			}
+		case key == "histogramBuckets":
+			if c.HistogramBuckets, err = parseBuckets(v); err != nil {
+				return c, fmt.Errorf("histogramBuckets %w", err)
 			}
+		case strings.HasPrefix(key, "metricHistogramBuckets."):
+			b, err := parseBuckets(v)
+			if err != nil {
+				return c, fmt.Errorf("%s %w", key, err)
+			}
+			if c.MetricHistogramBuckets == nil {
+				c.MetricHistogramBuckets = make(map[string][]float64)
+			}
+			c.MetricHistogramBuckets[strings.TrimPrefix(key, "metricHistogramBuckets.")] = b
+		case key == "trendStats":
+			if v == "" {
+				return c, errors.New("trendStats value can't be empty")
+			}
+			c.TrendStats = strings.Split(v, ",")
+		case key == "includeMetrics":
+			c.IncludeMetrics = splitSelectors(v)
+		case key == "excludeMetrics":
+			c.ExcludeMetrics = splitSelectors(v)
+		case strings.HasPrefix(key, "metricTrendStats."):
+			if v == "" {
+				return c, fmt.Errorf("%s value can't be empty", key)
+			}
+			if c.MetricTrendStats == nil {
+				c.MetricTrendStats = make(map[string][]string)
+			}
+			c.MetricTrendStats[strings.TrimPrefix(key, "metricTrendStats.")] = strings.Split(v, ",")
+		case strings.HasPrefix(key, "externalLabels."):
+			if c.ExternalLabels == nil {
+				c.ExternalLabels = make(map[string]string)
+			}
+			c.ExternalLabels[strings.TrimPrefix(key, "externalLabels.")] = v
+		case strings.HasPrefix(key, "metricHelp."):
+			if c.MetricHelp == nil {
+				c.MetricHelp = make(map[string]string)
+			}
+			c.MetricHelp[strings.TrimPrefix(key, "metricHelp.")] = v
+		case strings.HasPrefix(key, "metricRenames."):
+			if c.MetricRenames == nil {
+				c.MetricRenames = make(map[string]string)
+			}
+			c.MetricRenames[strings.TrimPrefix(key, "metricRenames.")] = v
+		case strings.HasPrefix(key, "headers."):
 			if c.Headers == nil {
 				c.Headers = make(map[string]string)
 			}
 			c.Headers[strings.TrimPrefix(key, "headers.")] = v
+		default:
+			return c, fmt.Errorf("%q is an unknown option's key", key)
 		}
 	}
 
 	return c, nil
 }
 
+// splitArg splits the argument string into the options
+// using the comma as separator. The commas in a quoted part,
+// within a tags' list in braces or escaped with a backslash are part of the option.
+// The quotes, except the ones in a tags' list, and the escaping backslashes are removed.
+func splitArg(text string) ([]string, error) {
+	var (
+		opts  []string
+		opt   strings.Builder
+		quote rune
+		depth int
+	)
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes) && isArgEscapable(runes[i+1], quote):
+			i++
+			opt.WriteRune(runes[i])
+		case quote != 0 && r == quote:
+			quote = 0
+			if depth > 0 {
+				opt.WriteRune(r)
+			}
+		case quote != 0:
+			opt.WriteRune(r)
+		case r == '"' || r == '\'':
+			// the quotes of the tags' values are kept for the selector
+			quote = r
+			if depth > 0 {
+				opt.WriteRune(r)
+			}
+		case r == '{':
+			depth++
+			opt.WriteRune(r)
+		case r == '}':
+			depth--
+			opt.WriteRune(r)
+		case r == ',' && depth <= 0:
+			opts = append(opts, opt.String())
+			opt.Reset()
+		default:
+			opt.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("the argument has an unterminated %c quote", quote)
+	}
+	return append(opts, opt.String()), nil
+}
+
+// isArgEscapable returns true if the rune can be escaped with a backslash.
+// Any other backslash is kept as is, so the Windows' paths don't require escaping.
+// In a single-quoted part only the single quote can be escaped.
+func isArgEscapable(r rune, quote rune) bool {
+	if quote == '\'' {
+		return r == '\''
+	}
+	return r == ',' || r == '"' || r == '\'' || r == '\\'
+}
+
+// cutOption cuts the option into the key and the value around
+// the first equal sign not within braces, so the keys can have
+// the tags' selectors with their own equal signs,
+// e.g. metricTrendStats.http_req_duration{method=GET}=p(90).
+// False is returned if the option has no equal sign.
+func cutOption(opt string) (key, value string, found bool) {
+	depth := 0
+	for i, r := range opt {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '=':
+			if depth == 0 {
+				return opt[:i], opt[i+1:], true
+			}
+		}
+	}
+	return opt, "", false
+}
+
 func isSigV4PartiallyConfigured(region, accessKey, secretKey null.String) bool {
 	hasRegion := region.Valid && len(strings.TrimSpace(region.String)) != 0
 	hasAccessID := accessKey.Valid && len(strings.TrimSpace(accessKey.String)) != 0
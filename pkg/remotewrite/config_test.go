@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/relabel"
 	"github.com/grafana/xk6-output-prometheus-remote/pkg/remote"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -80,12 +81,93 @@ func TestConfigRemoteConfig(t *testing.T) {
 			Password: "mypass",
 		},
 		Headers: headers,
+		Retry: &remote.RetryConfig{
+			MaxAttempts: 3,
+			MinBackoff:  250 * time.Millisecond,
+			MaxBackoff:  5 * time.Second,
+		},
+		MaxSamplesPerRequest: 2000,
+		MaxBytesPerRequest:   4 << 20,
 	}
 	rcc, err := config.RemoteConfig()
 	require.NoError(t, err)
 	assert.Equal(t, exprcc, rcc)
 }
 
+func TestConfigRemoteConfigRetry(t *testing.T) {
+	t.Parallel()
+
+	config := NewConfig()
+	config.RetryMaxAttempts = null.IntFrom(5)
+	config.RetryMinBackoff = types.NullDurationFrom(time.Second)
+	config.RetryMaxBackoff = types.NullDurationFrom(10 * time.Second)
+
+	rcc, err := config.RemoteConfig()
+	require.NoError(t, err)
+	assert.Equal(t, &remote.RetryConfig{
+		MaxAttempts: 5,
+		MinBackoff:  time.Second,
+		MaxBackoff:  10 * time.Second,
+		MaxElapsed:  defaultPushInterval,
+	}, rcc.Retry)
+
+	config.RetryMaxAttempts = null.IntFrom(0)
+	_, err = config.RemoteConfig()
+	assert.ErrorContains(t, err, "max attempts")
+
+	config.RetryMaxAttempts = null.IntFrom(1)
+	config.RetryMinBackoff = types.NullDurationFrom(time.Minute)
+	_, err = config.RemoteConfig()
+	assert.ErrorContains(t, err, "min backoff")
+
+	config.RetryMinBackoff = types.NullDurationFrom(-time.Second)
+	_, err = config.RemoteConfig()
+	assert.ErrorContains(t, err, "can't be negative")
+
+	config.RetryMinBackoff = types.NullDurationFrom(time.Second)
+	config.RetryMaxBackoff = types.NullDurationFrom(-time.Second)
+	_, err = config.RemoteConfig()
+	assert.ErrorContains(t, err, "can't be negative")
+}
+
+func TestConfigRemoteConfigProtocolVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		version null.String
+		exp     remote.ProtocolVersion
+		expErr  bool
+	}{
+		"Default": {version: null.NewString("", false), exp: ""},
+		"V1":      {version: null.StringFrom("1"), exp: remote.ProtocolV1},
+		"V2":      {version: null.StringFrom("2.0"), exp: remote.ProtocolV2},
+		"Invalid": {version: null.StringFrom("3"), expErr: true},
+	}
+	for name, tt := range tests {
+		config := NewConfig()
+		config.ProtocolVersion = tt.version
+		rcc, err := config.RemoteConfig()
+		if tt.expErr {
+			assert.ErrorContains(t, err, "not supported", name)
+			continue
+		}
+		require.NoError(t, err, name)
+		assert.Equal(t, tt.exp, rcc.ProtocolVersion, name)
+	}
+}
+
+func TestConfigRemoteConfigCompression(t *testing.T) {
+	t.Parallel()
+
+	config := NewConfig()
+	config.Compression = null.StringFrom("gzip")
+	config.CompressionLevel = null.IntFrom(9)
+	rcc, err := config.RemoteConfig()
+	require.NoError(t, err)
+	assert.Equal(t, remote.CompressionGzip, rcc.Compression)
+	assert.Equal(t, 9, rcc.CompressionLevel)
+}
+
 func TestConfigRemoteConfigClientCertificateError(t *testing.T) {
 	t.Parallel()
 
@@ -146,11 +228,11 @@ func TestGetConsolidatedConfig(t *testing.T) {
 				"K6_PROMETHEUS_RW_INSECURE_SKIP_TLS_VERIFY": "false",
 				"K6_PROMETHEUS_RW_USERNAME":                 "u",
 			},
-			// arg: "username=user",
+			arg: "username=user",
 			config: Config{
 				ServerURL:             null.StringFrom(u.String()),
 				InsecureSkipTLSVerify: null.BoolFrom(false),
-				Username:              null.NewString("u", true),
+				Username:              null.StringFrom("user"),
 				Password:              null.NewString("", false),
 				PushInterval:          types.NullDurationFrom(defaultPushInterval),
 				Headers:               make(map[string]string),
@@ -164,12 +246,12 @@ func TestGetConsolidatedConfig(t *testing.T) {
 				"K6_PROMETHEUS_RW_USERNAME": "env",
 				"K6_PROMETHEUS_RW_PASSWORD": "env",
 			},
-			// arg: "password=arg",
+			arg: "password=arg",
 			config: Config{
 				ServerURL:             null.StringFrom("http://json:9090"),
 				InsecureSkipTLSVerify: null.BoolFrom(false),
 				Username:              null.StringFrom("env"),
-				Password:              null.StringFrom("env"),
+				Password:              null.StringFrom("arg"),
 				PushInterval:          types.NullDurationFrom(defaultPushInterval),
 				Headers:               make(map[string]string),
 				TrendStats:            []string{"p(99)"},
@@ -184,11 +266,10 @@ func TestGetConsolidatedConfig(t *testing.T) {
 			env:       map[string]string{"K6_PROMETHEUS_RW_INSECURE_SKIP_TLS_VERIFY": "d"},
 			errString: "parse environment variables options failed",
 		},
-		//nolint:gocritic
-		//"InvalidArg": {
-		//arg:       "insecureSkipTLSVerify=wrongtime",
-		//errString: "parse argument string options failed",
-		//},
+		"InvalidArg": {
+			arg:       "insecureSkipTLSVerify=wrongtime",
+			errString: "parse argument string options failed",
+		},
 	}
 
 	for name, testCase := range testCases {
@@ -224,6 +305,103 @@ func TestParseServerURL(t *testing.T) {
 	assert.Equal(t, map[string]string{"X-Header": "value"}, c.Headers)
 }
 
+func TestParseArg(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		arg    string
+		exp    Config
+		expErr string
+	}{
+		"DoubleQuoted": {
+			arg: `trendStats="p(90),p(99)",url=http://localhost`,
+			exp: Config{TrendStats: []string{"p(90)", "p(99)"}, ServerURL: null.StringFrom("http://localhost")},
+		},
+		"SingleQuoted": {
+			arg: `headers.X-Values='a,"b"'`,
+			exp: Config{Headers: map[string]string{"X-Values": `a,"b"`}},
+		},
+		"Escaped": {
+			arg: `headers.X-Values=a\,b\\,password=p\"w`,
+			exp: Config{Headers: map[string]string{"X-Values": `a,b\`}, Password: null.StringFrom(`p"w`)},
+		},
+		"EscapedInSingleQuotes": {
+			arg: `password='it\'s\,'`,
+			exp: Config{Password: null.StringFrom(`it's\,`)},
+		},
+		"WindowsPath": {
+			arg: `clientCertificate=C:\certs\client.crt`,
+			exp: Config{ClientCertificate: null.StringFrom(`C:\certs\client.crt`)},
+		},
+		"ValueWithEquals": {
+			arg: "bearerToken=abc==",
+			exp: Config{BearerToken: null.StringFrom("abc==")},
+		},
+		"SigV4": {
+			arg: "sigV4Region=us-east-1,sigV4AccessKey=key,sigV4SecretKey=secret",
+			exp: Config{
+				SigV4Region:    null.StringFrom("us-east-1"),
+				SigV4AccessKey: null.StringFrom("key"),
+				SigV4SecretKey: null.StringFrom("secret"),
+			},
+		},
+		"SelectorKey": {
+			arg: "metricTrendStats.http_req_duration{method=GET,status=200}=p(90)",
+			exp: Config{MetricTrendStats: map[string][]string{
+				"http_req_duration{method=GET,status=200}": {"p(90)"},
+			}},
+		},
+		"SelectorValue": {
+			arg: `includeMetrics=http_req_*{scenario="smoke",method=GET},staleMarkers=true`,
+			exp: Config{
+				IncludeMetrics: []string{`http_req_*{scenario="smoke",method=GET}`},
+				StaleMarkers:   null.BoolFrom(true),
+			},
+		},
+		"UnterminatedQuote": {
+			arg:    `trendStats="p(90),p(99)`,
+			expErr: "unterminated",
+		},
+		"UnquotedComma": {
+			arg:    "trendStats=p(90),p(99)",
+			expErr: `couldn't parse argument "p(99)"`,
+		},
+		"EmptyTrendStats": {
+			arg:    "trendStats=",
+			expErr: "can't be empty",
+		},
+		"UnknownKey": {
+			arg:    "unknown=1",
+			expErr: "unknown option's key",
+		},
+		"InvalidBool": {
+			arg:    "staleMarkers=yes",
+			expErr: "must be true or false",
+		},
+		"InvalidInt": {
+			arg:    "maxShards=ten",
+			expErr: "must be an integer",
+		},
+		"InvalidDuration": {
+			arg:    "pushInterval=soon",
+			expErr: "must be a duration",
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := parseArg(tt.arg)
+			if tt.expErr != "" {
+				assert.ErrorContains(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.exp, c)
+		})
+	}
+}
+
 // TODO: replace all the expconfigs below
 // with a function that returns the expected default values,
 // then override only the values to expect differently.
@@ -238,8 +416,7 @@ func TestOptionServerURL(t *testing.T) {
 	}{
 		"JSON": {jsonRaw: json.RawMessage(`{"url":"http://prometheus:9090/api/v1/write"}`)},
 		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_SERVER_URL": "http://prometheus:9090/api/v1/write"}},
-		//nolint:gocritic
-		//"Arg":  {arg: "url=http://prometheus:9090/api/v1/write"},
+		"Arg":  {arg: "url=http://prometheus:9090/api/v1/write"},
 	}
 
 	expconfig := Config{
@@ -281,8 +458,8 @@ func TestOptionHeaders(t *testing.T) {
 			"K6_PROMETHEUS_RW_HEADERS_X-Scope-OrgID": "my-org-id-old-method",
 			"K6_PROMETHEUS_RW_HTTP_HEADERS":          "X-Scope-OrgID:my-org-id,another-header:true,empty:",
 		}},
-		//nolint:gocritic
-		//"Arg":  {arg: "headers.X-MY-HEADER1=hval1,headers.X-MY-HEADER2=hval2"},
+		"Arg": {arg: "headers.X-MY-HEADER1=hval1,headers.X-MY-HEADER2=hval2," +
+			"headers.X-Scope-OrgID=my-org-id,headers.another-header=true,headers.empty="},
 	}
 
 	expconfig := Config{
@@ -321,8 +498,7 @@ func TestOptionInsecureSkipTLSVerify(t *testing.T) {
 	}{
 		"JSON": {jsonRaw: json.RawMessage(`{"insecureSkipTLSVerify":false}`)},
 		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_INSECURE_SKIP_TLS_VERIFY": "false"}},
-		//nolint:gocritic
-		//"Arg":  {arg: "insecureSkipTLSVerify=false"},
+		"Arg":  {arg: "insecureSkipTLSVerify=false"},
 	}
 
 	expconfig := Config{
@@ -355,8 +531,7 @@ func TestOptionBasicAuth(t *testing.T) {
 	}{
 		"JSON": {jsonRaw: json.RawMessage(`{"username":"user1","password":"pass1"}`)},
 		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_USERNAME": "user1", "K6_PROMETHEUS_RW_PASSWORD": "pass1"}},
-		//nolint:gocritic
-		//"Arg":  {arg: "username=user1,password=pass1"},
+		"Arg":  {arg: "username=user1,password=pass1"},
 	}
 
 	expconfig := Config{
@@ -392,6 +567,7 @@ func TestOptionBearerToken(t *testing.T) {
 	}{
 		"JSON": {jsonRaw: json.RawMessage(`{"bearerToken":"my-bearer-token"}`)},
 		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_BEARER_TOKEN": "my-bearer-token"}},
+		"Arg":  {arg: "bearerToken=my-bearer-token"},
 	}
 
 	expconfig := Config{
@@ -426,6 +602,7 @@ func TestOptionClientCertificate(t *testing.T) {
 	}{
 		"JSON": {jsonRaw: json.RawMessage(`{"clientCertificate":"client.crt","clientCertificateKey":"client.key"}`)},
 		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_CLIENT_CERTIFICATE": "client.crt", "K6_PROMETHEUS_RW_CLIENT_CERTIFICATE_KEY": "client.key"}},
+		"Arg":  {arg: "clientCertificate=client.crt,clientCertificateKey=client.key"},
 	}
 
 	expconfig := Config{
@@ -461,8 +638,7 @@ func TestOptionTrendAsNativeHistogram(t *testing.T) {
 	}{
 		"JSON": {jsonRaw: json.RawMessage(`{"trendAsNativeHistogram":true}`)},
 		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_TREND_AS_NATIVE_HISTOGRAM": "true"}},
-		//nolint:gocritic
-		//"Arg":  {arg: "trendAsNativeHistogram=true"},
+		"Arg":  {arg: "trendAsNativeHistogram=true"},
 	}
 
 	expconfig := Config{
@@ -499,6 +675,7 @@ func TestOptionPushInterval(t *testing.T) {
 	}{
 		"JSON": {jsonRaw: json.RawMessage(`{"pushInterval":"1m2s"}`)},
 		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_PUSH_INTERVAL": "1m2s"}},
+		"Arg":  {arg: "pushInterval=1m2s"},
 	}
 
 	expconfig := Config{
@@ -532,11 +709,10 @@ func TestConfigTrendStats(t *testing.T) {
 		env     map[string]string
 		jsonRaw json.RawMessage
 	}{
-		"JSON": {jsonRaw: json.RawMessage(`{"trendStats":["max","p(95)"]}`)},
-		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_TREND_STATS": "max,p(95)"}},
-		// TODO: support arg, check the comment in the code
-		//nolint:gocritic
-		//"Arg":  {arg: "trendStats=max,p(95)"},
+		"JSON":       {jsonRaw: json.RawMessage(`{"trendStats":["max","p(95)"]}`)},
+		"Env":        {env: map[string]string{"K6_PROMETHEUS_RW_TREND_STATS": "max,p(95)"}},
+		"Arg":        {arg: `trendStats="max,p(95)"`},
+		"ArgEscaped": {arg: `trendStats=max\,p(95)`},
 	}
 
 	expconfig := Config{
@@ -570,6 +746,7 @@ func TestOptionStaleMarker(t *testing.T) {
 	}{
 		"JSON": {jsonRaw: json.RawMessage(`{"staleMarkers":true}`)},
 		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_STALE_MARKERS": "true"}},
+		"Arg":  {arg: "staleMarkers=true"},
 	}
 
 	expconfig := Config{
@@ -592,3 +769,1020 @@ func TestOptionStaleMarker(t *testing.T) {
 		})
 	}
 }
+
+func TestOptionSigV4(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"sigV4Region":"us-east-1","sigV4AccessKey":"key","sigV4SecretKey":"secret"}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_SIGV4_REGION":     "us-east-1",
+			"K6_PROMETHEUS_RW_SIGV4_ACCESS_KEY": "key",
+			"K6_PROMETHEUS_RW_SIGV4_SECRET_KEY": "secret",
+		}},
+		"Arg": {arg: "sigV4Region=us-east-1,sigV4AccessKey=key,sigV4SecretKey=secret"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		SigV4Region:           null.StringFrom("us-east-1"),
+		SigV4AccessKey:        null.StringFrom("key"),
+		SigV4SecretKey:        null.StringFrom("secret"),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionProtocolVersion(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"protocolVersion":"2"}`)},
+		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_PROTOCOL_VERSION": "2"}},
+		"Arg":  {arg: "protocolVersion=2"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		ProtocolVersion:       null.StringFrom("2"),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionCompression(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"compression":"zstd","compressionLevel":3}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_COMPRESSION":       "zstd",
+			"K6_PROMETHEUS_RW_COMPRESSION_LEVEL": "3",
+		}},
+		"Arg": {arg: "compression=zstd,compressionLevel=3"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		Compression:           null.StringFrom("zstd"),
+		CompressionLevel:      null.IntFrom(3),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionRelabelConfigs(t *testing.T) {
+	t.Parallel()
+
+	rules := `[{"action":"labeldrop","regex":"url"},{"sourceLabels":["status"],"regex":"5..","action":"drop"}]`
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"relabelConfigs":` + rules + `}`)},
+		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_RELABEL_CONFIGS": rules}},
+		"Arg":  {arg: "relabelConfigs='" + rules + "'"},
+	}
+
+	regexURL, regexStatus := "url", "5.."
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		RelabelConfigs: []relabel.Config{
+			{Regex: &regexURL, Action: relabel.LabelDrop},
+			{SourceLabels: []string{"status"}, Regex: &regexStatus, Action: relabel.Drop},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+
+	_, err := GetConsolidatedConfig(nil, map[string]string{"K6_PROMETHEUS_RW_RELABEL_CONFIGS": "{"}, "")
+	assert.ErrorContains(t, err, "JSON array")
+}
+
+func TestOptionRetry(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"retryMaxAttempts":5,"retryMinBackoff":"1s","retryMaxBackoff":"30s"}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_RETRY_MAX_ATTEMPTS": "5",
+			"K6_PROMETHEUS_RW_RETRY_MIN_BACKOFF":  "1s",
+			"K6_PROMETHEUS_RW_RETRY_MAX_BACKOFF":  "30s",
+		}},
+		"Arg": {arg: "retryMaxAttempts=5,retryMinBackoff=1s,retryMaxBackoff=30s"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		RetryMaxAttempts:      null.IntFrom(5),
+		RetryMinBackoff:       types.NullDurationFrom(time.Second),
+		RetryMaxBackoff:       types.NullDurationFrom(30 * time.Second),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionWAL(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"walDir":"/tmp/k6-wal","walMaxSize":1048576,"walMaxAge":"2h"}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_WAL_DIR":      "/tmp/k6-wal",
+			"K6_PROMETHEUS_RW_WAL_MAX_SIZE": "1048576",
+			"K6_PROMETHEUS_RW_WAL_MAX_AGE":  "2h",
+		}},
+		"Arg": {arg: "walDir=/tmp/k6-wal,walMaxSize=1048576,walMaxAge=2h"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		WALDir:                null.StringFrom("/tmp/k6-wal"),
+		WALMaxSize:            null.IntFrom(1 << 20),
+		WALMaxAge:             types.NullDurationFrom(2 * time.Hour),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionQueue(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(
+			`{"queueCapacity":500,"maxSamplesPerSend":100,"maxBytesPerSend":1024,` +
+				`"minShards":2,"maxShards":8,"queueOverflowPolicy":"block"}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_MAX_BYTES_PER_SEND":    "1024",
+			"K6_PROMETHEUS_RW_QUEUE_CAPACITY":        "500",
+			"K6_PROMETHEUS_RW_MAX_SAMPLES_PER_SEND":  "100",
+			"K6_PROMETHEUS_RW_MIN_SHARDS":            "2",
+			"K6_PROMETHEUS_RW_MAX_SHARDS":            "8",
+			"K6_PROMETHEUS_RW_QUEUE_OVERFLOW_POLICY": "block",
+		}},
+		"Arg": {arg: "queueCapacity=500,maxSamplesPerSend=100,maxBytesPerSend=1024," +
+			"minShards=2,maxShards=8,queueOverflowPolicy=block"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		QueueCapacity:         null.IntFrom(500),
+		MaxSamplesPerSend:     null.IntFrom(100),
+		MaxBytesPerSend:       null.IntFrom(1024),
+		MinShards:             null.IntFrom(2),
+		MaxShards:             null.IntFrom(8),
+		QueueOverflowPolicy:   null.StringFrom("block"),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestConfigQueueConfig(t *testing.T) {
+	t.Parallel()
+
+	qc, err := NewConfig().QueueConfig()
+	require.NoError(t, err)
+	assert.Equal(t, remote.QueueConfig{
+		Capacity:          defaultQueueCapacity,
+		MaxSamplesPerSend: defaultMaxSamplesPerSend,
+		BatchSendDeadline: defaultBatchSendDeadline,
+		MinShards:         1,
+		MaxShards:         10,
+		ReshardInterval:   defaultPushInterval,
+		OverflowPolicy:    remote.OverflowDropOldest,
+	}, qc)
+
+	// max shards follows min shards if it isn't explicitly set
+	c := NewConfig()
+	c.MinShards = null.IntFrom(20)
+	qc, err = c.QueueConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 20, qc.MaxShards)
+
+	c.QueueOverflowPolicy = null.StringFrom("drop-newest")
+	_, err = c.QueueConfig()
+	assert.ErrorContains(t, err, "overflow policy")
+}
+
+func TestOptionMaxSeries(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"maxSeries":1000,"seriesOverflowPolicy":"drop"}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_MAX_SERIES":             "1000",
+			"K6_PROMETHEUS_RW_SERIES_OVERFLOW_POLICY": "drop",
+		}},
+		"Arg": {arg: "maxSeries=1000,seriesOverflowPolicy=drop"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		MaxSeries:             null.IntFrom(1000),
+		SeriesOverflowPolicy:  null.StringFrom("drop"),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionMetricNames(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(
+			`{"metricPrefix":"","metricRenames":{"http_req_duration":"loadtest_http_latency"}}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_METRIC_PREFIX":                    "",
+			"K6_PROMETHEUS_RW_METRIC_RENAMES_http_req_duration": "loadtest_http_latency",
+		}},
+		"Arg": {arg: "metricPrefix=,metricRenames.http_req_duration=loadtest_http_latency"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		MetricPrefix:          null.StringFrom(""),
+		MetricRenames:         map[string]string{"http_req_duration": "loadtest_http_latency"},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestConfigValidateMetricNames(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config Config
+		expErr string
+	}{
+		"Default":     {},
+		"EmptyPrefix": {config: Config{MetricPrefix: null.StringFrom("")}},
+		"Prefix":      {config: Config{MetricPrefix: null.StringFrom("loadgen1:k6_")}},
+		"Rename":      {config: Config{MetricRenames: map[string]string{"vus": "loadtest_vus"}}},
+		"InvalidPrefix": {
+			config: Config{MetricPrefix: null.StringFrom("1k6-")},
+			expErr: "not a valid metric name's prefix",
+		},
+		"InvalidRename": {
+			config: Config{MetricRenames: map[string]string{"vus": "loadtest-vus"}},
+			expErr: `the rename "loadtest-vus" for the metric "vus"`,
+		},
+		"UTF8Rename": {
+			config: Config{MetricRenames: map[string]string{"vus": "loadtest-vus"}, UTF8Names: null.BoolFrom(true)},
+		},
+		"UTF8EmptyRename": {
+			config: Config{MetricRenames: map[string]string{"vus": ""}, UTF8Names: null.BoolFrom(true)},
+			expErr: "not a valid metric name",
+		},
+	}
+	for name, tt := range tests {
+		err := tt.config.validateMetricNames()
+		if tt.expErr == "" {
+			assert.NoError(t, err, name)
+			continue
+		}
+		assert.ErrorContains(t, err, tt.expErr, name)
+	}
+}
+
+func TestOptionUTF8Names(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"utf8Names":true}`)},
+		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_UTF8_NAMES": "true"}},
+		"Arg":  {arg: "utf8Names=true"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		UTF8Names:             null.BoolFrom(true),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionExternalLabels(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"externalLabels":{"env":"staging","team":"perf"}}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_EXTERNAL_LABELS_env":  "staging",
+			"K6_PROMETHEUS_RW_EXTERNAL_LABELS_team": "perf",
+		}},
+		"Arg": {arg: "externalLabels.env=staging,externalLabels.team=perf"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		ExternalLabels:        map[string]string{"env": "staging", "team": "perf"},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestConfigValidateExternalLabels(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config Config
+		expErr string
+	}{
+		"Valid": {config: Config{ExternalLabels: map[string]string{"git_sha": "abc123"}}},
+		"InvalidName": {
+			config: Config{ExternalLabels: map[string]string{"git-sha": "abc123"}},
+			expErr: "not a valid label name",
+		},
+		"UTF8Name": {
+			config: Config{ExternalLabels: map[string]string{"git-sha": "abc123"}, UTF8Names: null.BoolFrom(true)},
+		},
+		"Reserved": {
+			config: Config{ExternalLabels: map[string]string{"__name__": "k6_vus"}},
+			expErr: "not a valid label name",
+		},
+		"EmptyValue": {
+			config: Config{ExternalLabels: map[string]string{"env": ""}},
+			expErr: "empty value",
+		},
+	}
+	for name, tt := range tests {
+		err := tt.config.validateExternalLabels()
+		if tt.expErr == "" {
+			assert.NoError(t, err, name)
+			continue
+		}
+		assert.ErrorContains(t, err, tt.expErr, name)
+	}
+}
+
+func TestOptionIdentity(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"runID":"auto","instance":"pod-1"}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_RUN_ID":   "auto",
+			"K6_PROMETHEUS_RW_INSTANCE": "pod-1",
+		}},
+		"Arg": {arg: "runID=auto,instance=pod-1"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		RunID:                 null.StringFrom("auto"),
+		Instance:              null.StringFrom("pod-1"),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionHistogram(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"trendAsHistogram":true,"histogramBuckets":[0.1,0.5,1],` +
+			`"metricHistogramBuckets":{"data_sent":[1024,4096]}}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_TREND_AS_HISTOGRAM":                 "true",
+			"K6_PROMETHEUS_RW_HISTOGRAM_BUCKETS":                  "0.1,0.5,1",
+			"K6_PROMETHEUS_RW_METRIC_HISTOGRAM_BUCKETS_data_sent": "1024,4096",
+		}},
+		"Arg": {arg: `trendAsHistogram=true,histogramBuckets="0.1,0.5,1",metricHistogramBuckets.data_sent="1024,4096"`},
+	}
+
+	expconfig := Config{
+		ServerURL:              null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify:  null.BoolFrom(false),
+		PushInterval:           types.NullDurationFrom(5 * time.Second),
+		Headers:                make(map[string]string),
+		TrendStats:             []string{"p(99)"},
+		StaleMarkers:           null.BoolFrom(false),
+		TrendAsHistogram:       null.BoolFrom(true),
+		HistogramBuckets:       []float64{0.1, 0.5, 1},
+		MetricHistogramBuckets: map[string][]float64{"data_sent": {1024, 4096}},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+
+	_, err := GetConsolidatedConfig(nil, map[string]string{"K6_PROMETHEUS_RW_HISTOGRAM_BUCKETS": "0.1,fast"}, "")
+	assert.ErrorContains(t, err, "comma-separated list of numbers")
+}
+
+func TestOptionNativeHistogram(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"nativeHistogramBucketFactor":1.05,"nativeHistogramZeroThreshold":0.001,` +
+			`"nativeHistogramMaxBucketNumber":160,"nativeHistogramMinResetDuration":"1h",` +
+			`"nativeHistogramCustomBuckets":true}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_BUCKET_FACTOR":      "1.05",
+			"K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_ZERO_THRESHOLD":     "0.001",
+			"K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_MAX_BUCKET_NUMBER":  "160",
+			"K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_MIN_RESET_DURATION": "1h",
+			"K6_PROMETHEUS_RW_NATIVE_HISTOGRAM_CUSTOM_BUCKETS":     "true",
+		}},
+		"Arg": {arg: "nativeHistogramBucketFactor=1.05,nativeHistogramZeroThreshold=0.001," +
+			"nativeHistogramMaxBucketNumber=160,nativeHistogramMinResetDuration=1h,nativeHistogramCustomBuckets=true"},
+	}
+
+	expconfig := Config{
+		ServerURL:                       null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify:           null.BoolFrom(false),
+		PushInterval:                    types.NullDurationFrom(5 * time.Second),
+		Headers:                         make(map[string]string),
+		TrendStats:                      []string{"p(99)"},
+		StaleMarkers:                    null.BoolFrom(false),
+		NativeHistogramBucketFactor:     null.FloatFrom(1.05),
+		NativeHistogramZeroThreshold:    null.FloatFrom(0.001),
+		NativeHistogramMaxBucketNumber:  null.IntFrom(160),
+		NativeHistogramMinResetDuration: types.NullDurationFrom(time.Hour),
+		NativeHistogramCustomBuckets:    null.BoolFrom(true),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionTrendStatsSketch(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"trendStatsSketch":true,"trendStatsSketchAccuracy":0.005}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_TREND_STATS_SKETCH":          "true",
+			"K6_PROMETHEUS_RW_TREND_STATS_SKETCH_ACCURACY": "0.005",
+		}},
+		"Arg": {arg: "trendStatsSketch=true,trendStatsSketchAccuracy=0.005"},
+	}
+
+	expconfig := Config{
+		ServerURL:                null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify:    null.BoolFrom(false),
+		PushInterval:             types.NullDurationFrom(5 * time.Second),
+		Headers:                  make(map[string]string),
+		TrendStats:               []string{"p(99)"},
+		StaleMarkers:             null.BoolFrom(false),
+		TrendStatsSketch:         null.BoolFrom(true),
+		TrendStatsSketchAccuracy: null.FloatFrom(0.005),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionTrendStatsWindow(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"trendStatsWindowed":true,"trendStatsWindow":"1m"}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_TREND_STATS_WINDOWED": "true",
+			"K6_PROMETHEUS_RW_TREND_STATS_WINDOW":   "1m",
+		}},
+		"Arg": {arg: "trendStatsWindowed=true,trendStatsWindow=1m"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		TrendStatsWindowed:    null.BoolFrom(true),
+		TrendStatsWindow:      types.NullDurationFrom(time.Minute),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionMetricTrendStats(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+		exp     map[string][]string
+	}{
+		"JSON": {
+			jsonRaw: json.RawMessage(`{"metricTrendStats":{"http_req_duration":["p(50)","p(99.9)","max"],` +
+				`"http_req_duration{scenario=checkout,method=GET}":["p(90)"]}}`),
+			exp: map[string][]string{
+				"http_req_duration": {"p(50)", "p(99.9)", "max"},
+				"http_req_duration{scenario=checkout,method=GET}": {"p(90)"},
+			},
+		},
+		"Env": {
+			env: map[string]string{"K6_PROMETHEUS_RW_METRIC_TREND_STATS_http_req_duration": "p(50),p(99.9),max"},
+			exp: map[string][]string{"http_req_duration": {"p(50)", "p(99.9)", "max"}},
+		},
+		"Arg": {
+			arg: `metricTrendStats.http_req_duration="p(50),p(99.9),max",` +
+				`'metricTrendStats.http_req_duration{scenario=checkout,method=GET}=p(90)'`,
+			exp: map[string][]string{
+				"http_req_duration": {"p(50)", "p(99.9)", "max"},
+				"http_req_duration{scenario=checkout,method=GET}": {"p(90)"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, tc.exp, c.MetricTrendStats)
+			assert.Equal(t, []string{"p(99)"}, c.TrendStats)
+		})
+	}
+}
+
+func TestOptionIncludeExcludeMetrics(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"includeMetrics":["http_req_*","iterations"],` +
+			`"excludeMetrics":["http_req_blocked","{scenario=\"smoke\",method=GET}"]}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_INCLUDE_METRICS": "http_req_*,iterations",
+			"K6_PROMETHEUS_RW_EXCLUDE_METRICS": `http_req_blocked,{scenario="smoke",method=GET}`,
+		}},
+		"Arg": {arg: `includeMetrics='http_req_*,iterations',excludeMetrics='http_req_blocked,{scenario="smoke",method=GET}'`},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"http_req_*", "iterations"}, c.IncludeMetrics)
+			assert.Equal(t, []string{"http_req_blocked", `{scenario="smoke",method=GET}`}, c.ExcludeMetrics)
+		})
+	}
+}
+
+func TestOptionMetadata(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"metadataSendInterval":"30s","metricHelp":{"my_trend":"My trend."}}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_METADATA_SEND_INTERVAL": "30s",
+			"K6_PROMETHEUS_RW_METRIC_HELP_my_trend":   "My trend.",
+		}},
+		"Arg": {arg: "metadataSendInterval=30s,metricHelp.my_trend=My trend."},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		MetadataSendInterval:  types.NullDurationFrom(30 * time.Second),
+		MetricHelp:            map[string]string{"my_trend": "My trend."},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionExemplars(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"exemplars":true,"exemplarMetadataKey":"traceID","exemplarSampling":"last"}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_EXEMPLARS":             "true",
+			"K6_PROMETHEUS_RW_EXEMPLAR_METADATA_KEY": "traceID",
+			"K6_PROMETHEUS_RW_EXEMPLAR_SAMPLING":     "last",
+		}},
+		"Arg": {arg: "exemplars=true,exemplarMetadataKey=traceID,exemplarSampling=last"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		Exemplars:             null.BoolFrom(true),
+		ExemplarMetadataKey:   null.StringFrom("traceID"),
+		ExemplarSampling:      null.StringFrom("last"),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionStaleSeriesTTL(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"staleSeriesTTL":"1m"}`)},
+		"Env":  {env: map[string]string{"K6_PROMETHEUS_RW_STALE_SERIES_TTL": "1m"}},
+		"Arg":  {arg: "staleSeriesTTL=1m"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		StaleSeriesTTL:        types.NullDurationFrom(time.Minute),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionRateAsCounters(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"rateAsCounters":true,"rateGauge":true}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_RATE_AS_COUNTERS": "true",
+			"K6_PROMETHEUS_RW_RATE_GAUGE":       "true",
+		}},
+		"Arg": {arg: "rateAsCounters=true,rateGauge=true"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		RateAsCounters:        null.BoolFrom(true),
+		RateGauge:             null.BoolFrom(true),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
+
+func TestOptionCreatedTimestamps(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		arg     string
+		env     map[string]string
+		jsonRaw json.RawMessage
+	}{
+		"JSON": {jsonRaw: json.RawMessage(`{"createdTimestamps":true,"counterZeroSample":true}`)},
+		"Env": {env: map[string]string{
+			"K6_PROMETHEUS_RW_CREATED_TIMESTAMPS":  "true",
+			"K6_PROMETHEUS_RW_COUNTER_ZERO_SAMPLE": "true",
+		}},
+		"Arg": {arg: "createdTimestamps=true,counterZeroSample=true"},
+	}
+
+	expconfig := Config{
+		ServerURL:             null.StringFrom("http://localhost:9090/api/v1/write"),
+		InsecureSkipTLSVerify: null.BoolFrom(false),
+		PushInterval:          types.NullDurationFrom(5 * time.Second),
+		Headers:               make(map[string]string),
+		TrendStats:            []string{"p(99)"},
+		StaleMarkers:          null.BoolFrom(false),
+		CreatedTimestamps:     null.BoolFrom(true),
+		CounterZeroSample:     null.BoolFrom(true),
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c, err := GetConsolidatedConfig(
+				tc.jsonRaw, tc.env, tc.arg)
+			require.NoError(t, err)
+			assert.Equal(t, expconfig, c)
+		})
+	}
+}
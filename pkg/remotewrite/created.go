@@ -0,0 +1,114 @@
+package remotewrite
+
+import (
+	"strings"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"go.k6.io/k6/metrics"
+)
+
+// createdSendInterval is the interval for sending again the _created time series,
+// it is shorter than the Prometheus' default lookback delta of 5m
+// so the created time remains queryable.
+const createdSendInterval = time.Minute
+
+// counterSeries returns true if the time series is mapped to counters,
+// they are the time series with a created timestamp.
+func counterSeries(swm *seriesWithMeasure) bool {
+	if swm.Metric.Type == metrics.Counter {
+		return true
+	}
+	_, ok := swm.Measure.(*rateCountersSink)
+	return ok
+}
+
+// trackCreated returns true if the created time of the counters is required.
+func (o *Output) trackCreated() bool {
+	return o.config.CreatedTimestamps.Bool || o.config.CounterZeroSample.Bool
+}
+
+// setCreated sets the created time of the new time series, if it is a counter.
+// The counter has been zero until its first sample, so it is created 1ms before it.
+func (o *Output) setCreated(swm *seriesWithMeasure, first time.Time) {
+	if !o.trackCreated() || !counterSeries(swm) {
+		return
+	}
+	swm.Created = first.Add(-1 * time.Millisecond)
+	swm.ZeroSample = o.config.CounterZeroSample.Bool
+}
+
+// mapCreated adds the created time to the counters' mapped time series.
+// The zero sample is prepended if it is pending. With Remote Write 2.0
+// the created timestamps are tracked for the next append, otherwise
+// the returned _created time series are the created timestamps.
+// The _created time series are returned the first time,
+// then only once per created send interval, because the created time doesn't change.
+func (o *Output) mapCreated(swm *seriesWithMeasure, series []*prompb.TimeSeries) []*prompb.TimeSeries {
+	if swm.Created.IsZero() {
+		return nil
+	}
+	ct := swm.Created.UnixMilli()
+
+	if swm.ZeroSample {
+		for _, ts := range series {
+			if !strings.HasSuffix(seriesName(ts), "_total") || len(ts.Samples) < 1 {
+				continue
+			}
+			ts.Samples = append([]*prompb.Sample{{Value: 0, Timestamp: ct}}, ts.Samples...)
+		}
+		swm.ZeroSample = false
+	}
+
+	if !o.config.CreatedTimestamps.Bool {
+		return nil
+	}
+	if o.config.protocolV2() {
+		if o.pendingCreated == nil {
+			o.pendingCreated = make(map[*prompb.TimeSeries]int64, len(series))
+		}
+		for _, ts := range series {
+			if strings.HasSuffix(seriesName(ts), "_total") {
+				o.pendingCreated[ts] = ct
+			}
+		}
+		return nil
+	}
+	if !swm.CreatedSent.IsZero() && swm.Latest.Sub(swm.CreatedSent) < createdSendInterval {
+		return nil
+	}
+	swm.CreatedSent = swm.Latest
+	return o.createdSeries(swm, series)
+}
+
+// createdSeries returns the OpenMetrics' _created time series of the counters,
+// with the created time in seconds, for the Remote Write versions
+// without the created timestamp.
+func (o *Output) createdSeries(swm *seriesWithMeasure, series []*prompb.TimeSeries) []*prompb.TimeSeries {
+	if swm.Created.IsZero() || !o.config.CreatedTimestamps.Bool || o.config.protocolV2() {
+		return nil
+	}
+
+	var created []*prompb.TimeSeries
+	for _, ts := range series {
+		family, ok := strings.CutSuffix(seriesName(ts), "_total")
+		if !ok || len(ts.Samples) < 1 {
+			continue
+		}
+		labels := make([]*prompb.Label, len(ts.Labels))
+		for i, l := range ts.Labels {
+			labels[i] = &prompb.Label{Name: l.Name, Value: l.Value}
+			if l.Name == namelbl {
+				labels[i].Value = family + "_created"
+			}
+		}
+		created = append(created, &prompb.TimeSeries{
+			Labels: labels,
+			Samples: []*prompb.Sample{{
+				Value:     float64(swm.Created.UnixMilli()) / 1000,
+				Timestamp: ts.Samples[len(ts.Samples)-1].Timestamp,
+			}},
+		})
+	}
+	return created
+}
@@ -0,0 +1,129 @@
+package remotewrite
+
+import (
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestOutputConvertToPbSeriesCounterZeroSample(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("http_reqs", metrics.Counter)
+	rate := registry.MustNewMetric("checks", metrics.Rate)
+	tags := registry.RootTagSet()
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	o := Output{
+		config: Config{
+			CounterZeroSample: null.BoolFrom(true),
+			RateAsCounters:    null.BoolFrom(true),
+			RateGauge:         null.BoolFrom(true),
+		},
+		tsdb: make(map[metrics.TimeSeries]*seriesWithMeasure),
+	}
+
+	pbseries := o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: t0, Value: 2},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: rate, Tags: tags}, Time: t0, Value: 1},
+	})
+	require.Len(t, pbseries, 4)
+
+	created := t0.Add(-time.Millisecond).UnixMilli()
+	for _, ts := range pbseries {
+		if seriesName(ts) == "k6_checks_rate" {
+			assert.Len(t, ts.Samples, 1)
+			continue
+		}
+		require.Len(t, ts.Samples, 2, seriesName(ts))
+		assert.Equal(t, &prompb.Sample{Value: 0, Timestamp: created}, ts.Samples[0])
+		assert.Equal(t, t0.UnixMilli(), ts.Samples[1].Timestamp)
+	}
+
+	// the zero sample is sent once
+	pbseries = o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: t0.Add(time.Second), Value: 1},
+	})
+	require.Len(t, pbseries, 1)
+	require.Len(t, pbseries[0].Samples, 1)
+	assert.Equal(t, 3.0, pbseries[0].Samples[0].Value)
+}
+
+func TestOutputConvertToPbSeriesCreatedTimestamps(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("http_reqs", metrics.Counter)
+	gauge := registry.MustNewMetric("vus", metrics.Gauge)
+	tags := registry.RootTagSet().With("method", "GET")
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+	created := t0.Add(-time.Millisecond)
+
+	samples := func(t time.Time) []metrics.SampleContainer {
+		return []metrics.SampleContainer{
+			metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: t, Value: 1},
+			metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: gauge, Tags: tags}, Time: t, Value: 1},
+		}
+	}
+
+	t.Run("CreatedSeries", func(t *testing.T) {
+		t.Parallel()
+
+		o := Output{
+			config: Config{CreatedTimestamps: null.BoolFrom(true)},
+			now:    func() time.Time { return t0.Add(time.Minute) },
+			tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+		}
+		for _, offset := range []time.Duration{0, time.Second, time.Minute} {
+			now := t0.Add(offset)
+			pbseries := o.convertToPbSeries(samples(now))
+			sortByNameLabel(pbseries)
+
+			if offset == time.Second {
+				// it isn't sent again before the interval
+				require.Len(t, pbseries, 2)
+				assert.Equal(t, "k6_http_reqs_total", seriesName(pbseries[0]))
+				continue
+			}
+			require.Len(t, pbseries, 3)
+			assert.Equal(t, []*prompb.Label{
+				{Name: namelbl, Value: "k6_http_reqs_created"},
+				{Name: "method", Value: "GET"},
+			}, pbseries[0].Labels)
+			assert.Equal(t, []*prompb.Sample{{
+				Value:     float64(created.UnixMilli()) / 1000,
+				Timestamp: now.UnixMilli(),
+			}}, pbseries[0].Samples)
+			assert.Nil(t, o.pendingCreated)
+		}
+
+		// the _created time series is marked as stale too
+		markers := o.staleMarkers()
+		assert.Len(t, markers, 3)
+	})
+
+	t.Run("RemoteWriteV2", func(t *testing.T) {
+		t.Parallel()
+
+		o := Output{
+			config: Config{
+				CreatedTimestamps: null.BoolFrom(true),
+				ProtocolVersion:   null.StringFrom("2"),
+			},
+			tsdb: make(map[metrics.TimeSeries]*seriesWithMeasure),
+		}
+		pbseries := o.convertToPbSeries(samples(t0))
+		require.Len(t, pbseries, 2)
+		sortByNameLabel(pbseries)
+
+		assert.Equal(t, map[*prompb.TimeSeries]int64{
+			pbseries[0]: created.UnixMilli(),
+		}, o.pendingCreated)
+	})
+}
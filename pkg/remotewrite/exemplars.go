@@ -0,0 +1,131 @@
+package remotewrite
+
+import (
+	"fmt"
+	"strconv"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"go.k6.io/k6/metrics"
+)
+
+const (
+	// defaultExemplarMetadataKey is the sample's metadata key
+	// set from the k6 tracing instrumentation.
+	defaultExemplarMetadataKey = "trace_id"
+
+	// exemplarTraceIDLabel is the exemplar's label with the trace ID,
+	// it is the default label expected from Grafana.
+	exemplarTraceIDLabel = "trace_id"
+)
+
+// The sampling strategies select one exemplar per time series per flush.
+const (
+	// exemplarSamplingMax samples the highest value, e.g. the slowest request.
+	exemplarSamplingMax = "max"
+
+	// exemplarSamplingMin samples the lowest value.
+	exemplarSamplingMin = "min"
+
+	// exemplarSamplingFirst samples the first value.
+	exemplarSamplingFirst = "first"
+
+	// exemplarSamplingLast samples the latest value.
+	exemplarSamplingLast = "last"
+)
+
+// exemplarSampler samples the exemplars of the Trend's time series
+// from the samples with the trace ID in the metadata.
+type exemplarSampler struct {
+	key      string
+	strategy string
+}
+
+// newExemplarSampler creates the sampler from the config,
+// it returns nil if the exemplars are disabled.
+func newExemplarSampler(conf Config) (*exemplarSampler, error) {
+	if !conf.Exemplars.Bool {
+		return nil, nil //nolint:nilnil
+	}
+	s := &exemplarSampler{
+		key:      defaultExemplarMetadataKey,
+		strategy: exemplarSamplingMax,
+	}
+	if conf.ExemplarMetadataKey.Valid {
+		if conf.ExemplarMetadataKey.String == "" {
+			return nil, fmt.Errorf("the exemplar's metadata key can't be empty")
+		}
+		s.key = conf.ExemplarMetadataKey.String
+	}
+	if conf.ExemplarSampling.Valid {
+		switch conf.ExemplarSampling.String {
+		case exemplarSamplingMax, exemplarSamplingMin, exemplarSamplingFirst, exemplarSamplingLast:
+			s.strategy = conf.ExemplarSampling.String
+		default:
+			return nil, fmt.Errorf("the exemplar sampling %q is not supported, the supported values are %q, %q, %q and %q",
+				conf.ExemplarSampling.String,
+				exemplarSamplingMax, exemplarSamplingMin, exemplarSamplingFirst, exemplarSamplingLast)
+		}
+	}
+	return s, nil
+}
+
+// sample returns the exemplar selected between the current one and the sample,
+// the value is in the base unit. The samples without the trace ID are skipped.
+func (s *exemplarSampler) sample(current *prompb.Exemplar, sample metrics.Sample) *prompb.Exemplar {
+	traceID := sample.Metadata[s.key]
+	if traceID == "" {
+		return current
+	}
+	value := adaptUnit(sample.Metric.Contains, sample.Value)
+	if current != nil {
+		switch s.strategy {
+		case exemplarSamplingMax:
+			if value <= current.Value {
+				return current
+			}
+		case exemplarSamplingMin:
+			if value >= current.Value {
+				return current
+			}
+		case exemplarSamplingFirst:
+			return current
+		default:
+		}
+	}
+	return &prompb.Exemplar{
+		Labels:    []*prompb.Label{{Name: exemplarTraceIDLabel, Value: traceID}},
+		Value:     value,
+		Timestamp: sample.Time.UnixMilli(),
+	}
+}
+
+// attachExemplar attaches the exemplar to the Trend's time series.
+// For the native histograms it is attached to the histogram, for the classic
+// histograms to the lowest bucket containing the value and for the stats to all of them.
+func attachExemplar(series []*prompb.TimeSeries, sink metrics.Sink, e *prompb.Exemplar) {
+	if _, classic := sink.(*classicHistogramSink); classic {
+		for _, ts := range series {
+			le, ok := bucketUpperBound(ts)
+			if ok && e.Value <= le {
+				ts.Exemplars = append(ts.Exemplars, e)
+				return
+			}
+		}
+		return
+	}
+	for _, ts := range series {
+		ts.Exemplars = append(ts.Exemplars, e)
+	}
+}
+
+// bucketUpperBound returns the upper bound of the classic histogram's bucket.
+func bucketUpperBound(ts *prompb.TimeSeries) (float64, bool) {
+	for _, l := range ts.Labels {
+		if l.Name != bucketLabel {
+			continue
+		}
+		le, err := strconv.ParseFloat(l.Value, 64)
+		return le, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,194 @@
+package remotewrite
+
+import (
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestExemplarSamplerSample(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	trend := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	t0 := time.Unix(1000, 0)
+
+	samples := []metrics.Sample{
+		{Value: 200, Metadata: map[string]string{"trace_id": "a"}},
+		{Value: 900, Metadata: map[string]string{"trace_id": "b"}},
+		{Value: 2000},
+		{Value: 100, Metadata: map[string]string{"trace_id": "c"}},
+		{Value: 300, Metadata: map[string]string{"trace_id": "d"}},
+	}
+	for i := range samples {
+		samples[i].Metric = trend
+		samples[i].Time = t0.Add(time.Duration(i) * time.Second)
+	}
+
+	tests := map[string]struct {
+		exp   string
+		value float64
+	}{
+		exemplarSamplingMax:   {exp: "b", value: 0.9},
+		exemplarSamplingMin:   {exp: "c", value: 0.1},
+		exemplarSamplingFirst: {exp: "a", value: 0.2},
+		exemplarSamplingLast:  {exp: "d", value: 0.3},
+	}
+	for strategy, tt := range tests {
+		s, err := newExemplarSampler(Config{Exemplars: null.BoolFrom(true), ExemplarSampling: null.StringFrom(strategy)})
+		require.NoError(t, err)
+
+		var e *prompb.Exemplar
+		for _, sample := range samples {
+			e = s.sample(e, sample)
+		}
+		require.NotNil(t, e, strategy)
+		assert.Equal(t, []*prompb.Label{{Name: "trace_id", Value: tt.exp}}, e.Labels, strategy)
+		assert.Equal(t, tt.value, e.Value, strategy)
+	}
+}
+
+func TestExemplarSamplerMetadataKey(t *testing.T) {
+	t.Parallel()
+
+	s, err := newExemplarSampler(Config{Exemplars: null.BoolFrom(true), ExemplarMetadataKey: null.StringFrom("traceID")})
+	require.NoError(t, err)
+
+	registry := metrics.NewRegistry()
+	trend := registry.MustNewMetric("trend", metrics.Trend)
+	sample := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: trend},
+		Time:       time.Unix(1, 0),
+		Value:      5,
+		Metadata:   map[string]string{"trace_id": "a"},
+	}
+	assert.Nil(t, s.sample(nil, sample))
+
+	sample.Metadata = map[string]string{"traceID": "b"}
+	assert.Equal(t, &prompb.Exemplar{
+		Labels:    []*prompb.Label{{Name: "trace_id", Value: "b"}},
+		Value:     5,
+		Timestamp: 1000,
+	}, s.sample(nil, sample))
+}
+
+func TestNewExemplarSampler(t *testing.T) {
+	t.Parallel()
+
+	s, err := newExemplarSampler(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	_, err = newExemplarSampler(Config{Exemplars: null.BoolFrom(true), ExemplarSampling: null.StringFrom("random")})
+	assert.ErrorContains(t, err, "not supported")
+
+	_, err = newExemplarSampler(Config{Exemplars: null.BoolFrom(true), ExemplarMetadataKey: null.StringFrom("")})
+	assert.ErrorContains(t, err, "can't be empty")
+}
+
+func TestAttachExemplar(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: registry.MustNewMetric("test", metrics.Trend, metrics.Time),
+		Tags:   registry.RootTagSet(),
+	}
+	now := time.Unix(1, 0)
+	e := &prompb.Exemplar{Labels: []*prompb.Label{{Name: "trace_id", Value: "a"}}, Value: 0.3}
+
+	t.Run("ClassicHistogram", func(t *testing.T) {
+		t.Parallel()
+
+		sink := newClassicHistogramSink(series.Metric, []float64{0.1, 0.5, 1})
+		sink.Add(metrics.Sample{TimeSeries: series, Value: 300})
+		pbseries := sink.MapPrompb(series, MapSeries(series, ""), now)
+		attachExemplar(pbseries, sink, e)
+
+		for _, ts := range pbseries {
+			le, _ := bucketUpperBound(ts)
+			if le == 0.5 {
+				assert.Equal(t, []*prompb.Exemplar{e}, ts.Exemplars)
+				continue
+			}
+			assert.Empty(t, ts.Exemplars)
+		}
+	})
+
+	t.Run("NativeHistogram", func(t *testing.T) {
+		t.Parallel()
+
+		sink := newNativeHistogramSink(series.Metric, nativeHistogramOptions{})
+		sink.Add(metrics.Sample{TimeSeries: series, Value: 300})
+		pbseries := sink.MapPrompb(series, MapSeries(series, ""), now)
+		attachExemplar(pbseries, sink, e)
+
+		require.Len(t, pbseries, 1)
+		assert.Equal(t, []*prompb.Exemplar{e}, pbseries[0].Exemplars)
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		t.Parallel()
+
+		resolvers, err := newTrendStatsResolver([]string{"p(99)", "max"})
+		require.NoError(t, err)
+		sink, err := newExtendedTrendSink(resolvers)
+		require.NoError(t, err)
+		sink.Add(metrics.Sample{TimeSeries: series, Value: 300})
+		pbseries := sink.MapPrompb(series, MapSeries(series, ""), now)
+		attachExemplar(pbseries, sink, e)
+
+		require.Len(t, pbseries, 2)
+		for _, ts := range pbseries {
+			assert.Equal(t, []*prompb.Exemplar{e}, ts.Exemplars)
+		}
+	})
+}
+
+func TestOutputConvertToPbSeriesWithExemplars(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	trend := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	counter := registry.MustNewMetric("http_reqs", metrics.Counter)
+	tags := registry.RootTagSet()
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	s, err := newExemplarSampler(Config{Exemplars: null.BoolFrom(true)})
+	require.NoError(t, err)
+	o := Output{
+		config:    Config{TrendAsNativeHistogram: null.BoolFrom(true)},
+		tsdb:      make(map[metrics.TimeSeries]*seriesWithMeasure),
+		exemplars: s,
+	}
+
+	metadata := map[string]string{"trace_id": "abc"}
+	samples := []metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: trend, Tags: tags}, Time: t0, Value: 100, Metadata: metadata},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: t0, Value: 1, Metadata: metadata},
+	}
+	pbseries := o.convertToPbSeries(samples)
+	require.Len(t, pbseries, 2)
+	for _, ts := range pbseries {
+		if seriesName(ts) == "k6_http_reqs_total" {
+			assert.Empty(t, ts.Exemplars)
+			continue
+		}
+		require.Len(t, ts.Exemplars, 1)
+		assert.Equal(t, 0.1, ts.Exemplars[0].Value)
+		assert.Equal(t, t0.UnixMilli(), ts.Exemplars[0].Timestamp)
+	}
+
+	// the exemplar is sent once
+	samples = []metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: trend, Tags: tags}, Time: t0.Add(time.Second), Value: 100},
+	}
+	pbseries = o.convertToPbSeries(samples)
+	require.Len(t, pbseries, 1)
+	assert.Empty(t, pbseries[0].Exemplars)
+}
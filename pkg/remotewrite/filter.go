@@ -0,0 +1,100 @@
+package remotewrite
+
+import (
+	"fmt"
+	"path"
+
+	"go.k6.io/k6/metrics"
+)
+
+// seriesMatcher matches the time series by the metric's name glob and the tags.
+type seriesMatcher struct {
+	glob string
+	tags map[string]string
+}
+
+func (m seriesMatcher) matches(series metrics.TimeSeries) bool {
+	if m.glob != "" {
+		// the pattern has been already validated
+		if ok, _ := path.Match(m.glob, series.Metric.Name); !ok {
+			return false
+		}
+	}
+	return hasTags(series, m.tags)
+}
+
+// seriesFilter filters the time series by the include and the exclude rules.
+// Only the dropped time series are cached, the kept ones are evaluated
+// when they are added to the tsdb, so the cache doesn't grow with them.
+type seriesFilter struct {
+	include []seriesMatcher
+	exclude []seriesMatcher
+
+	dropped map[metrics.TimeSeries]struct{}
+}
+
+// newSeriesFilter creates the filter from the rules,
+// it returns nil if no rule is defined.
+func newSeriesFilter(include, exclude []string) (*seriesFilter, error) {
+	if len(include) < 1 && len(exclude) < 1 {
+		return nil, nil //nolint:nilnil
+	}
+
+	f := &seriesFilter{
+		dropped: make(map[metrics.TimeSeries]struct{}),
+	}
+	var err error
+	if f.include, err = newSeriesMatchers(include); err != nil {
+		return nil, fmt.Errorf("the include rules are invalid: %w", err)
+	}
+	if f.exclude, err = newSeriesMatchers(exclude); err != nil {
+		return nil, fmt.Errorf("the exclude rules are invalid: %w", err)
+	}
+	return f, nil
+}
+
+func newSeriesMatchers(rules []string) ([]seriesMatcher, error) {
+	matchers := make([]seriesMatcher, 0, len(rules))
+	for _, rule := range rules {
+		glob, tags, err := parseSeriesSelector(rule)
+		if err != nil {
+			return nil, err
+		}
+		if glob == "" && len(tags) == 0 {
+			return nil, fmt.Errorf("the rule %q is empty", rule)
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("the rule %q has an invalid glob: %w", rule, err)
+		}
+		matchers = append(matchers, seriesMatcher{glob: glob, tags: tags})
+	}
+	return matchers, nil
+}
+
+// keep returns true if the time series matches at least one include rule,
+// if any is defined, and no exclude rule.
+func (f *seriesFilter) keep(series metrics.TimeSeries) bool {
+	if _, dropped := f.dropped[series]; dropped {
+		return false
+	}
+
+	kept := len(f.include) == 0
+	for _, m := range f.include {
+		if m.matches(series) {
+			kept = true
+			break
+		}
+	}
+	if kept {
+		for _, m := range f.exclude {
+			if m.matches(series) {
+				kept = false
+				break
+			}
+		}
+	}
+	if !kept {
+		f.dropped[series] = struct{}{}
+	}
+	return kept
+}
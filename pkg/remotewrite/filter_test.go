@@ -0,0 +1,128 @@
+package remotewrite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+)
+
+func TestSeriesFilterKeep(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend)
+	blocked := registry.MustNewMetric("http_req_blocked", metrics.Trend)
+	dataSent := registry.MustNewMetric("data_sent", metrics.Counter)
+	smoke := registry.RootTagSet().With("scenario", "smoke")
+	load := registry.RootTagSet().With("scenario", "load")
+
+	tests := map[string]struct {
+		include []string
+		exclude []string
+		exp     map[metrics.TimeSeries]bool
+	}{
+		"Exclude": {
+			exclude: []string{"http_req_blocked", "data_*"},
+			exp: map[metrics.TimeSeries]bool{
+				{Metric: duration, Tags: load}: true,
+				{Metric: blocked, Tags: load}:  false,
+				{Metric: dataSent, Tags: load}: false,
+			},
+		},
+		"Include": {
+			include: []string{"http_req_*"},
+			exp: map[metrics.TimeSeries]bool{
+				{Metric: duration, Tags: load}: true,
+				{Metric: blocked, Tags: load}:  true,
+				{Metric: dataSent, Tags: load}: false,
+			},
+		},
+		"ExcludeTakesPrecedence": {
+			include: []string{"http_req_*"},
+			exclude: []string{`http_req_blocked{scenario="smoke"}`},
+			exp: map[metrics.TimeSeries]bool{
+				{Metric: blocked, Tags: load}:  true,
+				{Metric: blocked, Tags: smoke}: false,
+				{Metric: dataSent, Tags: load}: false,
+			},
+		},
+		"TagsOnly": {
+			exclude: []string{`{scenario="smoke"}`},
+			exp: map[metrics.TimeSeries]bool{
+				{Metric: duration, Tags: load}:  true,
+				{Metric: duration, Tags: smoke}: false,
+				{Metric: dataSent, Tags: smoke}: false,
+			},
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := newSeriesFilter(tt.include, tt.exclude)
+			require.NoError(t, err)
+			dropped := 0
+			for series, exp := range tt.exp {
+				assert.Equal(t, exp, f.keep(series), series.Metric.Name)
+				// the cached decision is the same
+				assert.Equal(t, exp, f.keep(series), series.Metric.Name)
+				if !exp {
+					dropped++
+				}
+			}
+			// only the dropped time series are cached
+			assert.Len(t, f.dropped, dropped)
+		})
+	}
+}
+
+func TestNewSeriesFilter(t *testing.T) {
+	t.Parallel()
+
+	f, err := newSeriesFilter(nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, f)
+
+	_, err = newSeriesFilter([]string{"http_req_[a"}, nil)
+	assert.ErrorContains(t, err, "invalid glob")
+
+	_, err = newSeriesFilter(nil, []string{""})
+	assert.ErrorContains(t, err, "is empty")
+
+	_, err = newSeriesFilter(nil, []string{"{scenario=smoke"})
+	assert.ErrorContains(t, err, "exclude rules")
+}
+
+func TestOutputConvertToPbSeriesWithFilter(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	iterations := registry.MustNewMetric("iterations", metrics.Counter)
+	dataSent := registry.MustNewMetric("data_sent", metrics.Counter)
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	f, err := newSeriesFilter(nil, []string{"data_*"})
+	require.NoError(t, err)
+	o := Output{
+		tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+		filter: f,
+	}
+
+	excluded := metrics.TimeSeries{Metric: dataSent, Tags: registry.RootTagSet()}
+	samples := []metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: iterations, Tags: registry.RootTagSet()}, Time: t0, Value: 1},
+		metrics.Sample{TimeSeries: excluded, Time: t0, Value: 10},
+		metrics.Sample{TimeSeries: excluded, Time: t0.Add(time.Millisecond), Value: 10},
+	}
+	pbseries := o.convertToPbSeries(samples)
+	require.Len(t, pbseries, 1)
+	assert.Equal(t, "k6_iterations_total", pbseries[0].Labels[0].Value)
+
+	// the excluded time series has no sink
+	assert.Len(t, o.tsdb, 1)
+	assert.NotContains(t, o.tsdb, excluded)
+}
@@ -0,0 +1,144 @@
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.k6.io/k6/metrics"
+)
+
+const bucketLabel = "le"
+
+// defaultHistogramBuckets returns the default buckets of the classic histogram
+// for the value type. They are in the base unit, seconds for the time and bytes for the data.
+func defaultHistogramBuckets(vt metrics.ValueType) []float64 {
+	switch vt {
+	case metrics.Time:
+		// from 5ms to 10s
+		return prometheus.DefBuckets
+	case metrics.Data:
+		// from 256B to 64MB
+		return prometheus.ExponentialBuckets(256, 4, 10)
+	default:
+		return prometheus.ExponentialBuckets(1, 2, 16)
+	}
+}
+
+// validateBuckets returns an error if the buckets
+// are empty or not in strictly increasing order.
+func validateBuckets(buckets []float64) error {
+	if len(buckets) < 1 {
+		return fmt.Errorf("at least one bucket is required")
+	}
+	for i, b := range buckets {
+		if math.IsNaN(b) {
+			return fmt.Errorf("the bucket #%d is not a number", i)
+		}
+		if i > 0 && b <= buckets[i-1] {
+			return fmt.Errorf("the buckets must be in strictly increasing order")
+		}
+	}
+	return nil
+}
+
+// classicHistogramSink maps the Trend type to a classic Prometheus' histogram,
+// the _bucket series with the cumulative counters, the _sum and the _count series.
+type classicHistogramSink struct {
+	H prometheus.Histogram
+}
+
+func newClassicHistogramSink(m *metrics.Metric, buckets []float64) *classicHistogramSink {
+	return &classicHistogramSink{
+		H: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    m.Name,
+			Buckets: buckets,
+		}),
+	}
+}
+
+// Add implements metrics.Sink.
+func (sink *classicHistogramSink) Add(s metrics.Sample) {
+	// the buckets are in the base unit
+	sink.H.Observe(adaptUnit(s.Metric.Contains, s.Value))
+}
+
+// P implements metrics.Sink.
+func (*classicHistogramSink) P(_ float64) float64 {
+	panic("Classic Histogram Sink has no support of percentile (P)")
+}
+
+// Format implements metrics.Sink.
+func (*classicHistogramSink) Format(_ time.Duration) map[string]float64 {
+	panic("Classic Histogram Sink has no support of formatting (Format)")
+}
+
+// IsEmpty implements metrics.Sink.
+func (*classicHistogramSink) IsEmpty() bool {
+	panic("Classic Histogram Sink has no support of emptiness check (IsEmpty)")
+}
+
+// Drain implements metrics.Sink.
+func (*classicHistogramSink) Drain() ([]byte, error) {
+	panic("Classic Histogram Sink has no support of draining")
+}
+
+// Merge implements metrics.Sink.
+func (*classicHistogramSink) Merge(_ []byte) error {
+	panic("Classic Histogram Sink has no support of merging")
+}
+
+// MapPrompb maps the Trend type to the series of a classic histogram.
+// The name has the base unit as suffix, if the metric has one.
+func (sink *classicHistogramSink) MapPrompb(
+	series metrics.TimeSeries, labels []*prompb.Label, t time.Time,
+) []*prompb.TimeSeries {
+	metric := &dto.Metric{}
+	if err := sink.H.Write(metric); err != nil {
+		panic(fmt.Errorf("failed to convert Classic Histogram to the related Protobuf: %w", err))
+	}
+	h := metric.Histogram
+	timestamp := t.UnixMilli()
+
+	prefix := baseUnit(series.Metric.Contains)
+	if prefix != "" {
+		prefix += "_"
+	}
+	mapSeries := func(suffix string, v float64) *prompb.TimeSeries {
+		return &prompb.TimeSeries{
+			Labels:  withNameSuffix(labels, prefix+suffix),
+			Samples: []*prompb.Sample{{Value: v, Timestamp: timestamp}},
+		}
+	}
+
+	// the buckets, the +Inf bucket, the sum and the count
+	newts := make([]*prompb.TimeSeries, 0, len(h.Bucket)+3)
+	for _, b := range h.Bucket {
+		newts = append(newts, withBucketLabel(
+			mapSeries("bucket", float64(b.GetCumulativeCount())), b.GetUpperBound()))
+	}
+	newts = append(newts,
+		withBucketLabel(mapSeries("bucket", float64(h.GetSampleCount())), math.Inf(1)),
+		mapSeries("sum", h.GetSampleSum()),
+		mapSeries("count", float64(h.GetSampleCount())),
+	)
+	return newts
+}
+
+// withBucketLabel adds the le label with the bucket's upper bound
+// to the time series, keeping the labels sorted.
+func withBucketLabel(ts *prompb.TimeSeries, upperBound float64) *prompb.TimeSeries {
+	ts.Labels = append(ts.Labels, &prompb.Label{
+		Name:  bucketLabel,
+		Value: strconv.FormatFloat(upperBound, 'f', -1, 64),
+	})
+	sort.Slice(ts.Labels, func(i, j int) bool {
+		return ts.Labels[i].Name < ts.Labels[j].Name
+	})
+	return ts
+}
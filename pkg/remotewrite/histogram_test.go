@@ -0,0 +1,131 @@
+package remotewrite
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestClassicHistogramSinkMapPrompb(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time),
+		Tags:   registry.RootTagSet().With("method", "GET"),
+	}
+
+	sink := newClassicHistogramSink(series.Metric, []float64{0.1, 0.5})
+	for _, v := range []float64{50, 200, 1000} {
+		sink.Add(metrics.Sample{TimeSeries: series, Value: v})
+	}
+
+	now := time.Unix(1, 0)
+	pbseries := sink.MapPrompb(series, MapSeries(series, ""), now)
+
+	ts := func(name, le string, v float64) *prompb.TimeSeries {
+		labels := []*prompb.Label{{Name: "__name__", Value: name}}
+		if le != "" {
+			labels = append(labels, &prompb.Label{Name: "le", Value: le})
+		}
+		labels = append(labels, &prompb.Label{Name: "method", Value: "GET"})
+		return &prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []*prompb.Sample{{Value: v, Timestamp: now.UnixMilli()}},
+		}
+	}
+	exp := []*prompb.TimeSeries{
+		ts("k6_http_req_duration_seconds_bucket", "0.1", 1),
+		ts("k6_http_req_duration_seconds_bucket", "0.5", 2),
+		ts("k6_http_req_duration_seconds_bucket", "+Inf", 3),
+		ts("k6_http_req_duration_seconds_sum", "", 1.25),
+		ts("k6_http_req_duration_seconds_count", "", 3),
+	}
+	assert.Equal(t, exp, pbseries)
+}
+
+func TestValidateBuckets(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, validateBuckets([]float64{0.1, 1, math.Inf(1)}))
+	assert.ErrorContains(t, validateBuckets(nil), "at least one")
+	assert.ErrorContains(t, validateBuckets([]float64{1, 1}), "increasing")
+	assert.ErrorContains(t, validateBuckets([]float64{2, 1}), "increasing")
+	assert.ErrorContains(t, validateBuckets([]float64{math.NaN()}), "not a number")
+}
+
+func TestOutputHistogramBuckets(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	received := registry.MustNewMetric("data_received_trend", metrics.Trend, metrics.Data)
+	custom := registry.MustNewMetric("custom", metrics.Trend)
+	counter := registry.MustNewMetric("iterations", metrics.Counter)
+
+	o := Output{config: Config{TrendAsHistogram: null.BoolFrom(true)}}
+	assert.Equal(t, prometheus.DefBuckets, o.histogramBuckets(duration))
+	assert.Equal(t, float64(256), o.histogramBuckets(received)[0])
+	assert.Equal(t, float64(1), o.histogramBuckets(custom)[0])
+	assert.Nil(t, o.histogramBuckets(counter))
+
+	o.config.HistogramBuckets = []float64{1, 2}
+	o.config.MetricHistogramBuckets = map[string][]float64{"http_req_duration": {0.2, 0.4}}
+	assert.Equal(t, []float64{0.2, 0.4}, o.histogramBuckets(duration))
+	assert.Equal(t, []float64{1, 2}, o.histogramBuckets(custom))
+
+	o.config.TrendAsHistogram = null.BoolFrom(false)
+	assert.Nil(t, o.histogramBuckets(duration))
+}
+
+func TestConfigValidateHistogram(t *testing.T) {
+	t.Parallel()
+
+	conf := Config{
+		TrendAsHistogram:       null.BoolFrom(true),
+		HistogramBuckets:       []float64{0.1, 1},
+		MetricHistogramBuckets: map[string][]float64{"http_req_duration": {1, 2}},
+	}
+	require.NoError(t, conf.validateHistogram())
+
+	conf.TrendAsNativeHistogram = null.BoolFrom(true)
+	assert.ErrorContains(t, conf.validateHistogram(), "at the same time")
+
+	conf.TrendAsNativeHistogram = null.BoolFrom(false)
+	conf.MetricHistogramBuckets["http_req_duration"] = []float64{2, 1}
+	assert.ErrorContains(t, conf.validateHistogram(), `metric "http_req_duration"`)
+
+	tests := map[string]struct {
+		config Config
+		expErr string
+	}{
+		"CustomBucketsWithoutNative": {
+			config: Config{NativeHistogramCustomBuckets: null.BoolFrom(true)},
+			expErr: "require the Trend mapped to native histograms",
+		},
+		"CustomBuckets": {
+			config: Config{NativeHistogramCustomBuckets: null.BoolFrom(true), TrendAsNativeHistogram: null.BoolFrom(true)},
+		},
+		"BucketFactor":      {config: Config{NativeHistogramBucketFactor: null.FloatFrom(1)}, expErr: "greater than 1"},
+		"ZeroThreshold":     {config: Config{NativeHistogramZeroThreshold: null.FloatFrom(-1)}, expErr: "negative"},
+		"MaxBucketNumber":   {config: Config{NativeHistogramMaxBucketNumber: null.IntFrom(-1)}, expErr: "out of range"},
+		"MinResetDuration":  {config: Config{NativeHistogramMinResetDuration: types.NullDurationFrom(-time.Second)}, expErr: "negative"},
+		"ValidNativeTuning": {config: Config{NativeHistogramBucketFactor: null.FloatFrom(1.05)}},
+	}
+	for name, tt := range tests {
+		err := tt.config.validateHistogram()
+		if tt.expErr == "" {
+			assert.NoError(t, err, name)
+			continue
+		}
+		assert.ErrorContains(t, err, tt.expErr, name)
+	}
+}
@@ -0,0 +1,333 @@
+package remotewrite
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/remote"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/sirupsen/logrus"
+	"go.k6.io/k6/metrics"
+)
+
+// coreMetricsHelp is the help text of the k6 built-in metrics.
+//
+//nolint:gochecknoglobals
+var coreMetricsHelp = map[string]string{
+	"vus":                      "Current number of active virtual users.",
+	"vus_max":                  "Max possible number of virtual users.",
+	"iterations":               "The aggregate number of times the VUs executed the JS script.",
+	"iteration_duration":       "The time to complete one full iteration, including time spent in setup and teardown.",
+	"dropped_iterations":       "The number of iterations that weren't started.",
+	"data_received":            "The amount of received data.",
+	"data_sent":                "The amount of data sent.",
+	"checks":                   "The rate of successful checks.",
+	"group_duration":           "Time to execute a specific group.",
+	"http_reqs":                "How many total HTTP requests k6 generated.",
+	"http_req_failed":          "The rate of failed HTTP requests.",
+	"http_req_duration":        "Total time for the HTTP request, excluding the time spent on the connection setup.",
+	"http_req_blocked":         "Time spent blocked before initiating the HTTP request.",
+	"http_req_connecting":      "Time spent establishing the TCP connection to the remote host.",
+	"http_req_tls_handshaking": "Time spent handshaking the TLS session with the remote host.",
+	"http_req_sending":         "Time spent sending the HTTP request to the remote host.",
+	"http_req_waiting":         "Time spent waiting for the HTTP response from the remote host.",
+	"http_req_receiving":       "Time spent receiving the HTTP response data from the remote host.",
+	"ws_connecting":            "Total duration for the WebSocket connection request.",
+	"ws_msgs_sent":             "Total number of WebSocket messages sent.",
+	"ws_msgs_received":         "Total number of WebSocket messages received.",
+	"ws_ping":                  "Duration between a ping request and its pong reception.",
+	"ws_session_duration":      "Duration of the WebSocket sessions.",
+	"ws_sessions":              "Total number of started WebSocket sessions.",
+	"grpc_req_duration":        "Time to receive the response from the remote gRPC host.",
+	"grpc_streams":             "Total number of started gRPC streams.",
+	"grpc_streams_msgs_sent":   "Total number of messages sent to the gRPC streams.",
+
+	"grpc_streams_msgs_received": "Total number of messages received from the gRPC streams.",
+
+	thresholdPassedMetric: "The result of the threshold: 1 if it is passing, 0 otherwise.",
+	runStatusMetric:       "The status of the test run, with the same values of k6 Cloud.",
+}
+
+// metadataTracker tracks the metadata of the sent time series by name.
+// The metadata of a time series is due when it is seen for the first time,
+// then the metadata of all the time series is due every interval.
+type metadataTracker struct {
+	interval time.Duration
+
+	// help is the help text by k6 metric's name,
+	// it takes precedence over the built-in one.
+	help map[string]string
+
+	// families is the metadata by metric family's name.
+	families map[string]*prompb.MetricMetadata
+
+	// series is the metadata by time series' name,
+	// it differs from the family's name for the classic histograms.
+	series map[string]*prompb.MetricMetadata
+
+	// pending are the metric families not yet sent.
+	pending []*prompb.MetricMetadata
+
+	// updated is true if new time series have been seen
+	// since the latest copy of the metadata by time series' name.
+	updated bool
+
+	lastSent time.Time
+}
+
+// newMetadataTracker creates the tracker from the config,
+// it returns nil if sending the metadata is not enabled.
+func newMetadataTracker(conf Config) *metadataTracker {
+	if !conf.MetadataSendInterval.Valid || conf.MetadataSendInterval.Duration <= 0 {
+		return nil
+	}
+	return &metadataTracker{
+		interval: conf.MetadataSendInterval.TimeDuration(),
+		help:     conf.MetricHelp,
+		families: make(map[string]*prompb.MetricMetadata),
+		series:   make(map[string]*prompb.MetricMetadata),
+	}
+}
+
+// observe tracks the metadata of the time series mapped from the metric.
+func (t *metadataTracker) observe(metric *metrics.Metric, sink metrics.Sink, series []*prompb.TimeSeries) {
+	for _, ts := range series {
+		name := seriesName(ts)
+		if name == "" {
+			continue
+		}
+		if _, ok := t.series[name]; ok {
+			continue
+		}
+
+		md := seriesMetadata(name, metric, sink, ts)
+		if family, ok := t.families[md.MetricFamilyName]; ok {
+			md = family
+		} else {
+			md.Help = t.help[metric.Name]
+			if md.Help == "" {
+				md.Help = coreMetricsHelp[metric.Name]
+			}
+			t.families[md.MetricFamilyName] = md
+			t.pending = append(t.pending, md)
+		}
+		t.series[name] = md
+		t.updated = true
+	}
+}
+
+// due returns the metadata to send: the metric families not yet sent,
+// or all of them if the interval has been elapsed since the latest time.
+func (t *metadataTracker) due(now time.Time) []*prompb.MetricMetadata {
+	if now.Sub(t.lastSent) >= t.interval {
+		t.lastSent = now
+		t.pending = t.pending[:0]
+		md := make([]*prompb.MetricMetadata, 0, len(t.families))
+		for _, family := range t.families {
+			md = append(md, family)
+		}
+		return md
+	}
+	md := t.pending
+	t.pending = nil
+	return md
+}
+
+// seriesMetadata returns a copy of the metadata by time series' name.
+func (t *metadataTracker) seriesMetadata() map[string]*prompb.MetricMetadata {
+	t.updated = false
+	md := make(map[string]*prompb.MetricMetadata, len(t.series))
+	for name, m := range t.series {
+		md[name] = m
+	}
+	return md
+}
+
+// seriesMetadata maps the time series of the k6 metric
+// to the metric family's metadata, without the help text.
+func seriesMetadata(
+	name string, metric *metrics.Metric, sink metrics.Sink, ts *prompb.TimeSeries,
+) *prompb.MetricMetadata {
+	md := &prompb.MetricMetadata{
+		Type:             prompb.MetricMetadata_GAUGE,
+		MetricFamilyName: name,
+	}
+	switch metric.Type {
+	case metrics.Counter:
+		md.Type = prompb.MetricMetadata_COUNTER
+	case metrics.Rate:
+		if _, counters := sink.(*rateCountersSink); counters && strings.HasSuffix(name, "_total") {
+			md.Type = prompb.MetricMetadata_COUNTER
+		}
+		return md
+	case metrics.Trend:
+		if _, classic := sink.(*classicHistogramSink); classic {
+			md.Type = prompb.MetricMetadata_HISTOGRAM
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if family, ok := strings.CutSuffix(name, suffix); ok {
+					md.MetricFamilyName = family
+					break
+				}
+			}
+		} else if len(ts.Histograms) > 0 {
+			md.Type = prompb.MetricMetadata_HISTOGRAM
+		} else if strings.HasSuffix(name, "_count") {
+			// the count of the Trend's values has no unit
+			return md
+		}
+	default:
+	}
+
+	switch metric.Contains {
+	case metrics.Data:
+		md.Unit = "bytes"
+	case metrics.Time:
+		// only the Trend's values are converted to seconds,
+		// the other ones are in milliseconds that isn't a base unit
+		if metric.Type == metrics.Trend {
+			md.Unit = "seconds"
+		}
+	default:
+	}
+	return md
+}
+
+// observeStatusMetadata tracks the metadata of the thresholds' results
+// and the run status.
+func (o *Output) observeStatusMetadata(series []*prompb.TimeSeries) {
+	names := map[string]*metrics.Metric{
+		o.metricName(thresholdPassedMetric): {Name: thresholdPassedMetric, Type: metrics.Gauge},
+		o.metricName(runStatusMetric):       {Name: runStatusMetric, Type: metrics.Gauge},
+	}
+	for _, ts := range series {
+		if metric, ok := names[seriesName(ts)]; ok {
+			o.metadata.observe(metric, nil, []*prompb.TimeSeries{ts})
+		}
+	}
+}
+
+// seriesName returns the value of the __name__ label.
+func seriesName(ts *prompb.TimeSeries) string {
+	for _, l := range ts.Labels {
+		if l.Name == namelbl {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// sendMetadata sends the metadata of the time series seen for the first time
+// and periodically the metadata of all of them.
+// With Remote Write 1.0, the metadata is sent in a dedicated request
+// from the background sender, so it doesn't block the flush.
+// With Remote Write 2.0, it is attached to the time series from the queue.
+func (o *Output) sendMetadata() {
+	if o.config.protocolV2() {
+		if o.metadata.updated {
+			o.queue.SetMetadata(o.metadata.seriesMetadata())
+		}
+		return
+	}
+	o.metadataSender.send(o.metadata.due(o.now()))
+}
+
+// metadataSender sends the metadata with Remote Write 1.0
+// from a background goroutine. The metadata that failed to be sent
+// with a recoverable error is retried with the next one.
+type metadataSender struct {
+	client *remote.WriteClient
+	logger logrus.FieldLogger
+
+	mu      sync.Mutex
+	pending []*prompb.MetricMetadata
+
+	signal chan struct{}
+	done   chan struct{}
+}
+
+// newMetadataSender creates the sender and it starts its goroutine.
+func newMetadataSender(client *remote.WriteClient, logger logrus.FieldLogger) *metadataSender {
+	s := &metadataSender{
+		client: client,
+		logger: logger,
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// send adds the metadata to the pending one and it wakes up the sender,
+// it doesn't wait for the metadata to be sent.
+func (s *metadataSender) send(md []*prompb.MetricMetadata) {
+	s.mu.Lock()
+	s.pending = mergeMetadata(s.pending, md)
+	pending := len(s.pending)
+	s.mu.Unlock()
+	if pending < 1 {
+		return
+	}
+	select {
+	case s.signal <- struct{}{}:
+	default:
+		// the sender has already been woken up
+	}
+}
+
+func (s *metadataSender) run() {
+	defer close(s.done)
+	for range s.signal {
+		s.mu.Lock()
+		md := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		if len(md) < 1 {
+			continue
+		}
+
+		err := s.client.StoreRequest(context.Background(), &remote.WriteRequest{Metadata: md})
+		if err == nil {
+			s.logger.WithField("metadata", len(md)).Debug("Sent the metrics' metadata")
+			continue
+		}
+		if !remote.IsRecoverable(err) {
+			s.logger.WithError(err).Warn("Failed to send the metrics' metadata, the endpoint rejected it")
+			continue
+		}
+		s.mu.Lock()
+		s.pending = mergeMetadata(md, s.pending)
+		s.mu.Unlock()
+		s.logger.WithError(err).Warn("Failed to send the metrics' metadata, it will be retried")
+	}
+}
+
+// stop waits for the woken up sender to complete, then it stops it.
+// The metadata can't be sent after it has been stopped.
+func (s *metadataSender) stop() {
+	close(s.signal)
+	<-s.done
+}
+
+// mergeMetadata merges the newer metadata into the older one
+// by metric family's name, the newer takes precedence.
+func mergeMetadata(older, newer []*prompb.MetricMetadata) []*prompb.MetricMetadata {
+	if len(older) < 1 {
+		return newer
+	}
+	index := make(map[string]int, len(older))
+	for i, md := range older {
+		index[md.MetricFamilyName] = i
+	}
+	for _, md := range newer {
+		if i, ok := index[md.MetricFamilyName]; ok {
+			older[i] = md
+			continue
+		}
+		index[md.MetricFamilyName] = len(older)
+		older = append(older, md)
+	}
+	return older
+}
@@ -0,0 +1,245 @@
+package remotewrite
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/remote"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/klauspost/compress/snappy"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSeriesMetadata(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("data_sent", metrics.Counter, metrics.Data)
+	gauge := registry.MustNewMetric("vus", metrics.Gauge)
+	timeGauge := registry.MustNewMetric("gauge_time", metrics.Gauge, metrics.Time)
+	rate := registry.MustNewMetric("checks", metrics.Rate)
+	trend := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+
+	histogram := &prompb.TimeSeries{Histograms: []*prompb.Histogram{{}}}
+	tests := []struct {
+		name   string
+		metric *metrics.Metric
+		sink   metrics.Sink
+		ts     *prompb.TimeSeries
+		exp    *prompb.MetricMetadata
+	}{
+		{
+			name: "k6_data_sent_total", metric: counter, sink: &metrics.CounterSink{},
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_COUNTER, Unit: "bytes"},
+		},
+		{
+			name: "k6_vus", metric: gauge, sink: &metrics.GaugeSink{},
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_GAUGE},
+		},
+		{
+			// the milliseconds are not advertised as unit
+			name: "k6_gauge_time", metric: timeGauge, sink: &metrics.GaugeSink{},
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_GAUGE},
+		},
+		{
+			name: "k6_checks_rate", metric: rate, sink: &metrics.RateSink{},
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_GAUGE},
+		},
+		{
+			name: "k6_checks_passes_total", metric: rate, sink: &rateCountersSink{},
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_COUNTER},
+		},
+		{
+			name: "k6_checks_rate", metric: rate, sink: &rateCountersSink{gauge: true},
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_GAUGE},
+		},
+		{
+			name: "k6_http_req_duration_p99", metric: trend, sink: &extendedTrendSink{},
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_GAUGE, Unit: "seconds"},
+		},
+		{
+			name: "k6_http_req_duration_count", metric: trend, sink: &extendedTrendSink{},
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_GAUGE},
+		},
+		{
+			name: "k6_http_req_duration_seconds", metric: trend, sink: &nativeHistogramSink{}, ts: histogram,
+			exp: &prompb.MetricMetadata{Type: prompb.MetricMetadata_HISTOGRAM, Unit: "seconds"},
+		},
+		{
+			name: "k6_http_req_duration_seconds_bucket", metric: trend, sink: &classicHistogramSink{},
+			exp: &prompb.MetricMetadata{
+				Type: prompb.MetricMetadata_HISTOGRAM, MetricFamilyName: "k6_http_req_duration_seconds", Unit: "seconds",
+			},
+		},
+	}
+	for _, tt := range tests {
+		ts := tt.ts
+		if ts == nil {
+			ts = &prompb.TimeSeries{}
+		}
+		if tt.exp.MetricFamilyName == "" {
+			tt.exp.MetricFamilyName = tt.name
+		}
+		assert.Equal(t, tt.exp, seriesMetadata(tt.name, tt.metric, tt.sink, ts), tt.name)
+	}
+}
+
+func TestMetadataTracker(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	custom := registry.MustNewMetric("custom_trend", metrics.Trend, metrics.Time)
+
+	tracker := newMetadataTracker(Config{
+		MetadataSendInterval: types.NullDurationFrom(time.Minute),
+		MetricHelp:           map[string]string{"custom_trend": "A custom trend."},
+	})
+	require.NotNil(t, tracker)
+
+	t0 := time.Unix(1000, 0)
+	tracker.observe(duration, &classicHistogramSink{}, []*prompb.TimeSeries{
+		buildTimeSeries("k6_http_req_duration_seconds_bucket", 1, t0),
+		buildTimeSeries("k6_http_req_duration_seconds_sum", 1, t0),
+		buildTimeSeries("k6_http_req_duration_seconds_count", 1, t0),
+	})
+	assert.True(t, tracker.updated)
+
+	// the first time all the metrics are due
+	md := tracker.due(t0)
+	require.Len(t, md, 1)
+	assert.Equal(t, "k6_http_req_duration_seconds", md[0].MetricFamilyName)
+	assert.Equal(t, coreMetricsHelp["http_req_duration"], md[0].Help)
+
+	// the same families are not due again before the interval
+	tracker.observe(duration, &classicHistogramSink{}, []*prompb.TimeSeries{
+		buildTimeSeries("k6_http_req_duration_seconds_bucket", 1, t0),
+	})
+	assert.Empty(t, tracker.due(t0.Add(time.Second)))
+
+	// the new families are due
+	tracker.observe(custom, &extendedTrendSink{}, []*prompb.TimeSeries{
+		buildTimeSeries("k6_custom_trend_p99", 1, t0),
+	})
+	md = tracker.due(t0.Add(2 * time.Second))
+	require.Len(t, md, 1)
+	assert.Equal(t, "A custom trend.", md[0].Help)
+
+	// all the metrics are due after the interval
+	assert.Len(t, tracker.due(t0.Add(time.Minute)), 2)
+
+	series := tracker.seriesMetadata()
+	assert.Len(t, series, 4)
+	assert.Equal(t, "k6_http_req_duration_seconds", series["k6_http_req_duration_seconds_sum"].MetricFamilyName)
+	assert.False(t, tracker.updated)
+}
+
+func TestNewMetadataTrackerDisabled(t *testing.T) {
+	t.Parallel()
+
+	// it is opt-in
+	assert.Nil(t, newMetadataTracker(Config{}))
+	assert.Nil(t, newMetadataTracker(Config{MetadataSendInterval: types.NullDurationFrom(0)}))
+	assert.NotNil(t, newMetadataTracker(Config{MetadataSendInterval: types.NullDurationFrom(time.Minute)}))
+}
+
+func TestOutputSendMetadata(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		requests int
+		received []*prompb.WriteRequest
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		b, err = snappy.Decode(nil, b)
+		require.NoError(t, err)
+		var wr prompb.WriteRequest
+		require.NoError(t, proto.Unmarshal(b, &wr))
+
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			// the first request fails with a recoverable error
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, &wr)
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	wc, err := remote.NewWriteClient(ts.URL, nil)
+	require.NoError(t, err)
+
+	registry := metrics.NewRegistry()
+	iterations := registry.MustNewMetric("iterations", metrics.Counter)
+	t0 := time.Unix(1000, 0)
+	o := Output{
+		client:         wc,
+		logger:         logrus.New(),
+		now:            func() time.Time { return t0 },
+		metadata:       newMetadataTracker(Config{MetadataSendInterval: types.NullDurationFrom(time.Minute)}),
+		metadataSender: newMetadataSender(wc, logrus.New()),
+	}
+	o.metadata.observe(iterations, &metrics.CounterSink{}, []*prompb.TimeSeries{
+		buildTimeSeries("k6_iterations_total", 1, t0),
+	})
+	// it doesn't wait for the metadata to be sent
+	o.sendMetadata()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		failed := requests == 1
+		mu.Unlock()
+
+		o.metadataSender.mu.Lock()
+		defer o.metadataSender.mu.Unlock()
+		// the failed metadata is pending again
+		return failed && len(o.metadataSender.pending) == 1
+	}, time.Second, time.Millisecond)
+
+	// nothing is due, the failed metadata is retried
+	o.sendMetadata()
+	o.metadataSender.stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 1)
+	assert.Empty(t, received[0].Timeseries)
+	require.Len(t, received[0].Metadata, 1)
+	assert.Equal(t, "k6_iterations_total", received[0].Metadata[0].MetricFamilyName)
+	assert.Equal(t, prompb.MetricMetadata_COUNTER, received[0].Metadata[0].Type)
+	assert.Equal(t, coreMetricsHelp["iterations"], received[0].Metadata[0].Help)
+}
+
+func TestMergeMetadata(t *testing.T) {
+	t.Parallel()
+
+	older := []*prompb.MetricMetadata{
+		{MetricFamilyName: "k6_a", Help: "old"},
+		{MetricFamilyName: "k6_b"},
+	}
+	newer := []*prompb.MetricMetadata{
+		{MetricFamilyName: "k6_c"},
+		{MetricFamilyName: "k6_a", Help: "new"},
+	}
+	assert.Equal(t, []*prompb.MetricMetadata{
+		{MetricFamilyName: "k6_a", Help: "new"},
+		{MetricFamilyName: "k6_b"},
+		{MetricFamilyName: "k6_c"},
+	}, mergeMetadata(older, newer))
+	assert.Equal(t, newer, mergeMetadata(nil, newer))
+}
@@ -0,0 +1,96 @@
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// customBucketsSchema is the schema of the native histograms
+	// with custom buckets (NHCB).
+	customBucketsSchema = -53
+
+	// histogramCustomValues is the field number of the custom_values
+	// of the Histogram message. The field isn't available
+	// from the generated code of the Prometheus' buf module currently in use,
+	// so it is encoded directly on the wire format as an unknown field.
+	histogramCustomValues protowire.Number = 16
+)
+
+// customBucketsHistogramToHistogramProto maps the histogram's classic buckets
+// to a native histogram with custom buckets. The custom values are the buckets'
+// upper bounds without +Inf, the bucket at index i counts the values
+// between the upper bounds at index i-1 and i, and the last one is +Inf.
+func customBucketsHistogramToHistogramProto(timestamp int64, h prometheus.Histogram) *prompb.Histogram {
+	metric := &dto.Metric{}
+	if err := h.Write(metric); err != nil {
+		panic(fmt.Errorf("failed to convert Native Histogram to the related Protobuf: %w", err))
+	}
+	hmetric := metric.Histogram
+
+	// the cumulative counts are converted to the counts per bucket,
+	// the +Inf bucket is implicit in the classic buckets
+	bounds := make([]float64, 0, len(hmetric.Bucket))
+	counts := make([]uint64, 0, len(hmetric.Bucket)+1)
+	var prev uint64
+	for _, b := range hmetric.Bucket {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		bounds = append(bounds, b.GetUpperBound())
+		counts = append(counts, b.GetCumulativeCount()-prev)
+		prev = b.GetCumulativeCount()
+	}
+	counts = append(counts, hmetric.GetSampleCount()-prev)
+
+	spans, deltas := bucketsToSpans(counts)
+	ph := &prompb.Histogram{
+		Count:          &prompb.Histogram_CountInt{CountInt: hmetric.GetSampleCount()},
+		Sum:            hmetric.GetSampleSum(),
+		Schema:         customBucketsSchema,
+		PositiveSpans:  spans,
+		PositiveDeltas: deltas,
+		Timestamp:      timestamp,
+	}
+
+	var customValues []byte
+	customValues = protowire.AppendTag(customValues, histogramCustomValues, protowire.BytesType)
+	packed := make([]byte, 0, 8*len(bounds))
+	for _, b := range bounds {
+		packed = protowire.AppendFixed64(packed, math.Float64bits(b))
+	}
+	customValues = protowire.AppendBytes(customValues, packed)
+	ph.ProtoReflect().SetUnknown(customValues)
+	return ph
+}
+
+// bucketsToSpans encodes the counts per bucket as the spans of the non-empty buckets
+// and the deltas between the counts of the consecutive non-empty buckets.
+func bucketsToSpans(counts []uint64) ([]*prompb.BucketSpan, []int64) {
+	var (
+		spans  []*prompb.BucketSpan
+		deltas []int64
+		prev   int64
+		// gap is the number of empty buckets since the last span
+		gap uint32
+	)
+	for _, c := range counts {
+		if c == 0 {
+			gap++
+			continue
+		}
+		if len(spans) == 0 || gap > 0 {
+			spans = append(spans, &prompb.BucketSpan{Offset: int32(gap)}) //nolint:gosec
+			gap = 0
+		}
+		spans[len(spans)-1].Length++
+		deltas = append(deltas, int64(c)-prev) //nolint:gosec
+		prev = int64(c)                        //nolint:gosec
+	}
+	return spans, deltas
+}
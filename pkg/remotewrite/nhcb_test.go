@@ -0,0 +1,157 @@
+package remotewrite
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestBucketsToSpans(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		counts    []uint64
+		expSpans  []*prompb.BucketSpan
+		expDeltas []int64
+	}{
+		"Empty":  {counts: []uint64{0, 0, 0}},
+		"Single": {counts: []uint64{3}, expSpans: []*prompb.BucketSpan{{Offset: 0, Length: 1}}, expDeltas: []int64{3}},
+		"Contiguous": {
+			counts:    []uint64{1, 4, 2},
+			expSpans:  []*prompb.BucketSpan{{Offset: 0, Length: 3}},
+			expDeltas: []int64{1, 3, -2},
+		},
+		"Gaps": {
+			counts:    []uint64{0, 2, 0, 0, 1, 1},
+			expSpans:  []*prompb.BucketSpan{{Offset: 1, Length: 1}, {Offset: 2, Length: 2}},
+			expDeltas: []int64{2, -1, 0},
+		},
+	}
+	for name, tt := range tests {
+		spans, deltas := bucketsToSpans(tt.counts)
+		assert.Equal(t, tt.expSpans, spans, name)
+		assert.Equal(t, tt.expDeltas, deltas, name)
+	}
+}
+
+func TestNativeHistogramSinkCustomBuckets(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time),
+		Tags:   registry.RootTagSet(),
+	}
+
+	sink := newNativeHistogramSink(series.Metric, nativeHistogramOptions{
+		CustomBuckets: []float64{0.1, 0.5, 1},
+	})
+	for _, v := range []float64{50, 60, 2000} {
+		sink.Add(metrics.Sample{TimeSeries: series, Value: v})
+	}
+
+	now := time.Unix(1, 0)
+	pbseries := sink.MapPrompb(series, MapSeries(series, ""), now)
+	require.Len(t, pbseries, 1)
+	assert.Equal(t, "k6_http_req_duration_seconds", pbseries[0].Labels[0].Value)
+	require.Len(t, pbseries[0].Histograms, 1)
+
+	h := pbseries[0].Histograms[0]
+	assert.Equal(t, int32(-53), h.Schema)
+	assert.Equal(t, uint64(3), h.GetCountInt())
+	assert.InDelta(t, 2.11, h.Sum, 1e-9)
+	assert.Equal(t, now.UnixMilli(), h.Timestamp)
+	// two values in the first bucket and one in +Inf
+	assert.Equal(t, []*prompb.BucketSpan{{Offset: 0, Length: 1}, {Offset: 2, Length: 1}}, h.PositiveSpans)
+	assert.Equal(t, []int64{2, -1}, h.PositiveDeltas)
+
+	// the custom values are preserved on the wire
+	b, err := proto.Marshal(h)
+	require.NoError(t, err)
+	var decoded prompb.Histogram
+	require.NoError(t, proto.Unmarshal(b, &decoded))
+	assert.Equal(t, []float64{0.1, 0.5, 1}, customValues(t, &decoded))
+}
+
+// customValues decodes the custom values from the histogram's unknown fields.
+func customValues(t *testing.T, h *prompb.Histogram) []float64 {
+	t.Helper()
+
+	var values []float64
+	b := h.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		if num != histogramCustomValues || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			require.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+			continue
+		}
+		packed, n := protowire.ConsumeBytes(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		for len(packed) > 0 {
+			v, n := protowire.ConsumeFixed64(packed)
+			require.GreaterOrEqual(t, n, 0)
+			packed = packed[n:]
+			values = append(values, math.Float64frombits(v))
+		}
+	}
+	return values
+}
+
+func TestNativeHistogramSinkOptions(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time),
+		Tags:   registry.RootTagSet(),
+	}
+
+	schema := func(opts nativeHistogramOptions) int32 {
+		sink := newNativeHistogramSink(series.Metric, opts)
+		sink.Add(metrics.Sample{TimeSeries: series, Value: 100})
+		return histogramToHistogramProto(0, sink.H).Schema
+	}
+	// the default factor 1.1 has schema 3, the factor 2 has schema 0
+	assert.Equal(t, int32(3), schema(nativeHistogramOptions{}))
+	assert.Equal(t, int32(0), schema(nativeHistogramOptions{BucketFactor: 2}))
+
+	sink := newNativeHistogramSink(series.Metric, nativeHistogramOptions{ZeroThreshold: 0.01})
+	sink.Add(metrics.Sample{TimeSeries: series, Value: 5})
+	h := histogramToHistogramProto(0, sink.H)
+	assert.Equal(t, 0.01, h.ZeroThreshold)
+	assert.Equal(t, uint64(1), h.GetZeroCountInt())
+}
+
+func TestOutputNativeHistogramOptions(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	counter := registry.MustNewMetric("iterations", metrics.Counter)
+
+	o := Output{}
+	assert.Nil(t, o.nativeHistogramOptions(duration))
+
+	o.config.TrendAsNativeHistogram = null.BoolFrom(true)
+	o.config.NativeHistogramBucketFactor = null.FloatFrom(1.05)
+	o.config.NativeHistogramMaxBucketNumber = null.IntFrom(160)
+	assert.Nil(t, o.nativeHistogramOptions(counter))
+	assert.Equal(t, &nativeHistogramOptions{BucketFactor: 1.05, MaxBucketNumber: 160}, o.nativeHistogramOptions(duration))
+
+	o.config.NativeHistogramCustomBuckets = null.BoolFrom(true)
+	o.config.MetricHistogramBuckets = map[string][]float64{"http_req_duration": {0.1, 1}}
+	assert.Equal(t, &nativeHistogramOptions{CustomBuckets: []float64{0.1, 1}}, o.nativeHistogramOptions(duration))
+}
@@ -41,12 +41,80 @@ func MapSeries(series metrics.TimeSeries, suffix string) []*prompb.Label {
 	if suffix != "" {
 		v += "_" + suffix
 	}
-	lbls := append(MapTagSet(series.Tags), &prompb.Label{
+	return withName(MapTagSet(series.Tags), v)
+}
+
+// withName adds the __name__ label with the provided name
+// to the labels and it sorts them.
+func withName(labels []*prompb.Label, name string) []*prompb.Label {
+	lbls := append(labels, &prompb.Label{
 		Name:  namelbl,
-		Value: v,
+		Value: name,
 	})
 	sort.Slice(lbls, func(i int, j int) bool {
 		return lbls[i].Name < lbls[j].Name
 	})
 	return lbls
 }
+
+// withExternalLabels adds the external labels missing from the labels
+// and it sorts them. The labels take precedence over the external labels.
+func withExternalLabels(labels []*prompb.Label, external map[string]string) []*prompb.Label {
+	if len(external) < 1 {
+		return labels
+	}
+	defined := make(map[string]struct{}, len(labels))
+	for _, l := range labels {
+		defined[l.Name] = struct{}{}
+	}
+	for name, value := range external {
+		if _, ok := defined[name]; ok {
+			continue
+		}
+		labels = append(labels, &prompb.Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// withNameSuffix returns a copy of the labels
+// with the suffix appended to the __name__ label's value.
+func withNameSuffix(labels []*prompb.Label, suffix string) []*prompb.Label {
+	lbls := make([]*prompb.Label, len(labels))
+	for i, l := range labels {
+		lbls[i] = &prompb.Label{Name: l.Name, Value: l.Value}
+		if suffix != "" && l.Name == namelbl {
+			lbls[i].Value += "_" + suffix
+		}
+	}
+	return lbls
+}
+
+// withLabel returns a sorted copy of the labels with the label,
+// it replaces the label if it is already defined.
+func withLabel(labels []*prompb.Label, name, value string) []*prompb.Label {
+	lbls := make([]*prompb.Label, 0, len(labels)+1)
+	for _, l := range labels {
+		if l.Name == name {
+			continue
+		}
+		lbls = append(lbls, &prompb.Label{Name: l.Name, Value: l.Value})
+	}
+	lbls = append(lbls, &prompb.Label{Name: name, Value: value})
+	sort.Slice(lbls, func(i, j int) bool {
+		return lbls[i].Name < lbls[j].Name
+	})
+	return lbls
+}
+
+// hasName returns true if the labels contain the __name__ label.
+func hasName(labels []*prompb.Label) bool {
+	for _, l := range labels {
+		if l.Name == namelbl {
+			return true
+		}
+	}
+	return false
+}
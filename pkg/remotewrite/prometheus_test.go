@@ -11,8 +11,6 @@ import (
 	"go.k6.io/k6/metrics"
 )
 
-// TODO: test MapSeries with suffix
-
 func TestMapSeries(t *testing.T) {
 	t.Parallel()
 
@@ -43,6 +41,28 @@ func TestMapSeries(t *testing.T) {
 	assert.Equal(t, exp, lbls)
 }
 
+func TestMapSeriesWithSuffix(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: &metrics.Metric{
+			Name: "test",
+			Type: metrics.Counter,
+		},
+		Tags: r.RootTagSet().With("a", "v1"),
+	}
+
+	base := MapSeries(series, "")
+	lbls := withNameSuffix(base, "total")
+	assert.Equal(t, MapSeries(series, "total"), lbls)
+
+	// the base labels are not changed
+	assert.Equal(t, "k6_test", base[0].Value)
+	assert.True(t, hasName(lbls))
+	assert.False(t, hasName(lbls[1:]))
+}
+
 // buildTimeSeries creates a TimSeries with the given name, value and timestamp
 func buildTimeSeries(name string, value float64, timestamp time.Time) *prompb.TimeSeries { //nolint:unparam
 	return &prompb.TimeSeries{
@@ -0,0 +1,55 @@
+package remotewrite
+
+import (
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"go.k6.io/k6/metrics"
+)
+
+// rateMapping defines how the Rate metrics are mapped.
+type rateMapping struct {
+	// Counters maps them to the counters of the true values
+	// and of all the values, instead of the rate's gauge.
+	Counters bool
+
+	// Gauge maps them also to the rate's gauge, when they are mapped to counters.
+	Gauge bool
+}
+
+// rateCountersSink maps the Rate to the counters of the true values
+// and of all the values, so the ratio can be computed exactly
+// over any time range and across the time series.
+type rateCountersSink struct {
+	metrics.RateSink
+
+	// gauge is true if the rate's gauge is mapped too.
+	gauge bool
+}
+
+// MapPrompb maps the Rate to the passes and total counters,
+// and optionally to the rate's gauge.
+func (sink *rateCountersSink) MapPrompb(
+	_ metrics.TimeSeries, labels []*prompb.Label, t time.Time,
+) []*prompb.TimeSeries {
+	timestamp := t.UnixMilli()
+	series := []*prompb.TimeSeries{
+		{
+			Labels:  withNameSuffix(labels, "passes_total"),
+			Samples: []*prompb.Sample{{Value: float64(sink.Trues), Timestamp: timestamp}},
+		},
+		{
+			Labels:  withNameSuffix(labels, "total"),
+			Samples: []*prompb.Sample{{Value: float64(sink.Total), Timestamp: timestamp}},
+		},
+	}
+	if sink.gauge {
+		// pass zero duration here because time is useless for formatting rate
+		rate := sink.Format(time.Duration(0))["rate"]
+		series = append(series, &prompb.TimeSeries{
+			Labels:  withNameSuffix(labels, "rate"),
+			Samples: []*prompb.Sample{{Value: rate, Timestamp: timestamp}},
+		})
+	}
+	return series
+}
@@ -0,0 +1,88 @@
+package remotewrite
+
+import (
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestRateCountersSinkMapPrompb(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: registry.MustNewMetric("checks", metrics.Rate),
+		Tags:   registry.RootTagSet(),
+	}
+	now := time.Unix(1, 0)
+
+	tests := map[string]struct {
+		gauge bool
+		exp   map[string]float64
+	}{
+		"Counters": {
+			exp: map[string]float64{"k6_checks_passes_total": 3, "k6_checks_total": 4},
+		},
+		"WithGauge": {
+			gauge: true,
+			exp:   map[string]float64{"k6_checks_passes_total": 3, "k6_checks_total": 4, "k6_checks_rate": 0.75},
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			sink := &rateCountersSink{gauge: tt.gauge}
+			for _, v := range []float64{1, 1, 0, 1} {
+				sink.Add(metrics.Sample{TimeSeries: series, Value: v})
+			}
+			pbseries := sink.MapPrompb(series, MapSeries(series, ""), now)
+
+			values := make(map[string]float64, len(pbseries))
+			for _, ts := range pbseries {
+				require.Len(t, ts.Samples, 1)
+				assert.Equal(t, now.UnixMilli(), ts.Samples[0].Timestamp)
+				values[seriesName(ts)] = ts.Samples[0].Value
+			}
+			assert.Equal(t, tt.exp, values)
+		})
+	}
+}
+
+func TestOutputConvertToPbSeriesRateAsCounters(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	rate := registry.MustNewMetric("http_req_failed", metrics.Rate)
+	tags := registry.RootTagSet()
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	o := Output{
+		config: Config{RateAsCounters: null.BoolFrom(true)},
+		tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+	}
+
+	sample := func(t time.Time, v float64) metrics.SampleContainer {
+		return metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: rate, Tags: tags}, Time: t, Value: v}
+	}
+	pbseries := o.convertToPbSeries([]metrics.SampleContainer{sample(t0, 1), sample(t0, 0)})
+	require.Len(t, pbseries, 2)
+	sortByNameLabel(pbseries)
+	assert.Equal(t, []*prompb.Label{{Name: namelbl, Value: "k6_http_req_failed_passes_total"}}, pbseries[0].Labels)
+	assert.Equal(t, 1.0, pbseries[0].Samples[0].Value)
+	assert.Equal(t, []*prompb.Label{{Name: namelbl, Value: "k6_http_req_failed_total"}}, pbseries[1].Labels)
+	assert.Equal(t, 2.0, pbseries[1].Samples[0].Value)
+
+	// the counters are monotonic across the flushes
+	pbseries = o.convertToPbSeries([]metrics.SampleContainer{sample(t0.Add(time.Second), 0)})
+	require.Len(t, pbseries, 2)
+	sortByNameLabel(pbseries)
+	assert.Equal(t, 1.0, pbseries[0].Samples[0].Value)
+	assert.Equal(t, 3.0, pbseries[1].Samples[0].Value)
+}
@@ -3,21 +3,30 @@ package remotewrite
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/relabel"
 	"github.com/grafana/xk6-output-prometheus-remote/pkg/remote"
 	"github.com/grafana/xk6-output-prometheus-remote/pkg/stale"
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/wal"
 
 	"go.k6.io/k6/metrics"
 	"go.k6.io/k6/output"
 
 	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
 )
 
-var _ output.Output = new(Output)
+var (
+	_ output.Output                = new(Output)
+	_ output.WithThresholds        = new(Output)
+	_ output.WithStopWithTestError = new(Output)
+)
 
 // Output is a k6 output that sends metrics to a Prometheus remote write endpoint.
 type Output struct {
@@ -30,8 +39,95 @@ type Output struct {
 	tsdb               map[metrics.TimeSeries]*seriesWithMeasure
 	trendStatsResolver map[string]func(*metrics.TrendSink) float64
 
+	// sketchStatsResolver is the resolver for the Trend stats
+	// computed from a sketch, if it is enabled.
+	sketchStatsResolver sketchStatsResolver
+
+	// trendStatsRules are the Trend stats by metric,
+	// they take precedence over the global resolvers.
+	trendStatsRules []trendStatsRule
+
+	// relabel are the optional relabeling rules for the time series.
+	relabel *relabel.Rules
+
+	// filter filters the time series by the include and exclude rules.
+	filter *seriesFilter
+
+	// relabelDropped caches the time series dropped from the relabeling rules.
+	relabelDropped map[metrics.TimeSeries]struct{}
+
+	// names sanitizes the metrics' and tags' names.
+	names nameSanitizer
+
+	// limiter is the optional limiter of the active time series.
+	limiter *seriesLimiter
+
+	// thresholds are the copies of the test's thresholds by metric's name,
+	// their results are pushed as time series.
+	thresholds map[string][]*thresholdsSink
+
+	// thresholdsOrder are the thresholds sorted by the configured name.
+	thresholdsOrder []*thresholdsSink
+
+	// startTime is when the output has been started,
+	// the thresholds on the counters' rate are evaluated since then.
+	startTime time.Time
+
 	// TODO: copy the prometheus/remote.WriteClient interface and depend on it
 	client *remote.WriteClient
+
+	// queue sends the time series to the endpoint
+	// decoupled from the periodic flusher.
+	queue *remote.QueueManager
+
+	// exemplars samples the exemplars of the Trend's time series,
+	// it is nil if they are disabled.
+	exemplars *exemplarSampler
+
+	// metadata tracks the metadata of the sent time series,
+	// it is nil if sending the metadata is disabled.
+	metadata *metadataTracker
+
+	// metadataSender sends the metadata with Remote Write 1.0,
+	// it is nil if sending the metadata is disabled.
+	metadataSender *metadataSender
+
+	// staleness tracks the idle time series for marking them as stale
+	// and releasing them, it is nil if the stale series TTL is not set.
+	staleness *stale.Tracker[metrics.TimeSeries]
+
+	// pendingCreated are the created timestamps of the converted time series
+	// for Remote Write 2.0, they are sent with the next append.
+	pendingCreated map[*prompb.TimeSeries]int64
+
+	// queueDropped is the latest number of dropped time series
+	// reported from the queue.
+	queueDropped int64
+
+	// wal is the optional on-disk queue for the time series
+	// that failed to be sent.
+	wal *wal.WAL
+
+	// walMu guards the appends to the on-disk queue with the held time series,
+	// because the time series are stored concurrently from the queue's shards.
+	walMu sync.Mutex
+
+	// walDropped is the latest number of dropped segments
+	// reported from the on-disk queue.
+	walDropped int
+
+	// walHeld are the keys of the time series pending on the on-disk queue,
+	// their new samples are held back on it until it is drained,
+	// so they are sent in order.
+	walHeld map[string]struct{}
+
+	// walHoldAll is true if the on-disk queue has time series
+	// from a previous run, all the time series are held back until it is drained.
+	walHoldAll bool
+
+	// walReplay wakes up the goroutine replaying the on-disk queue.
+	walReplay     chan struct{}
+	walReplayDone chan struct{}
 }
 
 // New creates a new Output instance.
@@ -43,11 +139,36 @@ func New(params output.Params) (*Output, error) {
 		return nil, err
 	}
 
+	if err := config.validateMetricNames(); err != nil {
+		return nil, err
+	}
+	if err := config.validateExternalLabels(); err != nil {
+		return nil, err
+	}
+	if err := config.validateHistogram(); err != nil {
+		return nil, err
+	}
+	if err := config.validateTrendStatsSketch(); err != nil {
+		return nil, err
+	}
+	if err := config.validateTrendStatsWindow(); err != nil {
+		return nil, err
+	}
+	if err := config.validateStaleSeriesTTL(); err != nil {
+		return nil, err
+	}
+
 	clientConfig, err := config.RemoteConfig()
 	if err != nil {
 		return nil, err
 	}
 
+	// it validates the queue's options, so the failure
+	// is reported as soon as possible
+	if _, err := config.QueueConfig(); err != nil {
+		return nil, err
+	}
+
 	wc, err := remote.NewWriteClient(config.ServerURL.String, clientConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize the Prometheus remote write client: %w", err)
@@ -62,23 +183,104 @@ func New(params output.Params) (*Output, error) {
 		now:    time.Now,
 		logger: logger,
 		tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+		names:  nameSanitizer{utf8: config.UTF8Names.Bool},
+	}
+
+	// the identity labels are added as external labels,
+	// so the k6 tags with the same name take precedence
+	identity, err := identityLabels(config, o.now())
+	if err != nil {
+		return nil, err
+	}
+	if len(identity) > 0 {
+		externalLabels := make(map[string]string, len(config.ExternalLabels)+len(identity))
+		for k, v := range config.ExternalLabels {
+			externalLabels[k] = v
+		}
+		for k, v := range identity {
+			externalLabels[k] = v
+		}
+		o.config.ExternalLabels = externalLabels
 	}
 
 	if len(config.TrendStats) > 0 {
 		if err := o.setTrendStatsResolver(config.TrendStats); err != nil {
 			return nil, err
 		}
+		if config.TrendStatsSketch.Bool {
+			if o.sketchStatsResolver, err = newSketchStatsResolver(config.TrendStats); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(config.MetricTrendStats) > 0 {
+		if o.trendStatsRules, err = newTrendStatsRules(config.MetricTrendStats, config.TrendStatsSketch.Bool); err != nil {
+			return nil, err
+		}
+	}
+
+	o.metadata = newMetadataTracker(config)
+
+	if config.StaleSeriesTTL.Duration > 0 {
+		o.staleness = stale.NewTracker[metrics.TimeSeries](config.StaleSeriesTTL.TimeDuration())
+	}
+
+	o.exemplars, err = newExemplarSampler(config)
+	if err != nil {
+		return nil, err
+	}
+
+	o.filter, err = newSeriesFilter(config.IncludeMetrics, config.ExcludeMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.RelabelConfigs) > 0 {
+		o.relabel, err = relabel.New(config.RelabelConfigs)
+		if err != nil {
+			return nil, err
+		}
+		o.relabelDropped = make(map[metrics.TimeSeries]struct{})
+	}
+
+	o.limiter, err = newSeriesLimiter(config)
+	if err != nil {
+		return nil, err
 	}
 	return o, nil
 }
 
 // Description returns a short human-readable description of the output.
 func (o *Output) Description() string {
+	if runID, ok := o.config.ExternalLabels[runIDLabel]; ok && o.config.RunID.Valid {
+		return fmt.Sprintf("Prometheus remote write (%s, run ID: %s)", o.config.ServerURL.String, runID)
+	}
 	return fmt.Sprintf("Prometheus remote write (%s)", o.config.ServerURL.String)
 }
 
 // Start initializes the output.
 func (o *Output) Start() error {
+	o.startTime = o.now()
+	if o.config.WALDir.Valid && o.config.WALDir.String != "" {
+		if err := o.openWAL(); err != nil {
+			return err
+		}
+	}
+
+	queueConfig, err := o.config.QueueConfig()
+	if err != nil {
+		return err
+	}
+	o.queue = remote.NewQueueManager(o.client, queueConfig, o.handleStoreFailure)
+	if o.wal != nil {
+		o.queue.SetDivert(o.holdBack)
+		o.startWALReplay()
+	}
+	o.queue.Start()
+	if o.metadata != nil && !o.config.protocolV2() {
+		o.metadataSender = newMetadataSender(o.client, o.logger)
+	}
+
 	d := o.config.PushInterval.TimeDuration()
 	periodicFlusher, err := output.NewPeriodicFlusher(d, o.flush)
 	if err != nil {
@@ -86,19 +288,82 @@ func (o *Output) Start() error {
 	}
 	o.periodicFlusher = periodicFlusher
 	o.logger.WithField("flushtime", d).Debug("Output initialized")
+
+	if o.config.RunID.String != "" || o.config.Instance.String != "" {
+		o.logger.WithFields(logrus.Fields{
+			runIDLabel:    o.config.ExternalLabels[runIDLabel],
+			instanceLabel: o.config.ExternalLabels[instanceLabel],
+		}).Info("The time series are labeled with the test run's identity")
+	}
 	return nil
 }
 
 // Stop stops the output.
 func (o *Output) Stop() error {
+	return o.StopWithTestError(nil)
+}
+
+// StopWithTestError stops the output. The error the test run
+// finished with defines the final run status, nil means a finished test run.
+func (o *Output) StopWithTestError(testErr error) error {
 	o.logger.Debug("Stopping the output")
 	defer o.logger.Debug("Output stopped")
+	defer func() {
+		if err := o.client.Close(); err != nil {
+			o.logger.WithError(err).Error("Failed to close the remote write client")
+		}
+	}()
 	o.periodicFlusher.Stop()
+	if o.metadataSender != nil {
+		o.metadataSender.stop()
+	}
+	if o.wal != nil {
+		o.stopWALReplay()
+	}
+
+	// it waits for the queued time series to be sent
+	o.queue.Stop()
+	stats := o.queue.Stats()
+	o.logger.WithFields(logrus.Fields{
+		"enqueued": stats.Enqueued,
+		"sent":     stats.Sent,
+		"failed":   stats.Failed,
+		"dropped":  stats.Dropped,
+	}).Debug("Sending queue stopped")
+
+	o.logCardinalityReport()
+
+	if o.wal != nil {
+		defer func() {
+			if err := o.wal.Close(); err != nil {
+				o.logger.WithError(err).Error("Failed to close the on-disk queue")
+			}
+		}()
+		// the last attempt, the time series still pending are sent from the next run
+		o.replayWAL()
+	}
+
+	// Add 1ms so the final status doesn't overlap with the one
+	// sent from the last flush. They aren't marked as stale
+	// so the final results remain queryable.
+	finalStatus := o.statusSeries(runStatusFromError(testErr),
+		o.now().Truncate(time.Millisecond).Add(1*time.Millisecond))
+	if o.wal != nil {
+		finalStatus = o.holdBack(finalStatus)
+	}
+	if len(finalStatus) > 0 {
+		if err := o.client.Store(context.Background(), finalStatus); err != nil {
+			o.handleStoreFailure(finalStatus, err)
+		}
+	}
 
 	if !o.config.StaleMarkers.Bool {
 		return nil
 	}
 	staleMarkers := o.staleMarkers()
+	if o.wal != nil {
+		staleMarkers = o.holdBack(staleMarkers)
+	}
 	if len(staleMarkers) < 1 {
 		o.logger.Debug("No time series to mark as stale")
 		return nil
@@ -114,36 +379,46 @@ func (o *Output) Stop() error {
 
 // staleMarkers maps all the seen time series with a stale marker.
 func (o *Output) staleMarkers() []*prompb.TimeSeries {
-	// Add 1ms so in the extreme case that the time frame
-	// between the last and the next flush operation is under-millisecond,
-	// we can avoid the sample being seen as a duplicate,
-	// if we force it in the future.
-	// It is essential because if it overlaps, the remote write discards the last sample,
-	// so the stale marker and the metric will remain active for the next 5 min
-	// as the default logic without stale markers.
-	timestamp := o.now().
-		Truncate(time.Millisecond).Add(1 * time.Millisecond).UnixMilli()
-
 	staleMarkers := make([]*prompb.TimeSeries, 0, len(o.tsdb))
 	for _, swm := range o.tsdb {
-		series := swm.MapPrompb()
 		// series' length is expected to be equal to 1 for most of the cases
 		// the unique exception where more than 1 is expected is when
 		// trend stats have been configured with multiple values.
-		for _, s := range series {
-			if len(s.Samples) < 1 {
-				if len(s.Histograms) < 1 {
-					panic("data integrity check: samples and native histograms" +
-						" can't be empty at the same time")
-				}
-				s.Samples = append(s.Samples, &prompb.Sample{})
-			}
+		series := swm.MapPrompb()
+		staleMarkers = append(staleMarkers, series...)
+		staleMarkers = append(staleMarkers, o.createdSeries(swm, series)...)
+	}
+	stale.Mark(staleMarkers, stale.Timestamp(o.now()))
+	return staleMarkers
+}
+
+// expireSeries removes the time series idle for longer than the TTL
+// from the tsdb and it maps them with a stale marker.
+func (o *Output) expireSeries(now time.Time) []*prompb.TimeSeries {
+	expired := o.staleness.Expire(now)
+	if len(expired) < 1 {
+		return nil
+	}
 
-			s.Samples[0].Value = stale.Marker
-			s.Samples[0].Timestamp = timestamp
+	var staleMarkers []*prompb.TimeSeries
+	for _, series := range expired {
+		swm, ok := o.tsdb[series]
+		if !ok {
+			continue
+		}
+		pbseries := swm.MapPrompb()
+		staleMarkers = append(staleMarkers, pbseries...)
+		staleMarkers = append(staleMarkers, o.createdSeries(swm, pbseries)...)
+		delete(o.tsdb, series)
+		if o.limiter != nil && !swm.Overflow {
+			o.limiter.release()
 		}
-		staleMarkers = append(staleMarkers, series...)
 	}
+	stale.Mark(staleMarkers, stale.Timestamp(now))
+	o.logger.WithFields(logrus.Fields{
+		"series":       len(expired),
+		"staleMarkers": len(staleMarkers),
+	}).Debug("Marked the idle time series as stale")
 	return staleMarkers
 }
 
@@ -151,6 +426,17 @@ func (o *Output) staleMarkers() []*prompb.TimeSeries {
 //
 // TODO: refactor, the code can be improved
 func (o *Output) setTrendStatsResolver(trendStats []string) error {
+	resolver, err := newTrendStatsResolver(trendStats)
+	if err != nil {
+		return err
+	}
+	o.trendStatsResolver = resolver
+	return nil
+}
+
+// newTrendStatsResolver creates the resolvers for the Trend stats,
+// the keys are normalized for the metric names.
+func newTrendStatsResolver(trendStats []string) (TrendStatsResolver, error) {
 	trendStatsCopy := make([]string, 0, len(trendStats))
 	hasSum := false
 	// copy excluding sum
@@ -163,7 +449,7 @@ func (o *Output) setTrendStatsResolver(trendStats []string) error {
 	}
 	resolvers, err := metrics.GetResolversForTrendColumns(trendStatsCopy)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// sum is not supported from GetResolversForTrendColumns
 	// so if it has been requested
@@ -173,22 +459,27 @@ func (o *Output) setTrendStatsResolver(trendStats []string) error {
 			return t.Total()
 		}
 	}
-	o.trendStatsResolver = make(TrendStatsResolver, len(resolvers))
+	resolver := make(TrendStatsResolver, len(resolvers))
 	for stat, fn := range resolvers {
-		statKey := stat
+		resolver[trendStatKey(stat)] = fn
+	}
+	return resolver, nil
+}
 
-		// the config passes percentiles with p(x) form, for example p(95),
-		// but the mapping generates series name in the form p95.
-		//
-		// TODO: maybe decoupling mapping from the stat resolver keys?
-		if strings.HasPrefix(statKey, "p(") {
-			statKey = stat[2 : len(statKey)-1]             // trim the parenthesis
-			statKey = strings.ReplaceAll(statKey, ".", "") // remove dots, p(0.95) => p095
-			statKey = "p" + statKey
-		}
-		o.trendStatsResolver[statKey] = fn
+// trendStatKey returns the suffix of the series' name for the Trend stat.
+func trendStatKey(stat string) string {
+	statKey := stat
+
+	// the config passes percentiles with p(x) form, for example p(95),
+	// but the mapping generates series name in the form p95.
+	//
+	// TODO: maybe decoupling mapping from the stat resolver keys?
+	if strings.HasPrefix(statKey, "p(") {
+		statKey = stat[2 : len(statKey)-1]             // trim the parenthesis
+		statKey = strings.ReplaceAll(statKey, ".", "") // remove dots, p(0.95) => p095
+		statKey = "p" + statKey
 	}
-	return nil
+	return statKey
 }
 
 func (o *Output) flush() {
@@ -199,9 +490,9 @@ func (o *Output) flush() {
 
 	defer func() {
 		d := time.Since(start)
-		okmsg := "Successful flushed time series to remote write endpoint"
+		okmsg := "Successful enqueued time series for the remote write endpoint"
 		if d > time.Duration(o.config.PushInterval.Duration) {
-			// There is no intermediary storage so warn if writing to remote write endpoint becomes too slow
+			// the queue is blocking so warn if it becomes too slow
 			o.logger.WithField("nts", nts).
 				Warnf("%s but it took %s while flush period is %s. Some samples may be dropped.",
 					okmsg, d.String(), o.config.PushInterval.String())
@@ -210,10 +501,11 @@ func (o *Output) flush() {
 		}
 	}()
 
+	now := o.now().Truncate(time.Millisecond)
+
 	samplesContainers := o.GetBufferedSamples()
 	if len(samplesContainers) < 1 {
-		o.logger.Debug("no buffered samples, skip the flushing operation")
-		return
+		o.logger.Debug("no buffered samples, only the run status will be flushed")
 	}
 
 	// Remote write endpoint accepts TimeSeries structure defined in gRPC. It must:
@@ -224,13 +516,222 @@ func (o *Output) flush() {
 	// Prometheus write handler processes only some fields as of now, so here we'll add only them.
 
 	promTimeSeries := o.convertToPbSeries(samplesContainers)
+	created := o.pendingCreated
+	o.pendingCreated = nil
 	nts = len(promTimeSeries)
 	o.logger.WithField("nts", nts).Debug("Converted samples to Prometheus TimeSeries")
 
-	if err := o.client.Store(context.Background(), promTimeSeries); err != nil {
-		o.logger.WithError(err).Error("Failed to send the time series data to the endpoint")
+	// the thresholds' results and the run status are pushed on every flush,
+	// the thresholds are evaluated including the converted samples
+	statusSeries := o.statusSeries(runStatusRunning, now)
+	if o.staleness != nil {
+		promTimeSeries = append(promTimeSeries, o.expireSeries(o.now())...)
+	}
+	promTimeSeries = append(promTimeSeries, statusSeries...)
+	if o.metadata != nil {
+		o.observeStatusMetadata(statusSeries)
+	}
+
+	// the time series pending on the on-disk queue are held back from the queue's shards
+	o.queue.AppendCreated(promTimeSeries, created)
+	if o.wal != nil {
+		o.signalWALReplay()
+	}
+	if o.metadata != nil {
+		o.sendMetadata()
+	}
+
+	stats := o.queue.Stats()
+	if stats.Dropped > o.queueDropped {
+		o.logger.WithField("dropped", stats.Dropped-o.queueDropped).
+			Warn("The sending queue is full, the oldest time series have been dropped. " +
+				"Consider to increase the queue capacity or the max shards.")
+		o.queueDropped = stats.Dropped
+	}
+	o.logger.WithFields(logrus.Fields{
+		"pending": stats.Pending,
+		"shards":  stats.Shards,
+	}).Debug("Sending queue state")
+}
+
+// handleStoreFailure handles the time series the queue failed to send.
+// They are stored in the on-disk queue, if it is enabled,
+// unless the endpoint rejected them. If the batch has been split
+// then only the time series of the requests that failed with a recoverable error are stored.
+// The Remote Write 2.0 created timestamps are not stored,
+// so the time series replayed from the on-disk queue are sent without them.
+//
+// The new samples of the stored time series are held back on the on-disk queue
+// until it is drained, so they aren't sent before the replayed ones.
+func (o *Output) handleStoreFailure(series []*prompb.TimeSeries, err error) {
+	o.logger.WithError(err).WithField("nts", len(series)).
+		Error("Failed to send the time series data to the endpoint")
+	if o.wal != nil && remote.IsRecoverable(err) {
+		var serr *remote.SplitError
+		if errors.As(err, &serr) {
+			// the requests rejected from the endpoint would fail forever
+			series = serr.Recoverable
+		}
+		o.appendWAL(series)
+	}
+}
+
+func (o *Output) openWAL() error {
+	opts := wal.Options{
+		MaxSize: defaultWALMaxSize,
+		MaxAge:  o.config.WALMaxAge.TimeDuration(),
+	}
+	if o.config.WALMaxSize.Valid {
+		opts.MaxSize = o.config.WALMaxSize.Int64
+	}
+	w, err := wal.Open(o.config.WALDir.String, opts)
+	if err != nil {
+		return fmt.Errorf("failed to open the on-disk queue: %w", err)
+	}
+	o.wal = w
+
+	o.walHeld = make(map[string]struct{})
+	if stats := w.Stats(); stats.Size > 0 {
+		o.walHoldAll = true
+		o.logger.WithField("bytes", stats.Size).
+			Info("Found time series in the on-disk queue from a previous run, they will be sent in order")
+	}
+	return nil
+}
+
+// startWALReplay starts the goroutine replaying the on-disk queue,
+// so the flush doesn't wait for a failing endpoint.
+func (o *Output) startWALReplay() {
+	o.walReplay = make(chan struct{}, 1)
+	o.walReplayDone = make(chan struct{})
+	go func() {
+		defer close(o.walReplayDone)
+		for range o.walReplay {
+			o.replayWAL()
+		}
+	}()
+}
+
+// signalWALReplay wakes up the goroutine replaying the on-disk queue,
+// it doesn't wait for the replay.
+func (o *Output) signalWALReplay() {
+	select {
+	case o.walReplay <- struct{}{}:
+	default:
+		// the replay has already been requested
+	}
+}
+
+// stopWALReplay waits for the requested replay to complete, then it stops the goroutine.
+func (o *Output) stopWALReplay() {
+	close(o.walReplay)
+	<-o.walReplayDone
+}
+
+// holdBack stores in the on-disk queue the time series with samples pending on it,
+// so their new samples are sent after the pending ones. It returns the other time series.
+// It is the divert callback of the queue, so it is invoked concurrently from the shards.
+func (o *Output) holdBack(series []*prompb.TimeSeries) []*prompb.TimeSeries {
+	o.walMu.Lock()
+	defer o.walMu.Unlock()
+	if !o.walHoldAll && len(o.walHeld) < 1 {
+		return series
+	}
+
+	var kept, held []*prompb.TimeSeries
+	for _, ts := range series {
+		if _, ok := o.walHeld[seriesKey(ts)]; ok || o.walHoldAll {
+			held = append(held, ts)
+			continue
+		}
+		kept = append(kept, ts)
+	}
+	if len(held) > 0 {
+		o.appendWALLocked(held)
+	}
+	return kept
+}
+
+// seriesKey returns the key identifying the time series by its labels.
+func seriesKey(ts *prompb.TimeSeries) string {
+	var b strings.Builder
+	for _, l := range ts.Labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// replayWAL sends the time series pending on the on-disk queue.
+// It returns false if the endpoint is still failing
+// and some time series are still pending.
+func (o *Output) replayWAL() bool {
+	result, err := o.wal.Replay(func(rec []byte) error {
+		var wr prompb.WriteRequest
+		if err := proto.Unmarshal(rec, &wr); err != nil {
+			o.logger.WithError(err).Error("Dropped an invalid record from the on-disk queue")
+			return nil
+		}
+		err := o.client.Store(context.Background(), wr.Timeseries)
+		if err != nil && !remote.IsRecoverable(err) {
+			// it would fail forever so drop it
+			o.logger.WithError(err).Error("Dropped time series from the on-disk queue rejected by the endpoint")
+			return nil
+		}
+		return err
+	})
+	if result.Corrupted > 0 {
+		o.logger.WithField("segments", result.Corrupted).
+			Warn("Detected corrupted data in the on-disk queue, the corrupted part has been dropped")
+	}
+	if result.Replayed > 0 {
+		o.logger.WithField("batches", result.Replayed).Debug("Sent time series from the on-disk queue")
+	}
+	if err != nil {
+		o.logger.WithError(err).Error("Failed to send the time series pending on the on-disk queue")
+		return false
+	}
+
+	o.walMu.Lock()
+	defer o.walMu.Unlock()
+	if !o.wal.Pending() {
+		// it is drained, the new samples can be sent directly
+		o.walHeld = make(map[string]struct{})
+		o.walHoldAll = false
+	}
+	return true
+}
+
+// appendWAL stores the time series in the on-disk queue.
+func (o *Output) appendWAL(series []*prompb.TimeSeries) {
+	o.walMu.Lock()
+	defer o.walMu.Unlock()
+	o.appendWALLocked(series)
+}
+
+// appendWALLocked stores the time series in the on-disk queue
+// and it holds them back until it is drained. The caller must hold walMu.
+func (o *Output) appendWALLocked(series []*prompb.TimeSeries) {
+	rec, err := proto.Marshal(&prompb.WriteRequest{Timeseries: series})
+	if err == nil {
+		err = o.wal.Append(rec)
+	}
+	if err != nil {
+		o.logger.WithError(err).Error("Failed to store the time series in the on-disk queue, they have been dropped")
 		return
 	}
+	o.logger.WithField("nts", len(series)).Debug("Stored the time series in the on-disk queue")
+	for _, ts := range series {
+		o.walHeld[seriesKey(ts)] = struct{}{}
+	}
+
+	if stats := o.wal.Stats(); stats.DroppedSegments > o.walDropped {
+		o.logger.WithField("segments", stats.DroppedSegments-o.walDropped).
+			Warn("The on-disk queue reached its retention limits, the oldest time series have been dropped")
+		o.walDropped = stats.DroppedSegments
+	}
 }
 
 func (o *Output) convertToPbSeries(samplesContainers []metrics.SampleContainer) []*prompb.TimeSeries {
@@ -250,14 +751,20 @@ func (o *Output) convertToPbSeries(samplesContainers []metrics.SampleContainer)
 		samples := samplesContainer.GetSamples()
 
 		for _, sample := range samples {
+			o.observeThresholds(sample)
 			truncTime := sample.Time.Truncate(time.Millisecond)
 			swm, ok := o.tsdb[sample.TimeSeries]
 			if !ok {
-				// TODO: encapsulate the trend arguments into a Trend Mapping factory
-				swm = newSeriesWithMeasure(sample.TimeSeries, o.config.TrendAsNativeHistogram.Bool, o.trendStatsResolver)
+				// the time series could be aggregated into an existing overflow time series
+				swm, ok = o.addSeries(sample.TimeSeries)
+				if swm == nil {
+					continue
+				}
+			}
+			if !ok {
 				swm.Latest = truncTime
-				o.tsdb[sample.TimeSeries] = swm
-				seen[sample.TimeSeries] = struct{}{}
+				seen[swm.TimeSeries] = struct{}{}
+				o.setCreated(swm, truncTime)
 			} else { //nolint:gocritic
 				// FIXME: remove the gocritic linter inhibition as soon as the rest of the todo are done
 				// save as a seen item only when the samples have a time greater than
@@ -265,7 +772,7 @@ func (o *Output) convertToPbSeries(samplesContainers []metrics.SampleContainer)
 				// could see it as a duplicate and generate warnings (e.g. Mimir)
 				if truncTime.After(swm.Latest) {
 					swm.Latest = truncTime
-					seen[sample.TimeSeries] = struct{}{}
+					seen[swm.TimeSeries] = struct{}{}
 				}
 
 				// If current == previous:
@@ -288,20 +795,244 @@ func (o *Output) convertToPbSeries(samplesContainers []metrics.SampleContainer)
 				//   but same as for the equal condition it can rely on the previous seen value.
 			}
 			swm.Measure.Add(sample)
+			if o.exemplars != nil && swm.Metric.Type == metrics.Trend {
+				swm.Exemplar = o.exemplars.sample(swm.Exemplar, sample)
+			}
 		}
 	}
 
 	pbseries := make([]*prompb.TimeSeries, 0, len(seen))
 	for s := range seen {
-		pbseries = append(pbseries, o.tsdb[s].MapPrompb()...)
+		swm := o.tsdb[s]
+		if sink, ok := swm.Measure.(*windowedTrendSink); ok {
+			// the stale markers map the windowed stats without rotating them
+			sink.rotate(swm.Latest)
+		}
+		series := swm.MapPrompb()
+		if swm.Exemplar != nil {
+			attachExemplar(series, swm.Measure, swm.Exemplar)
+			swm.Exemplar = nil
+		}
+		if o.metadata != nil {
+			o.metadata.observe(swm.Metric, swm.Measure, series)
+		}
+		if o.staleness != nil {
+			o.staleness.Seen(s, swm.Latest)
+		}
+		pbseries = append(pbseries, series...)
+		pbseries = append(pbseries, o.mapCreated(swm, series)...)
+	}
+	return append(pbseries, o.rotateWindows(seen)...)
+}
+
+// rotateWindows rotates the windowed Trend sinks of the time series
+// without new samples, so the values expire from the window also without new ones.
+// The stats are mapped again if the window has changed,
+// they are marked as stale once the window becomes empty.
+func (o *Output) rotateWindows(seen map[metrics.TimeSeries]struct{}) []*prompb.TimeSeries {
+	var (
+		now      time.Time
+		pbseries []*prompb.TimeSeries
+	)
+	for s, swm := range o.tsdb {
+		sink, ok := swm.Measure.(*windowedTrendSink)
+		if !ok || sink.IsEmpty() {
+			continue
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		if now.IsZero() {
+			now = o.now().Truncate(time.Millisecond)
+		}
+		// the timestamps of a time series must increase
+		if !now.After(swm.Latest) || !sink.rotate(now) {
+			continue
+		}
+		swm.Latest = now
+
+		if !sink.IsEmpty() {
+			pbseries = append(pbseries, swm.MapPrompb()...)
+			continue
+		}
+		labels := swm.Labels
+		if labels == nil {
+			labels = MapSeries(swm.TimeSeries, "")
+		}
+		// now is already after the latest timestamp
+		staleMarkers := sink.mapEmpty(swm.TimeSeries, labels, now)
+		stale.Mark(staleMarkers, now.UnixMilli())
+		pbseries = append(pbseries, staleMarkers...)
 	}
 	return pbseries
 }
 
+// addSeries adds a new time series to the tsdb. The time series excluded
+// from the filter are dropped. If the max series limit
+// has been reached then the time series is aggregated into the metric's overflow
+// time series or dropped, depending on the policy. It returns nil if the time
+// series has been dropped and true if it has been aggregated into an existing one.
+func (o *Output) addSeries(series metrics.TimeSeries) (*seriesWithMeasure, bool) {
+	if o.limiter != nil && o.limiter.isRejected(series) {
+		return o.addLimitedSeries(series)
+	}
+	if o.filter != nil && !o.filter.keep(series) {
+		return nil, false
+	}
+
+	labels, keep := o.mapLabels(series)
+	if !keep {
+		return nil, false
+	}
+
+	if o.limiter != nil {
+		admitted, first := o.limiter.admit(series)
+		if !admitted {
+			if first {
+				o.warnSeriesLimit(series.Metric)
+			}
+			return o.addLimitedSeries(series)
+		}
+	}
+	return o.newSeries(series, labels), false
+}
+
+// newSeries adds the time series with the mapped labels to the tsdb.
+func (o *Output) newSeries(series metrics.TimeSeries, labels []*prompb.Label) *seriesWithMeasure {
+	// TODO: encapsulate the trend arguments into a Trend Mapping factory
+	swm := newSeriesWithMeasure(series, o.trendMapping(series), rateMapping{
+		Counters: o.config.RateAsCounters.Bool,
+		Gauge:    o.config.RateGauge.Bool,
+	})
+	swm.Labels = labels
+	o.tsdb[series] = swm
+	return swm
+}
+
+// mapLabels maps the time series to the labels, the __name__ label
+// is without the suffixes. The external labels are added before the relabeling rules,
+// as Prometheus does. If the relabeling rules are defined then they are applied,
+// false is returned if the time series has been dropped from them.
+// The dropped time series are cached.
+func (o *Output) mapLabels(series metrics.TimeSeries) ([]*prompb.Label, bool) {
+	labels := withName(o.mapTagSet(series.Tags), o.metricName(series.Metric.Name))
+	labels = withExternalLabels(labels, o.config.ExternalLabels)
+	if o.relabel == nil {
+		return labels, true
+	}
+	if _, dropped := o.relabelDropped[series]; dropped {
+		return nil, false
+	}
+	labels, keep := o.relabel.Process(labels)
+	if keep && !hasName(labels) {
+		// a time series without a name would be rejected
+		keep = false
+	}
+	if !keep {
+		o.relabelDropped[series] = struct{}{}
+		o.logger.WithField("metric", series.Metric.Name).Debug("A time series has been dropped from the relabeling rules")
+		return nil, false
+	}
+	return labels, true
+}
+
+// trendMapping returns the mapping for the Trend time series.
+func (o *Output) trendMapping(series metrics.TimeSeries) trendMapping {
+	metric := series.Metric
+	if metric.Type != metrics.Trend {
+		return trendMapping{}
+	}
+	statsResolver, sketchResolver := o.trendStatsResolvers(series)
+	accuracy := defaultTrendStatsSketchAccuracy
+	if o.config.TrendStatsSketchAccuracy.Valid {
+		accuracy = o.config.TrendStatsSketchAccuracy.Float64
+	}
+	return trendMapping{
+		NativeHistogram:     o.nativeHistogramOptions(metric),
+		HistogramBuckets:    o.histogramBuckets(metric),
+		SketchStatsResolver: sketchResolver,
+		SketchAccuracy:      accuracy,
+		StatsResolver:       statsResolver,
+		StatsWindowed:       o.config.TrendStatsWindowed.Bool || o.config.TrendStatsWindow.Valid,
+		StatsWindow:         o.config.TrendStatsWindow.TimeDuration(),
+		PushInterval:        o.config.PushInterval.TimeDuration(),
+	}
+}
+
+// histogramBuckets returns the buckets of the classic histogram for the metric,
+// nil is returned if the Trends are not mapped to classic histograms.
+func (o *Output) histogramBuckets(metric *metrics.Metric) []float64 {
+	if metric.Type != metrics.Trend || !o.config.TrendAsHistogram.Bool {
+		return nil
+	}
+	return o.metricHistogramBuckets(metric)
+}
+
+// metricHistogramBuckets returns the buckets for the metric,
+// the metric's buckets take precedence over the global buckets.
+func (o *Output) metricHistogramBuckets(metric *metrics.Metric) []float64 {
+	if buckets, ok := o.config.MetricHistogramBuckets[metric.Name]; ok {
+		return buckets
+	}
+	if len(o.config.HistogramBuckets) > 0 {
+		return o.config.HistogramBuckets
+	}
+	return defaultHistogramBuckets(metric.Contains)
+}
+
+// nativeHistogramOptions returns the options of the native histogram for the metric,
+// nil is returned if the Trends are not mapped to native histograms.
+func (o *Output) nativeHistogramOptions(metric *metrics.Metric) *nativeHistogramOptions {
+	if metric.Type != metrics.Trend || !o.config.TrendAsNativeHistogram.Bool {
+		return nil
+	}
+	if o.config.NativeHistogramCustomBuckets.Bool {
+		return &nativeHistogramOptions{CustomBuckets: o.metricHistogramBuckets(metric)}
+	}
+	return &nativeHistogramOptions{
+		BucketFactor:     o.config.NativeHistogramBucketFactor.Float64,
+		ZeroThreshold:    o.config.NativeHistogramZeroThreshold.Float64,
+		MaxBucketNumber:  uint32(o.config.NativeHistogramMaxBucketNumber.Int64), //nolint:gosec
+		MinResetDuration: o.config.NativeHistogramMinResetDuration.TimeDuration(),
+	}
+}
+
+// metricName returns the name of the metric without the suffixes.
+// It is the renamed one if the metric has a rename,
+// otherwise it is the sanitized prefixed one.
+func (o *Output) metricName(name string) string {
+	if renamed, ok := o.config.MetricRenames[name]; ok {
+		return renamed
+	}
+	sanitized, changed, collided := o.names.metricName(o.metricPrefix() + name)
+	switch {
+	case collided:
+		o.logger.WithFields(logrus.Fields{"metric": name, "name": sanitized}).
+			Warn("The metric's name collides with the sanitized name of a different metric, it has been changed")
+	case changed:
+		o.logger.WithFields(logrus.Fields{"metric": name, "name": sanitized}).
+			Warn("The metric's name is not a valid Prometheus metric name, it has been sanitized")
+	}
+	return sanitized
+}
+
+// metricPrefix returns the prefix for the metrics' names.
+func (o *Output) metricPrefix() string {
+	if o.config.MetricPrefix.Valid {
+		return o.config.MetricPrefix.String
+	}
+	return defaultMetricPrefix
+}
+
 type seriesWithMeasure struct {
 	metrics.TimeSeries
 	Measure metrics.Sink
 
+	// Labels are the labels of the time series, the __name__ label
+	// is without the suffixes. They are mapped once when the time series
+	// is seen for the first time, if nil they are mapped from the time series.
+	Labels []*prompb.Label
+
 	// Latest tracks the latest time
 	// when the measure has been updated
 	//
@@ -309,6 +1040,24 @@ type seriesWithMeasure struct {
 	// in a method in struct
 	Latest time.Time
 
+	// Exemplar is the exemplar sampled since the latest flush, if any.
+	Exemplar *prompb.Exemplar
+
+	// Created is the time when the counter started from zero,
+	// it is zero if it isn't tracked.
+	Created time.Time
+
+	// ZeroSample is true if the zero sample at the created time
+	// is pending, it is sent before the first counter's sample.
+	ZeroSample bool
+
+	// CreatedSent is the time of the latest sent _created time series.
+	CreatedSent time.Time
+
+	// Overflow is true if the time series collects the samples
+	// of the time series not admitted from the limiter.
+	Overflow bool
+
 	// TODO: maybe add some caching for the mapping?
 }
 
@@ -316,9 +1065,14 @@ type seriesWithMeasure struct {
 func (swm seriesWithMeasure) MapPrompb() []*prompb.TimeSeries {
 	var newts []*prompb.TimeSeries
 
-	mapMonoSeries := func(s metrics.TimeSeries, suffix string, t time.Time) prompb.TimeSeries {
+	labels := swm.Labels
+	if labels == nil {
+		labels = MapSeries(swm.TimeSeries, "")
+	}
+
+	mapMonoSeries := func(suffix string, t time.Time) prompb.TimeSeries {
 		return prompb.TimeSeries{
-			Labels: MapSeries(s, suffix),
+			Labels: withNameSuffix(labels, suffix),
 			Samples: []*prompb.Sample{
 				{Timestamp: t.UnixMilli()},
 			},
@@ -328,17 +1082,21 @@ func (swm seriesWithMeasure) MapPrompb() []*prompb.TimeSeries {
 	//nolint:forcetypeassert
 	switch swm.Metric.Type {
 	case metrics.Counter:
-		ts := mapMonoSeries(swm.TimeSeries, "total", swm.Latest)
+		ts := mapMonoSeries("total", swm.Latest)
 		ts.Samples[0].Value = swm.Measure.(*metrics.CounterSink).Value
 		newts = []*prompb.TimeSeries{&ts}
 
 	case metrics.Gauge:
-		ts := mapMonoSeries(swm.TimeSeries, "", swm.Latest)
+		ts := mapMonoSeries("", swm.Latest)
 		ts.Samples[0].Value = swm.Measure.(*metrics.GaugeSink).Value
 		newts = []*prompb.TimeSeries{&ts}
 
 	case metrics.Rate:
-		ts := mapMonoSeries(swm.TimeSeries, "rate", swm.Latest)
+		if rate, ok := swm.Measure.(prompbMapper); ok {
+			newts = rate.MapPrompb(swm.TimeSeries, labels, swm.Latest)
+			break
+		}
+		ts := mapMonoSeries("rate", swm.Latest)
 		// pass zero duration here because time is useless for formatting rate
 		rateVals := swm.Measure.(*metrics.RateSink).Format(time.Duration(0))
 		ts.Samples[0].Value = rateVals["rate"]
@@ -353,7 +1111,7 @@ func (swm seriesWithMeasure) MapPrompb() []*prompb.TimeSeries {
 		if !ok {
 			panic("Measure for Trend types must implement MapPromPb")
 		}
-		newts = trend.MapPrompb(swm.TimeSeries, swm.Latest)
+		newts = trend.MapPrompb(swm.TimeSeries, labels, swm.Latest)
 
 	default:
 		panic(
@@ -368,14 +1126,38 @@ func (swm seriesWithMeasure) MapPrompb() []*prompb.TimeSeries {
 }
 
 type prompbMapper interface {
-	MapPrompb(series metrics.TimeSeries, t time.Time) []*prompb.TimeSeries
+	// MapPrompb maps the time series, the labels
+	// are the base labels without the name's suffix.
+	MapPrompb(series metrics.TimeSeries, labels []*prompb.Label, t time.Time) []*prompb.TimeSeries
 }
 
-func newSeriesWithMeasure(
-	series metrics.TimeSeries,
-	trendAsNativeHistogram bool,
-	tsr TrendStatsResolver,
-) *seriesWithMeasure {
+// trendMapping defines how the Trend metrics are mapped.
+type trendMapping struct {
+	// NativeHistogram maps them to native histograms, if not nil.
+	NativeHistogram *nativeHistogramOptions
+
+	// HistogramBuckets maps them to classic histograms, if not nil.
+	HistogramBuckets []float64
+
+	// SketchStatsResolver maps them to the stats computed from a sketch
+	// with the SketchAccuracy relative accuracy, if not nil.
+	SketchStatsResolver sketchStatsResolver
+	SketchAccuracy      float64
+
+	// StatsResolver maps them to the stats computed from all the values,
+	// if the other mappings are not defined.
+	StatsResolver TrendStatsResolver
+
+	// StatsWindowed computes the stats over a window, instead of since the start.
+	// The window is the StatsWindow duration, or the PushInterval if it is zero.
+	StatsWindowed bool
+	StatsWindow   time.Duration
+	PushInterval  time.Duration
+}
+
+// newSeriesWithMeasure creates the time series with the sink for the metric's type,
+// the Trend and Rate mappings define the sink for the Trend and Rate metrics.
+func newSeriesWithMeasure(series metrics.TimeSeries, trend trendMapping, rate rateMapping) *seriesWithMeasure {
 	var sink metrics.Sink
 	switch series.Metric.Type {
 	case metrics.Counter:
@@ -383,19 +1165,29 @@ func newSeriesWithMeasure(
 	case metrics.Gauge:
 		sink = &metrics.GaugeSink{}
 	case metrics.Trend:
-		// TODO: refactor encapsulating in a factory method
-		if trendAsNativeHistogram {
-			sink = newNativeHistogramSink(series.Metric)
-		} else {
-			var err error
-			sink, err = newExtendedTrendSink(tsr)
-			if err != nil {
-				// the resolver must be already validated
-				panic(err)
-			}
+		var err error
+		switch {
+		case trend.NativeHistogram != nil:
+			sink = newNativeHistogramSink(series.Metric, *trend.NativeHistogram)
+		case trend.HistogramBuckets != nil:
+			sink = newClassicHistogramSink(series.Metric, trend.HistogramBuckets)
+		case trend.StatsWindowed:
+			sink, err = newWindowedTrendSink(trend)
+		case trend.SketchStatsResolver != nil:
+			sink, err = newSketchTrendSink(trend.SketchStatsResolver, trend.SketchAccuracy)
+		default:
+			sink, err = newExtendedTrendSink(trend.StatsResolver)
+		}
+		if err != nil {
+			// the resolver must be already validated
+			panic(err)
 		}
 	case metrics.Rate:
-		sink = &metrics.RateSink{}
+		if rate.Counters {
+			sink = &rateCountersSink{gauge: rate.Gauge}
+		} else {
+			sink = &metrics.RateSink{}
+		}
 	default:
 		panic(fmt.Sprintf("metric type %q unsupported", series.Metric.Type.String()))
 	}
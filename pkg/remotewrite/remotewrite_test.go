@@ -3,16 +3,26 @@ package remotewrite
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/relabel"
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/remote"
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/stale"
+
 	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/klauspost/compress/snappy"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.k6.io/k6/lib/types"
 	"go.k6.io/k6/metrics"
+	"google.golang.org/protobuf/proto"
 	"gopkg.in/guregu/null.v3"
 )
 
@@ -25,6 +35,11 @@ func TestOutputDescription(t *testing.T) {
 	}
 	exp := "Prometheus remote write (http://remote-url.fake)"
 	assert.Equal(t, exp, o.Description())
+
+	o.config.RunID = null.StringFrom("auto")
+	o.config.ExternalLabels = map[string]string{"run_id": "01ARYZ6S410000000000000000"}
+	exp = "Prometheus remote write (http://remote-url.fake, run ID: 01ARYZ6S410000000000000000)"
+	assert.Equal(t, exp, o.Description())
 }
 
 func TestOutputConvertToPbSeries(t *testing.T) {
@@ -113,6 +128,194 @@ func TestOutputConvertToPbSeries(t *testing.T) {
 }
 
 //nolint:paralleltest,tparallel
+func TestOutputConvertToPbSeriesWithRelabel(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("metric1", metrics.Counter)
+	trend := registry.MustNewMetric("metric2", metrics.Trend)
+	kept := registry.RootTagSet().With("url", "https://test.k6.io/users/42").With("status", "200")
+	dropped := registry.RootTagSet().With("url", "https://test.k6.io/users/42").With("status", "500")
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	regexStatus, regexURL := "5..", "url"
+	rules, err := relabel.New([]relabel.Config{
+		{SourceLabels: []string{"status"}, Regex: &regexStatus, Action: relabel.Drop},
+		{Regex: &regexURL, Action: relabel.LabelDrop},
+	})
+	require.NoError(t, err)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	o := Output{
+		logger:         logger,
+		tsdb:           make(map[metrics.TimeSeries]*seriesWithMeasure),
+		relabel:        rules,
+		relabelDropped: make(map[metrics.TimeSeries]struct{}),
+	}
+	require.NoError(t, o.setTrendStatsResolver([]string{"max"}))
+
+	samples := []metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: kept}, Time: t0, Value: 1},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: dropped}, Time: t0, Value: 1},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: trend, Tags: kept}, Time: t0, Value: 3},
+	}
+	pbseries := o.convertToPbSeries(samples)
+	sortByNameLabel(pbseries)
+
+	require.Len(t, pbseries, 2)
+	assert.Equal(t, []*prompb.Label{
+		{Name: "__name__", Value: "k6_metric1_total"},
+		{Name: "status", Value: "200"},
+	}, pbseries[0].Labels)
+	// the suffix is appended to the relabeled name
+	assert.Equal(t, []*prompb.Label{
+		{Name: "__name__", Value: "k6_metric2_max"},
+		{Name: "status", Value: "200"},
+	}, pbseries[1].Labels)
+
+	// the dropped time series is cached
+	assert.Len(t, o.tsdb, 2)
+	assert.Contains(t, o.relabelDropped, metrics.TimeSeries{Metric: counter, Tags: dropped})
+	assert.Len(t, o.convertToPbSeries(samples[1:2]), 0)
+}
+
+func TestOutputConvertToPbSeriesWithMetricNames(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("iterations", metrics.Counter)
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	waiting := registry.MustNewMetric("http_req_waiting", metrics.Trend, metrics.Time)
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		config   Config
+		expNames []string
+	}{
+		"EmptyPrefix": {
+			config:   Config{MetricPrefix: null.StringFrom("")},
+			expNames: []string{"http_req_duration_max", "http_req_waiting_max", "iterations_total"},
+		},
+		"Prefix": {
+			config: Config{MetricPrefix: null.StringFrom("loadgen1_")},
+			expNames: []string{
+				"loadgen1_http_req_duration_max", "loadgen1_http_req_waiting_max", "loadgen1_iterations_total",
+			},
+		},
+		"Rename": {
+			config: Config{MetricRenames: map[string]string{
+				"http_req_duration": "loadtest_http_latency",
+				"iterations":        "loadtest_iterations",
+			}},
+			expNames: []string{"k6_http_req_waiting_max", "loadtest_http_latency_max", "loadtest_iterations_total"},
+		},
+		"RenameNativeHistogram": {
+			config: Config{
+				MetricRenames:          map[string]string{"http_req_duration": "loadtest_http_latency"},
+				TrendAsNativeHistogram: null.BoolFrom(true),
+			},
+			expNames: []string{"k6_http_req_waiting_seconds", "k6_iterations_total", "loadtest_http_latency_seconds"},
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			o := Output{
+				config: tt.config,
+				tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+			}
+			require.NoError(t, o.setTrendStatsResolver([]string{"max"}))
+
+			samples := []metrics.SampleContainer{
+				metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: registry.RootTagSet()}, Time: t0, Value: 1},
+				metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: duration, Tags: registry.RootTagSet()}, Time: t0, Value: 3},
+				metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: waiting, Tags: registry.RootTagSet()}, Time: t0, Value: 2},
+			}
+			pbseries := o.convertToPbSeries(samples)
+			sortByNameLabel(pbseries)
+
+			names := make([]string, 0, len(pbseries))
+			for _, s := range pbseries {
+				names = append(names, s.Labels[0].Value)
+			}
+			assert.Equal(t, tt.expNames, names)
+		})
+	}
+}
+
+func TestOutputConvertToPbSeriesWithExternalLabels(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("metric1", metrics.Counter)
+	trend := registry.MustNewMetric("metric2", metrics.Trend, metrics.Time)
+	tags := registry.RootTagSet().With("method", "GET")
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	o := Output{
+		config: Config{
+			TrendAsNativeHistogram: null.BoolFrom(true),
+			ExternalLabels: map[string]string{
+				"env":    "staging",
+				"a_team": "perf",
+				// the k6 tag takes precedence
+				"method": "POST",
+			},
+		},
+		now:  func() time.Time { return t0 },
+		tsdb: make(map[metrics.TimeSeries]*seriesWithMeasure),
+	}
+
+	samples := []metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: t0, Value: 1},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: trend, Tags: tags}, Time: t0, Value: 3},
+	}
+	pbseries := o.convertToPbSeries(samples)
+	require.Len(t, pbseries, 2)
+	sortByNameLabel(pbseries)
+
+	expLabels := func(name string) []*prompb.Label {
+		return []*prompb.Label{
+			{Name: "__name__", Value: name},
+			{Name: "a_team", Value: "perf"},
+			{Name: "env", Value: "staging"},
+			{Name: "method", Value: "GET"},
+		}
+	}
+	assert.Equal(t, expLabels("k6_metric1_total"), pbseries[0].Labels)
+	assert.Equal(t, expLabels("k6_metric2_seconds"), pbseries[1].Labels)
+	require.Len(t, pbseries[1].Histograms, 1)
+
+	markers := o.staleMarkers()
+	require.Len(t, markers, 2)
+	sortByNameLabel(markers)
+	assert.Equal(t, expLabels("k6_metric1_total"), markers[0].Labels)
+	assert.Equal(t, expLabels("k6_metric2_seconds"), markers[1].Labels)
+
+	o.SetThresholds(map[string]metrics.Thresholds{
+		"metric1": metrics.NewThresholds([]string{"count>0"}),
+	})
+	status := o.statusSeries(runStatusRunning, t0)
+	require.Len(t, status, 2)
+	assert.Equal(t, []*prompb.Label{
+		{Name: "__name__", Value: "k6_threshold_passed"},
+		{Name: "a_team", Value: "perf"},
+		{Name: "env", Value: "staging"},
+		{Name: "method", Value: "POST"},
+		{Name: "metric", Value: "metric1"},
+		{Name: "threshold", Value: "count>0"},
+	}, status[0].Labels)
+	assert.Equal(t, []*prompb.Label{
+		{Name: "__name__", Value: "k6_run_status"},
+		{Name: "a_team", Value: "perf"},
+		{Name: "env", Value: "staging"},
+		{Name: "method", Value: "POST"},
+	}, status[1].Labels)
+}
+
 func TestOutputConvertToPbSeries_WithPreviousState(t *testing.T) {
 	t.Parallel()
 
@@ -220,7 +423,7 @@ func TestNewSeriesWithK6SinkMeasure(t *testing.T) {
 		}
 		resolvers, err := metrics.GetResolversForTrendColumns([]string{"avg"})
 		require.NoError(t, err)
-		swm := newSeriesWithMeasure(s, false, resolvers)
+		swm := newSeriesWithMeasure(s, trendMapping{StatsResolver: resolvers}, rateMapping{})
 		require.NotNil(t, swm)
 		assert.Equal(t, s, swm.TimeSeries)
 		require.NotNil(t, swm.Measure)
@@ -236,7 +439,7 @@ func TestNewSeriesWithNativeHistogramMeasure(t *testing.T) {
 		Metric: registry.MustNewMetric("metric1", metrics.Trend),
 	}
 
-	swm := newSeriesWithMeasure(s, true, nil)
+	swm := newSeriesWithMeasure(s, trendMapping{NativeHistogram: &nativeHistogramOptions{}}, rateMapping{})
 	require.NotNil(t, swm)
 	assert.Equal(t, s, swm.TimeSeries)
 	require.NotNil(t, swm.Measure)
@@ -347,16 +550,114 @@ func TestOutputStaleMarkers(t *testing.T) {
 	}
 }
 
+func TestOutputExpireSeries(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	counter := registry.MustNewMetric("metric1", metrics.Counter)
+	gauge := registry.MustNewMetric("metric2", metrics.Gauge)
+	tags := registry.RootTagSet()
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	limiter, err := newSeriesLimiter(Config{MaxSeries: null.IntFrom(2)})
+	require.NoError(t, err)
+	o := Output{
+		logger:    logrus.New(),
+		tsdb:      make(map[metrics.TimeSeries]*seriesWithMeasure),
+		limiter:   limiter,
+		staleness: stale.NewTracker[metrics.TimeSeries](10 * time.Second),
+	}
+
+	o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: t0, Value: 1},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: gauge, Tags: tags}, Time: t0, Value: 3},
+	})
+	o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: gauge, Tags: tags}, Time: t0.Add(8 * time.Second), Value: 4},
+	})
+	assert.Empty(t, o.expireSeries(t0.Add(10*time.Second)))
+
+	markers := o.expireSeries(t0.Add(15 * time.Second))
+	require.Len(t, markers, 1)
+	assert.Equal(t, "k6_metric1_total", markers[0].Labels[0].Value)
+	assert.True(t, math.IsNaN(markers[0].Samples[0].Value), "it isn't a StaleNaN value")
+	assert.Equal(t, t0.Add(15*time.Second+time.Millisecond).UnixMilli(), markers[0].Samples[0].Timestamp)
+
+	// the expired time series has been released
+	require.Len(t, o.tsdb, 1)
+	assert.Contains(t, o.tsdb, metrics.TimeSeries{Metric: gauge, Tags: tags})
+	assert.Equal(t, 1, o.limiter.active)
+
+	// it is a new time series when it receives new samples
+	pbseries := o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: counter, Tags: tags}, Time: t0.Add(20 * time.Second), Value: 1},
+	})
+	require.Len(t, pbseries, 1)
+	assert.Equal(t, 1.0, pbseries[0].Samples[0].Value)
+	assert.Len(t, o.tsdb, 2)
+	assert.Empty(t, o.limiter.limited)
+}
+
+func TestConfigValidateStaleSeriesTTL(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config Config
+		err    string
+	}{
+		"Disabled": {
+			config: Config{StaleSeriesTTL: types.NullDurationFrom(0)},
+		},
+		"TTL": {
+			config: Config{
+				PushInterval:   types.NullDurationFrom(5 * time.Second),
+				StaleSeriesTTL: types.NullDurationFrom(time.Minute),
+			},
+		},
+		"Negative": {
+			config: Config{StaleSeriesTTL: types.NullDurationFrom(-time.Minute)},
+			err:    "positive duration",
+		},
+		"PushInterval": {
+			config: Config{
+				PushInterval:   types.NullDurationFrom(5 * time.Second),
+				StaleSeriesTTL: types.NullDurationFrom(5 * time.Second),
+			},
+			err: "longer than the push interval",
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.config.validateStaleSeriesTTL()
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
 func TestOutputStopWithStaleMarkers(t *testing.T) {
 	t.Parallel()
 
+	endpoint := &fakeEndpoint{available: true}
+	ts := httptest.NewServer(endpoint)
+	defer ts.Close()
+
 	for _, tc := range []bool{true, false} {
 		buf := bytes.NewBuffer(nil)
 		logger := logrus.New()
 		logger.SetLevel(logrus.DebugLevel)
 		logger.SetOutput(buf)
 
+		wc, err := remote.NewWriteClient(ts.URL, nil)
+		require.NoError(t, err)
+
 		o := Output{
+			client: wc,
 			logger: logger,
 			config: Config{
 				// setting a large interval so it does not trigger
@@ -368,7 +669,7 @@ func TestOutputStopWithStaleMarkers(t *testing.T) {
 			now: time.Now,
 		}
 
-		err := o.Start()
+		err = o.Start()
 		require.NoError(t, err)
 		err = o.Stop()
 		require.NoError(t, err)
@@ -387,3 +688,167 @@ func TestOutputStopWithStaleMarkers(t *testing.T) {
 		assertfn(t, messages, msg)
 	}
 }
+
+// fakeEndpoint is a remote write endpoint that fails on purpose
+// until it is set as available.
+type fakeEndpoint struct {
+	mu        sync.Mutex
+	available bool
+
+	// metric, if set, is the only metric recorded.
+	metric   string
+	received []float64
+}
+
+func (e *fakeEndpoint) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.available {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b, err = snappy.Decode(nil, b)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(b, &wr); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, ts := range wr.Timeseries {
+		if e.metric != "" && seriesName(ts) != e.metric {
+			continue
+		}
+		for _, s := range ts.Samples {
+			e.received = append(e.received, s.Value)
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (e *fakeEndpoint) SetAvailable(v bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.available = v
+}
+
+func (e *fakeEndpoint) Received() []float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]float64(nil), e.received...)
+}
+
+func TestOutputFlushWithWAL(t *testing.T) {
+	t.Parallel()
+
+	endpoint := &fakeEndpoint{metric: "k6_gauge1"}
+	ts := httptest.NewServer(endpoint)
+	defer ts.Close()
+
+	walDir := t.TempDir()
+	registry := metrics.NewRegistry()
+	gauge := registry.MustNewMetric("gauge1", metrics.Gauge)
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	newOutput := func() *Output {
+		wc, err := remote.NewWriteClient(ts.URL, nil)
+		require.NoError(t, err)
+		logger := logrus.New()
+		logger.SetOutput(io.Discard)
+		return &Output{
+			client: wc,
+			logger: logger,
+			now:    time.Now,
+			tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+			config: Config{
+				PushInterval: types.NullDurationFrom(time.Hour),
+				WALDir:       null.StringFrom(walDir),
+			},
+		}
+	}
+	flushSample := func(o *Output, i int) {
+		o.AddMetricSamples([]metrics.SampleContainer{metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: gauge, Tags: registry.RootTagSet()},
+			Time:       t0.Add(time.Duration(i) * time.Second),
+			Value:      float64(i),
+		}})
+		o.flush()
+	}
+
+	o := newOutput()
+	o.config.MetadataSendInterval = types.NullDurationFrom(time.Hour)
+	o.metadata = newMetadataTracker(o.config)
+	require.NoError(t, o.Start())
+	flushSample(o, 1)
+	flushSample(o, 2)
+	// the metadata is sent also while the on-disk queue is pending
+	assert.False(t, o.metadata.lastSent.IsZero())
+	require.NoError(t, o.Stop())
+	assert.Empty(t, endpoint.Received())
+
+	// a new run resumes the pending time series
+	// sending them before the new ones
+	endpoint.SetAvailable(true)
+	o = newOutput()
+	require.NoError(t, o.Start())
+	flushSample(o, 3)
+	require.NoError(t, o.Stop())
+
+	assert.Equal(t, []float64{1, 2, 3}, endpoint.Received())
+	assert.False(t, o.wal.Pending())
+}
+
+func TestOutputFlushWithWALHoldsBackSeries(t *testing.T) {
+	t.Parallel()
+
+	endpoint := &fakeEndpoint{metric: "k6_gauge1"}
+	ts := httptest.NewServer(endpoint)
+	defer ts.Close()
+
+	wc, err := remote.NewWriteClient(ts.URL, nil)
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	o := &Output{
+		client: wc,
+		logger: logger,
+		now:    time.Now,
+		tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+		config: Config{
+			PushInterval: types.NullDurationFrom(time.Hour),
+			WALDir:       null.StringFrom(t.TempDir()),
+		},
+	}
+	registry := metrics.NewRegistry()
+	gauge := registry.MustNewMetric("gauge1", metrics.Gauge)
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+	flushSample := func(i int) {
+		o.AddMetricSamples([]metrics.SampleContainer{metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: gauge, Tags: registry.RootTagSet()},
+			Time:       t0.Add(time.Duration(i) * time.Second),
+			Value:      float64(i),
+		}})
+		o.flush()
+	}
+
+	require.NoError(t, o.Start())
+	flushSample(1)
+	assert.Eventually(t, o.wal.Pending, 5*time.Second, 10*time.Millisecond)
+
+	// the endpoint recovers, the new sample is held back
+	// until the failed one is replayed
+	endpoint.SetAvailable(true)
+	flushSample(2)
+	require.NoError(t, o.Stop())
+
+	assert.Equal(t, []float64{1, 2}, endpoint.Received())
+	assert.False(t, o.wal.Pending())
+}
@@ -0,0 +1,79 @@
+package remotewrite
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// runIDLabel is the label with the test run's identity.
+	runIDLabel = "run_id"
+
+	// instanceLabel is the label with the load generator's identity.
+	instanceLabel = "instance"
+
+	// autoIdentity is the value for generating the identity,
+	// a ULID for the run ID and the hostname for the instance.
+	autoIdentity = "auto"
+)
+
+// crockfordAlphabet is the Crockford's Base32 alphabet used from the ULIDs.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID generates a ULID, https://github.com/ulid/spec,
+// with the millisecond timestamp of t and the random part read from entropy.
+func newULID(t time.Time, entropy io.Reader) (string, error) {
+	var id [16]byte
+	ms := uint64(t.UnixMilli())
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (8 * (5 - i)))
+	}
+	if _, err := io.ReadFull(entropy, id[6:]); err != nil {
+		return "", fmt.Errorf("failed to read the ULID's entropy: %w", err)
+	}
+
+	// the 128 bits are encoded in 26 characters of 5 bits,
+	// starting from the least significant ones
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:]), nil
+}
+
+// identityLabels returns the run ID and the instance labels
+// from the config, generating the values set to auto.
+func identityLabels(conf Config, now time.Time) (map[string]string, error) {
+	labels := make(map[string]string, 2)
+	if conf.RunID.Valid && conf.RunID.String != "" {
+		runID := conf.RunID.String
+		if runID == autoIdentity {
+			var err error
+			runID, err = newULID(now, rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		labels[runIDLabel] = runID
+	}
+	if conf.Instance.Valid && conf.Instance.String != "" {
+		instance := conf.Instance.String
+		if instance == autoIdentity {
+			var err error
+			instance, err = os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the hostname for the instance label: %w", err)
+			}
+		}
+		labels[instanceLabel] = instance
+	}
+	return labels, nil
+}
@@ -0,0 +1,92 @@
+package remotewrite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+	"go.k6.io/k6/output"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestNewULID(t *testing.T) {
+	t.Parallel()
+
+	// the example from the spec's repository
+	ts := time.UnixMilli(1469918176385)
+	id, err := newULID(ts, bytes.NewReader(make([]byte, 10)))
+	require.NoError(t, err)
+	assert.Equal(t, "01ARYZ6S410000000000000000", id)
+
+	id, err = newULID(ts, bytes.NewReader(bytes.Repeat([]byte{0xff}, 10)))
+	require.NoError(t, err)
+	assert.Equal(t, "01ARYZ6S41ZZZZZZZZZZZZZZZZ", id)
+
+	_, err = newULID(ts, bytes.NewReader(make([]byte, 5)))
+	assert.ErrorContains(t, err, "entropy")
+
+	// they are sortable by time
+	id1, err := newULID(ts, rand.Reader)
+	require.NoError(t, err)
+	id2, err := newULID(ts.Add(time.Millisecond), rand.Reader)
+	require.NoError(t, err)
+	assert.Less(t, id1, id2)
+}
+
+func TestIdentityLabels(t *testing.T) {
+	t.Parallel()
+
+	now := time.UnixMilli(1469918176385)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	labels, err := identityLabels(Config{}, now)
+	require.NoError(t, err)
+	assert.Empty(t, labels)
+
+	labels, err = identityLabels(Config{
+		RunID:    null.StringFrom("nightly-42"),
+		Instance: null.StringFrom("pod-1"),
+	}, now)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"run_id": "nightly-42", "instance": "pod-1"}, labels)
+
+	labels, err = identityLabels(Config{
+		RunID:    null.StringFrom("auto"),
+		Instance: null.StringFrom("auto"),
+	}, now)
+	require.NoError(t, err)
+	assert.Regexp(t, `^01ARYZ6S41[0-9A-Z]{16}$`, labels["run_id"])
+	assert.Equal(t, hostname, labels["instance"])
+}
+
+func TestOutputStatusSeriesIdentityLabels(t *testing.T) {
+	t.Parallel()
+
+	o, err := New(output.Params{
+		Logger:         logrus.New(),
+		ConfigArgument: "runID=run-1,instance=lg-1",
+	})
+	require.NoError(t, err)
+	o.SetThresholds(map[string]metrics.Thresholds{
+		"checks": metrics.NewThresholds([]string{"rate>0.9"}),
+	})
+
+	// every status time series has the run-identifying labels
+	series := o.statusSeries(runStatusFinished, time.Now())
+	require.Len(t, series, 2)
+	for _, s := range series {
+		labels := make(map[string]string, len(s.Labels))
+		for _, l := range s.Labels {
+			labels[l.Name] = l.Value
+		}
+		assert.Equal(t, "run-1", labels[runIDLabel], labels[namelbl])
+		assert.Equal(t, "lg-1", labels[instanceLabel], labels[namelbl])
+	}
+}
@@ -0,0 +1,171 @@
+package remotewrite
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/sirupsen/logrus"
+	"go.k6.io/k6/metrics"
+)
+
+const (
+	// reservedNamePrefix is the prefix reserved for the Prometheus' internal names.
+	reservedNamePrefix = "__"
+
+	// reservedMetricPrefix and reservedLabelPrefix are prepended to the names
+	// starting with the reserved prefix, so they can't clash with the internal names.
+	reservedMetricPrefix = "metric"
+	reservedLabelPrefix  = "tag"
+
+	// collidingValuesSeparator joins the values of the tags
+	// whose names collide once sanitized.
+	collidingValuesSeparator = ";"
+)
+
+// nameSanitizer maps the k6 metrics' names and tags' keys
+// to valid Prometheus' metric and label names.
+//
+// The zero value is usable, it caches the names
+// so each name is sanitized only once.
+type nameSanitizer struct {
+	// utf8 allows all the valid UTF-8 characters,
+	// it requires a receiver supporting them.
+	utf8 bool
+
+	// metrics maps the metrics' names to the sanitized names.
+	metrics map[string]string
+
+	// metricOwners maps the sanitized metrics' names
+	// to the original names, for detecting the collisions.
+	metricOwners map[string]string
+
+	// labels maps the tags' keys to the sanitized names.
+	labels map[string]string
+}
+
+// metricName returns the sanitized metric's name. True is returned
+// the first time a name is changed.
+//
+// A name is never moved once it has been assigned, because its time series
+// could have already been sent. So, the first metric takes the name
+// and a later metric colliding with it has the hash of its original name as suffix,
+// also if its name doesn't require to be sanitized. True is returned as collided in this case.
+func (s *nameSanitizer) metricName(name string) (sanitized string, changed bool, collided bool) {
+	if sanitized, ok := s.metrics[name]; ok {
+		return sanitized, false, false
+	}
+	if s.metrics == nil {
+		s.metrics = make(map[string]string)
+		s.metricOwners = make(map[string]string)
+	}
+
+	sanitized = sanitizeName(name, s.utf8, true)
+	if strings.HasPrefix(sanitized, reservedNamePrefix) {
+		sanitized = reservedMetricPrefix + sanitized
+	}
+	if owner, ok := s.metricOwners[sanitized]; ok && owner != name {
+		sanitized = hashedName(sanitized, name)
+		collided = true
+	}
+	s.metrics[name] = sanitized
+	s.metricOwners[sanitized] = name
+	return sanitized, sanitized != name, collided
+}
+
+// hashedName returns the sanitized name
+// with the hash of the original name as suffix.
+func hashedName(sanitized, name string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return fmt.Sprintf("%s_%08x", sanitized, h.Sum32())
+}
+
+// labelName returns the sanitized tag's key.
+// True is returned the first time a key is changed.
+func (s *nameSanitizer) labelName(name string) (string, bool) {
+	if sanitized, ok := s.labels[name]; ok {
+		return sanitized, false
+	}
+	if s.labels == nil {
+		s.labels = make(map[string]string)
+	}
+
+	sanitized := sanitizeName(name, s.utf8, false)
+	if strings.HasPrefix(sanitized, reservedNamePrefix) {
+		sanitized = reservedLabelPrefix + sanitized
+	}
+	s.labels[name] = sanitized
+	return sanitized, sanitized != name
+}
+
+// sanitizeName replaces the characters not allowed in a Prometheus' name
+// with an underscore. A name starting with a digit is prefixed with an underscore.
+// The colons are allowed only in the metrics' names.
+// If utf8 is true then only the invalid UTF-8 sequences are replaced.
+func sanitizeName(name string, utf8Names bool, metric bool) string {
+	if utf8Names {
+		return strings.ToValidUTF8(name, "_")
+	}
+
+	var b strings.Builder
+	b.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', metric && r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// validName returns true if the name is a valid metric's name
+// or a valid metric's name prefix, if prefix is true.
+func validName(name string, utf8Names bool, prefix bool) bool {
+	if name == "" {
+		return prefix
+	}
+	if utf8Names {
+		return utf8.ValidString(name)
+	}
+	return metricNameRegex.MatchString(name)
+}
+
+// mapTagSet maps the tag set to the labels with the sanitized names.
+// The values of the tags whose names collide once sanitized are joined
+// with a semicolon, in the order of the original names.
+// It warns once for every tag's key that has been changed.
+func (o *Output) mapTagSet(tags *metrics.TagSet) []*prompb.Label {
+	labels := MapTagSet(tags)
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+
+	index := make(map[string]int, len(labels))
+	result := labels[:0]
+	for _, l := range labels {
+		name, changed := o.names.labelName(l.Name)
+		if changed {
+			o.logger.WithFields(logrus.Fields{"tag": l.Name, "label": name}).
+				Warn("The tag's key is not a valid Prometheus label name, it has been sanitized")
+		}
+		if i, ok := index[name]; ok {
+			result[i].Value += collidingValuesSeparator + l.Value
+			continue
+		}
+		index[name] = len(result)
+		l.Name = name
+		result = append(result, l)
+	}
+	return result
+}
@@ -0,0 +1,198 @@
+package remotewrite
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestSanitizeName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		utf8   bool
+		metric bool
+		exp    string
+	}{
+		{name: "http_req_duration", exp: "http_req_duration"},
+		{name: "my-custom.metric", exp: "my_custom_metric"},
+		{name: "with space", exp: "with_space"},
+		{name: "1st_request", exp: "_1st_request"},
+		{name: "k6_1st", exp: "k6_1st"},
+		{name: "rpc:latency", metric: true, exp: "rpc:latency"},
+		{name: "rpc:latency", exp: "rpc_latency"},
+		{name: "latência", exp: "lat_ncia"},
+		{name: "latência", utf8: true, exp: "latência"},
+		{name: "my-metric.1", utf8: true, exp: "my-metric.1"},
+		{name: "bad\xffname", utf8: true, exp: "bad_name"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.exp, sanitizeName(tt.name, tt.utf8, tt.metric), tt.name)
+	}
+}
+
+func TestNameSanitizerMetricName(t *testing.T) {
+	t.Parallel()
+
+	var s nameSanitizer
+
+	name, changed, _ := s.metricName("k6_valid")
+	assert.Equal(t, "k6_valid", name)
+	assert.False(t, changed)
+
+	name, changed, _ = s.metricName("k6_my-metric")
+	assert.Equal(t, "k6_my_metric", name)
+	assert.True(t, changed)
+
+	// changed is returned only the first time
+	name, changed, _ = s.metricName("k6_my-metric")
+	assert.Equal(t, "k6_my_metric", name)
+	assert.False(t, changed)
+
+	// a collision has the hash of the original name as suffix
+	name, changed, collided := s.metricName("k6_my.metric")
+	assert.Regexp(t, `^k6_my_metric_[0-9a-f]{8}$`, name)
+	assert.True(t, changed)
+	assert.True(t, collided)
+
+	// the name already assigned is never moved
+	name, _, _ = s.metricName("k6_my-metric")
+	assert.Equal(t, "k6_my_metric", name)
+
+	// also a valid name has the hash if it arrives later
+	name, changed, collided = s.metricName("k6_my_metric")
+	assert.Regexp(t, `^k6_my_metric_[0-9a-f]{8}$`, name)
+	assert.True(t, changed)
+	assert.True(t, collided)
+
+	name, changed, collided = s.metricName("__reserved")
+	assert.Equal(t, "metric__reserved", name)
+	assert.True(t, changed)
+	assert.False(t, collided)
+}
+
+func TestNameSanitizerMetricNameOrder(t *testing.T) {
+	t.Parallel()
+
+	names := []string{"k6_my-metric", "k6_my_metric", "k6_my.metric"}
+	orders := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+
+	for _, order := range orders {
+		var s nameSanitizer
+		mapped := make(map[string]string, len(names))
+		for _, i := range order {
+			mapped[names[i]], _, _ = s.metricName(names[i])
+		}
+
+		// the first name takes the sanitized name, the later ones have the hash
+		assert.Equal(t, "k6_my_metric", mapped[names[order[0]]], order)
+		for _, i := range order[1:] {
+			assert.Regexp(t, `^k6_my_metric_[0-9a-f]{8}$`, mapped[names[i]], order)
+		}
+		assert.NotEqual(t, mapped[names[order[1]]], mapped[names[order[2]]], order)
+
+		// the names are stable
+		for _, name := range names {
+			sanitized, _, _ := s.metricName(name)
+			assert.Equal(t, mapped[name], sanitized, order)
+		}
+	}
+}
+
+func TestOutputMetricNameCollision(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	changed := registry.MustNewMetric("__reserved", metrics.Gauge)
+	valid := registry.MustNewMetric("metric__reserved", metrics.Gauge)
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	o := Output{
+		config: Config{MetricPrefix: null.StringFrom("")},
+		logger: logrus.New(),
+		tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+	}
+	// the sanitized name is sent first
+	pbseries := o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: changed, Tags: registry.RootTagSet()}, Time: t0, Value: 1},
+	})
+	require.Len(t, pbseries, 1)
+	assert.Equal(t, "metric__reserved", pbseries[0].Labels[0].Value)
+
+	// the colliding name arrives later so it has the hash,
+	// the time series already sent keep their name
+	pbseries = o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: valid, Tags: registry.RootTagSet()}, Time: t0, Value: 2},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: changed, Tags: registry.RootTagSet()}, Time: t0.Add(time.Second), Value: 3},
+	})
+	require.Len(t, pbseries, 2)
+	sortByNameLabel(pbseries)
+	assert.Equal(t, "metric__reserved", pbseries[0].Labels[0].Value)
+	assert.Equal(t, 3.0, pbseries[0].Samples[0].Value)
+	assert.Regexp(t, `^metric__reserved_[0-9a-f]{8}$`, pbseries[1].Labels[0].Value)
+	assert.Equal(t, 2.0, pbseries[1].Samples[0].Value)
+}
+
+func TestNameSanitizerLabelName(t *testing.T) {
+	t.Parallel()
+
+	var s nameSanitizer
+
+	name, changed := s.labelName("__name__")
+	assert.Equal(t, "tag__name__", name)
+	assert.True(t, changed)
+
+	name, changed = s.labelName("content-type")
+	assert.Equal(t, "content_type", name)
+	assert.True(t, changed)
+
+	name, changed = s.labelName("status")
+	assert.Equal(t, "status", name)
+	assert.False(t, changed)
+
+	utf8 := nameSanitizer{utf8: true}
+	name, changed = utf8.labelName("content-type")
+	assert.Equal(t, "content-type", name)
+	assert.False(t, changed)
+
+	// the reserved names are kept reserved also with UTF-8
+	name, changed = utf8.labelName("__name__")
+	assert.Equal(t, "tag__name__", name)
+	assert.True(t, changed)
+}
+
+func TestOutputMapTagSet(t *testing.T) {
+	t.Parallel()
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+	o := Output{logger: logger}
+
+	registry := metrics.NewRegistry()
+	tags := registry.RootTagSet().
+		With("a_b", "3").
+		With("a.b", "2").
+		With("a-b", "1").
+		With("status", "200")
+
+	exp := []*prompb.Label{
+		{Name: "a_b", Value: "1;2;3"},
+		{Name: "status", Value: "200"},
+	}
+	assert.Equal(t, exp, o.mapTagSet(tags))
+	assert.Equal(t, exp, o.mapTagSet(tags))
+
+	// warned once per changed tag's key
+	assert.Equal(t, 1, bytes.Count(logs.Bytes(), []byte(`tag=a-b`)))
+	assert.Equal(t, 1, bytes.Count(logs.Bytes(), []byte(`tag=a.b`)))
+	assert.NotContains(t, logs.String(), "tag=a_b")
+}
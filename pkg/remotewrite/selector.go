@@ -0,0 +1,78 @@
+package remotewrite
+
+import (
+	"fmt"
+	"strings"
+
+	"go.k6.io/k6/metrics"
+)
+
+// parseSeriesSelector parses the selector of the time series in the form:
+// metric{tag1=value1,tag2=value2}. The metric's name and the tags are optional,
+// the values can be quoted.
+func parseSeriesSelector(selector string) (string, map[string]string, error) {
+	metric, rest, hasTags := strings.Cut(selector, "{")
+	metric = strings.TrimSpace(metric)
+	if !hasTags {
+		return metric, nil, nil
+	}
+
+	matchers, ok := strings.CutSuffix(strings.TrimSpace(rest), "}")
+	if !ok {
+		return "", nil, fmt.Errorf("the selector %q has an unterminated tags' list", selector)
+	}
+	tags := make(map[string]string)
+	for _, matcher := range strings.Split(matchers, ",") {
+		if strings.TrimSpace(matcher) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(matcher, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return "", nil, fmt.Errorf("the selector %q has an invalid tag's matcher %q", selector, matcher)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = v[1 : len(v)-1]
+		}
+		tags[k] = v
+	}
+	return metric, tags, nil
+}
+
+// splitSelectors splits the comma-separated list of selectors,
+// the commas within the tags' lists don't split.
+func splitSelectors(list string) []string {
+	var (
+		selectors []string
+		depth     int
+		start     int
+	)
+	for i, r := range list {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				selectors = append(selectors, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(selectors, strings.TrimSpace(list[start:]))
+}
+
+// hasTags returns true if the time series has all the tags.
+func hasTags(series metrics.TimeSeries, tags map[string]string) bool {
+	for k, v := range tags {
+		if series.Tags == nil {
+			return false
+		}
+		if tv, ok := series.Tags.Get(k); !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
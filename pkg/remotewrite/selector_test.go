@@ -0,0 +1,48 @@
+package remotewrite
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSeriesSelector(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in        string
+		expMetric string
+		expTags   map[string]string
+		expErr    bool
+	}{
+		{in: "http_req_duration", expMetric: "http_req_duration"},
+		{in: "http_req_duration{}", expMetric: "http_req_duration", expTags: map[string]string{}},
+		{
+			in:        `http_req_duration{scenario=checkout, method="GET"}`,
+			expMetric: "http_req_duration",
+			expTags:   map[string]string{"scenario": "checkout", "method": "GET"},
+		},
+		{in: "{scenario=checkout}", expTags: map[string]string{"scenario": "checkout"}},
+		{in: "http_req_duration{scenario=checkout", expErr: true},
+		{in: "http_req_duration{scenario}", expErr: true},
+	}
+	for _, tt := range tests {
+		metric, tags, err := parseSeriesSelector(tt.in)
+		if tt.expErr {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.expMetric, metric, tt.in)
+		assert.Equal(t, tt.expTags, tags, tt.in)
+	}
+}
+
+func TestSplitSelectors(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"http_req_*", "data_*{scenario=smoke,method=GET}", "{scenario=smoke}"},
+		splitSelectors("http_req_*, data_*{scenario=smoke,method=GET},{scenario=smoke}"))
+	assert.Equal(t, []string{"iterations"}, splitSelectors("iterations"))
+}
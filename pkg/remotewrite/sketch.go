@@ -0,0 +1,136 @@
+package remotewrite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/ddsketch"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"go.k6.io/k6/metrics"
+)
+
+// defaultTrendStatsSketchAccuracy is the default relative accuracy
+// of the percentiles computed from the sketch.
+const defaultTrendStatsSketchAccuracy = 0.01
+
+// sketchStatsResolver is a map of trend stats name and their relative resolver function
+// computing them from a sketch.
+type sketchStatsResolver map[string]func(*ddsketch.Sketch) float64
+
+// newSketchStatsResolver creates the resolvers for the Trend stats,
+// it supports the same stats supported from the exact Trend sink.
+func newSketchStatsResolver(trendStats []string) (sketchStatsResolver, error) {
+	resolvers := make(sketchStatsResolver, len(trendStats))
+	for _, stat := range trendStats {
+		var fn func(*ddsketch.Sketch) float64
+		switch stat {
+		case "avg":
+			fn = (*ddsketch.Sketch).Avg
+		case "min":
+			fn = (*ddsketch.Sketch).Min
+		case "max":
+			fn = (*ddsketch.Sketch).Max
+		case "sum":
+			fn = (*ddsketch.Sketch).Sum
+		case "count":
+			fn = func(s *ddsketch.Sketch) float64 { return float64(s.Count()) }
+		case "med":
+			fn = func(s *ddsketch.Sketch) float64 { return sketchPercentile(s, 0.5) }
+		default:
+			if !strings.HasPrefix(stat, "p(") || !strings.HasSuffix(stat, ")") {
+				return nil, fmt.Errorf("stat '%s' is unknown", stat)
+			}
+			p, err := strconv.ParseFloat(stat[2:len(stat)-1], 64)
+			if err != nil || p < 0 || p > 100 {
+				return nil, fmt.Errorf("stat '%s' has an invalid percentile", stat)
+			}
+			fn = func(s *ddsketch.Sketch) float64 { return sketchPercentile(s, p/100) }
+		}
+		resolvers[trendStatKey(stat)] = fn
+	}
+	return resolvers, nil
+}
+
+// sketchPercentile returns the quantile, zero if the sketch is empty.
+func sketchPercentile(s *ddsketch.Sketch, q float64) float64 {
+	if s.Count() == 0 {
+		return 0
+	}
+	return s.Quantile(q)
+}
+
+// sketchTrendSink is the alternative to extendedTrendSink computing the stats
+// from a DDSketch, so the memory is bounded instead of growing with every value.
+// The percentiles are within the relative accuracy of the exact ones.
+type sketchTrendSink struct {
+	sketch     *ddsketch.Sketch
+	trendStats sketchStatsResolver
+}
+
+func newSketchTrendSink(ssr sketchStatsResolver, accuracy float64) (*sketchTrendSink, error) {
+	if len(ssr) < 1 {
+		return nil, fmt.Errorf("trend stats resolver is empty")
+	}
+	sketch, err := ddsketch.New(accuracy, ddsketch.DefaultMaxBins)
+	if err != nil {
+		return nil, err
+	}
+	return &sketchTrendSink{
+		sketch:     sketch,
+		trendStats: ssr,
+	}, nil
+}
+
+// Add implements metrics.Sink.
+func (sink *sketchTrendSink) Add(s metrics.Sample) {
+	sink.sketch.Add(s.Value)
+}
+
+// P implements metrics.Sink.
+func (sink *sketchTrendSink) P(pct float64) float64 {
+	return sketchPercentile(sink.sketch, pct)
+}
+
+// Format implements metrics.Sink.
+func (sink *sketchTrendSink) Format(_ time.Duration) map[string]float64 {
+	values := make(map[string]float64, len(sink.trendStats))
+	for stat, statfn := range sink.trendStats {
+		values[stat] = statfn(sink.sketch)
+	}
+	return values
+}
+
+// IsEmpty implements metrics.Sink.
+func (sink *sketchTrendSink) IsEmpty() bool {
+	return sink.sketch.Count() == 0
+}
+
+// Drain implements metrics.Sink.
+func (*sketchTrendSink) Drain() ([]byte, error) {
+	panic("Sketch Trend Sink has no support of draining")
+}
+
+// Merge implements metrics.Sink.
+func (*sketchTrendSink) Merge(_ []byte) error {
+	panic("Sketch Trend Sink has no support of merging")
+}
+
+// MapPrompb maps the Trend's stats to gauges, as extendedTrendSink does.
+func (sink *sketchTrendSink) MapPrompb(
+	series metrics.TimeSeries, labels []*prompb.Label, t time.Time,
+) []*prompb.TimeSeries {
+	tg := &trendAsGauges{
+		series:    make([]*prompb.TimeSeries, 0, len(sink.trendStats)),
+		labels:    labels,
+		timestamp: t.UnixMilli(),
+	}
+	tg.CacheNameIndex()
+
+	for stat, statfn := range sink.trendStats {
+		tg.Append(stat, adaptUnit(series.Metric.Contains, statfn(sink.sketch)))
+	}
+	return tg.series
+}
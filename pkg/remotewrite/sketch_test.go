@@ -0,0 +1,150 @@
+package remotewrite
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+)
+
+func TestNewSketchStatsResolver(t *testing.T) {
+	t.Parallel()
+
+	resolvers, err := newSketchStatsResolver([]string{"avg", "min", "med", "max", "count", "sum", "p(90)", "p(99.9)"})
+	require.NoError(t, err)
+
+	keys := make([]string, 0, len(resolvers))
+	for k := range resolvers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"avg", "count", "max", "med", "min", "p90", "p999", "sum"}, keys)
+
+	for _, stat := range []string{"foo", "p(101)", "p(x)"} {
+		_, err := newSketchStatsResolver([]string{stat})
+		assert.Error(t, err, stat)
+	}
+}
+
+func TestSketchTrendSinkMapPrompb(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	r := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: &metrics.Metric{
+			Name: "test",
+			Type: metrics.Trend,
+		},
+		Tags: r.RootTagSet(),
+	}
+
+	resolvers, err := newSketchStatsResolver([]string{"count", "min", "max", "sum", "p(50)"})
+	require.NoError(t, err)
+	st, err := newSketchTrendSink(resolvers, 0.01)
+	require.NoError(t, err)
+	assert.True(t, st.IsEmpty())
+
+	for i := 1; i <= 100; i++ {
+		st.Add(metrics.Sample{TimeSeries: series, Value: float64(i * 10), Time: now})
+	}
+	assert.False(t, st.IsEmpty())
+	assert.InEpsilon(t, 500, st.P(0.5), 0.01)
+
+	ts := st.MapPrompb(series, MapSeries(series, ""), now)
+	require.Len(t, ts, 5)
+	sortByNameLabel(ts)
+
+	expected := []*prompb.TimeSeries{
+		buildTimeSeries("k6_test_count", 100, now),
+		buildTimeSeries("k6_test_max", 1000, now),
+		buildTimeSeries("k6_test_min", 10, now),
+		buildTimeSeries("k6_test_p50", 500, now),
+		buildTimeSeries("k6_test_sum", 50500, now),
+	}
+	for i, exp := range expected {
+		assert.Equal(t, exp.Labels, ts[i].Labels)
+		require.Len(t, ts[i].Samples, 1)
+		assert.InEpsilon(t, exp.Samples[0].Value, ts[i].Samples[0].Value, 0.01, exp.Labels[0].Value)
+	}
+}
+
+func TestNewSketchTrendSinkEmptyResolver(t *testing.T) {
+	t.Parallel()
+
+	_, err := newSketchTrendSink(nil, 0.01)
+	assert.Error(t, err)
+}
+
+// BenchmarkTrendStatsSink compares the exact sink and the sketch
+// for the memory retained and the error of the 99th percentile.
+func BenchmarkTrendStatsSink(b *testing.B) {
+	const values = 1_000_000
+
+	// a log-normal distribution, similar to the latencies
+	r := rand.New(rand.NewSource(42)) //nolint:gosec
+	samples := make([]float64, values)
+	for i := range samples {
+		samples[i] = math.Exp(r.NormFloat64() + 5)
+	}
+	sorted := make([]float64, values)
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+	exact := sorted[(values-1)*99/100]
+
+	series := metrics.TimeSeries{
+		Metric: &metrics.Metric{Name: "bench", Type: metrics.Trend},
+	}
+	tsr, err := metrics.GetResolversForTrendColumns([]string{"p(99)"})
+	require.NoError(b, err)
+	ssr, err := newSketchStatsResolver([]string{"p(99)"})
+	require.NoError(b, err)
+
+	type percentileSink interface {
+		Add(metrics.Sample)
+		P(float64) float64
+	}
+	sinks := map[string]func() percentileSink{
+		"Exact": func() percentileSink {
+			s, err := newExtendedTrendSink(tsr)
+			require.NoError(b, err)
+			return s
+		},
+		"Sketch": func() percentileSink {
+			s, err := newSketchTrendSink(ssr, defaultTrendStatsSketchAccuracy)
+			require.NoError(b, err)
+			return s
+		},
+	}
+	for name, newSink := range sinks {
+		newSink := newSink
+		b.Run(name, func(b *testing.B) {
+			var retained, p99 float64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				sink := newSink()
+				for _, v := range samples {
+					sink.Add(metrics.Sample{TimeSeries: series, Value: v})
+				}
+				p99 = sink.P(0.99)
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained = float64(after.HeapAlloc) - float64(before.HeapAlloc)
+				runtime.KeepAlive(sink)
+			}
+			b.ReportMetric(retained, "retained-B")
+			b.ReportMetric(math.Abs(p99-exact)/exact, "p99-rel-err")
+		})
+	}
+}
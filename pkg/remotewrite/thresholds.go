@@ -0,0 +1,188 @@
+package remotewrite
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"go.k6.io/k6/errext"
+	"go.k6.io/k6/metrics"
+)
+
+const (
+	thresholdPassedMetric = "threshold_passed"
+	runStatusMetric       = "run_status"
+)
+
+// runStatus is the status of the test run.
+// The values match the run statuses of k6 Cloud.
+type runStatus float64
+
+const (
+	runStatusRunning            runStatus = 2
+	runStatusFinished           runStatus = 3
+	runStatusAbortedUser        runStatus = 5
+	runStatusAbortedSystem      runStatus = 6
+	runStatusAbortedScriptError runStatus = 7
+	runStatusAbortedThreshold   runStatus = 8
+	runStatusAbortedLimit       runStatus = 9
+)
+
+// runStatusFromError maps the error the test run finished with
+// to the run status. A nil error means a finished test run.
+func runStatusFromError(testErr error) runStatus {
+	if testErr == nil {
+		return runStatusFinished
+	}
+
+	var err errext.HasAbortReason
+	if !errors.As(testErr, &err) {
+		return runStatusAbortedSystem
+	}
+	switch err.AbortReason() {
+	case errext.AbortedByUser, errext.AbortedByScriptAbort:
+		return runStatusAbortedUser
+	case errext.AbortedByThreshold:
+		return runStatusAbortedThreshold
+	case errext.AbortedByScriptError:
+		return runStatusAbortedScriptError
+	case errext.AbortedByTimeout:
+		return runStatusAbortedLimit
+	case errext.AbortedByThresholdsAfterTestEnd:
+		// the test run finished normally, the failed thresholds
+		// are reported from the thresholds' time series
+		return runStatusFinished
+	default:
+		return runStatusAbortedSystem
+	}
+}
+
+// thresholdsSink evaluates a copy of the thresholds of a metric or a submetric.
+//
+// The thresholds received from k6 are evaluated from the k6's metrics engine
+// that updates their LastFailed status concurrently, without a lock shared with the outputs.
+// So, the output evaluates its own copy over the samples it receives.
+type thresholdsSink struct {
+	// name is the metric's name with the optional submetric's selector,
+	// as defined in the thresholds' config.
+	name string
+
+	// tags are the submetric's selector.
+	tags map[string]string
+
+	thresholds metrics.Thresholds
+
+	// sink is nil until the first sample is observed.
+	sink metrics.Sink
+}
+
+// matches returns true if the sample's tags match the submetric's selector.
+func (ts *thresholdsSink) matches(tags *metrics.TagSet) bool {
+	for k, v := range ts.tags {
+		if tv, ok := tags.Get(k); !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SetThresholds receives the thresholds before the output is started.
+// The output evaluates a copy of them, see thresholdsSink.
+func (o *Output) SetThresholds(thresholds map[string]metrics.Thresholds) {
+	o.thresholds = make(map[string][]*thresholdsSink, len(thresholds))
+	o.thresholdsOrder = make([]*thresholdsSink, 0, len(thresholds))
+	for name, t := range thresholds {
+		metricName, selector, err := metrics.ParseMetricName(name)
+		if err != nil {
+			// k6 validates the thresholds before the outputs are started
+			continue
+		}
+		sources := make([]string, 0, len(t.Thresholds))
+		for _, threshold := range t.Thresholds {
+			sources = append(sources, threshold.Source)
+		}
+		ts := &thresholdsSink{
+			name:       name,
+			tags:       parseSubmetricSelector(selector),
+			thresholds: metrics.NewThresholds(sources),
+		}
+		if err := ts.thresholds.Parse(); err != nil {
+			continue
+		}
+		o.thresholds[metricName] = append(o.thresholds[metricName], ts)
+		o.thresholdsOrder = append(o.thresholdsOrder, ts)
+	}
+	sort.Slice(o.thresholdsOrder, func(i, j int) bool {
+		return o.thresholdsOrder[i].name < o.thresholdsOrder[j].name
+	})
+}
+
+// parseSubmetricSelector parses the key:value pairs of a submetric's selector
+// in the same way as k6.
+func parseSubmetricSelector(selector []string) map[string]string {
+	if len(selector) < 1 {
+		return nil
+	}
+	tags := make(map[string]string, len(selector))
+	for _, kv := range selector {
+		k, v, _ := strings.Cut(kv, ":")
+		tags[strings.Trim(strings.TrimSpace(k), `"'`)] = strings.Trim(strings.TrimSpace(v), `"'`)
+	}
+	return tags
+}
+
+// observeThresholds adds the sample to the sinks of the thresholds
+// defined for its metric.
+func (o *Output) observeThresholds(sample metrics.Sample) {
+	for _, ts := range o.thresholds[sample.Metric.Name] {
+		if !ts.matches(sample.Tags) {
+			continue
+		}
+		if ts.sink == nil {
+			ts.sink = metrics.NewSink(sample.Metric.Type)
+		}
+		ts.sink.Add(sample)
+	}
+}
+
+// statusSeries maps the thresholds' results and the run status
+// to time series with a single sample at the provided time.
+//
+// Each threshold is a k6_threshold_passed{metric,threshold} series, with the configured prefix,
+// with 1 if it is passing and 0 if it is failing.
+// The thresholds without samples are passing, as in k6.
+// The external labels are added to all the time series.
+func (o *Output) statusSeries(status runStatus, t time.Time) []*prompb.TimeSeries {
+	timestamp := t.UnixMilli()
+	series := make([]*prompb.TimeSeries, 0, len(o.thresholdsOrder)+1)
+
+	for _, ts := range o.thresholdsOrder {
+		if ts.sink != nil {
+			// the failures are tracked in the thresholds' status
+			_, _ = ts.thresholds.Run(ts.sink, t.Sub(o.startTime))
+		}
+		for _, threshold := range ts.thresholds.Thresholds {
+			passed := 1.0
+			if threshold.LastFailed {
+				passed = 0
+			}
+			series = append(series, &prompb.TimeSeries{
+				Labels: withExternalLabels([]*prompb.Label{
+					{Name: namelbl, Value: o.metricName(thresholdPassedMetric)},
+					{Name: "metric", Value: ts.name},
+					{Name: "threshold", Value: threshold.Source},
+				}, o.config.ExternalLabels),
+				Samples: []*prompb.Sample{{Value: passed, Timestamp: timestamp}},
+			})
+		}
+	}
+
+	series = append(series, &prompb.TimeSeries{
+		Labels: withExternalLabels(
+			[]*prompb.Label{{Name: namelbl, Value: o.metricName(runStatusMetric)}}, o.config.ExternalLabels),
+		Samples: []*prompb.Sample{{Value: float64(status), Timestamp: timestamp}},
+	})
+	return series
+}
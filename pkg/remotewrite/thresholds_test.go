@@ -0,0 +1,171 @@
+package remotewrite
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/xk6-output-prometheus-remote/pkg/remote"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/errext"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
+)
+
+func TestRunStatusFromError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err error
+		exp runStatus
+	}{
+		{err: nil, exp: runStatusFinished},
+		{err: errors.New("unknown"), exp: runStatusAbortedSystem},
+		{err: errext.WithAbortReasonIfNone(errors.New("user"), errext.AbortedByUser), exp: runStatusAbortedUser},
+		{
+			err: errext.WithAbortReasonIfNone(errors.New("threshold"), errext.AbortedByThreshold),
+			exp: runStatusAbortedThreshold,
+		},
+		{
+			err: errext.WithAbortReasonIfNone(errors.New("script"), errext.AbortedByScriptError),
+			exp: runStatusAbortedScriptError,
+		},
+		{
+			err: errext.WithAbortReasonIfNone(errors.New("timeout"), errext.AbortedByTimeout),
+			exp: runStatusAbortedLimit,
+		},
+		{
+			err: errext.WithAbortReasonIfNone(errors.New("end"), errext.AbortedByThresholdsAfterTestEnd),
+			exp: runStatusFinished,
+		},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.exp, runStatusFromError(tt.err), tt.err)
+	}
+}
+
+func TestOutputStatusSeries(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	reqDuration := registry.MustNewMetric("http_req_duration", metrics.Trend)
+	checks := registry.MustNewMetric("checks", metrics.Rate)
+
+	o := Output{}
+	o.SetThresholds(map[string]metrics.Thresholds{
+		"http_req_duration":                metrics.NewThresholds([]string{"p(95)<200", "avg<100"}),
+		"http_req_duration{status:'200'}":  metrics.NewThresholds([]string{"max<200"}),
+		"http_req_duration{status:'404'}":  metrics.NewThresholds([]string{"max<100"}),
+		"checks":                           metrics.NewThresholds([]string{"rate>0.9"}),
+		"iterations{scenario:unavailable}": metrics.NewThresholds([]string{"count>0"}),
+	})
+
+	now := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+	for _, sample := range []metrics.Sample{
+		{TimeSeries: metrics.TimeSeries{Metric: reqDuration, Tags: registry.RootTagSet().With("status", "200")}, Value: 50},
+		{TimeSeries: metrics.TimeSeries{Metric: reqDuration, Tags: registry.RootTagSet().With("status", "404")}, Value: 150},
+		{TimeSeries: metrics.TimeSeries{Metric: checks, Tags: registry.RootTagSet()}, Value: 1},
+	} {
+		o.observeThresholds(sample)
+	}
+	series := o.statusSeries(runStatusRunning, now)
+
+	sample := func(v float64) []*prompb.Sample {
+		return []*prompb.Sample{{Value: v, Timestamp: now.UnixMilli()}}
+	}
+	threshold := func(metric, source string) []*prompb.Label {
+		return []*prompb.Label{
+			{Name: "__name__", Value: "k6_threshold_passed"},
+			{Name: "metric", Value: metric},
+			{Name: "threshold", Value: source},
+		}
+	}
+	exp := []*prompb.TimeSeries{
+		{Labels: threshold("checks", "rate>0.9"), Samples: sample(1)},
+		{Labels: threshold("http_req_duration", "p(95)<200"), Samples: sample(1)},
+		{Labels: threshold("http_req_duration", "avg<100"), Samples: sample(0)},
+		{Labels: threshold("http_req_duration{status:'200'}", "max<200"), Samples: sample(1)},
+		{Labels: threshold("http_req_duration{status:'404'}", "max<100"), Samples: sample(0)},
+		// without samples it is passing
+		{Labels: threshold("iterations{scenario:unavailable}", "count>0"), Samples: sample(1)},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "k6_run_status"}}, Samples: sample(2)},
+	}
+	assert.Equal(t, exp, series)
+}
+
+func TestOutputStatusSeriesConcurrentEngine(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	checks := registry.MustNewMetric("checks", metrics.Rate)
+	thresholds := metrics.NewThresholds([]string{"rate>0.9"})
+	require.NoError(t, thresholds.Parse())
+
+	o := Output{}
+	o.SetThresholds(map[string]metrics.Thresholds{"checks": thresholds})
+
+	// the k6's metrics engine evaluates the thresholds concurrently
+	sink := metrics.NewSink(metrics.Rate)
+	sink.Add(metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: checks, Tags: registry.RootTagSet()}})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_, _ = thresholds.Run(sink, time.Second)
+			}
+		}
+	}()
+
+	now := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		o.observeThresholds(metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: checks, Tags: registry.RootTagSet()},
+			Value:      1,
+		})
+		series := o.statusSeries(runStatusRunning, now)
+		require.Len(t, series, 2)
+		assert.Equal(t, 1.0, series[0].Samples[0].Value)
+	}
+	close(stop)
+	<-done
+}
+
+func TestOutputStopWithTestError(t *testing.T) {
+	t.Parallel()
+
+	endpoint := &fakeEndpoint{available: true, metric: "k6_run_status"}
+	ts := httptest.NewServer(endpoint)
+	defer ts.Close()
+
+	wc, err := remote.NewWriteClient(ts.URL, nil)
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	o := Output{
+		client: wc,
+		logger: logger,
+		now:    time.Now,
+		tsdb:   make(map[metrics.TimeSeries]*seriesWithMeasure),
+		config: Config{
+			PushInterval: types.NullDurationFrom(time.Hour),
+		},
+	}
+	require.NoError(t, o.Start())
+	abort := errext.WithAbortReasonIfNone(errors.New("threshold crossed"), errext.AbortedByThreshold)
+	require.NoError(t, o.StopWithTestError(abort))
+
+	// the running status from the last flush, then the final status
+	assert.Equal(t, []float64{2, 8}, endpoint.Received())
+}
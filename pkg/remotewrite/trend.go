@@ -33,7 +33,9 @@ func newExtendedTrendSink(tsr TrendStatsResolver) (*extendedTrendSink, error) {
 // MapPrompb converts a k6 time series and its relative
 // Sink into the equivalent TimeSeries model as defined from
 // the Remote write specification.
-func (sink *extendedTrendSink) MapPrompb(series metrics.TimeSeries, t time.Time) []*prompb.TimeSeries {
+func (sink *extendedTrendSink) MapPrompb(
+	series metrics.TimeSeries, labels []*prompb.Label, t time.Time,
+) []*prompb.TimeSeries {
 	// Prometheus metric system does not support Trend so this mapping will
 	// store a counter for the number of reported values and gauges to keep
 	// track of aggregated values. Also store a sum of the values to allow
@@ -45,7 +47,7 @@ func (sink *extendedTrendSink) MapPrompb(series metrics.TimeSeries, t time.Time)
 		// TODO: should we add the base unit suffix?
 		// It could depends from the decision for other metric types
 		// Does k6_http_req_duration_seconds_count make sense?
-		labels:    MapSeries(series, ""),
+		labels:    labels,
 		timestamp: t.UnixMilli(),
 	}
 	tg.CacheNameIndex()
@@ -118,20 +120,61 @@ func (tg *trendAsGauges) CacheNameIndex() {
 	}
 }
 
+// defaultNativeHistogramBucketFactor is the starting value suggested by Prometheus.
+// It sounds good considering the general purpose it have to address.
+const defaultNativeHistogramBucketFactor = 1.1
+
+// nativeHistogramOptions are the options for tuning the native histograms.
+// The zero values use the defaults.
+type nativeHistogramOptions struct {
+	// BucketFactor is the max growth factor between two consecutive buckets.
+	BucketFactor float64
+
+	// ZeroThreshold is the width of the zero bucket.
+	ZeroThreshold float64
+
+	// MaxBucketNumber is the max number of buckets,
+	// when it is exceeded the resolution is reduced. Zero means no limit.
+	MaxBucketNumber uint32
+
+	// MinResetDuration is the min time between the resets of the histogram
+	// when the max number of buckets is exceeded, instead of reducing the resolution.
+	MinResetDuration time.Duration
+
+	// CustomBuckets are the upper bounds of the custom buckets.
+	// If they are defined then the native histogram has custom buckets (NHCB)
+	// and the other options are not used.
+	CustomBuckets []float64
+}
+
 type nativeHistogramSink struct {
 	H prometheus.Histogram
+
+	// customBuckets is true if the native histogram has custom buckets.
+	customBuckets bool
 }
 
-func newNativeHistogramSink(m *metrics.Metric) *nativeHistogramSink {
+func newNativeHistogramSink(m *metrics.Metric, opts nativeHistogramOptions) *nativeHistogramSink {
+	if len(opts.CustomBuckets) > 0 {
+		return &nativeHistogramSink{
+			H: prometheus.NewHistogram(prometheus.HistogramOpts{
+				Name:    m.Name,
+				Buckets: opts.CustomBuckets,
+			}),
+			customBuckets: true,
+		}
+	}
+
+	if opts.BucketFactor == 0 {
+		opts.BucketFactor = defaultNativeHistogramBucketFactor
+	}
 	return &nativeHistogramSink{
 		H: prometheus.NewHistogram(prometheus.HistogramOpts{
-			Name: m.Name,
-			// 1.1 is the starting value suggested by Prometheus'
-			// It sounds good considering the general purpose
-			// it have to address.
-			// In the future, we could consider to add more tuning
-			// if it will be required.
-			NativeHistogramBucketFactor: 1.1,
+			Name:                            m.Name,
+			NativeHistogramBucketFactor:     opts.BucketFactor,
+			NativeHistogramZeroThreshold:    opts.ZeroThreshold,
+			NativeHistogramMaxBucketNumber:  opts.MaxBucketNumber,
+			NativeHistogramMinResetDuration: opts.MinResetDuration,
 		}),
 	}
 }
@@ -180,16 +223,21 @@ func (*nativeHistogramSink) Merge(_ []byte) error {
 }
 
 // MapPrompb maps the Trend type to the experimental Native Histogram.
-func (sink *nativeHistogramSink) MapPrompb(series metrics.TimeSeries, t time.Time) []*prompb.TimeSeries {
+func (sink *nativeHistogramSink) MapPrompb(
+	series metrics.TimeSeries, labels []*prompb.Label, t time.Time,
+) []*prompb.TimeSeries {
 	suffix := baseUnit(series.Metric.Contains)
-	labels := MapSeries(series, suffix)
 	timestamp := t.UnixMilli()
 
+	toProto := histogramToHistogramProto
+	if sink.customBuckets {
+		toProto = customBucketsHistogramToHistogramProto
+	}
 	return []*prompb.TimeSeries{
 		{
-			Labels: labels,
+			Labels: withNameSuffix(labels, suffix),
 			Histograms: []*prompb.Histogram{
-				histogramToHistogramProto(timestamp, sink.H),
+				toProto(timestamp, sink.H),
 			},
 		},
 	}
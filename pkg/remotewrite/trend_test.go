@@ -56,7 +56,7 @@ func TestExtendedTrendSinkMapPrompb(t *testing.T) {
 	st.Add(sample)
 	require.Equal(t, st.Count(), uint64(1))
 
-	ts := st.MapPrompb(sample.TimeSeries, sample.Time)
+	ts := st.MapPrompb(sample.TimeSeries, MapSeries(sample.TimeSeries, ""), sample.Time)
 	require.Len(t, ts, 8)
 
 	sortByNameLabel(ts)
@@ -108,7 +108,7 @@ func TestNativeHistogramSinkAdd(t *testing.T) {
 			Contains: metrics.Time,
 		},
 	}
-	sink := newNativeHistogramSink(ts.Metric)
+	sink := newNativeHistogramSink(ts.Metric, nativeHistogramOptions{})
 
 	// k6 passes time values with ms time unit
 	// the sink converts them to seconds.
@@ -137,7 +137,7 @@ func TestNativeHistogramSinkMapPrompb(t *testing.T) {
 		Tags: r.RootTagSet().With("tagk1", "tagv1"),
 	}
 
-	st := newNativeHistogramSink(series.Metric)
+	st := newNativeHistogramSink(series.Metric, nativeHistogramOptions{})
 	st.Add(metrics.Sample{
 		TimeSeries: series,
 		Value:      1.52,
@@ -148,7 +148,7 @@ func TestNativeHistogramSinkMapPrompb(t *testing.T) {
 		Value:      3.14,
 		Time:       time.Unix(2, 0),
 	})
-	ts := st.MapPrompb(series, time.Unix(3, 0))
+	ts := st.MapPrompb(series, MapSeries(series, ""), time.Unix(3, 0))
 
 	// It should be the easiest way for asserting the entire struct,
 	// because the structs contains a bunch of internals value that we don't want to assert.
@@ -191,13 +191,13 @@ func TestNativeHistogramSinkMapPrompbWithValueType(t *testing.T) {
 		Tags: r.RootTagSet(),
 	}
 
-	st := newNativeHistogramSink(series.Metric)
+	st := newNativeHistogramSink(series.Metric, nativeHistogramOptions{})
 	st.Add(metrics.Sample{
 		TimeSeries: series,
 		Value:      1.52,
 		Time:       time.Unix(1, 0),
 	})
-	ts := st.MapPrompb(series, time.Unix(2, 0))
+	ts := st.MapPrompb(series, MapSeries(series, ""), time.Unix(2, 0))
 	require.Len(t, ts, 1)
 	assert.Equal(t, "k6_test_seconds", ts[0].Labels[0].Value)
 }
@@ -224,7 +224,7 @@ func BenchmarkHistogramSinkAdd(b *testing.B) {
 		Type:     metrics.Trend,
 		Contains: metrics.Time,
 	}
-	ts := newNativeHistogramSink(m)
+	ts := newNativeHistogramSink(m, nativeHistogramOptions{})
 	s := metrics.Sample{
 		TimeSeries: metrics.TimeSeries{
 			Metric: m,
@@ -0,0 +1,71 @@
+package remotewrite
+
+import (
+	"fmt"
+	"sort"
+
+	"go.k6.io/k6/metrics"
+)
+
+// trendStatsRule defines the Trend stats for the time series of a metric
+// with the selector's tags.
+type trendStatsRule struct {
+	key    string
+	metric string
+	tags   map[string]string
+
+	resolver       TrendStatsResolver
+	sketchResolver sketchStatsResolver
+}
+
+// newTrendStatsRules creates the rules from the stats by metric,
+// the rules with the most tags come first, so they take precedence.
+func newTrendStatsRules(metricTrendStats map[string][]string, sketch bool) ([]trendStatsRule, error) {
+	rules := make([]trendStatsRule, 0, len(metricTrendStats))
+	for key, stats := range metricTrendStats {
+		metric, tags, err := parseSeriesSelector(key)
+		if err != nil {
+			return nil, err
+		}
+		if metric == "" {
+			return nil, fmt.Errorf("the Trend stats selector %q has no metric's name", key)
+		}
+		if len(stats) < 1 {
+			return nil, fmt.Errorf("the Trend stats of %q can't be empty", key)
+		}
+		rule := trendStatsRule{key: key, metric: metric, tags: tags}
+		if rule.resolver, err = newTrendStatsResolver(stats); err != nil {
+			return nil, fmt.Errorf("the Trend stats of %q are invalid: %w", key, err)
+		}
+		if sketch {
+			if rule.sketchResolver, err = newSketchStatsResolver(stats); err != nil {
+				return nil, fmt.Errorf("the Trend stats of %q are invalid: %w", key, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].tags) != len(rules[j].tags) {
+			return len(rules[i].tags) > len(rules[j].tags)
+		}
+		return rules[i].key < rules[j].key
+	})
+	return rules, nil
+}
+
+// matches returns true if the time series is of the rule's metric
+// and it has all the rule's tags.
+func (r trendStatsRule) matches(series metrics.TimeSeries) bool {
+	return series.Metric.Name == r.metric && hasTags(series, r.tags)
+}
+
+// trendStatsResolvers returns the resolvers of the Trend stats for the time series,
+// the global resolvers are the fallback if no rule matches.
+func (o *Output) trendStatsResolvers(series metrics.TimeSeries) (TrendStatsResolver, sketchStatsResolver) {
+	for _, rule := range o.trendStatsRules {
+		if rule.matches(series) {
+			return rule.resolver, rule.sketchResolver
+		}
+	}
+	return o.trendStatsResolver, o.sketchStatsResolver
+}
@@ -0,0 +1,84 @@
+package remotewrite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/metrics"
+)
+
+func TestNewTrendStatsRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := newTrendStatsRules(map[string][]string{
+		"http_req_duration":                               {"p(99)"},
+		"http_req_duration{scenario=checkout}":            {"p(99.9)"},
+		"http_req_duration{scenario=checkout,status=200}": {"max"},
+	}, true)
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	assert.Equal(t, "http_req_duration{scenario=checkout,status=200}", rules[0].key)
+	assert.Equal(t, "http_req_duration{scenario=checkout}", rules[1].key)
+	assert.Equal(t, "http_req_duration", rules[2].key)
+	assert.Contains(t, rules[1].resolver, "p999")
+	assert.Contains(t, rules[1].sketchResolver, "p999")
+
+	_, err = newTrendStatsRules(map[string][]string{"http_req_duration": {"foo"}}, false)
+	assert.ErrorContains(t, err, `"http_req_duration"`)
+
+	_, err = newTrendStatsRules(map[string][]string{"http_req_duration": {}}, false)
+	assert.ErrorContains(t, err, "can't be empty")
+
+	_, err = newTrendStatsRules(map[string][]string{"{scenario=checkout}": {"max"}}, false)
+	assert.ErrorContains(t, err, "no metric's name")
+}
+
+func TestOutputConvertToPbSeriesWithMetricTrendStats(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend)
+	blocked := registry.MustNewMetric("http_req_blocked", metrics.Trend)
+	checkout := registry.RootTagSet().With("scenario", "checkout")
+	browse := registry.RootTagSet().With("scenario", "browse")
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	o := Output{
+		tsdb: make(map[metrics.TimeSeries]*seriesWithMeasure),
+	}
+	require.NoError(t, o.setTrendStatsResolver([]string{"avg"}))
+	var err error
+	o.trendStatsRules, err = newTrendStatsRules(map[string][]string{
+		"http_req_duration":                    {"p(50)", "p(99.9)", "max"},
+		"http_req_duration{scenario=checkout}": {"p(90)"},
+	}, false)
+	require.NoError(t, err)
+
+	samples := []metrics.SampleContainer{
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: duration, Tags: checkout}, Time: t0, Value: 3},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: duration, Tags: browse}, Time: t0, Value: 3},
+		metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: blocked, Tags: browse}, Time: t0, Value: 2},
+	}
+	pbseries := o.convertToPbSeries(samples)
+
+	names := make(map[string][]string)
+	for _, s := range pbseries {
+		var name, scenario string
+		for _, l := range s.Labels {
+			switch l.Name {
+			case namelbl:
+				name = l.Value
+			case "scenario":
+				scenario = l.Value
+			}
+		}
+		names[scenario] = append(names[scenario], name)
+	}
+	assert.ElementsMatch(t, []string{"k6_http_req_duration_p90"}, names["checkout"])
+	assert.ElementsMatch(t, []string{
+		"k6_http_req_duration_p50", "k6_http_req_duration_p999", "k6_http_req_duration_max",
+		"k6_http_req_blocked_avg",
+	}, names["browse"])
+}
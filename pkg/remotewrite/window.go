@@ -0,0 +1,237 @@
+package remotewrite
+
+import (
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/prometheus/common/model"
+	"go.k6.io/k6/metrics"
+)
+
+const (
+	// windowLabel is the label with the window's duration
+	// of the windowed Trend stats.
+	windowLabel = "window"
+
+	// exportedWindowLabel is the label with the time series' value
+	// of the window label, when it collides with the windowed Trend stats.
+	exportedWindowLabel = "exported_" + windowLabel
+)
+
+// trendBucket collects the Trend's values between two flushes.
+type trendBucket interface {
+	Add(metrics.Sample)
+	IsEmpty() bool
+}
+
+// closedTrendBucket is a bucket closed from a flush.
+type closedTrendBucket struct {
+	trendBucket
+
+	// end is the time of the latest value in the bucket.
+	end time.Time
+}
+
+// windowedTrendSink computes the Trend stats over a window instead of
+// since the start of the test. It collects the values in a bucket per flush,
+// so the window's resolution is the push interval.
+//
+// If the window is zero then the stats are computed from the values
+// since the previous flush, otherwise over a window sliding
+// across the buckets ended within the window's duration.
+// The window becomes empty when all the buckets are expired.
+type windowedTrendSink struct {
+	window time.Duration
+
+	// labelValue is the value of the window label.
+	labelValue string
+
+	current trendBucket
+	closed  []closedTrendBucket
+
+	newBucket func() trendBucket
+
+	// merge merges the buckets into a sink mapping the stats.
+	merge func([]closedTrendBucket) prompbMapper
+}
+
+// newWindowedTrendSink creates the windowed sink for the Trend mapping,
+// the stats are computed from the sketch if it is defined.
+// The push interval is the window label's value if the window is zero.
+func newWindowedTrendSink(trend trendMapping) (*windowedTrendSink, error) {
+	labelDuration := trend.StatsWindow
+	if labelDuration == 0 {
+		labelDuration = trend.PushInterval
+	}
+	sink := &windowedTrendSink{
+		window:     trend.StatsWindow,
+		labelValue: model.Duration(labelDuration).String(),
+	}
+
+	if trend.SketchStatsResolver != nil {
+		// it validates the resolver and the accuracy
+		if _, err := newSketchTrendSink(trend.SketchStatsResolver, trend.SketchAccuracy); err != nil {
+			return nil, err
+		}
+		newSketchSink := func() *sketchTrendSink {
+			s, _ := newSketchTrendSink(trend.SketchStatsResolver, trend.SketchAccuracy)
+			return s
+		}
+		sink.newBucket = func() trendBucket {
+			return newSketchSink()
+		}
+		sink.merge = func(buckets []closedTrendBucket) prompbMapper {
+			merged := newSketchSink()
+			for _, b := range buckets {
+				//nolint:forcetypeassert
+				if err := merged.sketch.Merge(b.trendBucket.(*sketchTrendSink).sketch); err != nil {
+					// the sketches are created with the same accuracy
+					panic(err)
+				}
+			}
+			return merged
+		}
+		sink.current = sink.newBucket()
+		return sink, nil
+	}
+
+	if _, err := newExtendedTrendSink(trend.StatsResolver); err != nil {
+		return nil, err
+	}
+	sink.newBucket = func() trendBucket {
+		return &trendValues{}
+	}
+	sink.merge = func(buckets []closedTrendBucket) prompbMapper {
+		merged, _ := newExtendedTrendSink(trend.StatsResolver)
+		for _, b := range buckets {
+			//nolint:forcetypeassert
+			for _, v := range b.trendBucket.(*trendValues).values {
+				merged.TrendSink.Add(metrics.Sample{Value: v})
+			}
+		}
+		return merged
+	}
+	sink.current = sink.newBucket()
+	return sink, nil
+}
+
+// Add implements metrics.Sink.
+func (sink *windowedTrendSink) Add(s metrics.Sample) {
+	sink.current.Add(s)
+}
+
+// P implements metrics.Sink.
+func (*windowedTrendSink) P(_ float64) float64 {
+	panic("Windowed Trend Sink has no support of percentile (P)")
+}
+
+// Format implements metrics.Sink.
+func (*windowedTrendSink) Format(_ time.Duration) map[string]float64 {
+	panic("Windowed Trend Sink has no support of formatting (Format)")
+}
+
+// IsEmpty implements metrics.Sink.
+func (sink *windowedTrendSink) IsEmpty() bool {
+	return sink.current.IsEmpty() && len(sink.closed) == 0
+}
+
+// Drain implements metrics.Sink.
+func (*windowedTrendSink) Drain() ([]byte, error) {
+	panic("Windowed Trend Sink has no support of draining")
+}
+
+// Merge implements metrics.Sink.
+func (*windowedTrendSink) Merge(_ []byte) error {
+	panic("Windowed Trend Sink has no support of merging")
+}
+
+// rotate closes the current bucket at the provided time and it drops
+// the buckets expired from the window. It is expected to be invoked
+// on flush, before mapping the time series with new values.
+// It returns true if the window has changed.
+func (sink *windowedTrendSink) rotate(t time.Time) bool {
+	changed := false
+	if !sink.current.IsEmpty() {
+		sink.closed = append(sink.closed, closedTrendBucket{trendBucket: sink.current, end: t})
+		sink.current = sink.newBucket()
+		changed = true
+	}
+
+	expired := sink.expired(t)
+	if expired > 0 {
+		n := copy(sink.closed, sink.closed[expired:])
+		for i := n; i < len(sink.closed); i++ {
+			sink.closed[i] = closedTrendBucket{}
+		}
+		sink.closed = sink.closed[:n]
+		changed = true
+	}
+	return changed
+}
+
+// expired returns the number of the closed buckets expired from the window
+// at the provided time. If the window is zero then only the bucket
+// closed at the provided time is not expired.
+func (sink *windowedTrendSink) expired(t time.Time) int {
+	isExpired := func(end time.Time) bool {
+		return !end.After(t.Add(-sink.window))
+	}
+	if sink.window == 0 {
+		isExpired = func(end time.Time) bool {
+			return end.Before(t)
+		}
+	}
+	expired := 0
+	for expired < len(sink.closed) && isExpired(sink.closed[expired].end) {
+		expired++
+	}
+	return expired
+}
+
+// MapPrompb maps the stats computed over the window's closed buckets
+// to gauges with the window label. It doesn't change the sink,
+// so mapping again without a rotation returns the same stats,
+// e.g. for the stale markers. It returns nil if the window is empty.
+func (sink *windowedTrendSink) MapPrompb(
+	series metrics.TimeSeries, labels []*prompb.Label, t time.Time,
+) []*prompb.TimeSeries {
+	buckets := sink.closed[sink.expired(t):]
+	if len(buckets) == 0 {
+		return nil
+	}
+	return sink.merge(buckets).MapPrompb(series, withWindowLabel(labels, sink.labelValue), t)
+}
+
+// mapEmpty maps the time series of the stats as MapPrompb does,
+// also if the window is empty, for marking them as stale.
+func (sink *windowedTrendSink) mapEmpty(
+	series metrics.TimeSeries, labels []*prompb.Label, t time.Time,
+) []*prompb.TimeSeries {
+	return sink.merge(nil).MapPrompb(series, withWindowLabel(labels, sink.labelValue), t)
+}
+
+// withWindowLabel returns a copy of the labels with the window label.
+// A colliding window label, e.g. from a k6 tag, is kept
+// as the exported_window label, as Prometheus does for the colliding labels.
+func withWindowLabel(labels []*prompb.Label, value string) []*prompb.Label {
+	for _, l := range labels {
+		if l.Name == windowLabel {
+			labels = withLabel(labels, exportedWindowLabel, l.Value)
+			break
+		}
+	}
+	return withLabel(labels, windowLabel, value)
+}
+
+// trendValues is the bucket of the exact Trend stats.
+type trendValues struct {
+	values []float64
+}
+
+func (tv *trendValues) Add(s metrics.Sample) {
+	tv.values = append(tv.values, s.Value)
+}
+
+func (tv *trendValues) IsEmpty() bool {
+	return len(tv.values) == 0
+}
@@ -0,0 +1,298 @@
+package remotewrite
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
+	"gopkg.in/guregu/null.v3"
+)
+
+// windowStats rotates and maps the windowed sink, as a flush does,
+// and it returns the stats by name.
+func windowStats(t *testing.T, sink *windowedTrendSink, series metrics.TimeSeries, now time.Time) map[string]float64 {
+	t.Helper()
+
+	sink.rotate(now)
+	return mapWindowStats(t, sink, series, now)
+}
+
+// mapWindowStats maps the windowed sink and it returns the stats by name.
+func mapWindowStats(t *testing.T, sink *windowedTrendSink, series metrics.TimeSeries, now time.Time) map[string]float64 {
+	t.Helper()
+
+	stats := make(map[string]float64)
+	for _, ts := range sink.MapPrompb(series, MapSeries(series, ""), now) {
+		var name, window string
+		for _, l := range ts.Labels {
+			switch l.Name {
+			case namelbl:
+				name = l.Value
+			case windowLabel:
+				window = l.Value
+			}
+		}
+		assert.Equal(t, sink.labelValue, window)
+		require.Len(t, ts.Samples, 1)
+		assert.Equal(t, now.UnixMilli(), ts.Samples[0].Timestamp)
+		stats[name] = ts.Samples[0].Value
+	}
+	return stats
+}
+
+func TestWindowedTrendSinkPushInterval(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: &metrics.Metric{Name: "test", Type: metrics.Trend},
+		Tags:   r.RootTagSet(),
+	}
+	resolvers, err := metrics.GetResolversForTrendColumns([]string{"count", "max"})
+	require.NoError(t, err)
+
+	sink, err := newWindowedTrendSink(trendMapping{
+		StatsResolver: resolvers,
+		StatsWindowed: true,
+		PushInterval:  5 * time.Second,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "5s", sink.labelValue)
+	assert.True(t, sink.IsEmpty())
+
+	now := time.Unix(100, 0)
+	for _, v := range []float64{10, 30, 20} {
+		sink.Add(metrics.Sample{TimeSeries: series, Value: v})
+	}
+	assert.Equal(t, map[string]float64{"k6_test_count": 3, "k6_test_max": 30},
+		windowStats(t, sink, series, now))
+
+	// the values before the previous flush are not in the window
+	now = now.Add(5 * time.Second)
+	sink.Add(metrics.Sample{TimeSeries: series, Value: 5})
+	assert.Equal(t, map[string]float64{"k6_test_count": 1, "k6_test_max": 5},
+		windowStats(t, sink, series, now))
+
+	// without new values the stats are the same, e.g. for the stale markers
+	assert.Equal(t, map[string]float64{"k6_test_count": 1, "k6_test_max": 5},
+		windowStats(t, sink, series, now))
+	assert.Len(t, sink.closed, 1)
+
+	// the window is empty at the next flush without new values
+	now = now.Add(5 * time.Second)
+	assert.True(t, sink.rotate(now))
+	assert.True(t, sink.IsEmpty())
+	assert.Empty(t, mapWindowStats(t, sink, series, now))
+}
+
+func TestWindowedTrendSinkSliding(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry()
+	series := metrics.TimeSeries{
+		Metric: &metrics.Metric{Name: "test", Type: metrics.Trend},
+		Tags:   r.RootTagSet(),
+	}
+	resolvers, err := newSketchStatsResolver([]string{"count", "max"})
+	require.NoError(t, err)
+
+	sink, err := newWindowedTrendSink(trendMapping{
+		SketchStatsResolver: resolvers,
+		SketchAccuracy:      0.01,
+		StatsWindowed:       true,
+		StatsWindow:         time.Minute,
+		PushInterval:        5 * time.Second,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1m", sink.labelValue)
+
+	start := time.Unix(100, 0)
+	flush := func(offset time.Duration, values ...float64) map[string]float64 {
+		for _, v := range values {
+			sink.Add(metrics.Sample{TimeSeries: series, Value: v})
+		}
+		return windowStats(t, sink, series, start.Add(offset))
+	}
+
+	assert.Equal(t, map[string]float64{"k6_test_count": 1, "k6_test_max": 100}, flush(0, 100))
+	assert.Equal(t, map[string]float64{"k6_test_count": 3, "k6_test_max": 100}, flush(30*time.Second, 1, 2))
+	assert.Equal(t, map[string]float64{"k6_test_count": 4, "k6_test_max": 100}, flush(59*time.Second, 3))
+
+	// the first bucket is expired
+	assert.Equal(t, map[string]float64{"k6_test_count": 3, "k6_test_max": 3}, flush(60*time.Second))
+	assert.Len(t, sink.closed, 2)
+
+	// the mapping without a rotation doesn't change the sink
+	sink.Add(metrics.Sample{TimeSeries: series, Value: 50})
+	assert.Equal(t, map[string]float64{"k6_test_count": 3, "k6_test_max": 3},
+		mapWindowStats(t, sink, series, start.Add(80*time.Second)))
+	assert.Len(t, sink.closed, 2)
+	assert.False(t, sink.current.IsEmpty())
+
+	assert.Equal(t, map[string]float64{"k6_test_count": 1, "k6_test_max": 50}, flush(5*time.Minute))
+	assert.Len(t, sink.closed, 1)
+
+	// the window becomes empty without new values
+	assert.Empty(t, flush(6*time.Minute))
+	assert.True(t, sink.IsEmpty())
+	assert.False(t, sink.rotate(start.Add(7*time.Minute)))
+}
+
+func TestOutputRotateWindows(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	trend := registry.MustNewMetric("trend", metrics.Trend)
+	series := metrics.TimeSeries{Metric: trend, Tags: registry.RootTagSet()}
+	t0 := time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	now := t0
+	o := Output{
+		config: Config{
+			PushInterval:     types.NullDurationFrom(10 * time.Second),
+			TrendStatsWindow: types.NullDurationFrom(time.Minute),
+		},
+		now:  func() time.Time { return now },
+		tsdb: make(map[metrics.TimeSeries]*seriesWithMeasure),
+	}
+	require.NoError(t, o.setTrendStatsResolver([]string{"count"}))
+
+	pbseries := o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: series, Time: t0, Value: 1},
+	})
+	require.Len(t, pbseries, 1)
+	assert.Equal(t, 1.0, pbseries[0].Samples[0].Value)
+
+	// the window doesn't change without new values
+	now = t0.Add(30 * time.Second)
+	assert.Empty(t, o.convertToPbSeries(nil))
+
+	// the stats are updated when the values expire from the window
+	pbseries = o.convertToPbSeries([]metrics.SampleContainer{
+		metrics.Sample{TimeSeries: series, Time: t0.Add(40 * time.Second), Value: 2},
+	})
+	require.Len(t, pbseries, 1)
+	assert.Equal(t, 2.0, pbseries[0].Samples[0].Value)
+	now = t0.Add(70 * time.Second)
+	pbseries = o.convertToPbSeries(nil)
+	require.Len(t, pbseries, 1)
+	assert.Equal(t, 1.0, pbseries[0].Samples[0].Value)
+	assert.Equal(t, now.UnixMilli(), pbseries[0].Samples[0].Timestamp)
+
+	// the stale marker is sent once the window becomes empty
+	now = t0.Add(100 * time.Second)
+	pbseries = o.convertToPbSeries(nil)
+	require.Len(t, pbseries, 1)
+	assert.Equal(t, "k6_trend_count", pbseries[0].Labels[0].Value)
+	assert.True(t, math.IsNaN(pbseries[0].Samples[0].Value), "it isn't a StaleNaN value")
+	assert.Equal(t, now.UnixMilli(), pbseries[0].Samples[0].Timestamp)
+
+	now = t0.Add(110 * time.Second)
+	assert.Empty(t, o.convertToPbSeries(nil))
+}
+
+func TestNewSeriesWithWindowedTrendMeasure(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	s := metrics.TimeSeries{
+		Metric: registry.MustNewMetric("metric1", metrics.Trend),
+	}
+	resolvers, err := metrics.GetResolversForTrendColumns([]string{"avg"})
+	require.NoError(t, err)
+
+	swm := newSeriesWithMeasure(s, trendMapping{StatsResolver: resolvers, StatsWindowed: true}, rateMapping{})
+	require.NotNil(t, swm)
+	assert.IsType(t, &windowedTrendSink{}, swm.Measure)
+}
+
+func TestWithLabel(t *testing.T) {
+	t.Parallel()
+
+	labels := []*prompb.Label{
+		{Name: namelbl, Value: "k6_test"},
+		{Name: "zone", Value: "eu"},
+		{Name: windowLabel, Value: "tag"},
+	}
+	assert.Equal(t, []*prompb.Label{
+		{Name: namelbl, Value: "k6_test"},
+		{Name: windowLabel, Value: "5s"},
+		{Name: "zone", Value: "eu"},
+	}, withLabel(labels, windowLabel, "5s"))
+
+	// the labels are not changed
+	assert.Equal(t, "tag", labels[2].Value)
+}
+
+func TestWithWindowLabel(t *testing.T) {
+	t.Parallel()
+
+	// the window tag is kept as exported_window
+	labels := []*prompb.Label{
+		{Name: namelbl, Value: "k6_test"},
+		{Name: windowLabel, Value: "tag"},
+	}
+	assert.Equal(t, []*prompb.Label{
+		{Name: namelbl, Value: "k6_test"},
+		{Name: exportedWindowLabel, Value: "tag"},
+		{Name: windowLabel, Value: "5s"},
+	}, withWindowLabel(labels, "5s"))
+
+	assert.Equal(t, []*prompb.Label{
+		{Name: namelbl, Value: "k6_test"},
+		{Name: windowLabel, Value: "5s"},
+	}, withWindowLabel(labels[:1], "5s"))
+}
+
+func TestConfigValidateTrendStatsWindow(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		config Config
+		err    string
+	}{
+		"Disabled": {
+			config: Config{TrendAsHistogram: null.BoolFrom(true)},
+		},
+		"PushInterval": {
+			config: Config{TrendStatsWindowed: null.BoolFrom(true)},
+		},
+		"Window": {
+			config: Config{
+				PushInterval:     types.NullDurationFrom(5 * time.Second),
+				TrendStatsWindow: types.NullDurationFrom(time.Minute),
+			},
+		},
+		"ShorterThanPushInterval": {
+			config: Config{
+				PushInterval:     types.NullDurationFrom(5 * time.Second),
+				TrendStatsWindow: types.NullDurationFrom(time.Second),
+			},
+			err: "shorter than the push interval",
+		},
+		"Histogram": {
+			config: Config{
+				TrendStatsWindowed:     null.BoolFrom(true),
+				TrendAsNativeHistogram: null.BoolFrom(true),
+			},
+			err: "not supported",
+		},
+	}
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.config.validateTrendStatsWindow()
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
@@ -1,10 +1,12 @@
 // Package stale handles the staleness process.
-//
-// TODO: migrate here more logic dedicated to this topic
-// from the remote write package.
 package stale
 
-import "math"
+import (
+	"math"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+)
 
 // Marker is the Prometheus Remote Write special value for marking
 // a time series as stale.
@@ -22,3 +24,76 @@ import "math"
 //
 //nolint:gochecknoglobals
 var Marker = math.Float64frombits(0x7ff0000000000002)
+
+// Timestamp returns the timestamp in ms for the stale markers generated at now.
+//
+// Add 1ms so in the extreme case that the time frame
+// between the last and the next flush operation is under-millisecond,
+// we can avoid the sample being seen as a duplicate,
+// if we force it in the future.
+// It is essential because if it overlaps, the remote write discards the last sample,
+// so the stale marker and the metric will remain active for the next 5 min
+// as the default logic without stale markers.
+func Timestamp(now time.Time) int64 {
+	return now.Truncate(time.Millisecond).Add(1 * time.Millisecond).UnixMilli()
+}
+
+// Mark sets the stale marker with the timestamp as the first sample
+// of the time series. The time series with only native histograms
+// get a sample for the marker.
+func Mark(series []*prompb.TimeSeries, timestamp int64) {
+	for _, s := range series {
+		if len(s.Samples) < 1 {
+			if len(s.Histograms) < 1 {
+				panic("data integrity check: samples and native histograms" +
+					" can't be empty at the same time")
+			}
+			s.Samples = append(s.Samples, &prompb.Sample{})
+		}
+
+		s.Samples[0].Value = Marker
+		s.Samples[0].Timestamp = timestamp
+	}
+}
+
+// Tracker tracks the latest update of the time series,
+// so the ones idle for longer than the TTL can be marked as stale
+// and released. It isn't safe for concurrent use.
+type Tracker[K comparable] struct {
+	ttl    time.Duration
+	latest map[K]time.Time
+}
+
+// NewTracker creates a tracker with the TTL of the idle time series.
+func NewTracker[K comparable](ttl time.Duration) *Tracker[K] {
+	return &Tracker[K]{
+		ttl:    ttl,
+		latest: make(map[K]time.Time),
+	}
+}
+
+// Seen records the time series as updated at the time.
+func (t *Tracker[K]) Seen(key K, at time.Time) {
+	if latest, ok := t.latest[key]; ok && !at.After(latest) {
+		return
+	}
+	t.latest[key] = at
+}
+
+// Expire removes and returns the time series
+// not updated since longer than the TTL.
+func (t *Tracker[K]) Expire(now time.Time) []K {
+	var expired []K
+	for key, latest := range t.latest {
+		if now.Sub(latest) > t.ttl {
+			expired = append(expired, key)
+			delete(t.latest, key)
+		}
+	}
+	return expired
+}
+
+// Len returns the number of the tracked time series.
+func (t *Tracker[K]) Len() int {
+	return len(t.latest)
+}
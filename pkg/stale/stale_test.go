@@ -0,0 +1,65 @@
+package stale
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	prompb "buf.build/gen/go/prometheus/prometheus/protocolbuffers/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestamp(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1, int64(500*time.Microsecond))
+	assert.Equal(t, int64(1001), Timestamp(now))
+}
+
+func TestMark(t *testing.T) {
+	t.Parallel()
+
+	series := []*prompb.TimeSeries{
+		{Samples: []*prompb.Sample{{Value: 1, Timestamp: 1}}},
+		{Histograms: []*prompb.Histogram{{Timestamp: 1}}},
+	}
+	Mark(series, 10)
+	for _, s := range series {
+		require.Len(t, s.Samples, 1)
+		assert.True(t, math.IsNaN(s.Samples[0].Value), "it isn't a StaleNaN value")
+		assert.Equal(t, math.Float64bits(Marker), math.Float64bits(s.Samples[0].Value))
+		assert.Equal(t, int64(10), s.Samples[0].Timestamp)
+	}
+
+	assert.Panics(t, func() {
+		Mark([]*prompb.TimeSeries{{}}, 10)
+	})
+}
+
+func TestTracker(t *testing.T) {
+	t.Parallel()
+
+	t0 := time.Unix(100, 0)
+	tr := NewTracker[string](10 * time.Second)
+	tr.Seen("a", t0)
+	tr.Seen("b", t0.Add(5*time.Second))
+	tr.Seen("c", t0.Add(8*time.Second))
+	// an older update doesn't move back the latest
+	tr.Seen("c", t0)
+	assert.Equal(t, 3, tr.Len())
+
+	assert.Empty(t, tr.Expire(t0.Add(10*time.Second)))
+
+	expired := tr.Expire(t0.Add(16 * time.Second))
+	sort.Strings(expired)
+	assert.Equal(t, []string{"a", "b"}, expired)
+	assert.Equal(t, 1, tr.Len())
+
+	// an expired time series is tracked again when it is updated
+	tr.Seen("a", t0.Add(17*time.Second))
+	assert.Equal(t, []string{"c"}, tr.Expire(t0.Add(19*time.Second)))
+	assert.Equal(t, []string{"a"}, tr.Expire(t0.Add(28*time.Second)))
+	assert.Zero(t, tr.Len())
+}
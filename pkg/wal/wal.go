@@ -0,0 +1,497 @@
+// Package wal implements a persistent on-disk queue (write-ahead log)
+// for the batches of time series that failed to be delivered.
+//
+// The records are appended to segment files in a dedicated directory,
+// they are replayed in the same order they have been appended and
+// the segments are deleted as soon as all their records have been replayed.
+// The replay progress is saved in a checkpoint file so a new process
+// can resume from the first not-replayed record.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt     = ".seg"
+	checkpointName = "checkpoint"
+
+	// recordHeaderSize is the size of the record's header:
+	// the payload's length and its CRC32 checksum.
+	recordHeaderSize = 8
+
+	// DefaultSegmentSize is the size after which a new segment is created.
+	DefaultSegmentSize = 8 << 20
+)
+
+//nolint:gochecknoglobals
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrRecordTooLarge is returned when a record can't fit the max size of the WAL.
+var ErrRecordTooLarge = errors.New("the record is larger than the WAL's max size")
+
+// Options holds the configuration for the WAL.
+type Options struct {
+	// MaxSize is the max size in bytes of all the segments,
+	// the oldest segments are deleted for keeping the WAL under the limit.
+	// Zero means no limit.
+	MaxSize int64
+
+	// MaxAge is the max age of a segment, the segments
+	// older than it are deleted. Zero means no limit.
+	MaxAge time.Duration
+
+	// SegmentSize is the size after which a new segment is created.
+	// DefaultSegmentSize is used if it is zero.
+	SegmentSize int64
+}
+
+// ReplayResult reports the outcome of a Replay operation.
+type ReplayResult struct {
+	// Replayed is the number of records successfully replayed.
+	Replayed int
+
+	// Corrupted is the number of segments with a corrupted part.
+	// The data after a corruption point is discarded
+	// because the records' boundaries can't be trusted anymore.
+	Corrupted int
+}
+
+// Stats reports the current state of the WAL.
+type Stats struct {
+	// Size is the size in bytes of the segments.
+	Size int64
+
+	// Segments is the number of segments.
+	Segments int
+
+	// DroppedSegments is the number of segments deleted by the retention policy
+	// before they have been replayed.
+	DroppedSegments int
+}
+
+// WAL is a persistent queue of records split across segment files.
+// It is safe for concurrent use.
+type WAL struct {
+	dir  string
+	opts Options
+	now  func() time.Time
+
+	mu       sync.Mutex
+	segments []int
+	sizes    map[int]int64
+	head     *os.File
+
+	// readSegment and readOffset are the position
+	// of the next record to replay.
+	readSegment int
+	readOffset  int64
+
+	dropped int
+}
+
+// Open opens the WAL in the directory, it is created if it doesn't exist.
+// The records not yet replayed from a previous process are preserved.
+func Open(dir string, opts Options) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create the WAL directory: %w", err)
+	}
+
+	w := &WAL{
+		dir:   dir,
+		opts:  opts,
+		now:   time.Now,
+		sizes: make(map[int]int64),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the WAL directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(e.Name(), segmentExt))
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		w.segments = append(w.segments, id)
+		w.sizes[id] = info.Size()
+	}
+	sort.Ints(w.segments)
+
+	if err := w.readCheckpoint(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Append appends a record to the WAL.
+// The oldest segments are deleted if the record exceeds the max size.
+func (w *WAL) Append(rec []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	recSize := int64(recordHeaderSize + len(rec))
+	if w.opts.MaxSize > 0 && recSize > w.opts.MaxSize {
+		return ErrRecordTooLarge
+	}
+
+	if err := w.applyRetention(recSize); err != nil {
+		return err
+	}
+
+	if w.head == nil || w.sizes[w.headID()] >= w.opts.SegmentSize {
+		if err := w.cut(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, recordHeaderSize, recSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(rec))) //nolint:gosec
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(rec, castagnoli))
+	buf = append(buf, rec...)
+
+	if _, err := w.head.Write(buf); err != nil {
+		return fmt.Errorf("failed to write the record to the WAL: %w", err)
+	}
+	if err := w.head.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the WAL segment: %w", err)
+	}
+	w.sizes[w.headID()] += recSize
+	return nil
+}
+
+// Replay invokes fn for each record in the same order they have been appended.
+// The replay stops at the first error returned from fn and
+// the failed record will be the first one of the next replay.
+//
+// The lock is not held while fn is invoked, so the records can be appended
+// concurrently. The replay ends at the last record appended before it started,
+// the records appended during the replay are replayed from the next one.
+// It must not be invoked concurrently.
+func (w *WAL) Replay(fn func(rec []byte) error) (ReplayResult, error) {
+	var result ReplayResult
+
+	w.mu.Lock()
+	if err := w.applyRetention(0); err != nil {
+		w.mu.Unlock()
+		return result, err
+	}
+	if len(w.segments) < 1 {
+		w.mu.Unlock()
+		return result, nil
+	}
+	endID := w.segments[len(w.segments)-1]
+	endSize := w.sizes[endID]
+	w.mu.Unlock()
+
+	for {
+		w.mu.Lock()
+		if len(w.segments) < 1 || w.segments[0] > endID {
+			w.mu.Unlock()
+			return result, nil
+		}
+		id := w.segments[0]
+		if w.readSegment != id {
+			w.readSegment, w.readOffset = id, 0
+		}
+		offset, size := w.readOffset, w.sizes[id]
+		if id == endID {
+			size = endSize
+		}
+		w.mu.Unlock()
+
+		corrupted, err := w.replaySegment(id, offset, size, fn, &result)
+		if corrupted {
+			result.Corrupted++
+		}
+		if err != nil {
+			return result, err
+		}
+
+		w.mu.Lock()
+		if !w.reading(id) {
+			// the segment has been dropped from the retention policy
+			w.mu.Unlock()
+			continue
+		}
+		// the head segment is kept open for the next appends
+		// and the segment is kept if records have been appended to it
+		if w.isHead(id) || w.readOffset < w.sizes[id] {
+			w.mu.Unlock()
+			return result, nil
+		}
+		err = w.removeOldest()
+		w.mu.Unlock()
+		if err != nil || id == endID {
+			return result, err
+		}
+	}
+}
+
+// replaySegment replays the records of the segment
+// from the offset to the end offset, without holding the lock.
+// It returns true if a corruption has been detected.
+func (w *WAL) replaySegment(
+	id int, offset, end int64, fn func(rec []byte) error, result *ReplayResult,
+) (bool, error) {
+	f, err := os.Open(w.segmentPath(id))
+	if err != nil {
+		return false, fmt.Errorf("failed to open the WAL segment: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	header := make([]byte, recordHeaderSize)
+	for offset < end {
+		if _, err := io.ReadFull(f, header); err != nil {
+			return true, w.discard(id, end)
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if int64(length) > end-offset-recordHeaderSize {
+			return true, w.discard(id, end)
+		}
+
+		rec := make([]byte, length)
+		if _, err := io.ReadFull(f, rec); err != nil || crc32.Checksum(rec, castagnoli) != checksum {
+			return true, w.discard(id, end)
+		}
+
+		if err := fn(rec); err != nil {
+			return false, err
+		}
+		result.Replayed++
+		offset += recordHeaderSize + int64(length)
+		if ok, err := w.advance(id, offset); !ok || err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// reading returns true if the segment is the one under replay.
+// The caller must hold the lock.
+func (w *WAL) reading(id int) bool {
+	return len(w.segments) > 0 && w.segments[0] == id && w.readSegment == id
+}
+
+// advance saves the replay position in the segment. It returns false
+// if the segment has been dropped in the meantime.
+func (w *WAL) advance(id int, offset int64) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.reading(id) {
+		return false, nil
+	}
+	w.readOffset = offset
+	return true, w.writeCheckpoint()
+}
+
+// discard skips the data of the segment from the read offset to the end offset.
+// The end offset is a record's boundary, so the records appended after it are preserved.
+func (w *WAL) discard(id int, end int64) error {
+	_, err := w.advance(id, end)
+	return err
+}
+
+// Stats returns the current state of the WAL.
+func (w *WAL) Stats() Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := Stats{
+		Segments:        len(w.segments),
+		DroppedSegments: w.dropped,
+	}
+	for _, id := range w.segments {
+		s.Size += w.sizes[id]
+	}
+	return s
+}
+
+// Pending returns true if there are records to replay.
+func (w *WAL) Pending() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, id := range w.segments {
+		if id != w.readSegment || w.readOffset < w.sizes[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the WAL, the not replayed records are preserved on disk.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.head == nil {
+		return nil
+	}
+	err := w.head.Close()
+	w.head = nil
+	return err
+}
+
+// applyRetention deletes the oldest segments
+// if they exceed the max age or if the max size
+// would be exceeded appending the next bytes.
+func (w *WAL) applyRetention(next int64) error {
+	if w.opts.MaxAge > 0 {
+		for len(w.segments) > 0 && !w.isHead(w.segments[0]) {
+			info, err := os.Stat(w.segmentPath(w.segments[0]))
+			if err != nil {
+				return err
+			}
+			if w.now().Sub(info.ModTime()) <= w.opts.MaxAge {
+				break
+			}
+			if err := w.dropOldest(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.opts.MaxSize <= 0 {
+		return nil
+	}
+	var size int64
+	for _, id := range w.segments {
+		size += w.sizes[id]
+	}
+	for size+next > w.opts.MaxSize && len(w.segments) > 0 {
+		oldest := w.segments[0]
+		if w.isHead(oldest) {
+			// the head must be rotated before it can be deleted
+			if err := w.cut(); err != nil {
+				return err
+			}
+		}
+		size -= w.sizes[oldest]
+		if err := w.dropOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropOldest deletes the oldest segment before it has been fully replayed.
+func (w *WAL) dropOldest() error {
+	id := w.segments[0]
+	if id != w.readSegment || w.readOffset < w.sizes[id] {
+		w.dropped++
+	}
+	return w.removeOldest()
+}
+
+func (w *WAL) removeOldest() error {
+	id := w.segments[0]
+	if err := os.Remove(w.segmentPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove the WAL segment: %w", err)
+	}
+	w.segments = w.segments[1:]
+	delete(w.sizes, id)
+	if len(w.segments) > 0 {
+		w.readSegment, w.readOffset = w.segments[0], 0
+	}
+	return w.writeCheckpoint()
+}
+
+// cut closes the current head segment and creates a new one.
+func (w *WAL) cut() error {
+	if w.head != nil {
+		if err := w.head.Close(); err != nil {
+			return err
+		}
+		w.head = nil
+	}
+
+	id := 1
+	if len(w.segments) > 0 {
+		id = w.segments[len(w.segments)-1] + 1
+	}
+	f, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("failed to create the WAL segment: %w", err)
+	}
+	w.head = f
+	w.segments = append(w.segments, id)
+	w.sizes[id] = 0
+	return nil
+}
+
+func (w *WAL) headID() int {
+	return w.segments[len(w.segments)-1]
+}
+
+func (w *WAL) isHead(id int) bool {
+	return w.head != nil && id == w.headID()
+}
+
+func (w *WAL) segmentPath(id int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d%s", id, segmentExt))
+}
+
+// writeCheckpoint persists the replay position.
+// It is written to a temporary file and renamed for being atomic.
+func (w *WAL) writeCheckpoint() error {
+	path := filepath.Join(w.dir, checkpointName)
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d", w.readSegment, w.readOffset)
+	if err := os.WriteFile(tmp, []byte(data), 0o640); err != nil { //nolint:gosec
+		return fmt.Errorf("failed to write the WAL checkpoint: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// readCheckpoint restores the replay position saved from a previous process.
+// An invalid checkpoint is ignored and the replay restarts from the oldest segment.
+func (w *WAL) readCheckpoint() error {
+	data, err := os.ReadFile(filepath.Join(w.dir, checkpointName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the WAL checkpoint: %w", err)
+	}
+
+	var segment int
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &segment, &offset); err != nil {
+		return nil //nolint:nilerr
+	}
+	for _, id := range w.segments {
+		if id == segment && offset <= w.sizes[id] {
+			w.readSegment, w.readOffset = segment, offset
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendRecords(t *testing.T, w *WAL, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		require.NoError(t, w.Append([]byte(fmt.Sprintf("record-%d", i))))
+	}
+}
+
+func replayAll(t *testing.T, w *WAL) []string {
+	t.Helper()
+	var got []string
+	_, err := w.Replay(func(rec []byte) error {
+		got = append(got, string(rec))
+		return nil
+	})
+	require.NoError(t, err)
+	return got
+}
+
+func TestWALAppendReplay(t *testing.T) {
+	t.Parallel()
+
+	w, err := Open(t.TempDir(), Options{SegmentSize: 32})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	assert.False(t, w.Pending())
+	appendRecords(t, w, 0, 5)
+	assert.True(t, w.Pending())
+	// the segment size is small so the records are split across segments
+	assert.Greater(t, w.Stats().Segments, 1)
+
+	got := replayAll(t, w)
+	assert.Equal(t, []string{"record-0", "record-1", "record-2", "record-3", "record-4"}, got)
+	assert.False(t, w.Pending())
+	// only the head segment is kept
+	assert.Equal(t, 1, w.Stats().Segments)
+
+	appendRecords(t, w, 5, 6)
+	assert.Equal(t, []string{"record-5"}, replayAll(t, w))
+}
+
+func TestWALReplayStopsOnError(t *testing.T) {
+	t.Parallel()
+
+	w, err := Open(t.TempDir(), Options{})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	appendRecords(t, w, 0, 3)
+
+	errEndpoint := errors.New("endpoint down")
+	var got []string
+	result, err := w.Replay(func(rec []byte) error {
+		if string(rec) == "record-1" {
+			return errEndpoint
+		}
+		got = append(got, string(rec))
+		return nil
+	})
+	require.ErrorIs(t, err, errEndpoint)
+	assert.Equal(t, 1, result.Replayed)
+	assert.Equal(t, []string{"record-0"}, got)
+
+	// the failed record is the first of the next replay
+	assert.Equal(t, []string{"record-1", "record-2"}, replayAll(t, w))
+}
+
+func TestWALResumeAfterReopen(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 32})
+	require.NoError(t, err)
+	appendRecords(t, w, 0, 4)
+
+	var n int
+	_, err = w.Replay(func([]byte) error {
+		if n == 2 {
+			return errors.New("stop")
+		}
+		n++
+		return nil
+	})
+	require.Error(t, err)
+	require.NoError(t, w.Close())
+
+	w, err = Open(dir, Options{SegmentSize: 32})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	assert.True(t, w.Pending())
+	appendRecords(t, w, 4, 5)
+	assert.Equal(t, []string{"record-2", "record-3", "record-4"}, replayAll(t, w))
+}
+
+func TestWALCorruption(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	w, err := Open(dir, Options{SegmentSize: 1 << 20})
+	require.NoError(t, err)
+	appendRecords(t, w, 0, 3)
+	require.NoError(t, w.Close())
+
+	// flip a byte of the second record's payload
+	path := filepath.Join(dir, "00000001.seg")
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	recSize := recordHeaderSize + len("record-0")
+	b[recSize+recordHeaderSize] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+
+	w, err = Open(dir, Options{})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	var got []string
+	result, err := w.Replay(func(rec []byte) error {
+		got = append(got, string(rec))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record-0"}, got)
+	assert.Equal(t, 1, result.Corrupted)
+	assert.False(t, w.Pending())
+}
+
+func TestWALRetention(t *testing.T) {
+	t.Parallel()
+
+	t.Run("MaxSize", func(t *testing.T) {
+		t.Parallel()
+
+		// each record is 16 bytes, so a segment holds one record
+		w, err := Open(t.TempDir(), Options{MaxSize: 48, SegmentSize: 16})
+		require.NoError(t, err)
+		defer func() { require.NoError(t, w.Close()) }()
+
+		appendRecords(t, w, 0, 5)
+		stats := w.Stats()
+		assert.LessOrEqual(t, stats.Size, int64(48))
+		assert.Equal(t, 2, stats.DroppedSegments)
+		assert.Equal(t, []string{"record-2", "record-3", "record-4"}, replayAll(t, w))
+
+		assert.ErrorIs(t, w.Append(make([]byte, 64)), ErrRecordTooLarge)
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		t.Parallel()
+
+		w, err := Open(t.TempDir(), Options{MaxAge: time.Minute, SegmentSize: 16})
+		require.NoError(t, err)
+		defer func() { require.NoError(t, w.Close()) }()
+
+		appendRecords(t, w, 0, 3)
+		w.now = func() time.Time { return time.Now().Add(time.Hour) }
+
+		// all the segments but the head are expired
+		assert.Equal(t, []string{"record-2"}, replayAll(t, w))
+		assert.Equal(t, 2, w.Stats().DroppedSegments)
+	})
+}
+
+func TestWALAppendDuringReplay(t *testing.T) {
+	t.Parallel()
+
+	w, err := Open(t.TempDir(), Options{SegmentSize: 32})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	appendRecords(t, w, 0, 3)
+
+	var got []string
+	_, err = w.Replay(func(rec []byte) error {
+		got = append(got, string(rec))
+		if len(got) == 1 {
+			// the lock isn't held while the record is replayed,
+			// so it would deadlock otherwise
+			appendRecords(t, w, 3, 5)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// the records appended during the replay are replayed from the next one
+	assert.Equal(t, []string{"record-0", "record-1", "record-2"}, got)
+	assert.True(t, w.Pending())
+	assert.Equal(t, []string{"record-3", "record-4"}, replayAll(t, w))
+	assert.False(t, w.Pending())
+}